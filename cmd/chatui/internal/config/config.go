@@ -13,7 +13,7 @@ type ChatSettings struct {
 	SystemPrompt string  `json:"system_prompt"`
 	Temperature  float64 `json:"temperature"`
 	ModelMode    string  `json:"model_mode"` // "auto", "creative", "precise" и т.д.
-	LLMProvider  string  `json:"llm_provider"` // "mistral", "geminillm", "ghllm", "groqllm", "ollama" и т.д.
+	LLMProvider  string  `json:"llm_provider"` // "mistral", "geminillm", "ghllm", "groqllm", "plnllm", "openaillm", "ollama"
 }
 
 // Config глобальная конфигурация приложения
@@ -24,6 +24,8 @@ type Config struct {
 	X             int  `json:"x"`
 	Y             int  `json:"y"`
 	SendCtrlEnter bool `json:"send_ctrl_enter"`
+	// NoStreaming отключает потоковый вывод ответа (ответ появляется целиком)
+	NoStreaming bool `json:"no_streaming"`
 
 	// Глобальные настройки по умолчанию (для новых чатов)
 	DefaultSettings ChatSettings `json:"default_settings"`
@@ -4,9 +4,11 @@ package llm
 import (
 	"context"
 	"fmt"
+	"io"
 	"os/exec"
 	"strings"
 	"syscall"
+	"unicode/utf8"
 )
 
 // LLMProvider интерфейс для различных LLM-провайдеров
@@ -14,6 +16,14 @@ type LLMProvider interface {
 	Run(ctx context.Context, opts RunOptions) (string, error)
 }
 
+// StreamingProvider LLM-провайдер, умеющий отдавать ответ по частям.
+// onChunk вызывается из фоновой горутины для каждого куска текста;
+// итоговое значение совпадает с тем, что вернул бы Run.
+type StreamingProvider interface {
+	LLMProvider
+	RunStream(ctx context.Context, opts RunOptions, onChunk func(string)) (string, error)
+}
+
 // RunOptions опции запуска LLM
 type RunOptions struct {
 	Prompt       string
@@ -37,6 +47,11 @@ func GetProvider(providerName string) (LLMProvider, error) {
 		return &GenericClient{command: "groqllm.exe"}, nil
 	case "plnllm":
 		return &GenericClient{command: "plnllm.exe"}, nil
+	case "openaillm":
+		return &GenericClient{command: "openaillm.exe"}, nil
+	case "ollama":
+		// Нативный API Ollama (ollama.conf)
+		return &GenericClient{command: "ollamallm.exe"}, nil
 	default:
 		return &MistralClient{}, nil // Mistral по умолчанию
 	}
@@ -46,6 +61,34 @@ func GetProvider(providerName string) (LLMProvider, error) {
 type MistralClient struct{}
 
 func (m *MistralClient) Run(ctx context.Context, opts RunOptions) (string, error) {
+	return runCLI(ctx, "mistral.exe", buildArgs(opts), opts.Prompt, nil)
+}
+
+func (m *MistralClient) RunStream(ctx context.Context, opts RunOptions, onChunk func(string)) (string, error) {
+	return runCLI(ctx, "mistral.exe", append(buildArgs(opts), "--stream"), opts.Prompt, onChunk)
+}
+
+// GenericClient общий клиент для других LLM-утилит
+type GenericClient struct {
+	command   string
+	extraArgs []string // добавляются к каждому вызову (например, --endpoint)
+}
+
+func (g *GenericClient) Run(ctx context.Context, opts RunOptions) (string, error) {
+	return runCLI(ctx, g.command, g.args(opts), opts.Prompt, nil)
+}
+
+func (g *GenericClient) RunStream(ctx context.Context, opts RunOptions, onChunk func(string)) (string, error) {
+	return runCLI(ctx, g.command, append(g.args(opts), "--stream"), opts.Prompt, onChunk)
+}
+
+func (g *GenericClient) args(opts RunOptions) []string {
+	return append(append([]string{}, g.extraArgs...), buildArgs(opts)...)
+}
+
+// buildArgs собирает аргументы командной строки. geminillm, ghllm, groqllm,
+// plnllm и openaillm поддерживают те же флаги, что и mistral
+func buildArgs(opts RunOptions) []string {
 	args := []string{}
 
 	if opts.ChatID != "" {
@@ -63,21 +106,31 @@ func (m *MistralClient) Run(ctx context.Context, opts RunOptions) (string, error
 	if opts.ModelMode != "" && opts.ModelMode != "auto" {
 		args = append(args, "-m", opts.ModelMode)
 	}
+	return args
+}
 
-	cmd := exec.CommandContext(ctx, "mistral.exe", args...)
+// runCLI запускает утилиту и возвращает ее stdout.
+// Если задан onChunk, stdout читается по мере поступления и передается в onChunk.
+func runCLI(ctx context.Context, command string, args []string, prompt string, onChunk func(string)) (string, error) {
+	cmd := exec.CommandContext(ctx, command, args...)
 
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		HideWindow: true,
 	}
 
-	cmd.Stdin = strings.NewReader(opts.Prompt)
+	cmd.Stdin = strings.NewReader(prompt)
 
 	var out strings.Builder
 	var stderr strings.Builder
-	cmd.Stdout = &out
 	cmd.Stderr = &stderr
 
-	err := cmd.Run()
+	var err error
+	if onChunk == nil {
+		cmd.Stdout = &out
+		err = cmd.Run()
+	} else {
+		err = runStreaming(cmd, &out, onChunk)
+	}
 
 	if err != nil {
 		if ctx.Err() == context.Canceled {
@@ -93,57 +146,50 @@ func (m *MistralClient) Run(ctx context.Context, opts RunOptions) (string, error
 	return out.String(), nil
 }
 
-// GenericClient общий клиент для других LLM-утилит
-type GenericClient struct {
-	command string
-}
-
-func (g *GenericClient) Run(ctx context.Context, opts RunOptions) (string, error) {
-	args := []string{}
-
-	// Используем те же аргументы, что и mistral, так как geminillm, ghllm и groqllm
-	// также поддерживают те же флаги, что и mistral
-	if opts.ChatID != "" {
-		args = append(args, "-chat", opts.ChatID)
-	}
-	for _, f := range opts.Files {
-		args = append(args, "-f", f)
-	}
-	if opts.SystemPrompt != "" {
-		args = append(args, "-s", opts.SystemPrompt)
-	}
-	if opts.Temperature >= 0 {
-		args = append(args, "-t", fmt.Sprintf("%.2f", opts.Temperature))
-	}
-	if opts.ModelMode != "" && opts.ModelMode != "auto" {
-		args = append(args, "-m", opts.ModelMode)
+// runStreaming читает stdout процесса кусками, не разрывая UTF-8 символы
+func runStreaming(cmd *exec.Cmd, out *strings.Builder, onChunk func(string)) error {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
 	}
-
-	cmd := exec.CommandContext(ctx, g.command, args...)
-
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		HideWindow: true,
+	if err := cmd.Start(); err != nil {
+		return err
 	}
 
-	cmd.Stdin = strings.NewReader(opts.Prompt)
-
-	var out strings.Builder
-	var stderr strings.Builder
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
-
-	if err != nil {
-		if ctx.Err() == context.Canceled {
-			return "⏹ Генерация остановлена пользователем.", nil
+	buf := make([]byte, 4096)
+	var pending []byte
+	for {
+		n, readErr := stdout.Read(buf)
+		if n > 0 {
+			pending = append(pending, buf[:n]...)
+
+			// Хвост может оказаться незаконченным многобайтовым символом
+			valid := len(pending)
+			for valid > 0 && len(pending)-valid < utf8.UTFMax && !utf8.Valid(pending[:valid]) {
+				valid--
+			}
+			if valid == 0 && len(pending) >= utf8.UTFMax {
+				valid = len(pending) // Битые байты, отдаем как есть
+			}
+			if valid > 0 {
+				chunk := string(pending[:valid])
+				pending = pending[valid:]
+				out.WriteString(chunk)
+				onChunk(chunk)
+			}
 		}
-
-		if stderr.Len() > 0 {
-			return stderr.String(), nil
+		if readErr != nil {
+			if readErr != io.EOF {
+				_ = cmd.Wait()
+				return readErr
+			}
+			break
 		}
-		return "", err
+	}
+	if len(pending) > 0 {
+		out.Write(pending)
+		onChunk(string(pending))
 	}
 
-	return out.String(), nil
+	return cmd.Wait()
 }
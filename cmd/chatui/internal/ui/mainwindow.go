@@ -90,7 +90,7 @@ func CreateAndRunMainWindow() {
 	var historyTE, inputTE *walk.TextEdit
 	var sendBtn *walk.PushButton
 	var chatCombo *walk.ComboBox
-	var chkCtrlEnter *walk.CheckBox
+	var chkCtrlEnter, chkStream *walk.CheckBox
 
 	var filesListBox *walk.ListBox
 	var filesBox *walk.Composite
@@ -114,6 +114,7 @@ func CreateAndRunMainWindow() {
 		b := mainWindow.Bounds()
 		cfg.X, cfg.Y, cfg.Width, cfg.Height = b.X, b.Y, b.Width, b.Height
 		cfg.SendCtrlEnter = chkCtrlEnter.Checked()
+		cfg.NoStreaming = !chkStream.Checked()
 		cfg.Save()
 	}
 
@@ -132,6 +133,24 @@ func CreateAndRunMainWindow() {
 		})
 	}
 
+	// appendToLastEntry дописывает текст в конец последней записи истории (для потокового ответа).
+	// Заменяется только хвостовой разделитель записи: SetText всей истории
+	// на каждый кусок ответа тормозит на длинных чатах.
+	appendToLastEntry := func(text string) {
+		text = strings.ReplaceAll(text, "\r\n", "\n")
+		text = strings.ReplaceAll(text, "\n", "\r\n")
+		tail := 0
+		if strings.HasSuffix(fullChatHistory, "\r\n\r\n") {
+			tail = 4 // длина в символах поля ввода (UTF-16), как и в байтах
+		}
+		fullChatHistory = fullChatHistory[:len(fullChatHistory)-tail] + text + "\r\n\r\n"
+
+		end := historyTE.TextLength()
+		historyTE.SetTextSelection(end-tail, end)
+		historyTE.ReplaceSelectedText(text+"\r\n\r\n", false)
+		historyTE.SendMessage(277, 7, 0) // WM_VSCROLL -> SB_BOTTOM
+	}
+
 	updateFilesVisibility := func() {
 		hasFiles := fileModel.ItemCount() > 0
 		filesBox.SetVisible(hasFiles)
@@ -286,6 +305,7 @@ func CreateAndRunMainWindow() {
 		updateFilesVisibility()
 
 		chatSettings := cfg.GetChatSettings(currentChatID)
+		streaming := chkStream.Checked()
 
 		ctx, cancel := context.WithCancel(context.Background())
 		cancelGen = cancel
@@ -314,6 +334,32 @@ func CreateAndRunMainWindow() {
 			provider, err := llm.GetProvider(chatSettings.LLMProvider)
 			if err != nil {
 				answer = "Ошибка инициализации LLM: " + err.Error()
+			} else if sp, ok := provider.(llm.StreamingProvider); ok && streaming {
+				// Потоковый режим: запись "AI" создается сразу и дополняется по мере генерации
+				mainWindow.Synchronize(func() {
+					appendHistory("AI", "")
+				})
+				var streamed strings.Builder
+				answer, err = sp.RunStream(ctx, opts, func(chunk string) {
+					streamed.WriteString(chunk)
+					mainWindow.Synchronize(func() {
+						appendToLastEntry(chunk)
+					})
+				})
+				if err != nil {
+					answer = "Ошибка: " + err.Error()
+				}
+				// Ошибка или остановка: дописываем сообщение после уже выведенного текста
+				if answer != streamed.String() {
+					tail := answer
+					if streamed.Len() > 0 {
+						tail = "\n" + tail
+					}
+					mainWindow.Synchronize(func() {
+						appendToLastEntry(tail)
+					})
+				}
+				return
 			} else {
 				answer, err = provider.Run(ctx, opts)
 				if err != nil {
@@ -374,6 +420,13 @@ func CreateAndRunMainWindow() {
 						OnCheckedChanged: saveConfigImmediately,
 						Font:             font12,
 					},
+					CheckBox{
+						AssignTo:         &chkStream,
+						Text:             "Поток",
+						Checked:          !cfg.NoStreaming,
+						OnCheckedChanged: saveConfigImmediately,
+						Font:             font12,
+					},
 					HSpacer{},
 					PushButton{Text: "Настройки", OnClicked: openSettings, Font: font12},
 				},
@@ -490,6 +543,10 @@ func CreateAndRunMainWindow() {
 		log.Fatalf("Ошибка создания MainWindow: %v", err)
 	}
 
+	// Снимаем лимит поля истории (по умолчанию 32K символов): дописывание
+	// потокового ответа через EM_REPLACESEL этот лимит соблюдает
+	historyTE.SetMaxLength(0)
+
 	// ==========================================================
 	// ОПТИМИЗАЦИЯ ЗАПУСКА
 	// Переносим загрузку иконки и истории в фон, чтобы окно
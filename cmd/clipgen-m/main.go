@@ -4,6 +4,7 @@ import (
 	"bytes"
 	_ "embed"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"image"
 	"image/png"
@@ -18,6 +19,8 @@ import (
 	"time"
 	"unsafe"
 
+	"ClipGen-m/internal/provider"
+
 	"github.com/getlantern/systray"
 	"github.com/micmonay/keybd_event"
 	"github.com/ncruces/zenity"
@@ -226,10 +229,12 @@ func restoreClipboardSnapshot(snapshots []ClipboardSnapshot) error {
 type Config struct {
 	EditorPath      string   `yaml:"editor_path"`
 	LLMPath         string   `yaml:"llm_path"`
+	LLMArgs         string   `yaml:"llm_args,omitempty"` // общие аргументы для каждого вызова (например, --endpoint ollama для openaillm)
 	SystemPrompt    string   `yaml:"system_prompt"`
 	AppToggleHotkey string   `yaml:"app_toggle_hotkey"`
 	ChatUIPath      string   `yaml:"chatui_path"`
 	ChatUIHotkey    string   `yaml:"chatui_hotkey"`
+	ModerationPath  string   `yaml:"moderation_path,omitempty"` // утилита с --moderate для действий с moderate: true (по умолчанию mistral.exe)
 	Actions         []Action `yaml:"actions"`
 }
 
@@ -240,6 +245,7 @@ type Action struct {
 	MistralArgs string `yaml:"mistral_args,omitempty"`
 	InputType   string `yaml:"input_type"`
 	OutputMode  string `yaml:"output_mode,omitempty"`
+	Moderate    bool   `yaml:"moderate,omitempty"` // проверить результат модерацией перед выводом
 }
 
 type HotkeyControl struct {
@@ -443,6 +449,30 @@ func handleAction(action Action) {
 		return
 	}
 
+	if action.Moderate {
+		report, flagged, err := moderateText(resultText)
+		if err != nil {
+			zenity.Error(fmt.Sprintf("Ошибка модерации:\n%v", err),
+				zenity.Title("ClipGen Error"),
+				zenity.Icon(zenity.ErrorIcon))
+			log.Printf("ERROR: модерация: %v", err)
+			_ = restoreClipboardSnapshot(snapshot)
+			return
+		}
+		if flagged {
+			log.Printf("Модерация: порог превышен\n%s", report)
+			askErr := zenity.Question(fmt.Sprintf("Текст не прошел модерацию:\n\n%s\n\nВсе равно вывести?", report),
+				zenity.Title("ClipGen: модерация"),
+				zenity.Icon(zenity.WarningIcon),
+				zenity.OKLabel("Вывести"),
+				zenity.CancelLabel("Отмена"))
+			if askErr != nil {
+				_ = restoreClipboardSnapshot(snapshot)
+				return
+			}
+		}
+	}
+
 	log.Println("Успех. Вывод результата.")
 	switch action.OutputMode {
 	case "notepad", "editor":
@@ -699,6 +729,9 @@ func preparePrompt(promptTmpl string, actionName string) (string, error) {
 
 func runLLM(prompt string, filePaths []string, args string) (string, error) {
 	var argList []string
+	if config.LLMArgs != "" {
+		argList = append(argList, strings.Fields(config.LLMArgs)...)
+	}
 	if config.SystemPrompt != "" {
 		argList = append(argList, "-s", config.SystemPrompt)
 	}
@@ -723,6 +756,32 @@ func runLLM(prompt string, filePaths []string, args string) (string, error) {
 	return strings.TrimSpace(out.String()), nil
 }
 
+// moderateText прогоняет текст через `<moderation_path> --moderate`.
+// Возвращает таблицу оценок и true, если порог превышен.
+func moderateText(text string) (string, bool, error) {
+	path := config.ModerationPath
+	if path == "" {
+		path = "mistral.exe"
+	}
+	cmd := exec.Command(path, "--moderate")
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	cmd.Stdin = strings.NewReader(text)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	report := strings.TrimSpace(out.String())
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == provider.ModerationFlaggedExitCode {
+		return report, true, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("%v | stderr: %s", err, stderr.String())
+	}
+	return report, false, nil
+}
+
 func getClipboardImageViaAPI() ([]byte, error) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
@@ -1141,6 +1200,7 @@ func loadOrCreateConfig() error {
 # --- СИСТЕМНЫЕ НАСТРОЙКИ ---
 editor_path: "notepad.exe"
 llm_path: "mistral.exe"
+# llm_args: "--endpoint ollama"  # для llm_path: "openaillm.exe"
 app_toggle_hotkey: "Ctrl+F12"
 chatui_path: ".\\ClipGen-m-chatui.exe"
 chatui_hotkey: "Ctrl+M"
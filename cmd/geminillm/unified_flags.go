@@ -2,31 +2,22 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
-	"math/rand"
-	"mime"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
-	"unicode/utf8"
 
-	"golang.org/x/text/encoding/charmap"
+	"ClipGen-m/internal/provider"
 )
 
 // --- Константы ---
 
 const (
-	ConfigDirName  = "clipgen-m"
 	ConfigFileName = "gemini.conf"
 	LogFileName    = "gemini_err.log"
-	MaxLogSize     = 10 * 1024 * 1024 // 10 MB
 
 	DefaultBaseURL      = "https://generativelanguage.googleapis.com/v1beta"
 	DefaultSystemPrompt = "Ты — ИИ-ассистент ClipGen-m. Будь лаконичен. Пиши простой текст без маркдауна."
@@ -65,17 +56,26 @@ var DefaultModels = map[string][]string{
 	},
 }
 
-// --- Структуры Google AI API ---
+// DefaultModeRules выбор режима для --mode auto
+// (mode_rules в конфиге, порядок важен).
+var DefaultModeRules = []provider.ModeRule{
+	{Name: "documents", Attachments: []string{"pdf", "document"}, Mode: "ocr"},
+	{Name: "images", Attachments: []string{"image"}, Mode: "vision"},
+	{Name: "code", Keywords: []string{"code"}, Mode: "code"},
+	{Name: "default", Mode: "general"},
+}
 
-type Config struct {
-	ApiKeys                []string            `json:"api_keys"`
-	BaseURL                string              `json:"base_url"` // Добавлено это поле
-	SystemPrompt           string              `json:"system_prompt"`
-	Temperature            float64             `json:"temperature"`
-	Models                 map[string][]string `json:"models"`
-	ChatHistoryMaxMessages int                 `json:"chat_history_max_messages"`
+var configDefaults = provider.Defaults{
+	BaseURL:      DefaultBaseURL,
+	SystemPrompt: DefaultSystemPrompt,
+	Temperature:  0.7,
+	Models:       DefaultModels,
+	ModeRules:    DefaultModeRules,
+	Backoff:      provider.Backoff{MaxDelay: provider.DefaultRetryMaxDelay},
 }
 
+// --- Структуры Google AI API ---
+
 type GeminiRequest struct {
 	Contents          []Content         `json:"contents"`
 	SystemInstruction *Content          `json:"system_instruction,omitempty"`
@@ -93,15 +93,9 @@ type FunctionCallingConfig struct {
 }
 
 type FunctionDeclaration struct {
-	Name        string              `json:"name"`
-	Description string              `json:"description"`
-	Parameters  *FunctionParameters `json:"parameters,omitempty"`
-}
-
-type FunctionParameters struct {
-	Type       string                 `json:"type"`
-	Properties map[string]interface{} `json:"properties,omitempty"`
-	Required   []string               `json:"required,omitempty"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Parameters  interface{} `json:"parameters,omitempty"` // схема в формате geminiSchema
 }
 
 type Part struct {
@@ -136,6 +130,7 @@ type InlineData struct {
 type GenerationConfig struct {
 	Temperature      float64         `json:"temperature,omitempty"`
 	ResponseMimeType string          `json:"response_mime_type,omitempty"`
+	ResponseSchema   interface{}     `json:"response_schema,omitempty"`
 	ThinkingConfig   *ThinkingConfig `json:"thinking_config,omitempty"`
 }
 
@@ -144,31 +139,35 @@ type ThinkingConfig struct {
 	IncludeThoughts bool   `json:"include_thoughts,omitempty"` // Добавлено
 }
 
-type GeminiResponse struct {
-	Candidates []struct {
-		Content Content `json:"content"`
-	} `json:"candidates"`
-	Error *struct {
-		Message string `json:"message"`
-		Status  string `json:"status"`
-	} `json:"error,omitempty"`
+type Candidate struct {
+	Content      Content `json:"content"`
+	FinishReason string  `json:"finishReason,omitempty"`
 }
 
-// --- Структуры Истории (совместимы с Mistral) ---
-
-type ChatMessageHistory struct {
-	Role      string      `json:"role"`
-	Content   interface{} `json:"content"`
-	Timestamp time.Time   `json:"timestamp"`
+type UsageMetadata struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
 }
 
-type ChatHistory struct {
-	ID       string               `json:"id"`
-	Messages []ChatMessageHistory `json:"messages"`
+func (u *UsageMetadata) usage() *provider.Usage {
+	if u == nil {
+		return nil
+	}
+	return &provider.Usage{
+		PromptTokens:     u.PromptTokenCount,
+		CompletionTokens: u.CandidatesTokenCount,
+		TotalTokens:      u.TotalTokenCount,
+	}
 }
 
-type FileData struct {
-	Name, MimeType, Base64Content string
+type GeminiResponse struct {
+	Candidates    []Candidate    `json:"candidates"`
+	UsageMetadata *UsageMetadata `json:"usageMetadata,omitempty"`
+	Error         *struct {
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error,omitempty"`
 }
 
 // --- Структуры Tavily API ---
@@ -193,178 +192,82 @@ type TavilySearchResponse struct {
 	} `json:"results"`
 }
 
-// UnifiedFlags структура для хранения унифицированных флагов
-type UnifiedFlags struct {
-	Files         []string
-	System        string
-	Json          bool
-	Mode          string
-	Temp          float64
-	Verbose       bool
-	SaveKey       string
-	SaveTavilyKey string
-	ChatID        string
-	NoTools       bool
-}
-
-// parseArgs унифицированный парсер аргументов, поддерживающий как одинарные, так и двойные дефисы
-func parseArgs() *UnifiedFlags {
-	flags := &UnifiedFlags{
-		Mode: "auto",
-		Temp: -1.0,
-	}
-
-	// Парсим аргументы вручную для поддержки и -flag и --flag
-	args := os.Args[1:]
-	for i := 0; i < len(args); i++ {
-		arg := args[i]
-
-		// Обработка аргументов с двойным дефисом
-		if strings.HasPrefix(arg, "--") {
-			key := strings.TrimPrefix(arg, "--")
-			switch key {
-			case "f", "file":
-				i++
-				if i < len(args) {
-					flags.Files = append(flags.Files, args[i])
-				}
-			case "s", "system", "system-prompt":
-				i++
-				if i < len(args) {
-					flags.System = args[i]
-				}
-			case "j", "json":
-				flags.Json = true
-			case "m", "mode":
-				i++
-				if i < len(args) {
-					flags.Mode = args[i]
-				}
-			case "t", "temp", "temperature":
-				i++
-				if i < len(args) {
-					if val, err := strconv.ParseFloat(args[i], 64); err == nil {
-						flags.Temp = val
-					}
-				}
-			case "v", "verbose":
-				flags.Verbose = true
-			case "save-key":
-				i++
-				if i < len(args) {
-					flags.SaveKey = args[i]
-				}
-			case "save-tavily-key":
-				i++
-				if i < len(args) {
-					flags.SaveTavilyKey = args[i]
-				}
-			case "chat", "chat-id":
-				i++
-				if i < len(args) {
-					flags.ChatID = args[i]
-				}
-			case "no-tools":
-				flags.NoTools = true
-			}
-		} else if strings.HasPrefix(arg, "-") {
-			// Обработка аргументов с одинарным дефисом
-			key := strings.TrimPrefix(arg, "-")
-			switch key {
-			case "f":
-				i++
-				if i < len(args) {
-					flags.Files = append(flags.Files, args[i])
-				}
-			case "s":
-				i++
-				if i < len(args) {
-					flags.System = args[i]
-				}
-			case "j":
-				flags.Json = true
-			case "m":
-				i++
-				if i < len(args) {
-					flags.Mode = args[i]
-				}
-			case "t":
-				i++
-				if i < len(args) {
-					if val, err := strconv.ParseFloat(args[i], 64); err == nil {
-						flags.Temp = val
-					}
-				}
-			case "v":
-				flags.Verbose = true
-			case "save-key":
-				i++
-				if i < len(args) {
-					flags.SaveKey = args[i]
-				}
-			case "save-tavily-key":
-				i++
-				if i < len(args) {
-					flags.SaveTavilyKey = args[i]
-				}
-			case "chat":
-				i++
-				if i < len(args) {
-					flags.ChatID = args[i]
-				}
-			case "no-tools":
-				flags.NoTools = true
-			}
-		}
-	}
-
-	return flags
-}
-
 // mainUnified экспортная функция для использования в основном файле
 func mainUnified() {
-	flags := parseArgs()
+	flags := provider.ParseArgs(os.Args[1:])
+	provider.SetupLog("[GeminiLLM]", LogFileName)
+	provider.Verbose = flags.Verbose
 
-	// Устанавливаем глобальную переменную для совместимости с logVerbose
-	flagVerbose = flags.Verbose
+	// Отчет по журналу расхода (общий для всех утилит)
+	if flags.UsageReport {
+		if err := provider.PrintUsageReport(flags.GroupBy, flags.OutputFormat); err != nil {
+			fatal("Ошибка построения отчета: %v", err)
+		}
+		return
+	}
 
-	configPath, err := getConfigPath()
+	configPath, err := provider.ConfigPath(ConfigFileName)
 	if err != nil {
 		fatal("Не удалось определить путь к конфигурации: %v", err)
 	}
 
 	if flags.SaveKey != "" {
-		if err := addKeyToConfig(configPath, flags.SaveKey); err != nil {
+		if err := provider.AddKeyToConfig(configPath, flags.SaveKey, configDefaults); err != nil {
 			fatal("Ошибка сохранения ключа: %v", err)
 		}
+		fmt.Printf("Ключ успешно добавлен в %s\n", configPath)
 		return
 	}
 
 	if flags.SaveTavilyKey != "" {
-		if err := addTavilyKey(flags.SaveTavilyKey); err != nil {
+		if err := provider.AddTavilyKey(flags.SaveTavilyKey); err != nil {
 			fatal("Ошибка сохранения Tavily ключа: %v", err)
 		}
-		fmt.Printf("Tavily ключ добавлен в %s\n", getTavilyConfigPath())
+		fmt.Printf("Tavily ключ добавлен в %s\n", provider.TavilyConfigPath())
 		return
 	}
 
-	cfg, err := loadConfig(configPath)
+	cfg, err := provider.LoadConfig(configPath, configDefaults)
 	if err != nil {
 		fatal("Ошибка загрузки конфигурации: %v", err)
 	}
 
-	if len(cfg.ApiKeys) == 0 {
+	keys := cfg.Keys()
+
+	if flags.ResetKeys {
+		if err := provider.ResetKeyState("gemini"); err != nil {
+			fatal("Ошибка сброса состояния ключей: %v", err)
+		}
+		fmt.Println("Состояние ключей сброшено")
+		return
+	}
+	if flags.KeyStatus {
+		if err := provider.PrintKeyStatus("gemini", keys); err != nil {
+			fatal("Ошибка чтения состояния ключей: %v", err)
+		}
+		return
+	}
+
+	if len(keys) == 0 {
 		fatal("Список API ключей пуст в gemini.conf. Используйте --save-key для добавления.")
 	}
 
-	userPrompt := readStdin()
-	filesData, hasImages, _, hasPdf := processFiles(flags.Files)
+	if flags.ClearChat != "" {
+		if err := provider.ClearChatHistory(flags.ClearChat); err != nil {
+			fatal("Ошибка очистки истории чата: %v", err)
+		}
+		fmt.Printf("История чата '%s' очищена\n", flags.ClearChat)
+		return
+	}
+
+	userPrompt := provider.ReadStdin()
+	filesData, _ := provider.ProcessFiles(flags.Files, provider.DefaultFileOptions)
 	if userPrompt == "" && len(filesData) == 0 {
 		fatal("Отсутствуют входные данные (stdin или файлы).")
 	}
 
-	mode := determineMode(flags.Mode, userPrompt, hasImages, hasPdf)
-	modelsList := selectModelList(mode, cfg)
+	decision := cfg.ResolveMode(flags, userPrompt, filesData)
+	mode := decision.Mode
 
 	finalSystem := cfg.SystemPrompt
 	if flags.System != "" {
@@ -383,259 +286,338 @@ func mainUnified() {
 		finalTemp = flags.Temp
 	}
 
-	var lastErr error
-
-	// Перемешивание ключей для равномерного распределения нагрузки
-	shuffledKeys := make([]string, len(cfg.ApiKeys))
-	copy(shuffledKeys, cfg.ApiKeys)
-	rand.Shuffle(len(shuffledKeys), func(i, j int) {
-		shuffledKeys[i], shuffledKeys[j] = shuffledKeys[j], shuffledKeys[i]
-	})
-
-	// Счетчик неудачных ключей подряд
-	failedKeysCount := 0
-
-	// Согласно правилу: Сначала перебираем модели для текущего ключа,
-	// и только если все модели на этом ключе выдали 429, переходим к следующему ключу.
-	for _, apiKey := range shuffledKeys {
-		// Маскируем ключ для лога
-		keySuffix := ""
-		if len(apiKey) > 4 {
-			keySuffix = apiKey[len(apiKey)-4:]
-		}
-
-		// Счетчик неудачных попыток для текущего ключа
-		failedModelsForCurrentKey := 0
-
-		for _, modelName := range modelsList {
-			logVerbose("Запрос: ключ=...%s, модель=%s, режим=%s", keySuffix, modelName, mode)
-
-			var chatHistory *ChatHistory
-			if flags.ChatID != "" {
-				chatHistory, _ = loadChatHistory(flags.ChatID)
-			}
+	schema, err := provider.LoadSchema(flags.Schema)
+	if err != nil {
+		fatal("Ошибка чтения --schema: %v", err)
+	}
 
-			result, errReq := requestGemini(apiKey, cfg.BaseURL, modelName, finalSystem, userPrompt, filesData, finalTemp, flags.Json, chatHistory, flags.NoTools)
+	req := &provider.Request{
+		Mode:        mode,
+		System:      finalSystem,
+		Prompt:      userPrompt,
+		Files:       filesData,
+		Temperature: finalTemp,
+		JSON:        flags.Json,
+		Schema:      schema,
+		NoTools:     flags.NoTools,
+	}
 
-			if errReq == nil {
-				// Успех
-				if flags.ChatID != "" && chatHistory != nil {
-					saveHistory(flags.ChatID, chatHistory, userPrompt, result, cfg)
-				}
-				printOutput(result, flags.Json)
-				return
-			}
+	if flags.ChatID != "" {
+		req.History, err = provider.LoadChatHistory(flags.ChatID)
+		if err != nil {
+			fatal("Ошибка загрузки истории чата: %v", err)
+		}
+	}
 
-			// Обработка ошибок
-			lastErr = errReq
-			errMsg := errReq.Error()
-			logVerbose("Ошибка (модель %s): %v", modelName, errMsg)
+	// Потоковый вывод: текст печатается по мере генерации
+	var printer provider.StreamPrinter
+	if flags.Stream {
+		req.OnDelta = printer.Write
+	}
 
-			// Если ошибка 401/403, ключ невалиден вообще.
-			// Нет смысла пробовать другие модели на этом ключе — переходим к следующему ключу.
-			if strings.Contains(errMsg, "401") || strings.Contains(errMsg, "403") {
-				logVerbose("Ключ ...%s невалиден. Переход к следующему ключу.", keySuffix)
-				break
-			}
+	// Инструменты: встроенные, файловые (папки tool_roots) и из tools.yaml
+	var tools *provider.Toolset
+	if !flags.NoTools {
+		userTools, err := provider.LoadTools()
+		if err != nil {
+			fatal("Ошибка чтения %s: %v", provider.ToolsFileName, err)
+		}
+		tools = provider.NewToolset(userTools, append(builtinTools(), provider.FileTools(cfg.ToolRoots)...)...).WithLimits(cfg.ToolLimits())
+	}
 
-			// Увеличиваем счетчик неудачных попыток для текущего ключа
-			failedModelsForCurrentKey++
+	// Сначала перебираем модели для текущего ключа, и только если все
+	// модели на этом ключе провалились, переходим к следующему ключу.
+	// Если 2 ключа подряд полностью провалились, прекращаем попытки.
+	runner := provider.Runner{
+		Provider:         &geminiProvider{baseURL: cfg.BaseURL, tools: tools},
+		Keys:             keys,
+		Models:           cfg.ModelsFor(decision),
+		KeyMajor:         true,
+		MaxFailedKeys:    2,
+		Backoff:          cfg.Backoff(),
+		MaxContinuations: cfg.MaxContinuations,
+		Chunking:         cfg.Chunking(flags),
+	}
 
-			// Если ошибка 429 (лимит) или любая другая (500, 400),
-			// пробуем следующую модель в списке (понижаем версию) для этого же ключа.
-			if strings.Contains(errMsg, "429") {
-				logVerbose("Лимит модели %s достигнут на ключе ...%s. Пробуем следующую модель.", modelName, keySuffix)
-				continue
-			}
+	resp, err := runner.Run(req)
+	if err != nil {
+		fatal("Не удалось получить ответ от доступных моделей и ключей. Последняя ошибка: %v", err)
+	}
 
-			// Для прочих ошибок тоже пробуем сменить модель
-			continue
+	if req.History != nil {
+		if err := provider.SaveToolExchange(req.History, userPrompt, resp.ToolMessages, resp.Text, cfg.HistoryLimits()); err != nil {
+			logVerbose("Ошибка сохранения истории чата: %v", err)
 		}
+	}
+	printer.Finish(resp, flags)
+}
 
-		// Если все модели для текущего ключа провалились, увеличиваем счетчик неудачных ключей
-		if failedModelsForCurrentKey == len(modelsList) {
-			failedKeysCount++
+// geminiProvider реализует provider.Provider для Google AI API.
+// Аудио, видео и документы Gemini понимает нативно через inline_data.
+type geminiProvider struct {
+	provider.Unsupported
+	baseURL string
+	tools   *provider.Toolset // встроенные инструменты и tools.yaml, nil с --no-tools
+}
 
-			// Если 2 ключа подряд полностью провалились, прекращаем попытки
-			if failedKeysCount >= 2 {
-				logVerbose("2 ключа подряд полностью провалились. Прекращаем попытки.")
-				break
-			}
-		} else {
-			// Сбрасываем счетчик, если хотя бы один ключ был успешным
-			failedKeysCount = 0
-		}
-	}
+func (p *geminiProvider) Name() string { return "gemini" }
 
-	fatal("Не удалось получить ответ от доступных моделей и ключей. Последняя ошибка: %v", lastErr)
+func (p *geminiProvider) Chat(apiKey, model string, req *provider.Request) (*provider.Response, error) {
+	return requestGemini(apiKey, p.baseURL, model, req, p.tools)
 }
 
 // --- API Логика ---
 
-// executeCalculator выполняет вычисления через lua-executor
-func executeCalculator(expression string) (string, error) {
-	logVerbose("Tool: Calculator -> %s", expression)
-
-	// Попробуем найти lua-executor.exe в различных расположениях
-	localPath := "./lua-executor/lua-executor.exe"
-	if _, err := os.Stat(localPath); err == nil {
-		cmd := exec.Command(localPath, expression)
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		err = cmd.Run()
+// sendGemini отправляет один запрос к модели и возвращает ответ с одним кандидатом.
+// Если задан onDelta, используется streamGenerateContent (SSE): куски текста
+// выводятся сразу, а части ответа склеиваются в один Content.
+func sendGemini(apiKey, baseURL, model string, req GeminiRequest, onDelta func(string)) (*GeminiResponse, error) {
+	// Ключ передается в URL, поэтому заголовок авторизации не нужен
+	body, _ := json.Marshal(req)
+
+	if onDelta != nil {
+		url := fmt.Sprintf("%s/models/%s:streamGenerateContent?alt=sse&key=%s", baseURL, model, apiKey)
+		var merged GeminiResponse
+		var content Content
+		err := provider.DoSSE("", url, body, provider.DefaultHTTPTimeout, func(data []byte) error {
+			var chunk GeminiResponse
+			if err := json.Unmarshal(data, &chunk); err != nil {
+				return fmt.Errorf("json parse error: %v", err)
+			}
+			if chunk.Error != nil {
+				return fmt.Errorf("API ERROR: %s", chunk.Error.Message)
+			}
+			// Счетчик токенов в потоке накопительный: берем последний
+			if chunk.UsageMetadata != nil {
+				merged.UsageMetadata = chunk.UsageMetadata
+			}
+			if len(chunk.Candidates) == 0 {
+				return nil
+			}
+			for _, p := range chunk.Candidates[0].Content.Parts {
+				if !p.Thought && p.Text != "" {
+					onDelta(p.Text)
+				}
+				content.Parts = append(content.Parts, p)
+			}
+			if reason := chunk.Candidates[0].FinishReason; reason != "" {
+				merged.Candidates = []Candidate{{FinishReason: reason}}
+			}
+			return nil
+		})
 		if err != nil {
-			return "", fmt.Errorf("error executing %s: %v, stderr: %s", localPath, err, stderr.String())
+			return nil, err
 		}
-		return strings.TrimSpace(stdout.String()), nil
+		if len(content.Parts) == 0 {
+			return nil, fmt.Errorf("empty response")
+		}
+		if len(merged.Candidates) == 0 {
+			merged.Candidates = []Candidate{{}}
+		}
+		merged.Candidates[0].Content = content
+		return &merged, nil
 	}
 
-	currentDirPath := "./lua-executor.exe"
-	if _, err := os.Stat(currentDirPath); err == nil {
-		cmd := exec.Command(currentDirPath, expression)
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		err = cmd.Run()
-		if err != nil {
-			return "", fmt.Errorf("error executing %s: %v, stderr: %s", currentDirPath, err, stderr.String())
-		}
-		return strings.TrimSpace(stdout.String()), nil
+	url := fmt.Sprintf("%s/models/%s:generateContent?key=%s", baseURL, model, apiKey)
+	respData, err := provider.DoHTTP("", url, "application/json", body, provider.DefaultHTTPTimeout)
+	if err != nil {
+		return nil, err
 	}
 
-	luaExecPath, err := exec.LookPath("lua-executor.exe")
-	if err == nil {
-		cmd := exec.Command(luaExecPath, expression)
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		err = cmd.Run()
-		if err != nil {
-			return "", fmt.Errorf("error executing %s: %v, stderr: %s", luaExecPath, err, stderr.String())
-		}
-		return strings.TrimSpace(stdout.String()), nil
+	// ЛОГ ДЛЯ ОТЛАДКИ (Виден только с флагом -v)
+	// logVerbose("--- RAW JSON FROM GEMINI ---")
+	// logVerbose("%s", string(respData))
+
+	var gResp GeminiResponse
+	if err := json.Unmarshal(respData, &gResp); err != nil {
+		return nil, fmt.Errorf("json parse error: %v", err)
 	}
 
-	cmdStr := fmt.Sprintf("cd lua-executor && go run main.go \"%s\"", strings.ReplaceAll(expression, "\"", "\\\""))
-	out, err := runCommand(cmdStr)
-	if err != nil {
-		return "", fmt.Errorf("error executing calculator (fallback method): %v", err)
+	if gResp.Error != nil {
+		return nil, fmt.Errorf("API ERROR: %s", gResp.Error.Message)
+	}
+	if len(gResp.Candidates) == 0 {
+		return nil, fmt.Errorf("empty response")
 	}
-	return strings.TrimSpace(out), nil
+	return &gResp, nil
 }
 
-func runCommand(cmdStr string) (string, error) {
-	parts := strings.Split(cmdStr, " && ")
-	if len(parts) == 1 {
-		cmd := exec.Command("cmd", "/c", parts[0])
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		err := cmd.Run()
-		if err != nil {
-			return "", fmt.Errorf("command failed: %v, stderr: %s", err, stderr.String())
-		}
-		return stdout.String(), nil
-	} else if len(parts) >= 2 {
-		dir := strings.TrimPrefix(parts[0], "cd ")
-		dir = strings.TrimSpace(dir)
-		command := strings.Join(parts[1:], " && ")
-
-		cmd := exec.Command("cmd", "/c", command)
-		cmd.Dir = dir
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		err := cmd.Run()
-		if err != nil {
-			return "", fmt.Errorf("command failed: %v, stderr: %s", err, stderr.String())
+// geminiSchemaKeys поля JSON Schema, которые понимает responseSchema (OpenAPI 3.0)
+var geminiSchemaKeys = map[string]bool{
+	"type": true, "format": true, "description": true, "nullable": true, "enum": true,
+	"properties": true, "required": true, "items": true, "minItems": true, "maxItems": true,
+	"minimum": true, "maximum": true, "anyOf": true, "title": true, "propertyOrdering": true,
+	"minLength": true, "maxLength": true, "pattern": true,
+}
+
+// geminiSchema приводит JSON Schema к виду responseSchema: убирает
+// неподдерживаемые поля ($schema, additionalProperties...), переводит
+// type в верхний регистр и ["string", "null"] в nullable.
+func geminiSchema(node interface{}) interface{} {
+	schema, ok := node.(map[string]interface{})
+	if !ok {
+		return node
+	}
+	out := map[string]interface{}{}
+	for k, v := range schema {
+		if !geminiSchemaKeys[k] {
+			continue
 		}
-		return stdout.String(), nil
+		switch k {
+		case "type":
+			switch t := v.(type) {
+			case string:
+				out["type"] = strings.ToUpper(t)
+			case []interface{}:
+				for _, item := range t {
+					name, _ := item.(string)
+					if name == "null" {
+						out["nullable"] = true
+					} else if name != "" {
+						out["type"] = strings.ToUpper(name)
+					}
+				}
+			}
+		case "properties":
+			props := map[string]interface{}{}
+			if m, ok := v.(map[string]interface{}); ok {
+				for name, sub := range m {
+					props[name] = geminiSchema(sub)
+				}
+			}
+			out[k] = props
+		case "items":
+			out[k] = geminiSchema(v)
+		case "anyOf":
+			var variants []interface{}
+			if list, ok := v.([]interface{}); ok {
+				for _, sub := range list {
+					variants = append(variants, geminiSchema(sub))
+				}
+			}
+			out[k] = variants
+		default:
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// builtinTools встроенные инструменты: калькулятор на Lua (в процессе,
+// в песочнице), веб-поиск Tavily и чтение страниц fetch_url.
+// К ним добавляются инструменты из tools.yaml.
+func builtinTools() []provider.Builtin {
+	return []provider.Builtin{
+		{
+			Spec: provider.ToolSpec{
+				Name:        "calculator",
+				Description: "ALWAYS use this tool for ANY mathematical calculations. NEVER guess. Executes Lua scripts for math, algorithms, and logic.",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"expression": map[string]interface{}{
+							"type":        "string",
+							"description": "Lua script to execute (e.g. '2+2')",
+						},
+					},
+					"required": []string{"expression"},
+				},
+			},
+			Run: provider.LuaTool,
+		},
+		{
+			Spec: provider.ToolSpec{
+				Name:        "tavily_search",
+				Description: "ALWAYS use this tool to get current information, news, exchange rates, weather, and real-time facts. NEVER guess current data.",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"query": map[string]interface{}{
+							"type":        "string",
+							"description": "Search query",
+						},
+					},
+					"required": []string{"query"},
+				},
+			},
+			Run: func(args map[string]interface{}) (string, error) {
+				query, _ := args["query"].(string)
+				return executeTavilySearch(query)
+			},
+		},
+		{
+			Spec: provider.ToolSpec{
+				Name:        "fetch_url",
+				Description: "Use this tool to read a specific web page (a link from the user or from search results). Returns the main content as markdown or text.",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"url": map[string]interface{}{
+							"type":        "string",
+							"description": "Absolute http(s) URL",
+						},
+						"format": map[string]interface{}{
+							"type":        "string",
+							"enum":        []string{provider.FetchMarkdown, provider.FetchText},
+							"description": "markdown (default) or text",
+						},
+					},
+					"required": []string{"url"},
+				},
+			},
+			Run: provider.FetchURLTool,
+		},
+	}
+}
+
+// functionDeclarations инструменты в формате function_declarations:
+// схемы параметров приводятся к OpenAPI-подмножеству Gemini.
+func functionDeclarations(toolset *provider.Toolset) []FunctionDeclaration {
+	var decls []FunctionDeclaration
+	for _, spec := range toolset.Specs() {
+		decls = append(decls, FunctionDeclaration{
+			Name:        spec.Name,
+			Description: spec.Description,
+			Parameters:  geminiSchema(spec.Parameters),
+		})
 	}
-	return "", fmt.Errorf("invalid command format")
+	return decls
 }
 
-func requestGemini(apiKey, baseURL, model, system, prompt string, files []FileData, temp float64, isJson bool, history *ChatHistory, noTools bool) (string, error) {
+func requestGemini(apiKey, baseURL, model string, r *provider.Request, toolset *provider.Toolset) (*provider.Response, error) {
+	system, prompt, files, history := r.System, r.Prompt, r.Files, r.History
 	modelL := strings.ToLower(model)
 	isGemma := strings.Contains(modelL, "gemma")
 
 	var tools []interface{}
-	if !isGemma && !noTools {
+	if !isGemma && !r.NoTools && toolset != nil {
 		hasMedia := false
 		hasDocuments := false
 		for _, file := range files {
-			if strings.HasPrefix(file.MimeType, "audio/") || strings.HasPrefix(file.MimeType, "video/") {
+			if file.IsAudio() || file.IsVideo() {
 				hasMedia = true
 			}
-			if strings.HasPrefix(file.MimeType, "application/") &&
-				(strings.Contains(file.MimeType, "pdf") ||
-					strings.Contains(file.MimeType, "wordprocessingml") ||
-					strings.Contains(file.MimeType, "msword") ||
-					strings.Contains(file.MimeType, "spreadsheetml") ||
-					strings.Contains(file.MimeType, "ms-excel") ||
-					strings.Contains(file.MimeType, "rtf")) {
+			if file.IsDocument() {
 				hasDocuments = true
 			}
 		}
 
 		if !hasMedia && !hasDocuments {
 			tools = []interface{}{
-				map[string]interface{}{
-					"function_declarations": []FunctionDeclaration{
-						{
-							Name:        "calculator",
-							Description: "ALWAYS use this tool for ANY mathematical calculations. NEVER guess. Executes Lua scripts for math, algorithms, and logic.",
-							Parameters: &FunctionParameters{
-								Type: "OBJECT",
-								Properties: map[string]interface{}{
-									"expression": map[string]interface{}{
-										"type":        "STRING",
-										"description": "Lua script to execute (e.g. '2+2')",
-									},
-								},
-								Required: []string{"expression"},
-							},
-						},
-						{
-							Name:        "tavily_search",
-							Description: "ALWAYS use this tool to get current information, news, exchange rates, weather, and real-time facts. NEVER guess current data.",
-							Parameters: &FunctionParameters{
-								Type: "OBJECT",
-								Properties: map[string]interface{}{
-									"query": map[string]interface{}{
-										"type":        "STRING",
-										"description": "Search query",
-									},
-								},
-								Required: []string{"query"},
-							},
-						},
-					},
-				},
+				map[string]interface{}{"function_declarations": functionDeclarations(toolset)},
 			}
 		}
 	}
 
-	url := fmt.Sprintf("%s/models/%s:generateContent?key=%s", baseURL, model, apiKey)
-
-	var reqContents []Content
-	if history != nil {
-		for _, m := range history.Messages {
-			role := m.Role
-			if role == "assistant" {
-				role = "model"
-			}
-			var parts []Part
-			if str, ok := m.Content.(string); ok {
-				parts = append(parts, Part{Text: str})
-			}
-			reqContents = append(reqContents, Content{Role: role, Parts: parts})
-		}
-	}
+	reqContents := historyContents(history.Replay(len(tools) > 0))
 
 	curPart := Part{Text: prompt}
 	if isGemma {
 		curPart.Text = fmt.Sprintf("SYSTEM INSTRUCTION: %s\n\nUSER REQUEST: %s", system, prompt)
+		// У Gemma нет responseSchema, схема передается текстом
+		if r.Schema != nil {
+			curPart.Text += r.Schema.Instruction()
+		}
 	}
 	curContent := Content{Role: "user", Parts: []Part{curPart}}
 	for _, f := range files {
@@ -645,12 +627,18 @@ func requestGemini(apiKey, baseURL, model, system, prompt string, files []FileDa
 	}
 	reqContents = append(reqContents, curContent)
 
+	// Расход токенов и вызовы инструментов копятся по всем итерациям,
+	// вызовы с результатами — еще и для истории чата
+	var usage *provider.Usage
+	var calls []provider.ToolCall
+	var toolMessages []provider.ChatMessageHistory
+
 	maxIterations := 5
 	for iteration := 0; iteration < maxIterations; iteration++ {
 		req := GeminiRequest{
 			Contents: reqContents,
 			GenerationConfig: &GenerationConfig{
-				Temperature: temp,
+				Temperature: r.Temperature,
 			},
 		}
 
@@ -668,40 +656,19 @@ func requestGemini(apiKey, baseURL, model, system, prompt string, files []FileDa
 			}
 		}
 
-		if isJson && !isGemma {
+		if r.JSON && !isGemma {
 			req.GenerationConfig.ResponseMimeType = "application/json"
+			if r.Schema != nil {
+				req.GenerationConfig.ResponseSchema = geminiSchema(r.Schema.Inline())
+			}
 		}
 
-		body, _ := json.Marshal(req)
-		resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+		resp, err := sendGemini(apiKey, baseURL, model, req, r.OnDelta)
 		if err != nil {
-			return "", err
-		}
-
-		respData, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-
-		if resp.StatusCode != 200 {
-			return "", fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(respData))
-		}
-
-		// ЛОГ ДЛЯ ОТЛАДКИ (Виден только с флагом -v)
-		// logVerbose("--- RAW JSON FROM GEMINI ---")
-		// logVerbose("%s", string(respData))
-
-		var gResp GeminiResponse
-		if err := json.Unmarshal(respData, &gResp); err != nil {
-			return "", fmt.Errorf("json parse error: %v", err)
-		}
-
-		if gResp.Error != nil {
-			return "", fmt.Errorf("API ERROR: %s", gResp.Error.Message)
-		}
-		if len(gResp.Candidates) == 0 {
-			return "", fmt.Errorf("empty response")
+			return nil, err
 		}
-
-		content := gResp.Candidates[0].Content
+		usage = usage.Add(resp.UsageMetadata.usage())
+		content := resp.Candidates[0].Content
 
 		hasFunctionCall := false
 		for _, part := range content.Parts {
@@ -718,582 +685,146 @@ func requestGemini(apiKey, baseURL, model, system, prompt string, files []FileDa
 					finalResponse.WriteString(p.Text)
 				}
 			}
-			return finalResponse.String(), nil
+			return &provider.Response{
+				Text:         finalResponse.String(),
+				FinishReason: resp.Candidates[0].FinishReason,
+				Usage:        usage,
+				ToolCalls:    calls,
+				ToolMessages: toolMessages,
+			}, nil
 		}
 
 		content.Role = "model"
 		reqContents = append(reqContents, content)
 
-		var funcResponses []Part
+		// Gemini не выдает ID вызовов, для истории они создаются здесь
+		assistant := provider.ChatMessageHistory{Role: "assistant"}
+		var text strings.Builder
+		var turn []provider.ToolCall
 		for _, part := range content.Parts {
+			if !part.Thought && part.Text != "" {
+				text.WriteString(part.Text)
+			}
 			if part.FunctionCall != nil {
 				funcName := part.FunctionCall.Name
-				args := part.FunctionCall.Args
 				sig := part.ThoughtSignature // ТЕПЕРЬ ОНО РАСПАРСИТСЯ!
-
-				var funcRes string
+				argsJSON, _ := json.Marshal(part.FunctionCall.Args)
+				turn = append(turn, provider.ToolCall{Name: funcName, Arguments: string(argsJSON)})
+				assistant.ToolCalls = append(assistant.ToolCalls, provider.HistoryToolCall{ID: provider.NewToolCallID(), Name: funcName, Arguments: string(argsJSON), Signature: sig})
 				logVerbose("Executing tool: %s (Sig: %t)", funcName, sig != "")
+			}
+		}
+		calls = append(calls, turn...)
 
-				switch funcName {
-				case "calculator":
-					expr, _ := args["expression"].(string)
-					res, err := executeCalculator(expr)
-					if err != nil {
-						funcRes = "Error: " + err.Error()
-					} else {
-						funcRes = res
-					}
-				case "tavily_search":
-					query, _ := args["query"].(string)
-					res, err := executeTavilySearch(query)
-					if err != nil {
-						funcRes = "Error: " + err.Error()
-					} else {
-						funcRes = res
-					}
-				default:
-					funcRes = "Error: unknown function"
-				}
-
-				funcResponses = append(funcResponses, Part{
-					FunctionResponse: &FunctionResponse{
-						Name: funcName,
-						Response: map[string]interface{}{
-							"result": funcRes,
-						},
+		// Вызовы одного хода выполняются параллельно, ответы — в порядке вызовов
+		var results []provider.ChatMessageHistory
+		var funcResponses []Part
+		for i, funcRes := range toolset.CallAll(turn) {
+			call := assistant.ToolCalls[i]
+			results = append(results, provider.ChatMessageHistory{Role: "tool", Content: funcRes, ToolCallID: call.ID, Name: call.Name})
+			funcResponses = append(funcResponses, Part{
+				FunctionResponse: &FunctionResponse{
+					Name: call.Name,
+					Response: map[string]interface{}{
+						"result": funcRes,
 					},
-					ThoughtSignature: sig, // ЭХО ПОДПИСИ
-				})
-			}
+				},
+				ThoughtSignature: call.Signature, // ЭХО ПОДПИСИ
+			})
 		}
 
+		assistant.Content = text.String()
+		toolMessages = append(append(toolMessages, assistant), results...)
+
 		reqContents = append(reqContents, Content{
 			Role:  "function", // Для ответов инструментов в Gemini 3.1
 			Parts: funcResponses,
 		})
 	}
 
-	return "", fmt.Errorf("exceeded max tool iterations")
-}
-
-// --- Утилиты (Копия логики Mistral для совместимости) ---
-
-func loadConfig(path string) (*Config, error) {
-	// Флаг необходимости перезаписи файла (если мы что-то исправили или заполнили)
-	dirty := false
-
-	data, err := os.ReadFile(path)
-	var cfg Config
-
-	if err != nil {
-		// Если файла нет вообще — создаем структуру с дефолтами
-		cfg = Config{
-			BaseURL:                DefaultBaseURL,
-			SystemPrompt:           DefaultSystemPrompt,
-			Temperature:            0.7,
-			Models:                 DefaultModels,
-			ChatHistoryMaxMessages: 30,
-			ApiKeys:                []string{""}, // Добавляем пустой ключ для удобства
-		}
-		dirty = true
-	} else {
-		// Если файл есть — парсим его
-		if err := json.Unmarshal(data, &cfg); err != nil {
-			return nil, fmt.Errorf("ошибка парсинга конфигурации: %v", err)
-		}
-
-		// Проверяем наличие базовых полей
-		if cfg.BaseURL == "" {
-			cfg.BaseURL = DefaultBaseURL
-			dirty = true
-		}
-		if cfg.SystemPrompt == "" {
-			cfg.SystemPrompt = DefaultSystemPrompt
-			dirty = true
-		}
-		if cfg.ChatHistoryMaxMessages == 0 {
-			cfg.ChatHistoryMaxMessages = 30
-			dirty = true
-		}
-
-		// Проверяем и восстанавливаем список моделей
-		if cfg.Models == nil {
-			cfg.Models = make(map[string][]string)
-			dirty = true
-		}
-		for category, defaults := range DefaultModels {
-			if list, exists := cfg.Models[category]; !exists || len(list) == 0 {
-				cfg.Models[category] = defaults
-				dirty = true
-			}
-		}
-
-		// Если список ключей пуст — добавляем пустой шаблон
-		if len(cfg.ApiKeys) == 0 {
-			cfg.ApiKeys = []string{""}
-			dirty = true
-		}
-	}
-
-	// Если мы вносили исправления или создали конфиг с нуля — сохраняем изменения на диск
-	if dirty {
-		logVerbose("Конфигурация обновлена или восстановлена. Сохранение в %s", path)
-		if err := saveConfig(path, &cfg); err != nil {
-			return nil, fmt.Errorf("не удалось сохранить исправленную конфигурацию: %v", err)
-		}
-	}
-
-	return &cfg, nil
-}
-
-func saveConfig(path string, cfg *Config) error {
-	// Создаем или перезаписываем файл конфигурации
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	// Настраиваем энкодер с отступами для удобного ручного редактирования
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-
-	// Записываем структуру в формате JSON
-	return enc.Encode(cfg)
-}
-
-func addKeyToConfig(path, key string) error {
-	// Загружаем существующий конфиг или получаем дефолтный
-	cfg, err := loadConfig(path)
-	if err != nil {
-		return err
-	}
-
-	// Проверяем, нет ли уже такого ключа в списке, чтобы не дублировать
-	exists := false
-	for _, k := range cfg.ApiKeys {
-		if k == key {
-			exists = true
-			break
-		}
-	}
-
-	if !exists {
-		cfg.ApiKeys = append(cfg.ApiKeys, key)
-	}
-
-	// Открываем файл на запись (создаем или перезаписываем)
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	// Настраиваем энкодер с отступами для читаемости JSON
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-
-	// Сохраняем обновленную структуру в файл
-	if err := enc.Encode(cfg); err != nil {
-		return err
-	}
-
-	fmt.Printf("Ключ успешно добавлен в %s\n", path)
-	return nil
-}
-
-func processFiles(paths []string) (res []FileData, hasImg, hasAudio, hasPdf bool) {
-	for _, p := range paths {
-		data, err := os.ReadFile(p)
-		if err != nil {
-			continue
-		}
-
-		// First try to detect MIME type by content (more reliable)
-		mt := mime.TypeByExtension(filepath.Ext(p))
-		contentType := http.DetectContentType(data)
-
-		// If mime.TypeByExtension doesn't return an audio type but content detection does,
-		// use the content detection result
-		if !strings.HasPrefix(mt, "audio/") && strings.HasPrefix(contentType, "audio/") {
-			mt = contentType
-		} else if mt == "" || mt == "application/octet-stream" {
-			// Fallback to content detection if extension-based detection fails
-			mt = contentType
-		}
-
-		// Additional check: if we have an OGG file that was detected as application/ogg,
-		// treat it as audio since OGG files are typically audio/video containers
-		if mt == "application/ogg" || mt == "application/opus" {
-			mt = "audio/ogg" // Normalize to audio type
-		}
-
-		// Check if this is an unsupported audio format that needs transcoding
-		ext := strings.ToLower(filepath.Ext(p))
-		needsTranscoding := (ext == ".amr") // Add other formats as needed
-
-		if needsTranscoding {
-			// Transcode using ffmpeg to a supported format (WAV)
-			transcodedData, err := transcodeAudioWithFFmpeg(p)
-			if err != nil {
-				logVerbose("Warning: Could not transcode %s: %v. Attempting to use original file.", p, err)
-				// Fall back to original file if transcoding fails
+	return nil, fmt.Errorf("exceeded max tool iterations")
+}
+
+// historyAttachmentText заменяет в истории сообщение без текста (только
+// картинки или аудио, сохраненные другими утилитами).
+const historyAttachmentText = "[attachment]"
+
+// historyContents переводит историю чата в contents Gemini: вызовы
+// инструментов становятся functionCall (с сохраненной thoughtSignature),
+// результаты подряд идущих вызовов — одним сообщением functionResponse.
+func historyContents(messages []provider.ChatMessageHistory) []Content {
+	var contents []Content
+	for _, m := range messages {
+		switch m.Role {
+		case "tool":
+			result, _ := m.Content.(string)
+			part := Part{FunctionResponse: &FunctionResponse{
+				Name:     m.Name,
+				Response: map[string]interface{}{"result": result},
+			}}
+			if n := len(contents); n > 0 && contents[n-1].Role == "function" {
+				contents[n-1].Parts = append(contents[n-1].Parts, part)
 			} else {
-				// Use transcoded data instead of original
-				data = transcodedData
-				mt = "audio/wav" // Set to the format we're transcoding to
-			}
-		}
-
-		// Check if this is a video file
-		if strings.HasPrefix(mt, "video/") {
-			// For video files, normalize to a standard format
-			switch ext {
-			case ".mp4", ".m4v":
-				mt = "video/mp4"
-			case ".mov", ".qt":
-				mt = "video/quicktime"
-			case ".avi":
-				mt = "video/x-msvideo"
-			case ".wmv":
-				mt = "video/x-ms-wmv"
-			case ".webm":
-				mt = "video/webm"
-			case ".mkv":
-				mt = "video/x-matroska"
-			case ".m4a": // Sometimes m4a files can be handled as video
-				mt = "video/mp4"
-			default:
-				// For other video formats, use mp4 as a standard format
-				mt = "video/mp4"
+				contents = append(contents, Content{Role: "function", Parts: []Part{part}})
 			}
+			continue
 		}
 
-		if strings.HasPrefix(mt, "image/") {
-			hasImg = true
-		}
-		if strings.HasPrefix(mt, "audio/") {
-			hasAudio = true
-			// Normalize audio MIME types for better Gemini API compatibility
-			// Use appropriate audio format based on file extension when possible
-			ext := strings.ToLower(filepath.Ext(p))
-			switch ext {
-			case ".mp3":
-				mt = "audio/mpeg"
-			case ".wav":
-				mt = "audio/wav"
-			case ".m4a", ".mp4":
-				mt = "audio/mp4"
-			case ".ogg", ".opus":
-				mt = "audio/ogg"
-			default:
-				// For other audio formats, use wav as a standard format that Gemini supports
-				mt = "audio/wav"
-			}
+		role := m.Role
+		if role == "assistant" {
+			role = "model"
 		}
-		// Check for video files after audio processing
-		if strings.HasPrefix(mt, "video/") {
-			hasAudio = true // Treat video as audio for the purpose of disabling code execution
-			// Video files also need special handling - disable code execution tool
+		// Контент другой утилиты бывает массивом частей (текст + image_url):
+		// Gemini берет из него текст, пустые parts он отклоняет. Сообщение
+		// из одних вложений заменяется пометкой, чтобы не сбить очередность ролей
+		var parts []Part
+		text := provider.ContentText(m.Content)
+		if _, isString := m.Content.(string); text == "" && !isString && len(m.ToolCalls) == 0 {
+			text = historyAttachmentText
 		}
-		if mt == "application/pdf" {
-			hasPdf = true
+		if text != "" {
+			parts = append(parts, Part{Text: text})
 		}
-
-		// Check for document formats that Gemini supports
-		if mt == "application/pdf" {
-			hasPdf = true
-		} else if strings.HasPrefix(mt, "application/") {
-			switch mt {
-			case "application/vnd.openxmlformats-officedocument.wordprocessingml.document": // .docx
-				hasPdf = true // Treat as document type
-			case "application/msword": // .doc
-				hasPdf = true // Treat as document type
-			case "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": // .xlsx
-				hasPdf = true // Treat as document type
-			case "application/vnd.ms-excel": // .xls
-				hasPdf = true // Treat as document type
-			case "application/rtf", "application/x-rtf": // .rtf
-				hasPdf = true // Treat as document type
-			}
+		for _, call := range m.ToolCalls {
+			args := map[string]interface{}{}
+			_ = json.Unmarshal([]byte(call.Arguments), &args)
+			parts = append(parts, Part{
+				FunctionCall:     &FunctionCall{Name: call.Name, Args: args},
+				ThoughtSignature: call.Signature,
+			})
 		}
-
-		// Also check by file extension if MIME type detection failed
-		if !hasPdf {
-			ext := strings.ToLower(filepath.Ext(p))
-			switch ext {
-			case ".pdf":
-				hasPdf = true
-			case ".doc":
-				if mt == "" || mt == "application/octet-stream" {
-					mt = "application/msword"
-				}
-				hasPdf = true
-			case ".docx":
-				// According to API documentation, Gemini supports DOCX but may expect it as a different type
-				// Try sending as application/octet-stream or use text extraction approach
-				// For now, use the correct MIME type but the API may handle it internally
-				if mt == "" || mt == "application/octet-stream" {
-					mt = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
-				}
-				hasPdf = true
-			case ".txt":
-				if mt == "" || mt == "application/octet-stream" {
-					mt = "text/plain"
-				}
-				hasPdf = true
-			case ".html":
-				if mt == "" || mt == "application/octet-stream" {
-					mt = "text/html"
-				}
-				hasPdf = true
-			case ".rtf":
-				if mt == "" || mt == "application/octet-stream" {
-					mt = "application/rtf"
-				}
-				hasPdf = true
-			case ".xls":
-				if mt == "" || mt == "application/octet-stream" {
-					mt = "application/vnd.ms-excel"
-				}
-				hasPdf = true
-			case ".xlsx":
-				if mt == "" || mt == "application/octet-stream" {
-					mt = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
-				}
-				hasPdf = true
-			}
+		if len(parts) == 0 {
+			continue
 		}
-		res = append(res, FileData{
-			Name: filepath.Base(p), MimeType: mt,
-			Base64Content: base64.StdEncoding.EncodeToString(data),
-		})
-	}
-	return
-}
-
-// transcodeAudioWithFFmpeg transcodes an audio file to WAV format using ffmpeg
-func transcodeAudioWithFFmpeg(inputPath string) ([]byte, error) {
-	// Create a temporary file for the output
-	tempOutput, err := os.CreateTemp("", "transcoded_*.wav")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temp file: %v", err)
-	}
-	tempPath := tempOutput.Name()
-	tempOutput.Close()
-	defer os.Remove(tempPath) // Clean up temp file
-
-	// Run ffmpeg command: ffmpeg -i input.ext -ar 16000 -ac 1 -b:a 64k output.wav
-	cmd := exec.Command("ffmpeg", "-i", inputPath, "-ar", "16000", "-ac", "1", "-b:a", "64k", "-y", tempPath)
-
-	// Capture stderr for error reporting
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-
-	err = cmd.Run()
-	if err != nil {
-		return nil, fmt.Errorf("ffmpeg failed: %v, stderr: %s", err, stderr.String())
-	}
-
-	// Read the transcoded file
-	transcodedData, err := os.ReadFile(tempPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read transcoded file: %v", err)
-	}
-
-	return transcodedData, nil
-}
-
-func determineMode(flag, prompt string, hasImg, hasPdf bool) string {
-	if flag != "auto" {
-		return flag
-	}
-	if hasPdf {
-		return "ocr"
-	}
-	if hasImg {
-		return "vision"
-	}
-	if strings.Contains(strings.ToLower(prompt), "code") {
-		return "code"
-	}
-	return "general"
-}
-
-func selectModelList(mode string, cfg *Config) []string {
-	if l, ok := cfg.Models[mode]; ok {
-		return l
-	}
-	return DefaultModels["general"]
-}
-
-func loadChatHistory(id string) (*ChatHistory, error) {
-	dir, _ := os.UserConfigDir()
-	path := filepath.Join(dir, ConfigDirName, "mistral_chats", id+".json")
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return &ChatHistory{ID: id}, nil
-	}
-	var h ChatHistory
-	json.Unmarshal(data, &h)
-	return &h, nil
-}
-
-func saveHistory(id string, h *ChatHistory, user, assistant string, cfg *Config) {
-	h.Messages = append(h.Messages, ChatMessageHistory{Role: "user", Content: user, Timestamp: time.Now()})
-	h.Messages = append(h.Messages, ChatMessageHistory{Role: "assistant", Content: assistant, Timestamp: time.Now()})
-
-	if len(h.Messages) > cfg.ChatHistoryMaxMessages*2 {
-		h.Messages = h.Messages[len(h.Messages)-cfg.ChatHistoryMaxMessages*2:]
-	}
-
-	dir, _ := os.UserConfigDir()
-	path := filepath.Join(dir, ConfigDirName, "mistral_chats", id+".json")
-	os.MkdirAll(filepath.Dir(path), 0755)
-	f, _ := os.Create(path)
-	json.NewEncoder(f).Encode(h)
-}
-
-func readStdin() string {
-	stat, _ := os.Stdin.Stat()
-	if (stat.Mode() & os.ModeCharDevice) != 0 {
-		return ""
-	}
-	b, _ := io.ReadAll(os.Stdin)
-	if utf8.Valid(b) {
-		return strings.TrimSpace(string(b))
-	}
-	dec, _ := charmap.CodePage866.NewDecoder().Bytes(b)
-	return strings.TrimSpace(string(dec))
-}
-
-func printOutput(text string, isJson bool) {
-	if isJson {
-		text = strings.TrimSpace(text)
-		text = strings.TrimPrefix(text, "```json")
-		text = strings.TrimSuffix(text, "```")
+		contents = append(contents, Content{Role: role, Parts: parts})
 	}
-	fmt.Println(strings.TrimSpace(text))
+	return contents
 }
 
-var flagVerbose bool // Глобальная переменная для совместимости с logVerbose
+// --- Утилиты ---
 
 func logVerbose(f string, v ...interface{}) {
-	msg := fmt.Sprintf(f, v...)
-	if flagVerbose {
-		fmt.Fprintln(os.Stderr, "[GeminiLLM]", msg)
-	}
-	dir, _ := os.UserConfigDir()
-	path := filepath.Join(dir, ConfigDirName, LogFileName)
-	file, _ := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if file != nil {
-		defer file.Close()
-		fmt.Fprintf(file, "[%s] %s\n", time.Now().Format("15:04:05"), msg)
-	}
+	provider.Logf(f, v...)
 }
 
 func fatal(f string, v ...interface{}) {
-	logVerbose("FATAL: "+f, v...)
-	fmt.Fprintf(os.Stderr, "ERROR: "+f+"\n", v...)
-	os.Exit(1)
-}
-
-func getConfigPath() (string, error) {
-	dir, _ := os.UserConfigDir()
-	p := filepath.Join(dir, ConfigDirName)
-	os.MkdirAll(p, 0755)
-	return filepath.Join(p, ConfigFileName), nil
+	provider.Fatalf(f, v...)
 }
 
 // --- Tavily API Функции ---
 
-// getTavilyConfigPath возвращает путь к конфигурационному файлу Tavily
-func getTavilyConfigPath() string {
-	dir, _ := os.UserConfigDir()
-	return filepath.Join(dir, "clipgen-m", "tavily.conf")
-}
-
-// loadTavilyConfig загружает конфигурацию Tavily API ключей
-func loadTavilyConfig() ([]string, error) {
-	configPath := getTavilyConfigPath()
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("tavily.conf не найден в %s", configPath)
-		}
-		return nil, err
-	}
-
-	var config struct {
-		ApiKeys []string `json:"api_keys"`
-	}
-	if err := json.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("ошибка парсинга tavily.conf: %v", err)
-	}
-
-	if len(config.ApiKeys) == 0 {
-		return nil, fmt.Errorf("список API ключей пуст в tavily.conf")
-	}
-
-	return config.ApiKeys, nil
-}
-
-// addTavilyKey добавляет новый API ключ Tavily в конфигурацию
-func addTavilyKey(newKey string) error {
-	configPath := getTavilyConfigPath()
-
-	// Создаем директорию если не существует
-	dir := filepath.Dir(configPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
-	}
-
-	// Пытаемся загрузить существующие ключи
-	var keys []string
-	if data, err := os.ReadFile(configPath); err == nil {
-		var config struct {
-			ApiKeys []string `json:"api_keys"`
-		}
-		if err := json.Unmarshal(data, &config); err == nil {
-			keys = config.ApiKeys
-		}
-	}
-
-	// Проверяем, есть ли уже такой ключ
-	for _, key := range keys {
-		if key == newKey {
-			return nil // Ключ уже существует
-		}
-	}
-
-	// Добавляем новый ключ
-	keys = append(keys, newKey)
-
-	// Сохраняем конфигурацию
-	config := map[string]interface{}{
-		"api_keys": keys,
-	}
-
-	data, err := json.MarshalIndent(config, "", "    ")
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(configPath, data, 0644)
-}
-
 // executeTavilySearch выполняет поиск через Tavily API
 func executeTavilySearch(query string) (string, error) {
 	logVerbose("Tavily Search: %s", query)
 
 	// Загружаем API ключи
-	apiKeys, err := loadTavilyConfig()
+	apiKeys, err := provider.LoadTavilyKeys()
 	if err != nil {
 		return "", err
 	}
 
 	// Выбираем случайный ключ для распределения нагрузки
-	apiKey := apiKeys[rand.Intn(len(apiKeys))]
+	apiKey := provider.RandomKey(apiKeys, nil)
 
 	// Создаем запрос
 	req := TavilySearchRequest{
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"ClipGen-m/internal/provider"
+)
+
+func TestHistoryContents(t *testing.T) {
+	// История, в которую писали mistral/pollinationsllm (вложения — массивом
+	// частей) и сам geminillm (вызов калькулятора)
+	var h provider.ChatHistory
+	err := json.Unmarshal([]byte(`{"id":"mixed","messages":[
+		{"role":"user","content":[{"type":"text","text":"what is on the picture?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}}]},
+		{"role":"assistant","content":"a cat"},
+		{"role":"user","content":[{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}}]},
+		{"role":"assistant","content":"no idea"},
+		{"role":"user","content":"2+2?"},
+		{"role":"assistant","content":"","tool_calls":[{"id":"abc123XYZ","name":"calculator","arguments":"{\"expression\":\"2+2\"}","thought_signature":"sig"}]},
+		{"role":"tool","content":"4","tool_call_id":"abc123XYZ","name":"calculator"},
+		{"role":"assistant","content":"4"}
+	]}`), &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		tools bool
+		want  string
+	}{
+		{
+			name:  "with tools",
+			tools: true,
+			want: `[{"role":"user","parts":[{"text":"what is on the picture?"}]},{"role":"model","parts":[{"text":"a cat"}]},` +
+				`{"role":"user","parts":[{"text":"[attachment]"}]},{"role":"model","parts":[{"text":"no idea"}]},` +
+				`{"role":"user","parts":[{"text":"2+2?"}]},` +
+				`{"role":"model","parts":[{"functionCall":{"name":"calculator","args":{"expression":"2+2"}},"thoughtSignature":"sig"}]},` +
+				`{"role":"function","parts":[{"functionResponse":{"name":"calculator","response":{"result":"4"}}}]},` +
+				`{"role":"model","parts":[{"text":"4"}]}]`,
+		},
+		{
+			name:  "without tools",
+			tools: false,
+			want: `[{"role":"user","parts":[{"text":"what is on the picture?"}]},{"role":"model","parts":[{"text":"a cat"}]},` +
+				`{"role":"user","parts":[{"text":"[attachment]"}]},{"role":"model","parts":[{"text":"no idea"}]},` +
+				`{"role":"user","parts":[{"text":"2+2?"}]},` +
+				`{"role":"model","parts":[{"text":"4"}]}]`,
+		},
+	}
+	for _, tt := range tests {
+		contents := historyContents(h.Replay(tt.tools))
+		for _, c := range contents {
+			if len(c.Parts) == 0 {
+				t.Errorf("%s: %s content without parts", tt.name, c.Role)
+			}
+		}
+		if got, _ := json.Marshal(contents); string(got) != tt.want {
+			t.Errorf("%s: historyContents =\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
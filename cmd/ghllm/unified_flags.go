@@ -1,55 +1,65 @@
 package main
 
 import (
-	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
-	"math/rand"
-	"mime"
-	"net/http"
 	"os"
-	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
-	"unicode/utf8"
 
-	"golang.org/x/text/encoding/charmap"
+	"ClipGen-m/internal/provider"
 )
 
 // --- Константы и настройки ---
 
 const (
-	ConfigDirName  = "clipgen-m"
 	ConfigFileName = "github.conf"
 	LogFileName    = "github_err.log"
-	MaxLogSize     = 10 * 1024 * 1024 // 10 MB
 
-	// Единый эндпоинт для GitHub Models
-	BaseURL = "https://models.inference.ai.azure.com/chat/completions"
-)
+	// Единый эндпоинт для GitHub Models (к нему добавляется /chat/completions)
+	DefaultBaseURL = "https://models.inference.ai.azure.com"
 
-// Списки моделей
-var (
-	ModelsGeneral = []string{"gpt-4.1", "gpt-4.1-mini", "gpt-4o", "gpt-4o-mini"}
+	// Лимит из Python кода (чтобы влезть в 8к контекст)
+	DefaultMaxTokens = 4000
 
-	ModelsCode = []string{"gpt-4.1", "gpt-4.1-mini", "gpt-4o", "gpt-4o-mini"}
+	// Температура флага делится на 2 (по ТЗ), поэтому дефолт флага 1.0 == 0.5
+	DefaultTemperature = 0.5
 
-	// Вижн (картинки)
-	ModelsVision = []string{"gpt-4.1", "gpt-4.1-mini", "gpt-4o", "gpt-4o-mini"}
+	// Увеличенный таймаут для аудио
+	HTTPTimeout = 180 * time.Second
+)
 
+// Списки моделей
+var DefaultModels = map[string][]string{
+	"general": {"gpt-4.1", "gpt-4.1-mini", "gpt-4o", "gpt-4o-mini"},
+	"code":    {"gpt-4.1", "gpt-4.1-mini", "gpt-4o", "gpt-4o-mini"},
+	// Вижн (картинки), используется и для OCR
+	"vision": {"gpt-4.1", "gpt-4.1-mini", "gpt-4o", "gpt-4o-mini"},
+	"ocr":    {"gpt-4.1", "gpt-4.1-mini", "gpt-4o", "gpt-4o-mini"},
 	// Аудио (Специфичная модель для GitHub)
-	ModelAudio = "microsoft/Phi-4-multimodal-instruct"
-)
+	"audio": {"microsoft/Phi-4-multimodal-instruct"},
+}
 
-// --- Структуры данных API ---
+// DefaultModeRules выбор режима для --mode auto
+// (mode_rules в конфиге, порядок важен).
+var DefaultModeRules = []provider.ModeRule{
+	{Name: "audio", Attachments: []string{"audio"}, Mode: "audio"},
+	{Name: "images", Attachments: []string{"image"}, Mode: "vision"},
+	{Name: "code", Keywords: []string{"код", "code", "json", "script"}, Mode: "code"},
+	{Name: "default", Mode: "general"},
+}
 
-type Config struct {
-	ApiKeys []string `json:"api_keys"`
+var configDefaults = provider.Defaults{
+	BaseURL:     DefaultBaseURL,
+	Temperature: DefaultTemperature,
+	MaxTokens:   DefaultMaxTokens,
+	Models:      DefaultModels,
+	ModeRules:   DefaultModeRules,
+	Backoff:     provider.Backoff{BaseDelay: 2 * time.Second, MaxDelay: provider.DefaultRetryMaxDelay},
 }
 
+// --- Структуры данных API ---
+
 type ChatMessage struct {
 	Role    string      `json:"role"`
 	Content interface{} `json:"content"` // string или []ContentPart
@@ -72,13 +82,12 @@ type ContentPart struct {
 }
 
 type ChatRequest struct {
-	Model          string        `json:"model"`
-	Messages       []ChatMessage `json:"messages"`
-	Temperature    float64       `json:"temperature"`
-	MaxTokens      int           `json:"max_tokens,omitempty"` // Важно для GH (лимиты)
-	ResponseFormat *struct {
-		Type string `json:"type"`
-	} `json:"response_format,omitempty"`
+	Model          string                   `json:"model"`
+	Messages       []ChatMessage            `json:"messages"`
+	Temperature    float64                  `json:"temperature"`
+	MaxTokens      int                      `json:"max_tokens,omitempty"` // Важно для GH (лимиты)
+	Stream         bool                     `json:"stream,omitempty"`
+	ResponseFormat *provider.ResponseFormat `json:"response_format,omitempty"`
 }
 
 type ChatResponse struct {
@@ -86,7 +95,9 @@ type ChatResponse struct {
 		Message struct {
 			Content string `json:"content"`
 		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
+	Usage *provider.Usage `json:"usage,omitempty"`
 	Error *struct {
 		Message string `json:"message"`
 		Code    string `json:"code"` // GH иногда возвращает int коды ошибок, но json.Unmarshal в string справится или упадет, лучше interface{} но оставим string пока
@@ -94,186 +105,89 @@ type ChatResponse struct {
 	} `json:"error,omitempty"`
 }
 
-// --- Флаги ---
-
-type arrayFlags []string
-
-func (i *arrayFlags) String() string { return strings.Join(*i, ",") }
-func (i *arrayFlags) Set(value string) error {
-	*i = append(*i, value)
-	return nil
-}
-
-// UnifiedFlags структура для хранения унифицированных флагов
-type UnifiedFlags struct {
-	Files   []string
-	System  string
-	Json    bool
-	Mode    string
-	Temp    float64
-	Verbose bool
-	SaveKey string
-	ChatID  string // Добавляем поддержку чата для унификации
-}
-
-// parseArgs унифицированный парсер аргументов, поддерживающий как одинарные, так и двойные дефисы
-func parseArgs() *UnifiedFlags {
-	flags := &UnifiedFlags{
-		Mode: "auto",
-		Temp: 1.0,
-	}
-
-	// Парсим аргументы вручную для поддержки и -flag и --flag
-	args := os.Args[1:]
-	for i := 0; i < len(args); i++ {
-		arg := args[i]
-		
-		// Обработка аргументов с двойным дефисом
-		if strings.HasPrefix(arg, "--") {
-			key := strings.TrimPrefix(arg, "--")
-			switch key {
-			case "f", "file":
-				i++
-				if i < len(args) {
-					flags.Files = append(flags.Files, args[i])
-				}
-			case "s", "system", "system-prompt":
-				i++
-				if i < len(args) {
-					flags.System = args[i]
-				}
-			case "j", "json":
-				flags.Json = true
-			case "m", "mode":
-				i++
-				if i < len(args) {
-					flags.Mode = args[i]
-				}
-			case "t", "temp", "temperature":
-				i++
-				if i < len(args) {
-					if val, err := strconv.ParseFloat(args[i], 64); err == nil {
-						flags.Temp = val
-					}
-				}
-			case "v", "verbose":
-				flags.Verbose = true
-			case "save-key":
-				i++
-				if i < len(args) {
-					flags.SaveKey = args[i]
-				}
-			case "chat", "chat-id":
-				i++
-				if i < len(args) {
-					flags.ChatID = args[i]
-				}
-			}
-		} else if strings.HasPrefix(arg, "-") {
-			// Обработка аргументов с одинарным дефисом
-			key := strings.TrimPrefix(arg, "-")
-			switch key {
-			case "f":
-				i++
-				if i < len(args) {
-					flags.Files = append(flags.Files, args[i])
-				}
-			case "s":
-				i++
-				if i < len(args) {
-					flags.System = args[i]
-				}
-			case "j":
-				flags.Json = true
-			case "m":
-				i++
-				if i < len(args) {
-					flags.Mode = args[i]
-				}
-			case "t":
-				i++
-				if i < len(args) {
-					if val, err := strconv.ParseFloat(args[i], 64); err == nil {
-						flags.Temp = val
-					}
-				}
-			case "v":
-				flags.Verbose = true
-			case "save-key":
-				i++
-				if i < len(args) {
-					flags.SaveKey = args[i]
-				}
-			case "chat":
-				i++
-				if i < len(args) {
-					flags.ChatID = args[i]
-				}
-			}
-		}
-	}
-
-	return flags
-}
-
-type FileData struct {
-	Name          string
-	Path          string
-	MimeType      string
-	Base64Content string
-}
-
 // --- Main ---
 
 func mainUnified() {
-	flags := parseArgs()
-	rand.Seed(time.Now().UnixNano())
-
-	// Устанавливаем глобальную переменную для совместимости с logVerbose
-	flagVerbose = flags.Verbose
+	flags := provider.ParseArgs(os.Args[1:])
+	provider.SetupLog("[GH-CLI]", LogFileName)
+	provider.Verbose = flags.Verbose
+
+	// Отчет по журналу расхода (общий для всех утилит)
+	if flags.UsageReport {
+		if err := provider.PrintUsageReport(flags.GroupBy, flags.OutputFormat); err != nil {
+			fatal("Ошибка построения отчета: %v", err)
+		}
+		return
+	}
 
 	// 1. Работа с конфигом
-	configPath, err := getConfigPath()
+	configPath, err := provider.ConfigPath(ConfigFileName)
 	if err != nil {
 		fatal("Ошибка получения пути конфига: %v", err)
 	}
 
 	if flags.SaveKey != "" {
-		if err := addKeyToConfig(configPath, flags.SaveKey); err != nil {
+		if err := provider.AddKeyToConfig(configPath, flags.SaveKey, configDefaults); err != nil {
 			fatal("Ошибка сохранения ключа: %v", err)
 		}
 		fmt.Printf("Ключ сохранен в %s\n", configPath)
 		return
 	}
 
-	config, err := loadConfig(configPath)
+	config, err := provider.LoadConfig(configPath, configDefaults)
 	if err != nil {
 		fatal("Ошибка загрузки конфига: %v", err)
 	}
 
-	if len(config.ApiKeys) == 0 {
+	keys := config.Keys()
+
+	if flags.ResetKeys {
+		if err := provider.ResetKeyState("github"); err != nil {
+			fatal("Ошибка сброса состояния ключей: %v", err)
+		}
+		fmt.Println("Состояние ключей сброшено")
+		return
+	}
+	if flags.KeyStatus {
+		if err := provider.PrintKeyStatus("github", keys); err != nil {
+			fatal("Ошибка чтения состояния ключей: %v", err)
+		}
+		return
+	}
+
+	if len(keys) == 0 {
 		fatal("Нет API ключей. Запустите: gh-cli --save-key ВАШ_КЛЮЧ")
 	}
 
+	if flags.ClearChat != "" {
+		if err := provider.ClearChatHistory(flags.ClearChat); err != nil {
+			fatal("Ошибка очистки истории чата: %v", err)
+		}
+		fmt.Printf("История чата '%s' очищена\n", flags.ClearChat)
+		return
+	}
+
 	// 2. Чтение входных данных
-	userPrompt := readStdin()
-	filesData, hasImages, hasAudio := processFiles(flags.Files)
+	userPrompt := provider.ReadStdin()
+	filesData, att := provider.ProcessFiles(flags.Files, provider.DefaultFileOptions)
 
 	if userPrompt == "" && len(filesData) == 0 {
 		fatal("Нет входных данных")
 	}
 
 	// 3. Определение режима
-	mode := determineMode(flags.Mode, userPrompt, hasImages, hasAudio)
+	decision := config.ResolveMode(flags, userPrompt, filesData)
+	mode := decision.Mode
 
-	if hasImages && hasAudio {
+	if att.Images && att.Audio {
 		logVerbose("ВНИМАНИЕ: Смешивание аудио и картинок. Используем режим AUDIO (Phi-4), картинки могут быть проигнорированы моделью.")
 	}
 
-	modelsList := selectModelList(mode)
-
-	// Системный промпт (добавляем дату, как в питоне)
+	// Системный промпт: Флаг > Конфиг > Дефолт (добавляем дату, как в питоне)
 	sysPrompt := flags.System
+	if sysPrompt == "" {
+		sysPrompt = config.SystemPrompt
+	}
 	if sysPrompt == "" && mode != "audio" { // Phi-4 обычно не требует system prompt для транскрибации
 		sysPrompt = fmt.Sprintf("Current date and time: %s\nYou are a helpful assistant.", time.Now().Format(time.RFC1123))
 		if mode == "ocr" {
@@ -284,80 +198,96 @@ func mainUnified() {
 		sysPrompt += " Output strictly in JSON format."
 	}
 
-	// Делим температуру на 2 (по ТЗ)
-	finalTemp := flags.Temp / 2.0
+	// Делим температуру флага на 2 (по ТЗ)
+	finalTemp := config.Temperature
+	if flags.Temp != -1.0 {
+		finalTemp = flags.Temp / 2.0
+	}
 
-	// 4. Цикл запросов
-	var lastErr error
-	usedKeys := make(map[string]bool)
-
-	// Перебираем модели, если первая не сработала (хотя обычно модель одна или список из двух)
-	for _, modelName := range modelsList {
-		keyAttempts := 0
-		maxKeyAttempts := len(config.ApiKeys) * 2 // Даем шанс каждому ключу + ретраи
-
-		for keyAttempts < maxKeyAttempts {
-			apiKey := getRandomKey(config.ApiKeys, usedKeys)
-			if apiKey == "" {
-				// Если все ключи помечены как 401, сбрасываем список и пробуем еще раз (вдруг глюк)
-				if len(usedKeys) == len(config.ApiKeys) {
-					usedKeys = make(map[string]bool)
-					apiKey = getRandomKey(config.ApiKeys, usedKeys)
-				} else {
-					break
-				}
-			}
+	schema, err := provider.LoadSchema(flags.Schema)
+	if err != nil {
+		fatal("Ошибка чтения --schema: %v", err)
+	}
 
-			logVerbose("Попытка: Модель [%s], Режим [%s], Ключ [...%s]", modelName, mode, suffix(apiKey))
+	req := &provider.Request{
+		Mode:        mode,
+		System:      sysPrompt,
+		Prompt:      userPrompt,
+		Files:       filesData,
+		Temperature: finalTemp,
+		MaxTokens:   config.MaxTokens,
+		JSON:        flags.Json,
+		Schema:      schema,
+	}
 
-			var result string
-			var errReq error
+	// Потоковый вывод: текст печатается по мере генерации
+	var printer provider.StreamPrinter
+	if flags.Stream {
+		req.OnDelta = printer.Write
+	}
 
-			// Единый метод запроса (так как в GH все через chat/completions)
-			result, errReq = requestChat(apiKey, modelName, sysPrompt, userPrompt, filesData, finalTemp, flags.Json, mode)
+	if flags.ChatID != "" {
+		req.History, err = provider.LoadChatHistory(flags.ChatID)
+		if err != nil {
+			fatal("Ошибка загрузки истории чата: %v", err)
+		}
+	}
 
-			if errReq == nil {
-				// Успех
-				printOutput(result, flags.Json)
-				return
-			}
+	// 4. Цикл запросов
+	runner := provider.Runner{
+		Provider:         &githubProvider{baseURL: config.BaseURL},
+		Keys:             keys,
+		Models:           config.ModelsFor(decision),
+		Backoff:          config.Backoff(),
+		MaxContinuations: config.MaxContinuations,
+		Chunking:         config.Chunking(flags),
+	}
 
-			// Обработка ошибок
-			lastErr = errReq
-			logVerbose("Ошибка: %v", errReq)
-			errMsg := errReq.Error()
-
-			if strings.Contains(errMsg, "401") || strings.Contains(errMsg, "Bad credentials") {
-				usedKeys[apiKey] = true
-				logVerbose("Ключ невалиден, пробуем другой...")
-				keyAttempts++
-				continue
-			} else if strings.Contains(errMsg, "429") || strings.Contains(errMsg, "Too Many Requests") {
-				logVerbose("Лимит запросов. Ждем 2 сек...")
-				time.Sleep(2 * time.Second)
-				// Не помечаем ключ как плохой, просто пробуем снова (возможно с ним же или другим рандомным)
-				keyAttempts++
-				continue
-			} else if strings.Contains(errMsg, "content management policy") {
-				fatal("Запрос заблокирован Content Filter (Azure). Измените запрос.")
-			} else {
-				// Другие ошибки (сеть и т.д.)
-				time.Sleep(1 * time.Second)
-				keyAttempts++
-			}
+	resp, err := runner.Run(req)
+	if err != nil {
+		if strings.Contains(err.Error(), "content management policy") {
+			fatal("Запрос заблокирован Content Filter (Azure). Измените запрос.")
 		}
+		fatal("Не удалось получить ответ после всех попыток. Последняя ошибка: %v", err)
 	}
 
-	fatal("Не удалось получить ответ после всех попыток. Последняя ошибка: %v", lastErr)
+	if req.History != nil {
+		if err := provider.SaveExchange(req.History, userPrompt, resp.Text, config.HistoryLimits()); err != nil {
+			logVerbose("Ошибка сохранения истории чата: %v", err)
+		}
+	}
+
+	printer.Finish(resp, flags)
+}
+
+// githubProvider реализует provider.Provider для GitHub Models.
+// В GH все (включая аудио для Phi-4) идет через chat/completions.
+type githubProvider struct {
+	provider.Unsupported
+	baseURL string
+}
+
+func (p *githubProvider) Name() string { return "github" }
+
+func (p *githubProvider) Chat(apiKey, model string, req *provider.Request) (*provider.Response, error) {
+	return requestChat(apiKey, p.baseURL, model, req)
 }
 
 // --- Логика запросов ---
 
-func requestChat(apiKey, model, systemPrompt, userText string, files []FileData, temp float64, jsonMode bool, mode string) (string, error) {
+func requestChat(apiKey, baseURL, model string, req *provider.Request) (*provider.Response, error) {
+	userText, files, mode := req.Prompt, req.Files, req.Mode
 
 	messages := []ChatMessage{}
-	if systemPrompt != "" {
-		messages = append(messages, ChatMessage{Role: "system", Content: systemPrompt})
+	if req.System != "" {
+		messages = append(messages, ChatMessage{Role: "system", Content: req.System})
+	}
+
+	// История чата (общий формат с mistral, вызовы инструментов пропускаются)
+	for _, msg := range req.History.Replay(false) {
+		if msg.Role == "user" || msg.Role == "assistant" {
+			messages = append(messages, ChatMessage{Role: msg.Role, Content: msg.Content})
+		}
 	}
 
 	var content interface{}
@@ -370,16 +300,16 @@ func requestChat(apiKey, model, systemPrompt, userText string, files []FileData,
 
 		// Обработка файлов в зависимости от режима
 		for _, f := range files {
-			if strings.HasPrefix(f.MimeType, "image/") {
+			if f.IsImage() {
 				parts = append(parts, ContentPart{
 					Type: "image_url",
 					ImageUrl: &struct {
 						Url string `json:"url"`
 					}{
-						Url: fmt.Sprintf("data:%s;base64,%s", f.MimeType, f.Base64Content),
+						Url: f.DataURL(),
 					},
 				})
-			} else if strings.HasPrefix(f.MimeType, "audio/") {
+			} else if f.IsAudio() {
 				// Специфика Phi-4: audio_url
 				// Согласно питону: {"type": "audio_url", "audio_url": {"url": "data:audio/wav;base64,..."}}
 				parts = append(parts, ContentPart{
@@ -387,15 +317,14 @@ func requestChat(apiKey, model, systemPrompt, userText string, files []FileData,
 					AudioUrl: &struct {
 						Url string `json:"url"`
 					}{
-						Url: fmt.Sprintf("data:%s;base64,%s", f.MimeType, f.Base64Content),
+						Url: f.DataURL(),
 					},
 				})
 			} else {
 				// Текстовый файл
-				textBytes, _ := base64.StdEncoding.DecodeString(f.Base64Content)
 				parts = append(parts, ContentPart{
 					Type: "text",
-					Text: fmt.Sprintf("\n--- File: %s ---\n%s\n", f.Name, string(textBytes)),
+					Text: fmt.Sprintf("\n--- File: %s ---\n%s\n", f.Name, string(f.Bytes())),
 				})
 			}
 		}
@@ -420,335 +349,51 @@ func requestChat(apiKey, model, systemPrompt, userText string, files []FileData,
 	reqBody := ChatRequest{
 		Model:       model,
 		Messages:    messages,
-		Temperature: temp,
-		MaxTokens:   4000, // Лимит из Python кода (чтобы влезть в 8к контекст)
+		Temperature: req.Temperature,
+		MaxTokens:   req.MaxTokens, // Важно для GH (лимиты)
+		Stream:      req.Streaming(),
 	}
 
-	if jsonMode {
-		reqBody.ResponseFormat = &struct {
-			Type string `json:"type"`
-		}{Type: "json_object"}
-	}
+	reqBody.ResponseFormat = provider.JSONResponseFormat(req)
 
 	jsonData, _ := json.Marshal(reqBody)
-	respBytes, err := doHttp(apiKey, BaseURL, "application/json", jsonData)
-	if err != nil {
-		return "", err
-	}
-
-	var resp ChatResponse
-	if err := json.Unmarshal(respBytes, &resp); err != nil {
-		// Попытка вернуть сырой ответ для отладки
-		return "", fmt.Errorf("json parse error: %v | Body: %s", err, string(respBytes))
-	}
-	if resp.Error != nil {
-		return "", fmt.Errorf("API Error [%s]: %s", resp.Error.Type, resp.Error.Message)
-	}
-	if len(resp.Choices) == 0 {
-		return "", fmt.Errorf("empty choices")
-	}
-
-	return resp.Choices[0].Message.Content, nil
-}
-
-// --- Утилиты HTTP ---
-
-func doHttp(apiKey, url, contentType string, body []byte) ([]byte, error) {
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	if err != nil {
-		return nil, err
-	}
-	// GitHub использует стандартный Bearer
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", contentType)
+	url := strings.TrimRight(baseURL, "/") + "/chat/completions"
 
-	client := &http.Client{Timeout: 180 * time.Second} // Увеличенный таймаут для аудио
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(respBody))
-	}
-
-	return respBody, nil
-}
-
-// --- Файловая система и Конфиг ---
-
-func getAppDataDir() (string, error) {
-	configDir, err := os.UserConfigDir()
-	if err != nil {
-		return "", err
-	}
-	path := filepath.Join(configDir, ConfigDirName)
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		_ = os.MkdirAll(path, 0755)
-	}
-	return path, nil
-}
-
-func getConfigPath() (string, error) {
-	dir, err := getAppDataDir()
-	if err != nil {
-		return "", err
-	}
-	return filepath.Join(dir, ConfigFileName), nil
-}
-
-func getLogFilePath() string {
-	dir, err := getAppDataDir()
-	if err != nil {
-		return ""
-	}
-	return filepath.Join(dir, LogFileName)
-}
-
-func loadConfig(path string) (*Config, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return &Config{}, nil
-		}
-		return nil, err
-	}
-	defer f.Close()
-
-	var cfg Config
-	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
-		return nil, err
-	}
-	return &cfg, nil
-}
-
-func addKeyToConfig(path, key string) error {
-	cfg, _ := loadConfig(path)
-	exists := false
-	for _, k := range cfg.ApiKeys {
-		if k == key {
-			exists = true
-			break
-		}
-	}
-	if !exists {
-		cfg.ApiKeys = append(cfg.ApiKeys, key)
-	}
-
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	encoder := json.NewEncoder(f)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(cfg)
-}
-
-func getRandomKey(keys []string, exclude map[string]bool) string {
-	validKeys := []string{}
-	for _, k := range keys {
-		if !exclude[k] {
-			validKeys = append(validKeys, k)
-		}
-	}
-	if len(validKeys) == 0 {
-		return ""
-	}
-	return validKeys[rand.Intn(len(validKeys))]
-}
-
-func processFiles(paths []string) ([]FileData, bool, bool) {
-	var result []FileData
-	hasImg, hasAudio := false, false
-
-	for _, p := range paths {
-		data, err := os.ReadFile(p)
+	if req.Streaming() {
+		result, err := provider.StreamChat(apiKey, url, jsonData, HTTPTimeout, req.OnDelta)
 		if err != nil {
-			logVerbose("Ошибка чтения файла %s: %v", p, err)
-			continue
-		}
-
-		mimeType := mime.TypeByExtension(filepath.Ext(p))
-		if mimeType == "" {
-			ext := strings.ToLower(filepath.Ext(p))
-			switch ext {
-			case ".png":
-				mimeType = "image/png"
-			case ".jpg", ".jpeg":
-				mimeType = "image/jpeg"
-			case ".webp":
-				mimeType = "image/webp"
-			case ".mp3":
-				mimeType = "audio/mpeg"
-			case ".wav":
-				mimeType = "audio/wav"
-			case ".m4a", ".mp4":
-				mimeType = "audio/mp4"
-			case ".ogg":
-				mimeType = "audio/ogg"
-			case ".flac":
-				mimeType = "audio/flac" // Phi-4 понимает flac
-			case ".txt", ".go", ".js", ".json", ".md", ".py":
-				mimeType = "text/plain"
-			default:
-				mimeType = "application/octet-stream"
-			}
-		}
-
-		if strings.HasPrefix(mimeType, "image/") {
-			hasImg = true
-		}
-		if strings.HasPrefix(mimeType, "audio/") {
-			hasAudio = true
+			return nil, err
 		}
-
-		result = append(result, FileData{
-			Name:          filepath.Base(p),
-			Path:          p,
-			MimeType:      mimeType,
-			Base64Content: base64.StdEncoding.EncodeToString(data),
-		})
-	}
-	return result, hasImg, hasAudio
-}
-
-// --- Логика выбора режима ---
-
-func determineMode(flagMode, prompt string, hasImg, hasAudio bool) string {
-	if flagMode != "auto" {
-		return flagMode
-	}
-	if hasAudio {
-		return "audio"
-	}
-	if hasImg {
-		// Если есть картинка, по дефолту vision, но если пользователь просил "ocr" флагом, это обработается выше
-		return "vision"
-	}
-
-	promptLower := strings.ToLower(prompt)
-	if strings.Contains(promptLower, "код") || strings.Contains(promptLower, "code") ||
-		strings.Contains(promptLower, "json") || strings.Contains(promptLower, "script") {
-		return "code"
-	}
-
-	return "general"
-}
-
-func selectModelList(mode string) []string {
-	switch mode {
-	case "code":
-		return ModelsCode
-	case "audio":
-		return []string{ModelAudio}
-	case "ocr":
-		return ModelsVision // Используем Vision для OCR
-	case "vision":
-		return ModelsVision
-	default:
-		return ModelsGeneral
-	}
-}
-
-// --- Хелперы ввода/вывода и Логирование ---
-
-func readStdin() string {
-	stat, _ := os.Stdin.Stat()
-	if (stat.Mode() & os.ModeCharDevice) != 0 {
-		return ""
+		return result.Response(), nil
 	}
 
-	inputBytes, err := io.ReadAll(os.Stdin)
+	respBytes, err := provider.DoHTTP(apiKey, url, "application/json", jsonData, HTTPTimeout)
 	if err != nil {
-		return ""
-	}
-
-	if utf8.Valid(inputBytes) {
-		return strings.TrimSpace(string(inputBytes))
-	}
-
-	decoded, err := charmap.CodePage866.NewDecoder().Bytes(inputBytes)
-	if err == nil {
-		return strings.TrimSpace(string(decoded))
-	}
-
-	decoded1251, err := charmap.Windows1251.NewDecoder().Bytes(inputBytes)
-	if err == nil {
-		return strings.TrimSpace(string(decoded1251))
-	}
-
-	return strings.TrimSpace(string(inputBytes))
-}
-
-func printOutput(text string, jsonMode bool) {
-	if jsonMode {
-		text = strings.TrimSpace(text)
-		text = strings.TrimPrefix(text, "```json")
-		text = strings.TrimPrefix(text, "```")
-		text = strings.TrimSuffix(text, "```")
-		text = strings.TrimSpace(text)
+		return nil, err
 	}
-	fmt.Println(text)
-}
 
-func rotateLog(logPath string) {
-	fi, err := os.Stat(logPath)
-	if err != nil {
-		return
+	var resp ChatResponse
+	if err := json.Unmarshal(respBytes, &resp); err != nil {
+		// Попытка вернуть сырой ответ для отладки
+		return nil, fmt.Errorf("json parse error: %v | Body: %s", err, string(respBytes))
 	}
-
-	if fi.Size() > MaxLogSize {
-		backupPath := logPath + ".old"
-		_ = os.Remove(backupPath)
-		_ = os.Rename(logPath, backupPath)
+	if resp.Error != nil {
+		return nil, fmt.Errorf("API Error [%s]: %s", resp.Error.Type, resp.Error.Message)
 	}
-}
-
-func appendLog(level, format string, v ...interface{}) {
-	logPath := getLogFilePath()
-	if logPath == "" {
-		return
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("empty choices")
 	}
 
-	rotateLog(logPath)
-
-	msg := fmt.Sprintf(format, v...)
-	timestamp := time.Now().Format("2006/01/02 15:04:05")
-	logLine := fmt.Sprintf("[%s] [%s] %s\n", timestamp, level, msg)
-
-	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err == nil {
-		defer f.Close()
-		_, _ = f.WriteString(logLine)
-	}
+	choice := resp.Choices[0]
+	return &provider.Response{Text: choice.Message.Content, FinishReason: choice.FinishReason, Usage: resp.Usage}, nil
 }
 
-var flagVerbose bool // Глобальная переменная для совместимости с logVerbose
+// --- Логирование ---
 
 func logVerbose(format string, v ...interface{}) {
-	appendLog("INFO", format, v...)
-	if flagVerbose {
-		fmt.Fprintf(os.Stderr, "[GH-CLI] "+format+"\n", v...)
-	}
+	provider.Logf(format, v...)
 }
 
 func fatal(format string, v ...interface{}) {
-	appendLog("FATAL", format, v...)
-	fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", v...)
-	os.Exit(1)
+	provider.Fatalf(format, v...)
 }
-
-func suffix(k string) string {
-	if len(k) > 4 {
-		return k[len(k)-4:]
-	}
-	return k
-}
\ No newline at end of file
@@ -1,3 +1,3 @@
 @echo off
-go build -o lua-executor.exe main.go
+go build -o lua-executor.exe .
 echo Built lua-executor.exe
\ No newline at end of file
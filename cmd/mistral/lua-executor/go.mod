@@ -1,5 +0,0 @@
-module lua-executor
-
-go 1.25.3
-
-require github.com/yuin/gopher-lua v1.1.1 // indirect
@@ -1,50 +1,109 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/yuin/gopher-lua"
+	"ClipGen-m/internal/provider"
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: lua-executor \"expression\"")
-		fmt.Println("Example: lua-executor \"2 + 3 * 4\"")
-		fmt.Println("For assignments, use: lua-executor \"x = 5; return x * 2\"")
-		return
+	limits, code, err := parseArgs(os.Args[1:])
+	if err == nil && code == "" && !isTerminal(os.Stdin) {
+		code, err = readToolInput(os.Stdin)
+	}
+	if err != nil || code == "" {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+		}
+		printUsage()
+		os.Exit(2)
 	}
 
-	// Get the Lua code from command line arguments
-	luaCode := strings.Join(os.Args[1:], " ")
-
-	// Create a new Lua state
-	L := lua.NewState()
-	defer L.Close()
-
-	// Open standard libraries
-	L.OpenLibs()
-
-	// First, try to execute as an expression by wrapping in return
-	exprScript := fmt.Sprintf("return (%s)", luaCode)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(provider.RunLua(code, limits))
+}
 
-	err := L.DoString(exprScript)
-	if err != nil {
-		// If expression failed, try as a statement/script
-		err2 := L.DoString(luaCode)
-		if err2 != nil {
-			log.Fatal("Error executing Lua code as expression: ", err, " or as statement: ", err2)
+// parseArgs разбирает флаги в начале командной строки. Все, что после
+// первого не-флага (или после --), — код Lua, поэтому "-5 + 3" не
+// принимается за флаг.
+func parseArgs(args []string) (provider.LuaLimits, string, error) {
+	limits := provider.DefaultLuaLimits
+	for len(args) > 0 {
+		switch args[0] {
+		case "--unsafe":
+			limits.Unsafe = true
+			args = args[1:]
+			continue
+		case "--timeout", "--max-output", "--max-memory":
+			if len(args) < 2 {
+				return limits, "", fmt.Errorf("%s: не указано значение", args[0])
+			}
+			if args[0] == "--timeout" {
+				d, err := time.ParseDuration(args[1])
+				if err != nil || d <= 0 {
+					return limits, "", fmt.Errorf("--timeout: неверная длительность %q", args[1])
+				}
+				limits.Timeout = d
+			} else {
+				n, err := strconv.Atoi(args[1])
+				if err != nil || n <= 0 {
+					return limits, "", fmt.Errorf("%s: неверное число %q", args[0], args[1])
+				}
+				if args[0] == "--max-output" {
+					limits.MaxOutput = n
+				} else {
+					limits.MaxMemory = n << 20 // мегабайты
+				}
+			}
+			args = args[2:]
+			continue
+		case "--":
+			args = args[1:]
 		}
+		break
 	}
+	return limits, strings.Join(args, " "), nil
+}
 
-	// Get the result from the stack (if any)
-	top := L.GetTop()
-	if top > 0 {
-		result := L.ToString(-1)
-		if result != "" {
-			fmt.Printf("%s\n", result)
-		}
+// readToolInput читает вызов инструмента из stdin ({"expression": "..."}):
+// так lua-executor подключается в tools.yaml вместо встроенного calculator.
+func readToolInput(r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(string(data)) == "" {
+		return "", nil
+	}
+	var args struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal(data, &args); err != nil {
+		return "", fmt.Errorf("stdin: ожидался JSON {\"expression\": ...}: %v", err)
 	}
-}
\ No newline at end of file
+	return args.Expression, nil
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func printUsage() {
+	fmt.Println(`Usage: lua-executor [--timeout 5s] [--max-output 65536] [--max-memory 64] [--unsafe] [--] "expression"
+       echo {"expression": "2 + 3 * 4"} | lua-executor [flags]
+Example: lua-executor "2 + 3 * 4"
+For assignments, use: lua-executor "x = 5; return x * 2"
+
+Prints JSON: {"ok":true,"value":14} or {"ok":false,"value":null,"error":"..."}.
+By default the code runs in a sandbox: base, math, string, table and os.time/date/clock
+only, no files or processes. --unsafe opens all libraries. A script whose memory grows
+by more than --max-memory megabytes is stopped, with or without --unsafe.`)
+}
@@ -1,2 +1,2 @@
 @echo off
-go run main.go %*
\ No newline at end of file
+go run . %*
\ No newline at end of file
@@ -1,63 +1,90 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
-	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
-	"math/rand"
-	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"text/tabwriter"
 	"time"
-	"unicode/utf8"
 
-	"golang.org/x/text/encoding/charmap"
+	"ClipGen-m/internal/provider"
 )
 
 // --- Константы и настройки ---
 
 const (
-	ConfigDirName  = "clipgen-m"
 	ConfigFileName = "mistral.conf"
 	LogFileName    = "mistral_err.log"
-	MaxLogSize     = 10 * 1024 * 1024 // 10 MB
 
 	// Значения по умолчанию для генерации нового конфига
-	DefaultBaseURL      = "https://api.mistral.ai"
-	DefaultTemperature  = 0.7
-	DefaultMaxTokens    = 8000
-	DefaultSystemPrompt = "Вы — ИИ-ассистент, интегрированный в инструмент командной строки Windows под названием ClipGen-m. Ваш вывод часто копируется непосредственно в буфер обмена пользователя или вставляется в редакторы кода.\n\nРУКОВОДСТВО:\n1. Будьте лаконичны и прямолинейны.\n2. Если ввод — это лог ошибки, кратко объясните причину.\n3. Не используйте разговорные фразы типа 'Вот код'.\n4. Пиши простой текст без маркдауна."
+	DefaultBaseURL     = "https://api.mistral.ai"
+	DefaultTemperature = 0.7
+	DefaultMaxTokens   = 8000
+	DefaultEmbedModel  = "mistral-embed"
+
+	// FIMCursor отмечает в stdin место вставки для -m fim
+	FIMCursor = "<|cursor|>"
+	// DefaultFIMTemperature для дополнения кода нужна детерминированность
+	DefaultFIMTemperature = 0.0
+
+	// DefaultModerationThreshold порог --moderate, если нет ни флага, ни moderation_threshold
+	DefaultModerationThreshold = 0.5
+	DefaultSystemPrompt        = "Вы — ИИ-ассистент, интегрированный в инструмент командной строки Windows под названием ClipGen-m. Ваш вывод часто копируется непосредственно в буфер обмена пользователя или вставляется в редакторы кода.\n\nРУКОВОДСТВО:\n1. Будьте лаконичны и прямолинейны.\n2. Если ввод — это лог ошибки, кратко объясните причину.\n3. Не используйте разговорные фразы типа 'Вот код'.\n4. Пиши простой текст без маркдауна."
 )
 
 // Списки моделей по умолчанию (используются, если в конфиге пусто)
 var DefaultModels = map[string][]string{
-	"general": {"mistral-small-latest", "mistral-medium-latest", "mistral-large-latest"},
-	"vision":  {"mistral-small-latest", "mistral-medium-latest", "mistral-large-latest"},
-	"code":    {"devstral-2512", "codestral-latest", "labs-devstral-small-2512"},
-	"audio":   {"voxtral-mini-latest", "voxtral-small-latest"},
-	"ocr":     {"mistral-ocr-latest"},
+	"general":  {"mistral-small-latest", "mistral-medium-latest", "mistral-large-latest"},
+	"vision":   {"mistral-small-latest", "mistral-medium-latest", "mistral-large-latest"},
+	"code":     {"devstral-2512", "codestral-latest", "labs-devstral-small-2512"},
+	"audio":    {"voxtral-mini-latest", "voxtral-small-latest"},
+	"ocr":      {"mistral-ocr-latest"},
+	"embed":    {DefaultEmbedModel},
+	"fim":      {"codestral-latest"},
+	"moderate": {"mistral-moderation-latest"},
 }
 
-// --- Структуры данных API ---
+// DefaultModeRules выбор режима для --mode auto
+// (mode_rules в конфиге, порядок важен).
+var DefaultModeRules = []provider.ModeRule{
+	{Name: "audio", Attachments: []string{"audio"}, Mode: "audio"},
+	{Name: "pdf", Attachments: []string{"pdf"}, Mode: "ocr"},
+	{Name: "images", Attachments: []string{"image"}, Mode: "vision"},
+	{Name: "code", Keywords: []string{"код", "code", "function", "script", "json"}, Mode: "code"},
+	{Name: "default", Mode: "general"},
+}
+
+// Ограничения одного запроса к /v1/embeddings
+const (
+	EmbedBatchSize  = 64    // текстов в запросе
+	EmbedBatchChars = 32000 // символов в запросе (~8k токенов)
+	EmbedItemChars  = 16000 // символов в одном тексте, с запасом для кириллицы
+)
 
-type Config struct {
-	ApiKeys                []string            `json:"api_keys"`
-	BaseURL                string              `json:"base_url"`
-	SystemPrompt           string              `json:"system_prompt"`
-	Temperature            float64             `json:"temperature"`
-	MaxTokens              int                 `json:"max_tokens"`
-	Models                 map[string][]string `json:"models"`
-	ChatHistoryMaxMessages int                 `json:"chat_history_max_messages"` // максимальное количество сообщений (по умолчанию 30)
-	ChatHistoryMaxChars    int                 `json:"chat_history_max_chars"`    // максимальное количество символов (по умолчанию 50000)
-	ImageCharCost          int                 `json:"image_char_cost"`           // стоимость изображения в символах (по умолчанию 2000)
+var configDefaults = provider.Defaults{
+	BaseURL:      DefaultBaseURL,
+	SystemPrompt: DefaultSystemPrompt,
+	Temperature:  DefaultTemperature,
+	MaxTokens:    DefaultMaxTokens,
+	Models:       DefaultModels,
+	ModeRules:    DefaultModeRules,
+	Backoff:      provider.Backoff{BaseDelay: 2 * time.Second, MaxDelay: provider.DefaultRetryMaxDelay},
 }
 
+// --- Структуры данных API ---
+
 type ChatMessage struct {
 	Role       string      `json:"role"`
 	Content    interface{} `json:"content"`
@@ -77,34 +104,6 @@ type ContentPart struct {
 	} `json:"input_audio,omitempty"`
 }
 
-// --- Структуры данных для истории чата ---
-type ChatMessageHistory struct {
-	Role      string      `json:"role"`
-	Content   interface{} `json:"content"`
-	Size      int         `json:"size"`
-	Timestamp time.Time   `json:"timestamp"`
-}
-
-type ChatHistory struct {
-	ID       string               `json:"id"`
-	Messages []ChatMessageHistory `json:"messages"`
-}
-
-type ToolFunction struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Parameters  struct {
-		Type       string                 `json:"type"`
-		Properties map[string]interface{} `json:"properties"`
-		Required   []string               `json:"required"`
-	} `json:"parameters"`
-}
-
-type Tool struct {
-	Type     string       `json:"type"`
-	Function ToolFunction `json:"function"`
-}
-
 type ToolCall struct {
 	ID       string `json:"id"`
 	Type     string `json:"type"`
@@ -135,38 +134,45 @@ type ToolMessage struct {
 	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
 }
 
+type ChatChoice struct {
+	Index   int `json:"index"`
+	Message struct {
+		Role      string     `json:"role"`
+		Content   string     `json:"content"`
+		ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	} `json:"message"`
+	FinishReason string `json:"finish_reason"`
+}
+
 type ChatResponse struct {
-	ID      string `json:"id"`
-	Choices []struct {
-		Index   int `json:"index"`
-		Message struct {
-			Role      string     `json:"role"`
-			Content   string     `json:"content"`
-			ToolCalls []ToolCall `json:"tool_calls,omitempty"`
-		} `json:"message"`
-		FinishReason string `json:"finish_reason"`
-	} `json:"choices"`
-	Usage struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-		TotalTokens      int `json:"total_tokens"`
-	} `json:"usage"`
-	Error *struct {
+	ID      string          `json:"id"`
+	Choices []ChatChoice    `json:"choices"`
+	Usage   *provider.Usage `json:"usage"`
+	Error   *struct {
 		Message string `json:"message"`
 		Code    string `json:"code"`
 	} `json:"error,omitempty"`
 }
 
 type ChatRequest struct {
-	Model          string        `json:"model"`
-	Messages       []ChatMessage `json:"messages"`
-	Temperature    float64       `json:"temperature"`
-	MaxTokens      int           `json:"max_tokens,omitempty"`
-	Tools          []Tool        `json:"tools,omitempty"`
-	ToolChoice     interface{}   `json:"tool_choice,omitempty"` // "auto", "required", или объект
-	ResponseFormat *struct {
-		Type string `json:"type"`
-	} `json:"response_format,omitempty"`
+	Model          string                   `json:"model"`
+	Messages       []ChatMessage            `json:"messages"`
+	Temperature    float64                  `json:"temperature"`
+	MaxTokens      int                      `json:"max_tokens,omitempty"`
+	Tools          []provider.OpenAITool    `json:"tools,omitempty"`
+	ToolChoice     interface{}              `json:"tool_choice,omitempty"` // "auto", "required", или объект
+	Stream         bool                     `json:"stream,omitempty"`
+	ResponseFormat *provider.ResponseFormat `json:"response_format,omitempty"`
+}
+
+// FIMRequest запрос к /v1/fim/completions: модель дописывает код между prompt и suffix.
+type FIMRequest struct {
+	Model       string  `json:"model"`
+	Prompt      string  `json:"prompt"`
+	Suffix      string  `json:"suffix,omitempty"`
+	Temperature float64 `json:"temperature"`
+	MaxTokens   int     `json:"max_tokens,omitempty"`
+	Stream      bool    `json:"stream,omitempty"`
 }
 
 type OCRRequest struct {
@@ -174,104 +180,124 @@ type OCRRequest struct {
 	Document struct {
 		Type        string `json:"type"`
 		DocumentUrl string `json:"document_url,omitempty"`
+		ImageUrl    string `json:"image_url,omitempty"`
 	} `json:"document"`
+	Pages                    []int             `json:"pages,omitempty"` // номера с нуля
+	IncludeImageBase64       bool              `json:"include_image_base64,omitempty"`
+	DocumentAnnotationFormat *AnnotationFormat `json:"document_annotation_format,omitempty"`
 }
 
-type OCRResponse struct {
-	Pages []struct {
-		Markdown string `json:"markdown"`
-	} `json:"pages"`
-	Error *struct {
-		Message string `json:"message"`
-	} `json:"error,omitempty"`
+// AnnotationFormat схема структурированного ответа OCR (document annotation).
+type AnnotationFormat struct {
+	Type       string          `json:"type"` // "json_schema"
+	JSONSchema json.RawMessage `json:"json_schema"`
 }
 
-// --- Флаги ---
-
-type arrayFlags []string
+type OCRImage struct {
+	ID           string `json:"id"`
+	TopLeftX     int    `json:"top_left_x"`
+	TopLeftY     int    `json:"top_left_y"`
+	BottomRightX int    `json:"bottom_right_x"`
+	BottomRightY int    `json:"bottom_right_y"`
+	ImageBase64  string `json:"image_base64,omitempty"`
+	Path         string `json:"-"` // куда сохранена картинка (--images-dir)
+}
 
-func (i *arrayFlags) String() string { return strings.Join(*i, ",") }
-func (i *arrayFlags) Set(value string) error {
-	*i = append(*i, value)
-	return nil
+type OCRDimensions struct {
+	DPI    int `json:"dpi"`
+	Height int `json:"height"`
+	Width  int `json:"width"`
 }
 
-var (
-	flagFiles        arrayFlags
-	flagSystem       string
-	flagJson         bool
-	flagMode         string
-	flagTemp         float64
-	flagVerbose      bool
-	flagSaveKey      string
-	flagChatID       string
-	flagClearChat    string
-	flagTools        bool
-	flagNoTools      bool
-	flagAddTavilyKey string
-)
+type OCRPage struct {
+	Index      int            `json:"index"`
+	Markdown   string         `json:"markdown"`
+	Images     []OCRImage     `json:"images"`
+	Dimensions *OCRDimensions `json:"dimensions,omitempty"`
+}
 
-func init() {
-	flag.Var(&flagFiles, "f", "Путь к файлу (можно несколько)")
-	// Дефолт ставим пустым, чтобы понять, задал ли пользователь флаг вручную
-	flag.StringVar(&flagSystem, "s", "", "Системный промпт (переопределяет конфиг)")
-	flag.BoolVar(&flagJson, "j", false, "Принудительный JSON ответ")
-	flag.StringVar(&flagMode, "m", "auto", "Режим: auto, general, code, ocr, audio, vision")
-	// Дефолт -1.0, чтобы отличить от 0.0 (валидной температуры)
-	flag.Float64Var(&flagTemp, "t", -1.0, "Температура генерации (переопределяет конфиг)")
-	flag.BoolVar(&flagVerbose, "v", false, "Вывод логов в stderr")
-	flag.StringVar(&flagSaveKey, "save-key", "", "Сохранить ключ и выйти")
-	flag.StringVar(&flagChatID, "chat", "", "ID чата для контекста (включает режим чата)")
-	flag.StringVar(&flagClearChat, "clear-chat", "", "Очистить историю указанного чата")
-	flag.BoolVar(&flagTools, "tools", false, "Включить режим вызова инструментов (устаревший, инструменты теперь включены по умолчанию)")
-	flag.BoolVar(&flagNoTools, "no-tools", false, "Отключить режим вызова инструментов")
-	flag.StringVar(&flagAddTavilyKey, "add-tavily-key", "", "Добавить Tavily API ключ и выйти")
+type OCRResponse struct {
+	Pages              []OCRPage `json:"pages"`
+	DocumentAnnotation string    `json:"document_annotation,omitempty"`
+	Error              *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
 }
 
 // --- Main ---
 
 func main() {
-	flag.Parse()
+	flags := provider.ParseArgs(os.Args[1:])
+	provider.SetupLog("[MistralCLI]", LogFileName)
+	provider.Verbose = flags.Verbose
+
+	if flags.Help {
+		printHelp()
+		return
+	}
+
+	// Отчет по журналу расхода (общий для всех утилит)
+	if flags.UsageReport {
+		if err := provider.PrintUsageReport(flags.GroupBy, flags.OutputFormat); err != nil {
+			fatal("Ошибка построения отчета: %v", err)
+		}
+		return
+	}
 
 	// Check if we're adding a Tavily key
-	if flagAddTavilyKey != "" {
-		err := addTavilyKey(flagAddTavilyKey)
-		if err != nil {
+	if flags.SaveTavilyKey != "" {
+		if err := provider.AddTavilyKey(flags.SaveTavilyKey); err != nil {
 			fatal("Ошибка добавления Tavily ключа: %v", err)
 		}
-		fmt.Printf("Tavily ключ добавлен в %s\n", getTavilyConfigPath())
+		fmt.Printf("Tavily ключ добавлен в %s\n", provider.TavilyConfigPath())
 		return
 	}
 
 	// 1. Работа с конфигом
-	configPath, err := getConfigPath()
+	configPath, err := provider.ConfigPath(ConfigFileName)
 	if err != nil {
 		fatal("Ошибка получения пути конфига: %v", err)
 	}
 
-	if flagSaveKey != "" {
-		if err := addKeyToConfig(configPath, flagSaveKey); err != nil {
+	if flags.SaveKey != "" {
+		if err := provider.AddKeyToConfig(configPath, flags.SaveKey, configDefaults); err != nil {
 			fatal("Ошибка сохранения ключа: %v", err)
 		}
 		fmt.Printf("Ключ сохранен в %s\n", configPath)
 		return
 	}
 
-	config, err := loadConfig(configPath)
+	config, err := provider.LoadConfig(configPath, configDefaults)
 	if err != nil {
 		fatal("Ошибка загрузки конфига: %v", err)
 	}
 
-	if len(config.ApiKeys) == 0 {
+	keys := config.Keys()
+
+	if flags.ResetKeys {
+		if err := provider.ResetKeyState("mistral"); err != nil {
+			fatal("Ошибка сброса состояния ключей: %v", err)
+		}
+		fmt.Println("Состояние ключей сброшено")
+		return
+	}
+	if flags.KeyStatus {
+		if err := provider.PrintKeyStatus("mistral", keys); err != nil {
+			fatal("Ошибка чтения состояния ключей: %v", err)
+		}
+		return
+	}
+
+	if len(keys) == 0 {
 		fatal("Нет API ключей. Запустите: mistral.exe -save-key ВАШ_КЛЮЧ")
 	}
 
 	// Проверяем флаг очистки чата, если задан - очищаем и завершаем работу
-	if flagClearChat != "" {
-		if err := clearChatHistory(flagClearChat); err != nil {
+	if flags.ClearChat != "" {
+		if err := provider.ClearChatHistory(flags.ClearChat); err != nil {
 			fatal("Ошибка очистки истории чата: %v", err)
 		}
-		fmt.Printf("История чата '%s' очищена\n", flagClearChat)
+		fmt.Printf("История чата '%s' очищена\n", flags.ClearChat)
 		return
 	}
 
@@ -279,47 +305,80 @@ func main() {
 
 	// Температура: Флаг > Конфиг > Дефолт
 	finalTemp := config.Temperature
-	if flagTemp != -1.0 {
-		finalTemp = flagTemp
+	if flags.Temp != -1.0 {
+		finalTemp = flags.Temp
 	}
 
 	// Системный промпт: Флаг > Конфиг > Дефолт
 	finalSystem := config.SystemPrompt
-	if flagSystem != "" {
-		finalSystem = flagSystem
-	}
-
-	// URL API
-	baseURL := config.BaseURL
-	if baseURL == "" {
-		baseURL = DefaultBaseURL
+	if flags.System != "" {
+		finalSystem = flags.System
 	}
 
 	// 3. Чтение входных данных
-	userPrompt := readStdin()
-	filesData, hasImages, hasAudio, hasPdf := processFiles(flagFiles)
+	userPrompt := provider.ReadStdin()
+	filesData, att := provider.ProcessFiles(flags.Files, provider.DefaultFileOptions)
 
-	if userPrompt == "" && len(filesData) == 0 {
+	if userPrompt == "" && len(filesData) == 0 && flags.Prefix == "" && flags.Suffix == "" {
 		fatal("Нет входных данных")
 	}
 
+	if flags.Embed {
+		runEmbed(flags, config, keys, userPrompt, filesData)
+		return
+	}
+	if flags.Mode == "fim" {
+		runFIM(flags, config, keys, userPrompt)
+		return
+	}
+	if flags.Moderate {
+		runModeration(flags, config, keys, userPrompt, filesData)
+		return
+	}
+
 	// Проверяем команду /clear в тексте для очистки текущего чата
-	if flagChatID != "" && strings.TrimSpace(userPrompt) == "/clear" {
-		if err := clearChatHistory(flagChatID); err != nil {
+	if flags.ChatID != "" && strings.TrimSpace(userPrompt) == "/clear" {
+		if err := provider.ClearChatHistory(flags.ChatID); err != nil {
 			fatal("Ошибка очистки истории чата: %v", err)
 		}
-		fmt.Printf("История чата '%s' очищена командой /clear\n", flagChatID)
+		fmt.Printf("История чата '%s' очищена командой /clear\n", flags.ChatID)
 		return
 	}
 
 	// 4. Определение режима
-	mode := determineMode(flagMode, userPrompt, hasImages, hasAudio, hasPdf)
+	decision := config.ResolveMode(flags, userPrompt, filesData)
+	mode := decision.Mode
+
+	pages, err := provider.ParsePages(flags.Pages)
+	if err != nil {
+		fatal("Ошибка в --pages: %v", err)
+	}
+
+	ocrFormat := flags.OCRFormat
+	switch ocrFormat {
+	case "":
+		ocrFormat = OCRMarkdown
+	case OCRMarkdown, OCRText, OCRJSON:
+	default:
+		fatal("Неизвестный --ocr-format '%s' (доступны: markdown, text, json)", ocrFormat)
+	}
+
+	var annotationSchema []byte
+	if flags.AnnotationSchema != "" {
+		annotationSchema, err = loadAnnotationSchema(flags.AnnotationSchema)
+		if err != nil {
+			fatal("Ошибка чтения --annotation-schema: %v", err)
+		}
+		// Аннотация возможна только в OCR вызове
+		if flags.Mode == "auto" {
+			mode = "ocr"
+		}
+	}
 
 	if userPrompt == "" {
 		switch mode {
 		case "audio":
-			// Для аудио самое логичное действие по умолчанию — транскрипция
-			userPrompt = "Запишите этот аудиофайл дословно. Выведите только текст."
+			// Без промпта аудио уходит в /v1/audio/transcriptions (Transcribe)
 		case "vision":
 			// Для картинок — описание
 			userPrompt = "Опиши это изображение подробно."
@@ -333,206 +392,311 @@ func main() {
 	}
 
 	// Предупреждение о смешивании форматов
-	if hasImages && hasAudio {
+	if att.Images && att.Audio {
 		logVerbose("ВНИМАНИЕ: Вы отправляете и изображения, и аудио. Текущие модели Mistral могут не поддерживать оба формата одновременно.")
 	}
 
-	// Выбор списка моделей из конфига
-	modelsList := selectModelList(mode, config)
-
-	if flagJson {
+	if flags.Json {
 		userPrompt += "\nIMPORTANT: Output strictly in JSON format."
 	}
 
-	// 5. Цикл запросов
-	var lastErr error
-	usedKeys := make(map[string]bool)
+	schema, err := provider.LoadSchema(flags.Schema)
+	if err != nil {
+		fatal("Ошибка чтения --schema: %v", err)
+	}
+
+	req := &provider.Request{
+		Mode:             mode,
+		System:           finalSystem,
+		Prompt:           userPrompt,
+		Files:            filesData,
+		Temperature:      finalTemp,
+		MaxTokens:        config.MaxTokens,
+		JSON:             flags.Json,
+		Schema:           schema,
+		NoTools:          flags.NoTools,
+		Pages:            pages,
+		ImagesDir:        flags.ImagesDir,
+		OCRFormat:        ocrFormat,
+		AnnotationSchema: annotationSchema,
+		Srt:              flags.Srt,
+		Vtt:              flags.Vtt,
+		Language:         flags.Language,
+	}
+
+	// Потоковый вывод: текст печатается по мере генерации
+	var printer provider.StreamPrinter
+	if flags.Stream {
+		req.OnDelta = printer.Write
+	}
+
+	if flags.ChatID != "" {
+		// Режим чата - загружаем историю
+		req.History, err = provider.LoadChatHistory(flags.ChatID)
+		if err != nil {
+			fatal("Ошибка загрузки истории чата: %v", err)
+		}
+	}
+
+	// Инструменты: встроенные, файловые (папки tool_roots) и из tools.yaml
+	var tools *provider.Toolset
+	if !flags.NoTools {
+		userTools, err := provider.LoadTools()
+		if err != nil {
+			fatal("Ошибка чтения %s: %v", provider.ToolsFileName, err)
+		}
+		tools = provider.NewToolset(userTools, append(builtinTools(), provider.FileTools(config.ToolRoots)...)...).WithLimits(config.ToolLimits())
+	}
 
-	for _, modelName := range modelsList {
-		keyAttempts := 0
-		maxKeyAttempts := len(config.ApiKeys)
+	// 5. Цикл запросов (общий для всех утилит)
+	runner := provider.Runner{
+		Provider:         &mistralProvider{baseURL: config.BaseURL, tools: tools},
+		Keys:             keys,
+		Models:           config.ModelsFor(decision),
+		Backoff:          config.Backoff(),
+		MaxContinuations: config.MaxContinuations,
+		Chunking:         config.Chunking(flags),
+	}
 
-		for keyAttempts < maxKeyAttempts {
-			apiKey := getRandomKey(config.ApiKeys, usedKeys)
-			if apiKey == "" {
-				break
-			}
+	resp, err := runner.Run(req)
+	if err != nil {
+		fatal("Не удалось получить ответ после всех попыток. Последняя ошибка: %v", err)
+	}
 
-			logVerbose("Попытка: Модель [%s], Режим [%s], Temp [%.2f]", modelName, mode, finalTemp)
+	// Если используется режим чата, сохраняем обновленную историю
+	if req.History != nil {
+		if err := provider.SaveToolExchange(req.History, formatChatContent(userPrompt, filesData), resp.ToolMessages, resp.Text, config.HistoryLimits()); err != nil {
+			logVerbose("Ошибка сохранения истории чата: %v", err)
+		}
+	}
 
-			var result string
-			var errReq error
+	printer.Finish(resp, flags)
+}
 
-			switch mode {
-			case "ocr":
-				if len(filesData) > 0 {
-					result, errReq = requestOCR(apiKey, baseURL, modelName, filesData[0])
-				} else {
-					errReq = fmt.Errorf("ocr mode requires a file")
-				}
-			default:
-				if flagChatID != "" {
-					// Режим чата - загружаем историю
-					chatHistory, err := loadChatHistory(flagChatID)
-					if err != nil {
-						errReq = fmt.Errorf("ошибка загрузки истории чата: %v", err)
-					} else {
-						// Формируем контекст запроса с историей
-						result, errReq = requestChatWithHistory(apiKey, baseURL, modelName, finalSystem, userPrompt, filesData, finalTemp, config.MaxTokens, flagJson, chatHistory)
-					}
-				} else {
-					result, errReq = requestChat(apiKey, baseURL, modelName, finalSystem, userPrompt, filesData, finalTemp, config.MaxTokens, flagJson)
-				}
-			}
+func printHelp() {
+	fmt.Println(`Mistral CLI для ClipGen-m
+
+Использование: mistral.exe [флаги] < input.txt
+
+  -f, --file <path>        Файл для анализа (можно несколько)
+  -s, --system <text>      Системный промпт (переопределяет конфиг)
+  -j, --json               Принудительный JSON ответ
+  -m, --mode <mode>        Режим: auto, general, code, ocr, audio, vision, fim
+  -t, --temp <float>       Температура генерации (переопределяет конфиг)
+  -v, --verbose            Вывод логов в stderr
+      --save-key <key>     Сохранить ключ и выйти
+      --save-tavily-key    Добавить Tavily API ключ и выйти
+      --chat <id>          ID чата для контекста (включает режим чата)
+      --clear-chat <id>    Очистить историю указанного чата
+      --no-tools           Отключить вызов инструментов
+      --stream             Выводить ответ по мере генерации
+      --schema <file.json> Ответ по JSON Schema (включает -j), при несоответствии повтор
+      --explain-mode       Показать в stderr, какое правило mode_rules выбрало режим
+      --chunk-size <n>     Части больших текстовых файлов в символах (по умолчанию chunk_size)
+      --strategy <name>    Обработка частей: map-reduce (по умолчанию) или refine
+      --pages <list>       Страницы для OCR, например 1-3,7 (по умолчанию все)
+      --srt, --vtt         Для аудио: субтитры SRT или WebVTT по сегментам
+      --language <code>    Для аудио: язык речи (ru, en...), без субтитров
+      --images-dir <dir>   Сохранить картинки страниц при OCR в каталог
+      --ocr-format <fmt>   Вывод OCR: markdown (по умолчанию), text, json
+      --annotation-schema <file.json>
+                           JSON Schema для извлечения полей документа (счета, чеки)
+      --output-format json Ответ с метаданными (модель, токены, попытки) в JSON
+      --usage-report       Отчет о расходе токенов (--group-by day,provider,model,key;
+                           --output-format csv|json)
+      --prefix <file>      Для -m fim: код до курсора (иначе stdin до маркера <|cursor|>)
+      --suffix <file>      Для -m fim: код после курсора (иначе stdin после маркера)
+      --moderate           Оценить stdin и текстовые файлы модерацией (таблица или
+                           --output-format json); код выхода 2, если порог превышен
+      --threshold <float>  Порог для --moderate (по умолчанию moderation_threshold или 0.5)
+      --embed              Векторы (mistral-embed) для строк stdin и текстовых файлов,
+                           JSON в stdout
+      --embed-out <file>   С --embed: сохранить векторы в бинарный float32 файл,
+                           ID источников в <file>.json
+      --key-status         Показать состояние ключей (баны, лимиты) и выйти
+      --reset-keys         Сбросить сохраненное состояние ключей и выйти`)
+}
 
-			if errReq == nil {
-				// Если используется режим чата, сохраняем обновленную историю
-				if flagChatID != "" {
-					chatHistory, err := loadChatHistory(flagChatID)
-					if err == nil {
-						userMessage := ChatMessage{
-							Role:    "user",
-							Content: formatChatContent(userPrompt, filesData),
-						}
-						updateChatHistory(chatHistory, userMessage, result, config)
-						if saveErr := saveChatHistory(chatHistory); saveErr != nil {
-							logVerbose("Ошибка сохранения истории чата: %v", saveErr)
-						}
-					}
-				}
-				// Успех
-				printOutput(result, flagJson)
-				return
-			}
+func logVerbose(format string, v ...interface{}) {
+	provider.Logf(format, v...)
+}
+
+func fatal(format string, v ...interface{}) {
+	provider.Fatalf(format, v...)
+}
 
-			// Обработка ошибок
-			lastErr = errReq
-			logVerbose("Ошибка: %v", errReq)
+// --- Провайдер ---
 
-			errMsg := errReq.Error()
+// mistralProvider реализует provider.Provider для Mistral API.
+// Аудио без промпта распознается через /v1/audio/transcriptions, с промптом
+// отправляется в chat/completions как input_audio.
+type mistralProvider struct {
+	provider.Unsupported
+	baseURL string
+	tools   *provider.Toolset // встроенные инструменты и tools.yaml
+}
 
-			if strings.Contains(errMsg, "401") {
-				// Ошибка авторизации: меняем ключ сразу
-				usedKeys[apiKey] = true
-				logVerbose("Ключ невалиден, пробуем другой...")
-				keyAttempts++
-				continue
+func (p *mistralProvider) Name() string { return "mistral" }
 
-			} else if strings.Contains(errMsg, "429") || strings.Contains(errMsg, "500") || strings.Contains(errMsg, "503") {
-				// Ошибка лимитов или сервера
-				logVerbose("Сервер перегружен или лимит. Ждем 2 сек перед повтором...")
-				time.Sleep(2 * time.Second)
-
-				if keyAttempts < maxKeyAttempts-1 {
-					keyAttempts++
-					logVerbose("Пробуем другой ключ...")
-					continue
-				} else {
-					logVerbose("Все ключи исчерпаны для этой модели, пробуем следующую модель...")
-					break
-				}
-			} else {
-				// Критическая ошибка (например 400 Bad Request)
-				// Если ошибка 400 и связана с моделью (invalid model), имеет смысл попробовать следующую модель
-				if strings.Contains(errMsg, "model") || strings.Contains(errMsg, "found") {
-					logVerbose("Модель %s недоступна или не существует, переходим к следующей...", modelName)
-					break
-				}
-				fatal("Критическая ошибка API: %v", errReq)
+func (p *mistralProvider) Chat(apiKey, model string, req *provider.Request) (*provider.Response, error) {
+	switch req.Mode {
+	case "fim":
+		return requestFIM(apiKey, p.baseURL, model, req)
+	case "moderate":
+		return requestModeration(apiKey, p.baseURL, model, req)
+	}
+	withTools := !req.NoTools && p.tools != nil
+	messages := buildMessages(req, withTools)
+	if !withTools {
+		return requestChat(apiKey, p.baseURL, model, messages, req)
+	}
+	return requestChatWithTools(apiKey, p.baseURL, model, messages, req, p.tools)
+}
+
+// OCR распознает все приложенные PDF, документы и картинки по очереди
+// и печатает результат в формате --ocr-format.
+func (p *mistralProvider) OCR(apiKey, model string, req *provider.Request) (*provider.Response, error) {
+	var files []provider.FileData
+	for _, f := range req.Files {
+		if f.IsDocument() || f.IsImage() {
+			files = append(files, f)
+		} else {
+			logVerbose("OCR: файл %s пропущен (%s)", f.Name, f.MimeType)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("ocr mode requires a pdf, document or image file")
+	}
+
+	var docs []ocrDocument
+	for n, file := range files {
+		resp, err := requestOCR(apiKey, p.baseURL, model, file, req)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Name, err)
+		}
+		if req.ImagesDir != "" {
+			if err := saveOCRImages(req.ImagesDir, n, file.Name, resp.Pages); err != nil {
+				return nil, fmt.Errorf("сохранение картинок %s: %w", file.Name, err)
 			}
 		}
+		docs = append(docs, ocrDocument{
+			File:       file.Name,
+			Pages:      resp.Pages,
+			Annotation: resp.DocumentAnnotation,
+			Paged:      len(resp.Pages) > 1 || (req.Pages != nil && !file.IsImage()),
+		})
+	}
+
+	text, err := formatOCR(docs, req.OCRFormat)
+	if err != nil {
+		return nil, err
 	}
+	return &provider.Response{Text: text}, nil
+}
 
-	fatal("Не удалось получить ответ после всех попыток. Последняя ошибка: %v", lastErr)
+// Transcribe распознает первый аудиофайл через /v1/audio/transcriptions.
+// Если задан промпт (вопрос к аудио) и субтитры не нужны, возвращает
+// ErrUnsupported — тогда Dispatch отправит аудио в чат.
+func (p *mistralProvider) Transcribe(apiKey, model string, req *provider.Request) (*provider.Response, error) {
+	if req.Prompt != "" && !req.Srt && !req.Vtt {
+		return nil, provider.ErrUnsupported
+	}
+	var audio []provider.FileData
+	for _, f := range req.Files {
+		if f.IsAudio() {
+			audio = append(audio, f)
+		}
+	}
+	if len(audio) == 0 {
+		return nil, fmt.Errorf("режим audio требует аудиофайл")
+	}
+	for _, f := range audio[1:] {
+		logVerbose("Транскрибация: файл %s пропущен (обрабатывается только первый)", f.Name)
+	}
+	return requestTranscription(apiKey, p.baseURL, model, audio[0], req)
 }
 
 // --- Логика запросов ---
 
-func createCalculatorTool() Tool {
-	return Tool{
-		Type: "function",
-		Function: ToolFunction{
-			Name:        "calculator",
-			Description: "Executes Lua scripts for mathematical calculations, algorithms, and general script execution",
-			Parameters: struct {
-				Type       string                 `json:"type"`
-				Properties map[string]interface{} `json:"properties"`
-				Required   []string               `json:"required"`
-			}{
-				Type: "object",
-				Properties: map[string]interface{}{
-					"expression": map[string]interface{}{
-						"type":        "string",
-						"description": "Lua script to execute - can be mathematical expression, algorithm function, loop, or any valid Lua code (e.g., '2 + 3 * 4', 'math.sqrt(16)', 'math.sin(math.pi / 2)', 'function factorial(n) if n <= 1 then return 1 else return n * factorial(n-1) end; return factorial(10)', 'for i=1,10 do sum = sum or 0; sum = sum + i end; return sum')",
+// builtinTools встроенные инструменты: калькулятор на Lua (в процессе,
+// в песочнице), веб-поиск Tavily и чтение страниц fetch_url.
+// К ним добавляются инструменты из tools.yaml.
+func builtinTools() []provider.Builtin {
+	return []provider.Builtin{
+		{
+			Spec: provider.ToolSpec{
+				Name:        "calculator",
+				Description: "Executes Lua scripts for mathematical calculations, algorithms, and general script execution",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"expression": map[string]interface{}{
+							"type":        "string",
+							"description": "Lua script to execute - can be mathematical expression, algorithm function, loop, or any valid Lua code (e.g., '2 + 3 * 4', 'math.sqrt(16)', 'math.sin(math.pi / 2)', 'function factorial(n) if n <= 1 then return 1 else return n * factorial(n-1) end; return factorial(10)', 'for i=1,10 do sum = sum or 0; sum = sum + i end; return sum')",
+						},
 					},
+					"required": []string{"expression"},
 				},
-				Required: []string{"expression"},
 			},
+			Run: provider.LuaTool,
 		},
-	}
-}
-
-func createTavilyTool() Tool {
-	return Tool{
-		Type: "function",
-		Function: ToolFunction{
-			Name:        "tavily_search",
-			Description: "Performs web searches to get current information on various topics",
-			Parameters: struct {
-				Type       string                 `json:"type"`
-				Properties map[string]interface{} `json:"properties"`
-				Required   []string               `json:"required"`
-			}{
-				Type: "object",
-				Properties: map[string]interface{}{
-					"query": map[string]interface{}{
-						"type":        "string",
-						"description": "Search query for finding current information",
+		{
+			Spec: provider.ToolSpec{
+				Name:        "tavily_search",
+				Description: "Performs web searches to get current information on various topics",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"query": map[string]interface{}{
+							"type":        "string",
+							"description": "Search query for finding current information",
+						},
 					},
+					"required": []string{"query"},
 				},
-				Required: []string{"query"},
 			},
+			Run: func(args map[string]interface{}) (string, error) {
+				query, ok := args["query"].(string)
+				if !ok {
+					return "", fmt.Errorf("query argument is not a string")
+				}
+				return executeTavilySearch(query)
+			},
+		},
+		{
+			Spec: provider.ToolSpec{
+				Name:        "fetch_url",
+				Description: "Downloads a web page and returns its main content as text or markdown (scripts, menus and footers removed). Use it to read a specific page, e.g. a link from the user or from search results",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"url": map[string]interface{}{
+							"type":        "string",
+							"description": "Absolute http(s) URL of the page",
+						},
+						"format": map[string]interface{}{
+							"type":        "string",
+							"enum":        []string{provider.FetchMarkdown, provider.FetchText},
+							"description": "Result format: markdown keeps headings, lists and links (default), text is plain text",
+						},
+					},
+					"required": []string{"url"},
+				},
+			},
+			Run: provider.FetchURLTool,
 		},
 	}
 }
 
 // executeTavilySearch performs web search using Tavily API
 func executeTavilySearch(query string) (string, error) {
-	// Get the path to tavily.conf
-	configDir, err := os.UserConfigDir()
-	if err != nil {
-		return "", fmt.Errorf("error getting config directory: %v", err)
-	}
-
-	configPath := filepath.Join(configDir, "clipgen-m", "tavily.conf")
-
-	// Read the config file
-	data, err := os.ReadFile(configPath)
+	keys, err := provider.LoadTavilyKeys()
 	if err != nil {
 		return "", fmt.Errorf("error reading tavily config: %v", err)
 	}
 
-	var config struct {
-		ApiKeys []string `json:"api_keys"`
-	}
-	if err := json.Unmarshal(data, &config); err != nil {
-		return "", fmt.Errorf("error parsing tavily config: %v", err)
-	}
-
-	if len(config.ApiKeys) == 0 {
-		return "", fmt.Errorf("no API keys found in tavily.conf")
-	}
-
 	// Shuffle the API keys randomly to distribute usage
-	shuffledKeys := make([]string, len(config.ApiKeys))
-	copy(shuffledKeys, config.ApiKeys)
-
-	// Create a new random source for shuffling
-	rand.Seed(time.Now().UnixNano())
-	for i := len(shuffledKeys) - 1; i > 0; i-- {
-		j := rand.Intn(i + 1)
-		shuffledKeys[i], shuffledKeys[j] = shuffledKeys[j], shuffledKeys[i]
-	}
+	shuffledKeys := provider.ShuffleKeys(keys)
 
 	// Try each API key until one works
 	var lastError error
@@ -634,1246 +798,1083 @@ func executeTavilySearch(query string) (string, error) {
 	return "", fmt.Errorf("all API keys failed without specific error")
 }
 
-func executeCalculator(expression string) (string, error) {
-	// Try to find lua-executor.exe in various locations
-
-	// First, try local directory
-	localPath := "./lua-executor/lua-executor.exe"
-	if _, err := os.Stat(localPath); err == nil {
-		cmd := exec.Command(localPath, expression)
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
+// buildMessages собирает системный промпт, историю чата и текущий запрос.
+// С инструментами в историю входят и прошлые вызовы с результатами.
+func buildMessages(req *provider.Request, withTools bool) []ChatMessage {
+	messages := []ChatMessage{
+		{Role: "system", Content: req.System},
+	}
 
-		err = cmd.Run()
-		if err != nil {
-			return "", fmt.Errorf("error executing calculator binary (%s): %v, stderr: %s", localPath, err, stderr.String())
+	// Добавляем сообщения из истории чата
+	for _, msg := range req.History.Replay(withTools) {
+		switch msg.Role {
+		case "user", "assistant":
+			m := ChatMessage{Role: msg.Role, Content: msg.Content}
+			for _, hc := range msg.ToolCalls {
+				call := ToolCall{ID: mistralToolCallID(hc.ID), Type: "function"}
+				call.Function.Name = hc.Name
+				call.Function.Arguments = hc.Arguments
+				m.ToolCalls = append(m.ToolCalls, call)
+			}
+			messages = append(messages, m)
+		case "tool":
+			messages = append(messages, ChatMessage{Role: "tool", Content: msg.Content, ToolCallID: mistralToolCallID(msg.ToolCallID)})
 		}
-
-		return strings.TrimSpace(stdout.String()), nil
 	}
 
-	// Second, try executable in current directory
-	currentDirPath := "./lua-executor.exe"
-	if _, err := os.Stat(currentDirPath); err == nil {
-		cmd := exec.Command(currentDirPath, expression)
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
+	// Добавляем текущий запрос
+	messages = append(messages, ChatMessage{Role: "user", Content: formatChatContent(req.Prompt, req.Files)})
+	return messages
+}
 
-		err = cmd.Run()
-		if err != nil {
-			return "", fmt.Errorf("error executing calculator binary (%s): %v, stderr: %s", currentDirPath, err, stderr.String())
-		}
+// mistralToolCallID приводит идентификатор вызова из истории к формату
+// Mistral (9 латинских букв и цифр): вызовы, сохраненные другими
+// утилитами (call_... у OpenAI-совместимых API), иначе отклоняются.
+// Одинаковые ID дают одинаковый результат, поэтому пары вызов-ответ сохраняются.
+func mistralToolCallID(id string) string {
+	if mistralToolCallIDRe.MatchString(id) {
+		return id
+	}
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	sum := h.Sum64()
+	out := make([]byte, 9)
+	for i := range out {
+		out[i] = alphabet[sum%uint64(len(alphabet))]
+		sum /= uint64(len(alphabet))
+	}
+	return string(out)
+}
 
-		return strings.TrimSpace(stdout.String()), nil
-	}
+var mistralToolCallIDRe = regexp.MustCompile(`^[a-zA-Z0-9]{9}$`)
 
-	// Third, try to find lua-executor.exe in PATH
-	luaExecPath, err := exec.LookPath("lua-executor.exe")
-	if err == nil {
-		cmd := exec.Command(luaExecPath, expression)
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
+// postChat отправляет запрос в chat/completions и разбирает ответ.
+// Если задан onDelta, ответ читается потоком (SSE) и собирается в тот же ChatResponse.
+func postChat(apiKey, baseURL string, reqBody ChatRequest, onDelta func(string)) (*ChatResponse, error) {
+	reqBody.Stream = onDelta != nil
+	jsonData, _ := json.Marshal(reqBody)
+	return postCompletion(apiKey, strings.TrimRight(baseURL, "/")+"/v1/chat/completions", jsonData, onDelta)
+}
 
-		err = cmd.Run()
+// postCompletion отправляет готовое тело в chat или fim completions:
+// ответы у них одинаковые, в том числе потоковые.
+func postCompletion(apiKey, url string, jsonData []byte, onDelta func(string)) (*ChatResponse, error) {
+	if onDelta != nil {
+		result, err := provider.StreamChat(apiKey, url, jsonData, provider.DefaultHTTPTimeout, onDelta)
 		if err != nil {
-			return "", fmt.Errorf("error executing calculator binary (%s): %v, stderr: %s", luaExecPath, err, stderr.String())
+			return nil, err
 		}
-
-		return strings.TrimSpace(stdout.String()), nil
+		return streamToResponse(result), nil
 	}
 
-	// Fallback: try to execute with go run
-	cmd := fmt.Sprintf("cd lua-executor && go run main.go \"%s\"", expression)
-	out, err := runCommand(cmd)
+	respBytes, err := provider.DoHTTP(apiKey, url, "application/json", jsonData, provider.DefaultHTTPTimeout)
 	if err != nil {
-		return "", fmt.Errorf("error executing calculator (fallback method): %v", err)
+		return nil, err
+	}
+
+	var resp ChatResponse
+	if err := json.Unmarshal(respBytes, &resp); err != nil {
+		return nil, fmt.Errorf("json parse error: %v | Body: %s", err, string(respBytes))
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("api error %s: %s", resp.Error.Code, resp.Error.Message)
 	}
-	return strings.TrimSpace(out), nil
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("empty choices")
+	}
+	return &resp, nil
 }
 
-func runCommand(cmdStr string) (string, error) {
-	// Split the command to handle "cd directory && command" pattern
-	parts := strings.Split(cmdStr, " && ")
+// streamToResponse приводит собранный поток к виду обычного ответа.
+func streamToResponse(result *provider.StreamResult) *ChatResponse {
+	var choice ChatChoice
+	choice.Message.Role = "assistant"
+	choice.Message.Content = result.Text
+	choice.FinishReason = result.FinishReason
+	for _, tc := range result.ToolCalls {
+		call := ToolCall{ID: tc.ID, Type: "function"}
+		call.Function.Name = tc.Name
+		call.Function.Arguments = tc.Arguments
+		choice.Message.ToolCalls = append(choice.Message.ToolCalls, call)
+	}
+	return &ChatResponse{Choices: []ChatChoice{choice}, Usage: result.Usage}
+}
 
-	if len(parts) == 1 {
-		// Simple command
-		cmd := exec.Command("cmd", "/c", parts[0])
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		err := cmd.Run()
-		if err != nil {
-			return "", fmt.Errorf("command failed: %v, stderr: %s", err, stderr.String())
-		}
-		return stdout.String(), nil
-	} else if len(parts) >= 2 {
-		// "cd dir && command" pattern
-		dir := strings.TrimPrefix(parts[0], "cd ")
-		dir = strings.TrimSpace(dir)
-		command := strings.Join(parts[1:], " && ")
-
-		cmd := exec.Command("cmd", "/c", command)
-		cmd.Dir = dir
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		err := cmd.Run()
-		if err != nil {
-			return "", fmt.Errorf("command failed: %v, stderr: %s", err, stderr.String())
-		}
-		return stdout.String(), nil
+// toResponse переносит текст, причину остановки и расход токенов в provider.Response.
+func toResponse(resp *ChatResponse) *provider.Response {
+	choice := resp.Choices[0]
+	return &provider.Response{
+		Text:         choice.Message.Content,
+		FinishReason: choice.FinishReason,
+		Usage:        resp.Usage,
 	}
-
-	return "", fmt.Errorf("invalid command format")
 }
 
-func requestChatWithTools(apiKey, baseURL, model, systemPrompt, userText string, files []FileData, temp float64, maxTokens int, jsonMode bool) (string, error) {
-	// Create the initial messages
-	messages := []ChatMessage{
-		{Role: "system", Content: systemPrompt},
+func newChatRequest(model string, messages []ChatMessage, req *provider.Request) ChatRequest {
+	reqBody := ChatRequest{
+		Model:       model,
+		Messages:    messages,
+		Temperature: req.Temperature,
+		MaxTokens:   req.MaxTokens,
 	}
 
-	var content interface{}
-	if len(files) == 0 {
-		content = userText
-	} else {
-		parts := []ContentPart{}
-		if userText != "" {
-			parts = append(parts, ContentPart{Type: "text", Text: userText})
-		}
-
-		for _, f := range files {
-			if strings.HasPrefix(f.MimeType, "image/") {
-				parts = append(parts, ContentPart{
-					Type: "image_url",
-					ImageUrl: &struct {
-						Url string `json:"url"`
-					}{
-						Url: fmt.Sprintf("data:%s;base64,%s", f.MimeType, f.Base64Content),
-					},
-				})
-			} else if strings.HasPrefix(f.MimeType, "audio/") {
-				format := "mp3"
-				if strings.Contains(f.MimeType, "wav") {
-					format = "wav"
-				}
-				parts = append(parts, ContentPart{
-					Type: "input_audio",
-					InputAudio: &struct {
-						Data   string `json:"data"`
-						Format string `json:"format"`
-					}{
-						Data:   f.Base64Content,
-						Format: format,
-					},
-				})
-			} else if strings.HasPrefix(f.MimeType, "text/") || f.MimeType == "application/json" {
-				textBytes, _ := base64.StdEncoding.DecodeString(f.Base64Content)
-				parts = append(parts, ContentPart{
-					Type: "text",
-					Text: fmt.Sprintf("\n--- File: %s ---\n%s\n", f.Name, string(textBytes)),
-				})
-			}
-		}
-		content = parts
+	reqBody.ResponseFormat = provider.JSONResponseFormat(req)
+	return reqBody
+}
+
+func requestChat(apiKey, baseURL, model string, messages []ChatMessage, req *provider.Request) (*provider.Response, error) {
+	resp, err := postChat(apiKey, baseURL, newChatRequest(model, messages, req), req.OnDelta)
+	if err != nil {
+		return nil, err
 	}
+	return toResponse(resp), nil
+}
 
-	messages = append(messages, ChatMessage{Role: "user", Content: content})
+// requestFIM дописывает код между req.Prompt и req.Suffix (Codestral FIM).
+func requestFIM(apiKey, baseURL, model string, req *provider.Request) (*provider.Response, error) {
+	reqBody := FIMRequest{
+		Model:       model,
+		Prompt:      req.Prompt,
+		Suffix:      req.Suffix,
+		Temperature: req.Temperature,
+		MaxTokens:   req.MaxTokens,
+		Stream:      req.Streaming(),
+	}
+	jsonData, _ := json.Marshal(reqBody)
+	resp, err := postCompletion(apiKey, strings.TrimRight(baseURL, "/")+"/v1/fim/completions", jsonData, req.OnDelta)
+	if err != nil {
+		return nil, err
+	}
+	return toResponse(resp), nil
+}
 
-	// Create the tools
-	calculatorTool := createCalculatorTool()
-	tavilyTool := createTavilyTool()
-	tools := []Tool{calculatorTool, tavilyTool}
+func requestChatWithTools(apiKey, baseURL, model string, messages []ChatMessage, req *provider.Request, toolset *provider.Toolset) (*provider.Response, error) {
+	tools := toolset.OpenAI()
 
 	// Maximum number of tool call iterations to prevent infinite loops
 	maxIterations := 5
-	currentIteration := 0
-	var resp ChatResponse
-
-	// Loop to handle multiple rounds of tool calls
-	for currentIteration < maxIterations {
-		url := strings.TrimRight(baseURL, "/") + "/v1/chat/completions"
 
-		reqBody := ChatRequest{
-			Model:       model,
-			Messages:    messages,
-			Temperature: temp,
-			MaxTokens:   maxTokens,
-			Tools:       tools,
-			ToolChoice:  "auto", // Let the model decide when to use tools
-		}
+	// Расход токенов и вызовы инструментов копятся по всем итерациям,
+	// сообщения с вызовами и результатами — для истории чата
+	var usage *provider.Usage
+	var calls []provider.ToolCall
+	var toolMessages []provider.ChatMessageHistory
 
-		if jsonMode {
-			reqBody.ResponseFormat = &struct {
-				Type string `json:"type"`
-			}{Type: "json_object"}
-		}
+	// Loop to handle multiple rounds of tool calls
+	for currentIteration := 0; currentIteration < maxIterations; currentIteration++ {
+		reqBody := newChatRequest(model, messages, req)
+		reqBody.Tools = tools
+		reqBody.ToolChoice = "auto" // Let the model decide when to use tools
 
-		jsonData, _ := json.Marshal(reqBody)
-		respBytes, err := doHttp(apiKey, url, "application/json", jsonData)
+		resp, err := postChat(apiKey, baseURL, reqBody, req.OnDelta)
 		if err != nil {
-			return "", err
-		}
-
-		resp = ChatResponse{} // Reset response
-		if err := json.Unmarshal(respBytes, &resp); err != nil {
-			return "", fmt.Errorf("json parse error: %v | Body: %s", err, string(respBytes))
-		}
-		if resp.Error != nil {
-			return "", fmt.Errorf("api error %s: %s", resp.Error.Code, resp.Error.Message)
-		}
-		if len(resp.Choices) == 0 {
-			return "", fmt.Errorf("empty choices")
+			return nil, err
 		}
+		usage = usage.Add(resp.Usage)
 
 		choice := resp.Choices[0]
 
-		// Check if the model wants to call any tools
-		if len(choice.Message.ToolCalls) > 0 {
-			// Add the assistant message with tool calls to the conversation
-			// This preserves the original tool calls for the API
-			assistantMessage := ChatMessage{
-				Role:      "assistant",
-				Content:   choice.Message.Content,   // This can be empty if only tool calls
-				ToolCalls: choice.Message.ToolCalls, // Include the original tool calls
-			}
-			messages = append(messages, assistantMessage)
-
-			// Process each tool call and add results as separate messages
-			for _, toolCall := range choice.Message.ToolCalls {
-				if toolCall.Function.Name == "calculator" {
-					var args map[string]interface{}
-					if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
-						return "", fmt.Errorf("error parsing tool arguments: %v", err)
-					}
-
-					// Convert the expression to string - args["expression"] is interface{}
-					expression, ok := args["expression"].(string)
-					if !ok {
-						return "", fmt.Errorf("expression argument is not a string")
-					}
-
-					logVerbose("Executing calculator tool with expression: %s", expression)
-					result, err := executeCalculator(expression)
-					if err != nil {
-						return "", fmt.Errorf("error executing calculator: %v", err)
-					}
-
-					logVerbose("Calculator result: %s", result[:min(len(result), 500)]) // Log first 500 chars of result
-
-					// Add the tool result to the conversation
-					toolResultMsg := ChatMessage{
-						Role:       "tool",
-						Content:    result,
-						ToolCallID: toolCall.ID,
-					}
-					messages = append(messages, toolResultMsg)
-				} else if toolCall.Function.Name == "tavily_search" {
-					var args map[string]interface{}
-					if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
-						return "", fmt.Errorf("error parsing tool arguments: %v", err)
-					}
-
-					// Convert the query to string - args["query"] is interface{}
-					query, ok := args["query"].(string)
-					if !ok {
-						return "", fmt.Errorf("query argument is not a string")
-					}
-
-					logVerbose("Executing tavily search tool with query: %s", query)
-					result, err := executeTavilySearch(query)
-					if err != nil {
-						return "", fmt.Errorf("error executing tavily search: %v", err)
-					}
-
-					logVerbose("Tavily result: %s", result[:min(len(result), 500)]) // Log first 500 chars of result
+		// No more tool calls, return final response
+		if len(choice.Message.ToolCalls) == 0 {
+			result := toResponse(resp)
+			result.Usage = usage
+			result.ToolCalls = calls
+			result.ToolMessages = toolMessages
+			return result, nil
+		}
 
-					// Add the tool result to the conversation
-					toolResultMsg := ChatMessage{
-						Role:       "tool",
-						Content:    result,
-						ToolCallID: toolCall.ID,
-					}
-					messages = append(messages, toolResultMsg)
-				}
-			}
+		// Add the assistant message with tool calls to the conversation
+		// This preserves the original tool calls for the API
+		messages = append(messages, ChatMessage{
+			Role:      "assistant",
+			Content:   choice.Message.Content,   // This can be empty if only tool calls
+			ToolCalls: choice.Message.ToolCalls, // Include the original tool calls
+		})
+		assistant := provider.ChatMessageHistory{Role: "assistant", Content: choice.Message.Content}
+		for _, tc := range choice.Message.ToolCalls {
+			assistant.ToolCalls = append(assistant.ToolCalls, provider.HistoryToolCall{ID: tc.ID, Name: tc.Function.Name, Arguments: tc.Function.Arguments})
+		}
+		toolMessages = append(toolMessages, assistant)
 
-			// Continue to next iteration to get model's response to tool results
-			currentIteration++
-		} else {
-			// No more tool calls, return final response
-			return choice.Message.Content, nil
+		// Run the tool calls of this turn concurrently; results come back in call order
+		turn := make([]provider.ToolCall, len(choice.Message.ToolCalls))
+		for i, toolCall := range choice.Message.ToolCalls {
+			turn[i] = provider.ToolCall{Name: toolCall.Function.Name, Arguments: toolCall.Function.Arguments}
+		}
+		calls = append(calls, turn...)
+		results := toolset.CallAll(turn)
+
+		// Add each tool result to the conversation as a separate message
+		for i, toolCall := range choice.Message.ToolCalls {
+			result := results[i]
+			messages = append(messages, ChatMessage{
+				Role:       "tool",
+				Content:    result,
+				ToolCallID: toolCall.ID,
+			})
+			toolMessages = append(toolMessages, provider.ChatMessageHistory{Role: "tool", Content: result, ToolCallID: toolCall.ID, Name: toolCall.Function.Name})
 		}
 	}
 
 	// If we've reached max iterations without a complete response, return an error
-	return "", fmt.Errorf("reached maximum iterations without complete response")
+	return nil, fmt.Errorf("reached maximum iterations without complete response")
 }
 
-func requestChat(apiKey, baseURL, model, systemPrompt, userText string, files []FileData, temp float64, maxTokens int, jsonMode bool) (string, error) {
-	if !flagNoTools {
-		return requestChatWithTools(apiKey, baseURL, model, systemPrompt, userText, files, temp, maxTokens, jsonMode)
+func formatChatContent(userText string, files []provider.FileData) interface{} {
+	if len(files) == 0 {
+		return userText
 	}
 
-	url := strings.TrimRight(baseURL, "/") + "/v1/chat/completions"
-
-	messages := []ChatMessage{
-		{Role: "system", Content: systemPrompt},
+	parts := []ContentPart{}
+	if userText != "" {
+		parts = append(parts, ContentPart{Type: "text", Text: userText})
 	}
 
-	var content interface{}
-	if len(files) == 0 {
-		content = userText
-	} else {
-		parts := []ContentPart{}
-		if userText != "" {
-			parts = append(parts, ContentPart{Type: "text", Text: userText})
-		}
-
-		for _, f := range files {
-			if strings.HasPrefix(f.MimeType, "image/") {
-				parts = append(parts, ContentPart{
-					Type: "image_url",
-					ImageUrl: &struct {
-						Url string `json:"url"`
-					}{
-						Url: fmt.Sprintf("data:%s;base64,%s", f.MimeType, f.Base64Content),
-					},
-				})
-			} else if strings.HasPrefix(f.MimeType, "audio/") {
-				format := "mp3"
-				if strings.Contains(f.MimeType, "wav") {
-					format = "wav"
-				}
-				parts = append(parts, ContentPart{
-					Type: "input_audio",
-					InputAudio: &struct {
-						Data   string `json:"data"`
-						Format string `json:"format"`
-					}{
-						Data:   f.Base64Content,
-						Format: format,
-					},
-				})
-			} else if strings.HasPrefix(f.MimeType, "text/") || f.MimeType == "application/json" {
-				textBytes, _ := base64.StdEncoding.DecodeString(f.Base64Content)
-				parts = append(parts, ContentPart{
-					Type: "text",
-					Text: fmt.Sprintf("\n--- File: %s ---\n%s\n", f.Name, string(textBytes)),
-				})
+	for _, f := range files {
+		if f.IsImage() {
+			parts = append(parts, ContentPart{
+				Type: "image_url",
+				ImageUrl: &struct {
+					Url string `json:"url"`
+				}{
+					Url: f.DataURL(),
+				},
+			})
+		} else if f.IsAudio() {
+			format := "mp3"
+			if strings.Contains(f.MimeType, "wav") {
+				format = "wav"
 			}
+			parts = append(parts, ContentPart{
+				Type: "input_audio",
+				InputAudio: &struct {
+					Data   string `json:"data"`
+					Format string `json:"format"`
+				}{
+					Data:   f.Base64Content,
+					Format: format,
+				},
+			})
+		} else if f.IsText() {
+			parts = append(parts, ContentPart{
+				Type: "text",
+				Text: fmt.Sprintf("\n--- File: %s ---\n%s\n", f.Name, string(f.Bytes())),
+			})
 		}
-		content = parts
 	}
+	return parts
+}
 
-	messages = append(messages, ChatMessage{Role: "user", Content: content})
+func requestOCR(apiKey, baseURL, model string, file provider.FileData, req *provider.Request) (*OCRResponse, error) {
+	url := strings.TrimRight(baseURL, "/") + "/v1/ocr"
 
-	reqBody := ChatRequest{
-		Model:       model,
-		Messages:    messages,
-		Temperature: temp,
-		MaxTokens:   maxTokens,
+	reqBody := OCRRequest{
+		Model:              model,
+		IncludeImageBase64: req.ImagesDir != "",
 	}
 
-	if jsonMode {
-		reqBody.ResponseFormat = &struct {
-			Type string `json:"type"`
-		}{Type: "json_object"}
+	if file.IsImage() {
+		reqBody.Document.Type = "image_url"
+		reqBody.Document.ImageUrl = file.DataURL()
+	} else {
+		reqBody.Document.Type = "document_url"
+		reqBody.Document.DocumentUrl = file.DataURL()
+		reqBody.Pages = req.Pages // у картинки одна страница
+	}
+	if req.AnnotationSchema != nil {
+		reqBody.DocumentAnnotationFormat = &AnnotationFormat{
+			Type:       "json_schema",
+			JSONSchema: json.RawMessage(req.AnnotationSchema),
+		}
 	}
 
 	jsonData, _ := json.Marshal(reqBody)
-	respBytes, err := doHttp(apiKey, url, "application/json", jsonData)
+	respBytes, err := provider.DoHTTP(apiKey, url, "application/json", jsonData, provider.DefaultHTTPTimeout)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var resp ChatResponse
+	var resp OCRResponse
 	if err := json.Unmarshal(respBytes, &resp); err != nil {
-		return "", fmt.Errorf("json parse error: %v | Body: %s", err, string(respBytes))
+		return nil, err
 	}
 	if resp.Error != nil {
-		return "", fmt.Errorf("api error %s: %s", resp.Error.Code, resp.Error.Message)
+		return nil, fmt.Errorf("ocr api error: %s", resp.Error.Message)
 	}
-	if len(resp.Choices) == 0 {
-		return "", fmt.Errorf("empty choices")
-	}
-
-	return resp.Choices[0].Message.Content, nil
+	return &resp, nil
 }
 
-func formatChatContent(userText string, files []FileData) interface{} {
-	var content interface{}
-	if len(files) == 0 {
-		content = userText
-	} else {
-		parts := []ContentPart{}
-		if userText != "" {
-			parts = append(parts, ContentPart{Type: "text", Text: userText})
-		}
-
-		for _, f := range files {
-			if strings.HasPrefix(f.MimeType, "image/") {
-				parts = append(parts, ContentPart{
-					Type: "image_url",
-					ImageUrl: &struct {
-						Url string `json:"url"`
-					}{
-						Url: fmt.Sprintf("data:%s;base64,%s", f.MimeType, f.Base64Content),
-					},
-				})
-			} else if strings.HasPrefix(f.MimeType, "audio/") {
-				format := "mp3"
-				if strings.Contains(f.MimeType, "wav") {
-					format = "wav"
-				}
-				parts = append(parts, ContentPart{
-					Type: "input_audio",
-					InputAudio: &struct {
-						Data   string `json:"data"`
-						Format string `json:"format"`
-					}{
-						Data:   f.Base64Content,
-						Format: format,
-					},
-				})
-			} else if strings.HasPrefix(f.MimeType, "text/") || f.MimeType == "application/json" {
-				textBytes, _ := base64.StdEncoding.DecodeString(f.Base64Content)
-				parts = append(parts, ContentPart{
-					Type: "text",
-					Text: fmt.Sprintf("\n--- File: %s ---\n%s\n", f.Name, string(textBytes)),
-				})
+// saveOCRImages сохраняет картинки страниц в dir как <файл>_<N файла>_p<страница>_<id картинки>.
+// Ссылки в markdown переписываются на сохраненные имена, чтобы
+// вывод можно было открыть рядом с каталогом картинок.
+func saveOCRImages(dir string, fileIndex int, fileName string, pages []OCRPage) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	base := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+	for i := range pages {
+		for j, img := range pages[i].Images {
+			data := img.ImageBase64
+			if idx := strings.Index(data, ","); strings.HasPrefix(data, "data:") && idx >= 0 {
+				data = data[idx+1:]
+			}
+			raw, err := base64.StdEncoding.DecodeString(data)
+			if err != nil {
+				return fmt.Errorf("картинка %s: %w", img.ID, err)
 			}
+			// Номер файла и страницы в имени: у разных файлов бывает одно
+			// имя, а ID картинок (img-0.jpeg) повторяются от файла к файлу
+			name := fmt.Sprintf("%s_%d_p%d_%s", base, fileIndex+1, pages[i].Index+1, filepath.Base(img.ID))
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, raw, 0644); err != nil {
+				return err
+			}
+			pages[i].Markdown = strings.ReplaceAll(pages[i].Markdown, "]("+img.ID+")", "]("+filepath.ToSlash(path)+")")
+			pages[i].Images[j].Path = path
+			pages[i].Images[j].ImageBase64 = ""
+			logVerbose("OCR: сохранена картинка %s", path)
 		}
-		content = parts
 	}
-	return content
+	return nil
 }
 
-func requestChatWithToolsHistory(apiKey, baseURL, model, systemPrompt, userText string, files []FileData, temp float64, maxTokens int, jsonMode bool, chatHistory *ChatHistory) (string, error) {
-	// Создаем начальные сообщения с системным промптом
-	messages := []ChatMessage{
-		{Role: "system", Content: systemPrompt},
-	}
-
-	// Добавляем сообщения из истории чата
-	for _, msg := range chatHistory.Messages {
-		if msg.Role == "user" || msg.Role == "assistant" || msg.Role == "tool" {
-			messages = append(messages, ChatMessage{Role: msg.Role, Content: msg.Content})
-		}
-	}
-
-	// Добавляем текущий запрос
-	currentContent := formatChatContent(userText, files)
-	messages = append(messages, ChatMessage{Role: "user", Content: currentContent})
+// --- Транскрибация ---
 
-	// Create the tools
-	calculatorTool := createCalculatorTool()
-	tavilyTool := createTavilyTool()
-	tools := []Tool{calculatorTool, tavilyTool}
+// TranscriptionResponse ответ /v1/audio/transcriptions.
+type TranscriptionResponse struct {
+	Model    string             `json:"model"`
+	Text     string             `json:"text"`
+	Language string             `json:"language"`
+	Segments []provider.Segment `json:"segments"`
+	Usage    *provider.Usage    `json:"usage,omitempty"`
+}
 
-	// Maximum number of tool call iterations to prevent infinite loops
-	maxIterations := 5
-	currentIteration := 0
+// requestTranscription отправляет аудио в /v1/audio/transcriptions (voxtral).
+// Для --srt/--vtt запрашиваются таймстампы сегментов; язык API вместе
+// с таймстампами не принимает, поэтому в этом случае подсказка языка опускается.
+func requestTranscription(apiKey, baseURL, model string, file provider.FileData, req *provider.Request) (*provider.Response, error) {
+	url := strings.TrimRight(baseURL, "/") + "/v1/audio/transcriptions"
 
-	// Loop to handle multiple rounds of tool calls
-	for currentIteration < maxIterations {
-		url := strings.TrimRight(baseURL, "/") + "/v1/chat/completions"
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", file.Name)
+	if err != nil {
+		return nil, err
+	}
+	part.Write(file.Bytes())
+	writer.WriteField("model", model)
 
-		reqBody := ChatRequest{
-			Model:       model,
-			Messages:    messages,
-			Temperature: temp,
-			MaxTokens:   maxTokens,
-			Tools:       tools,
-			ToolChoice:  "auto", // Let the model decide when to use tools
+	needSubtitles := req.Srt || req.Vtt
+	if needSubtitles {
+		writer.WriteField("timestamp_granularities", "segment")
+		if req.Language != "" {
+			logVerbose("Транскрибация: --language %s не используется вместе с таймстампами", req.Language)
 		}
+	} else if req.Language != "" {
+		writer.WriteField("language", req.Language)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
 
-		if jsonMode {
-			reqBody.ResponseFormat = &struct {
-				Type string `json:"type"`
-			}{Type: "json_object"}
-		}
+	respBytes, err := provider.DoHTTP(apiKey, url, writer.FormDataContentType(), body.Bytes(), provider.DefaultHTTPTimeout)
+	if err != nil {
+		return nil, err
+	}
 
-		jsonData, _ := json.Marshal(reqBody)
-		respBytes, err := doHttp(apiKey, url, "application/json", jsonData)
-		if err != nil {
-			return "", err
-		}
+	var resp TranscriptionResponse
+	if err := json.Unmarshal(respBytes, &resp); err != nil {
+		return nil, fmt.Errorf("json parse error: %v", err)
+	}
+	if resp.Language != "" {
+		logVerbose("Транскрибация: язык %s, сегментов %d", resp.Language, len(resp.Segments))
+	}
 
-		var resp ChatResponse
-		if err := json.Unmarshal(respBytes, &resp); err != nil {
-			return "", fmt.Errorf("json parse error: %v | Body: %s", err, string(respBytes))
-		}
-		if resp.Error != nil {
-			return "", fmt.Errorf("api error %s: %s", resp.Error.Code, resp.Error.Message)
+	text := strings.TrimSpace(resp.Text)
+	if needSubtitles {
+		if len(resp.Segments) == 0 {
+			return nil, fmt.Errorf("ответ без сегментов, субтитры не построить")
 		}
-		if len(resp.Choices) == 0 {
-			return "", fmt.Errorf("empty choices")
-		}
-
-		choice := resp.Choices[0]
-
-		// Check if the model wants to call any tools
-		if len(choice.Message.ToolCalls) > 0 {
-			// Add the assistant message with tool calls to the conversation
-			// This preserves the original tool calls for the API
-			assistantMessage := ChatMessage{
-				Role:      "assistant",
-				Content:   choice.Message.Content,   // This can be empty if only tool calls
-				ToolCalls: choice.Message.ToolCalls, // Include the original tool calls
-			}
-			messages = append(messages, assistantMessage)
-
-			// Process each tool call and add results as separate messages
-			for _, toolCall := range choice.Message.ToolCalls {
-				if toolCall.Function.Name == "calculator" {
-					var args map[string]interface{}
-					if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
-						return "", fmt.Errorf("error parsing tool arguments: %v", err)
-					}
+		text = provider.Subtitles(req, resp.Segments)
+	}
+	return &provider.Response{Model: resp.Model, Text: text, Usage: resp.Usage}, nil
+}
 
-					// Convert the expression to string - args["expression"] is interface{}
-					expression, ok := args["expression"].(string)
-					if !ok {
-						return "", fmt.Errorf("expression argument is not a string")
-					}
+// --- Форматы OCR ---
 
-					logVerbose("Executing calculator tool with expression: %s", expression)
-					result, err := executeCalculator(expression)
-					if err != nil {
-						return "", fmt.Errorf("error executing calculator: %v", err)
-					}
+// Форматы вывода OCR (--ocr-format)
+const (
+	OCRMarkdown = "markdown"
+	OCRText     = "text" // без разметки, для буфера обмена
+	OCRJSON     = "json" // страницы, размеры, картинки и таблицы
+)
 
-					logVerbose("Calculator result: %s", result[:min(len(result), 500)]) // Log first 500 chars of result
+// ocrDocument результат OCR одного файла.
+type ocrDocument struct {
+	File       string
+	Pages      []OCRPage
+	Annotation string // JSON document annotation, пусто без --annotation-schema
+	Paged      bool   // подписывать страницы
+}
 
-					// Add the tool result to the conversation
-					toolResultMsg := ChatMessage{
-						Role:       "tool",
-						Content:    result,
-						ToolCallID: toolCall.ID,
-					}
-					messages = append(messages, toolResultMsg)
-				} else if toolCall.Function.Name == "tavily_search" {
-					var args map[string]interface{}
-					if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
-						return "", fmt.Errorf("error parsing tool arguments: %v", err)
-					}
+// ocrJSONDocument и ocrJSONPage — структура вывода --ocr-format json.
+type ocrJSONDocument struct {
+	File       string          `json:"file"`
+	Annotation json.RawMessage `json:"annotation,omitempty"`
+	Pages      []ocrJSONPage   `json:"pages"`
+}
 
-					// Convert the query to string - args["query"] is interface{}
-					query, ok := args["query"].(string)
-					if !ok {
-						return "", fmt.Errorf("query argument is not a string")
-					}
+type ocrJSONPage struct {
+	Page       int            `json:"page"` // нумерация с 1
+	Markdown   string         `json:"markdown"`
+	Dimensions *OCRDimensions `json:"dimensions,omitempty"`
+	Images     []ocrJSONImage `json:"images,omitempty"`
+	Tables     [][][]string   `json:"tables,omitempty"` // таблица -> строки -> ячейки
+}
 
-					logVerbose("Executing tavily search tool with query: %s", query)
-					result, err := executeTavilySearch(query)
-					if err != nil {
-						return "", fmt.Errorf("error executing tavily search: %v", err)
-					}
+type ocrJSONImage struct {
+	ID   string `json:"id"`
+	BBox [4]int `json:"bbox"` // x1, y1, x2, y2
+	Path string `json:"path,omitempty"`
+}
 
-					logVerbose("Tavily result: %s", result[:min(len(result), 500)]) // Log first 500 chars of result
+// formatOCR собирает вывод всех файлов. При нескольких файлах каждый
+// подписывается заголовком, при нескольких страницах — каждая страница.
+// Если есть document annotation, в текстовых форматах печатается она.
+func formatOCR(docs []ocrDocument, format string) (string, error) {
+	if format == OCRJSON {
+		return formatOCRJSON(docs)
+	}
 
-					// Add the tool result to the conversation
-					toolResultMsg := ChatMessage{
-						Role:       "tool",
-						Content:    result,
-						ToolCallID: toolCall.ID,
-					}
-					messages = append(messages, toolResultMsg)
-				}
+	var sb strings.Builder
+	for _, doc := range docs {
+		if len(docs) > 1 {
+			fmt.Fprintf(&sb, "=== %s ===\n\n", doc.File)
+		}
+		if doc.Annotation != "" {
+			sb.WriteString(prettyJSON(doc.Annotation))
+			sb.WriteString("\n\n")
+			continue
+		}
+		for _, page := range doc.Pages {
+			if doc.Paged {
+				fmt.Fprintf(&sb, "--- Страница %d ---\n\n", page.Index+1)
 			}
-
-			// Continue to next iteration to get model's response to tool results
-			currentIteration++
-		} else {
-			// No more tool calls, return final response
-			return choice.Message.Content, nil
+			body := page.Markdown
+			if format == OCRText {
+				body = stripMarkdown(body)
+			}
+			sb.WriteString(strings.TrimSpace(body))
+			sb.WriteString("\n\n")
 		}
 	}
-
-	// If we've reached max iterations without a complete response, return an error
-	return "", fmt.Errorf("reached maximum iterations without complete response")
+	return strings.TrimRight(sb.String(), "\n") + "\n", nil
 }
 
-func requestChatWithHistory(apiKey, baseURL, model, systemPrompt, userText string, files []FileData, temp float64, maxTokens int, jsonMode bool, chatHistory *ChatHistory) (string, error) {
-	if !flagNoTools {
-		return requestChatWithToolsHistory(apiKey, baseURL, model, systemPrompt, userText, files, temp, maxTokens, jsonMode, chatHistory)
-	}
-
-	url := strings.TrimRight(baseURL, "/") + "/v1/chat/completions"
-
-	// Создаем начальные сообщения с системным промптом
-	messages := []ChatMessage{
-		{Role: "system", Content: systemPrompt},
-	}
-
-	// Добавляем сообщения из истории чата
-	for _, msg := range chatHistory.Messages {
-		if msg.Role == "user" || msg.Role == "assistant" {
-			messages = append(messages, ChatMessage{Role: msg.Role, Content: msg.Content})
+func formatOCRJSON(docs []ocrDocument) (string, error) {
+	out := make([]ocrJSONDocument, 0, len(docs))
+	for _, doc := range docs {
+		jd := ocrJSONDocument{File: doc.File, Pages: []ocrJSONPage{}}
+		if doc.Annotation != "" {
+			if json.Valid([]byte(doc.Annotation)) {
+				jd.Annotation = json.RawMessage(doc.Annotation)
+			} else {
+				jd.Annotation, _ = json.Marshal(doc.Annotation)
+			}
 		}
+		for _, page := range doc.Pages {
+			jp := ocrJSONPage{
+				Page:       page.Index + 1,
+				Markdown:   page.Markdown,
+				Dimensions: page.Dimensions,
+				Tables:     markdownTables(page.Markdown),
+			}
+			for _, img := range page.Images {
+				jp.Images = append(jp.Images, ocrJSONImage{
+					ID:   img.ID,
+					BBox: [4]int{img.TopLeftX, img.TopLeftY, img.BottomRightX, img.BottomRightY},
+					Path: img.Path,
+				})
+			}
+			jd.Pages = append(jd.Pages, jp)
+		}
+		out = append(out, jd)
 	}
-
-	// Добавляем текущий запрос
-	currentContent := formatChatContent(userText, files)
-	messages = append(messages, ChatMessage{Role: "user", Content: currentContent})
-
-	reqBody := ChatRequest{
-		Model:       model,
-		Messages:    messages,
-		Temperature: temp,
-		MaxTokens:   maxTokens,
-	}
-
-	if jsonMode {
-		reqBody.ResponseFormat = &struct {
-			Type string `json:"type"`
-		}{Type: "json_object"}
-	}
-
-	jsonData, _ := json.Marshal(reqBody)
-	respBytes, err := doHttp(apiKey, url, "application/json", jsonData)
+	data, err := json.MarshalIndent(out, "", "  ")
 	if err != nil {
 		return "", err
 	}
+	return string(data) + "\n", nil
+}
 
-	var resp ChatResponse
-	if err := json.Unmarshal(respBytes, &resp); err != nil {
-		return "", fmt.Errorf("json parse error: %v | Body: %s", err, string(respBytes))
-	}
-	if resp.Error != nil {
-		return "", fmt.Errorf("api error %s: %s", resp.Error.Code, resp.Error.Message)
+// prettyJSON форматирует JSON с отступами, невалидный возвращает как есть.
+func prettyJSON(s string) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(s), "", "  "); err != nil {
+		return s
 	}
-	if len(resp.Choices) == 0 {
-		return "", fmt.Errorf("empty choices")
-	}
-
-	return resp.Choices[0].Message.Content, nil
+	return buf.String()
 }
 
-func requestOCR(apiKey, baseURL, model string, file FileData) (string, error) {
-	url := strings.TrimRight(baseURL, "/") + "/v1/ocr"
-
-	reqBody := OCRRequest{
-		Model: model,
+// tableCells разбивает строку таблицы markdown "| a | b |" на ячейки.
+func tableCells(line string) []string {
+	cells := strings.Split(strings.Trim(strings.TrimSpace(line), "|"), "|")
+	for i := range cells {
+		cells[i] = strings.TrimSpace(cells[i])
 	}
+	return cells
+}
 
-	reqBody.Document.Type = "document_url"
-	base64Full := fmt.Sprintf("data:%s;base64,%s", file.MimeType, file.Base64Content)
-	reqBody.Document.DocumentUrl = base64Full
+var tableSeparatorCell = regexp.MustCompile(`^:?-+:?$`)
 
-	jsonData, _ := json.Marshal(reqBody)
-	respBytes, err := doHttp(apiKey, url, "application/json", jsonData)
-	if err != nil {
-		return "", err
+// isTableSeparator распознает строку "|---|:---:|" под заголовком таблицы.
+func isTableSeparator(cells []string) bool {
+	for _, c := range cells {
+		if !tableSeparatorCell.MatchString(c) {
+			return false
+		}
 	}
+	return true
+}
 
-	var resp OCRResponse
-	if err := json.Unmarshal(respBytes, &resp); err != nil {
-		return "", err
-	}
-	if resp.Error != nil {
-		return "", fmt.Errorf("ocr api error: %s", resp.Error.Message)
+// markdownTables извлекает таблицы markdown страницы.
+func markdownTables(md string) [][][]string {
+	var tables [][][]string
+	var current [][]string
+	for _, line := range strings.Split(md, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "|") {
+			if current != nil {
+				tables = append(tables, current)
+				current = nil
+			}
+			continue
+		}
+		if cells := tableCells(line); !isTableSeparator(cells) {
+			current = append(current, cells)
+		}
 	}
-
-	var sb strings.Builder
-	for _, p := range resp.Pages {
-		sb.WriteString(p.Markdown)
-		sb.WriteString("\n\n")
+	if current != nil {
+		tables = append(tables, current)
 	}
-	return sb.String(), nil
+	return tables
 }
 
-// --- Утилиты HTTP ---
+var (
+	mdImage    = regexp.MustCompile(`!\[[^\]]*\]\([^)]*\)`)
+	mdLink     = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	mdHeading  = regexp.MustCompile(`(?m)^#{1,6}[ \t]+`)
+	mdQuote    = regexp.MustCompile(`(?m)^>[ \t]?`)
+	mdBold     = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	mdItalic   = regexp.MustCompile(`\*([^*\n]+)\*`)
+	mdCode     = regexp.MustCompile("`([^`]*)`")
+	blankLines = regexp.MustCompile(`\n{3,}`)
+)
 
-func doHttp(apiKey, url, contentType string, body []byte) ([]byte, error) {
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", contentType)
-	req.Header.Set("Accept", "application/json")
+// stripMarkdown убирает разметку для --ocr-format text: картинки,
+// ссылки, заголовки, выделение. Таблицы выводятся через табуляцию.
+func stripMarkdown(md string) string {
+	lines := strings.Split(md, "\n")
+	out := lines[:0]
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "|") {
+			cells := tableCells(line)
+			if isTableSeparator(cells) {
+				continue
+			}
+			line = strings.Join(cells, "\t")
+		}
+		out = append(out, line)
+	}
+	text := strings.Join(out, "\n")
+
+	text = mdImage.ReplaceAllString(text, "")
+	text = mdLink.ReplaceAllString(text, "$1")
+	text = mdHeading.ReplaceAllString(text, "")
+	text = mdQuote.ReplaceAllString(text, "")
+	text = mdBold.ReplaceAllString(text, "$1$2")
+	text = mdItalic.ReplaceAllString(text, "$1")
+	text = mdCode.ReplaceAllString(text, "$1")
+	return blankLines.ReplaceAllString(text, "\n\n")
+}
 
-	client := &http.Client{Timeout: 300 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+// schemaNameChars символы, недопустимые в имени json_schema
+var schemaNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
 
-	respBody, err := io.ReadAll(resp.Body)
+// loadAnnotationSchema читает --annotation-schema. Файл может содержать
+// готовый объект json_schema ({"name", "schema", ...}) или саму JSON Schema,
+// тогда она оборачивается с именем по имени файла.
+func loadAnnotationSchema(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-
-	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(respBody))
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("файл не является JSON объектом: %w", err)
+	}
+	if _, ok := obj["schema"]; ok {
+		return data, nil
 	}
 
-	return respBody, nil
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	name = schemaNameChars.ReplaceAllString(name, "_")
+	return json.Marshal(map[string]interface{}{
+		"name":   name,
+		"schema": json.RawMessage(data),
+		"strict": true,
+	})
 }
 
-// --- Файловая система и Конфиг ---
-
-type FileData struct {
-	Name          string
-	Path          string
-	MimeType      string
-	Base64Content string
-}
+// --- Дополнение кода (FIM) ---
 
-func getAppDataDir() (string, error) {
-	configDir, err := os.UserConfigDir()
-	if err != nil {
-		return "", err
-	}
-	path := filepath.Join(configDir, ConfigDirName)
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		_ = os.MkdirAll(path, 0755)
+// fimParts собирает код до и после курсора. stdin делится маркером
+// FIMCursor, без маркера весь stdin считается кодом до курсора.
+// Файлы --prefix / --suffix заменяют соответствующую часть.
+func fimParts(flags *provider.Flags, stdin string) (prefix, suffix string, err error) {
+	prefix = stdin
+	if i := strings.Index(stdin, FIMCursor); i >= 0 {
+		prefix, suffix = stdin[:i], stdin[i+len(FIMCursor):]
 	}
-	return path, nil
-}
-
-func getConfigPath() (string, error) {
-	dir, err := getAppDataDir()
-	if err != nil {
-		return "", err
+	if flags.Prefix != "" {
+		data, err := os.ReadFile(flags.Prefix)
+		if err != nil {
+			return "", "", err
+		}
+		prefix = string(data)
 	}
-	return filepath.Join(dir, ConfigFileName), nil
-}
-
-func getLogFilePath() string {
-	dir, err := getAppDataDir()
-	if err != nil {
-		return ""
+	if flags.Suffix != "" {
+		data, err := os.ReadFile(flags.Suffix)
+		if err != nil {
+			return "", "", err
+		}
+		suffix = string(data)
 	}
-	return filepath.Join(dir, LogFileName)
+	return prefix, suffix, nil
 }
 
-func loadConfig(path string) (*Config, error) {
-	f, err := os.Open(path)
+// runFIM запрашивает вставку в месте курсора и печатает только ее,
+// без обрезки пробелов и перевода строки: отступы важны для редактора.
+func runFIM(flags *provider.Flags, config *provider.Config, keys []string, stdin string) {
+	prefix, suffix, err := fimParts(flags, stdin)
 	if err != nil {
-		if os.IsNotExist(err) {
-			// Если файла нет, возвращаем дефолтный конфиг
-			return &Config{
-				ApiKeys:      []string{},
-				BaseURL:      DefaultBaseURL,
-				SystemPrompt: DefaultSystemPrompt,
-				Temperature:  DefaultTemperature,
-				MaxTokens:    DefaultMaxTokens,
-				Models:       DefaultModels,
-			}, nil
-		}
-		return nil, err
+		fatal("Ошибка чтения --prefix/--suffix: %v", err)
 	}
-	defer f.Close()
-
-	var cfg Config
-	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
-		return nil, err
+	if strings.TrimSpace(prefix+suffix) == "" {
+		fatal("Нет кода для дополнения")
 	}
 
-	// Валидация и заполнение отсутствующих полей (миграция старых конфигов)
-	dirty := false
-
-	if cfg.BaseURL == "" {
-		cfg.BaseURL = DefaultBaseURL
-		dirty = true
-	}
-	if cfg.SystemPrompt == "" {
-		cfg.SystemPrompt = DefaultSystemPrompt
-		dirty = true
+	temp := DefaultFIMTemperature
+	if flags.Temp != -1.0 {
+		temp = flags.Temp
 	}
-	if cfg.MaxTokens == 0 {
-		cfg.MaxTokens = DefaultMaxTokens
-		dirty = true
-	}
-	// Для float (Temperature) сложно проверить "пустоту" (0.0 может быть валидным),
-	// поэтому оставим как есть, если конфиг уже был. Но если models нет, заполним.
-
-	if cfg.Models == nil {
-		cfg.Models = make(map[string][]string)
-		dirty = true
+	req := &provider.Request{
+		Mode:        "fim",
+		Prompt:      prefix,
+		Suffix:      suffix,
+		Temperature: temp,
+		MaxTokens:   config.MaxTokens,
 	}
-
-	// Проверяем каждую категорию моделей
-	for k, v := range DefaultModels {
-		if list, exists := cfg.Models[k]; !exists || len(list) == 0 {
-			cfg.Models[k] = v
-			dirty = true
-		}
+	var printer provider.StreamPrinter
+	if flags.Stream {
+		req.OnDelta = printer.Write
 	}
 
-	// Устанавливаем параметры истории чата, если не заданы
-	if cfg.ChatHistoryMaxMessages == 0 {
-		cfg.ChatHistoryMaxMessages = 30 // значение по умолчанию
-		dirty = true
+	// В старых конфигах списка fim нет, а general-модели FIM не умеют
+	models := config.Models["fim"]
+	if len(models) == 0 {
+		models = DefaultModels["fim"]
 	}
-	if cfg.ChatHistoryMaxChars == 0 {
-		cfg.ChatHistoryMaxChars = 50000 // значение по умолчанию
-		dirty = true
+	runner := provider.Runner{
+		Provider:         &mistralProvider{baseURL: config.BaseURL},
+		Keys:             keys,
+		Models:           models,
+		Backoff:          config.Backoff(),
+		MaxContinuations: config.MaxContinuations,
 	}
-	if cfg.ImageCharCost == 0 {
-		cfg.ImageCharCost = 2000 // значение по умолчанию
-		dirty = true
+	resp, err := runner.Run(req)
+	if err != nil {
+		fatal("Не удалось получить ответ после всех попыток. Последняя ошибка: %v", err)
 	}
 
-	// Если мы обновили структуру конфига, сохраним его, чтобы пользователь видел новые поля
-	if dirty && len(cfg.ApiKeys) > 0 {
-		saveConfig(path, &cfg)
+	switch {
+	case flags.OutputFormat == provider.OutputJSON:
+		printer.Finish(resp, flags)
+	case !flags.Stream:
+		fmt.Print(resp.Text)
 	}
-
-	return &cfg, nil
 }
 
-func saveConfig(path string, cfg *Config) error {
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+// --- Модерация ---
 
-	encoder := json.NewEncoder(f)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(cfg)
+type ModerationRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
 }
 
-func addKeyToConfig(path, key string) error {
-	cfg, _ := loadConfig(path)
-	exists := false
-	for _, k := range cfg.ApiKeys {
-		if k == key {
-			exists = true
-			break
-		}
-	}
-	if !exists {
-		cfg.ApiKeys = append(cfg.ApiKeys, key)
-	}
-	return saveConfig(path, cfg)
+type ModerationResponse struct {
+	Model   string                      `json:"model"`
+	Results []provider.ModerationResult `json:"results"`
+	Usage   *provider.Usage             `json:"usage,omitempty"`
 }
 
-func getRandomKey(keys []string, exclude map[string]bool) string {
-	validKeys := []string{}
-	for _, k := range keys {
-		if !exclude[k] {
-			validKeys = append(validKeys, k)
-		}
+// requestModeration оценивает req.Inputs одним запросом к /v1/moderations.
+func requestModeration(apiKey, baseURL, model string, req *provider.Request) (*provider.Response, error) {
+	url := strings.TrimRight(baseURL, "/") + "/v1/moderations"
+	jsonData, _ := json.Marshal(ModerationRequest{Model: model, Input: req.Inputs})
+	respBytes, err := provider.DoHTTP(apiKey, url, "application/json", jsonData, provider.DefaultHTTPTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp ModerationResponse
+	if err := json.Unmarshal(respBytes, &resp); err != nil {
+		return nil, err
 	}
-	if len(validKeys) == 0 {
-		return ""
+	if len(resp.Results) != len(req.Inputs) {
+		return nil, fmt.Errorf("moderation: получено %d результатов вместо %d", len(resp.Results), len(req.Inputs))
 	}
-	return validKeys[rand.Intn(len(validKeys))]
+	return &provider.Response{Model: resp.Model, Moderation: resp.Results, Usage: resp.Usage}, nil
 }
 
-func processFiles(paths []string) ([]FileData, bool, bool, bool) {
-	var result []FileData
-	hasImg, hasAudio, hasPdf := false, false, false
+// moderationScore оценка одной категории.
+type moderationScore struct {
+	Category string  `json:"category"`
+	Score    float64 `json:"score"`
+	Flagged  bool    `json:"flagged"`
+}
 
-	for _, p := range paths {
-		data, err := os.ReadFile(p)
-		if err != nil {
-			logVerbose("Ошибка чтения файла %s: %v", p, err)
-			continue
-		}
+// moderationReport итог по одному источнику для вывода.
+type moderationReport struct {
+	ID      string            `json:"id"`
+	Flagged bool              `json:"flagged"`
+	Scores  []moderationScore `json:"scores"` // по убыванию оценки
+}
 
-		mimeType := mime.TypeByExtension(filepath.Ext(p))
-		if mimeType == "" {
-			ext := strings.ToLower(filepath.Ext(p))
-			switch ext {
-			case ".png":
-				mimeType = "image/png"
-			case ".jpg", ".jpeg":
-				mimeType = "image/jpeg"
-			case ".webp":
-				mimeType = "image/webp"
-			case ".pdf":
-				mimeType = "application/pdf"
-			case ".mp3":
-				mimeType = "audio/mpeg"
-			case ".wav":
-				mimeType = "audio/wav"
-			case ".m4a":
-				mimeType = "audio/mp4"
-			case ".txt", ".go", ".js", ".json", ".md", ".py":
-				mimeType = "text/plain"
-			default:
-				mimeType = "application/octet-stream"
-			}
-		}
+// moderationItem один проверяемый текст и его источник.
+type moderationItem struct {
+	ID   string // stdin или путь к файлу
+	Text string
+}
 
-		if strings.HasPrefix(mimeType, "image/") {
-			hasImg = true
-		}
-		if strings.HasPrefix(mimeType, "audio/") {
-			hasAudio = true
+// collectModerationItems: stdin целиком (в отличие от --embed, где каждая
+// строка — отдельный текст) и каждый текстовый файл целиком.
+func collectModerationItems(stdin string, files []provider.FileData) []moderationItem {
+	var items []moderationItem
+	if strings.TrimSpace(stdin) != "" {
+		items = append(items, moderationItem{ID: "stdin", Text: stdin})
+	}
+	for _, f := range files {
+		if !f.IsText() {
+			logVerbose("moderate: файл %s пропущен (%s)", f.Name, f.MimeType)
+			continue
 		}
-		if mimeType == "application/pdf" {
-			hasPdf = true
+		id := f.Path
+		if id == "" {
+			id = f.Name
 		}
-
-		result = append(result, FileData{
-			Name:          filepath.Base(p),
-			Path:          p,
-			MimeType:      mimeType,
-			Base64Content: base64.StdEncoding.EncodeToString(data),
-		})
+		items = append(items, moderationItem{ID: id, Text: string(f.Bytes())})
 	}
-	return result, hasImg, hasAudio, hasPdf
+	return items
 }
 
-// --- Логика выбора режима ---
-
-func determineMode(flagMode, prompt string, hasImg, hasAudio, hasPdf bool) string {
-	if flagMode != "auto" {
-		return flagMode
-	}
-	if hasAudio {
-		return "audio"
-	}
-	if hasPdf {
-		return "ocr"
-	}
-	if hasImg {
-		return "vision"
+// runModeration оценивает stdin и каждый текстовый файл отдельно, печатает
+// оценки по категориям и завершается с provider.ModerationFlaggedExitCode, если
+// хотя бы одна оценка не ниже порога. Так действия clipgen-m могут
+// остановить вывод текста.
+func runModeration(flags *provider.Flags, config *provider.Config, keys []string, stdin string, files []provider.FileData) {
+	items := collectModerationItems(stdin, files)
+	if len(items) == 0 {
+		fatal("Нет текста для модерации")
 	}
 
-	promptLower := strings.ToLower(prompt)
-	if strings.Contains(promptLower, "код") || strings.Contains(promptLower, "code") ||
-		strings.Contains(promptLower, "function") || strings.Contains(promptLower, "script") ||
-		strings.Contains(promptLower, "json") {
-		return "code"
+	threshold := DefaultModerationThreshold
+	if config.ModerationThreshold != nil {
+		threshold = *config.ModerationThreshold
 	}
-
-	return "general"
-}
-
-func selectModelList(mode string, cfg *Config) []string {
-	// Ищем список в конфиге
-	if list, ok := cfg.Models[mode]; ok && len(list) > 0 {
-		return list
+	if flags.Threshold >= 0 {
+		threshold = flags.Threshold
 	}
-	// Если нет в конфиге, ищем в дефолтах
-	if list, ok := DefaultModels[mode]; ok {
-		return list
+
+	models := config.Models["moderate"]
+	if len(models) == 0 {
+		models = DefaultModels["moderate"]
 	}
-	// Фолбэк на general
-	if list, ok := cfg.Models["general"]; ok && len(list) > 0 {
-		return list
+	runner := provider.Runner{
+		Provider: &mistralProvider{baseURL: config.BaseURL},
+		Keys:     keys,
+		Models:   models,
+		Backoff:  config.Backoff(),
 	}
-	return DefaultModels["general"]
-}
-
-// --- Хелперы ввода/вывода и Логирование ---
-
-func readStdin() string {
-	stat, _ := os.Stdin.Stat()
-	if (stat.Mode() & os.ModeCharDevice) != 0 {
-		return ""
+	req := &provider.Request{Mode: "moderate"}
+	for _, item := range items {
+		req.Inputs = append(req.Inputs, item.Text)
 	}
-
-	inputBytes, err := io.ReadAll(os.Stdin)
+	resp, err := runner.Run(req)
 	if err != nil {
-		return ""
+		fatal("Не удалось получить оценку после всех попыток. Последняя ошибка: %v", err)
 	}
 
-	if utf8.Valid(inputBytes) {
-		return strings.TrimSpace(string(inputBytes))
+	flagged := false
+	reports := make([]moderationReport, len(items))
+	for i, item := range items {
+		report := moderationReport{ID: item.ID, Scores: []moderationScore{}}
+		for category, score := range resp.Moderation[i].Scores {
+			hit := score >= threshold
+			report.Scores = append(report.Scores, moderationScore{Category: category, Score: score, Flagged: hit})
+			report.Flagged = report.Flagged || hit
+		}
+		sort.Slice(report.Scores, func(a, b int) bool {
+			if report.Scores[a].Score != report.Scores[b].Score {
+				return report.Scores[a].Score > report.Scores[b].Score
+			}
+			return report.Scores[a].Category < report.Scores[b].Category
+		})
+		flagged = flagged || report.Flagged
+		reports[i] = report
 	}
 
-	decoded, err := charmap.CodePage866.NewDecoder().Bytes(inputBytes)
-	if err == nil {
-		return strings.TrimSpace(string(decoded))
+	if flags.OutputFormat == provider.OutputJSON {
+		data, err := json.Marshal(map[string]interface{}{
+			"model":     resp.Model,
+			"threshold": threshold,
+			"flagged":   flagged,
+			"results":   reports,
+		})
+		if err != nil {
+			fatal("Ошибка сериализации: %v", err)
+		}
+		fmt.Println(string(data))
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for i, report := range reports {
+			if len(reports) > 1 {
+				if i > 0 {
+					fmt.Fprintln(w)
+				}
+				fmt.Fprintf(w, "=== %s ===\n", report.ID)
+			}
+			for _, sc := range report.Scores {
+				mark := ""
+				if sc.Flagged {
+					mark = "ПРЕВЫШЕН"
+				}
+				fmt.Fprintf(w, "%s\t%.4f\t%s\n", sc.Category, sc.Score, mark)
+			}
+		}
+		w.Flush()
 	}
 
-	decoded1251, err := charmap.Windows1251.NewDecoder().Bytes(inputBytes)
-	if err == nil {
-		return strings.TrimSpace(string(decoded1251))
+	if flagged {
+		logVerbose("Модерация: порог %.2f превышен", threshold)
+		os.Exit(provider.ModerationFlaggedExitCode)
 	}
+}
+
+// --- Эмбеддинги ---
 
-	return strings.TrimSpace(string(inputBytes))
+type EmbeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
 }
 
-func printOutput(text string, jsonMode bool) {
-	if jsonMode {
-		text = strings.TrimSpace(text)
-		text = strings.TrimPrefix(text, "```json")
-		text = strings.TrimPrefix(text, "```")
-		text = strings.TrimSuffix(text, "```")
-		text = strings.TrimSpace(text)
-	}
-	fmt.Println(text)
+type EmbeddingResponse struct {
+	Model string `json:"model"`
+	Data  []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Usage *provider.Usage `json:"usage,omitempty"`
 }
 
-func rotateLog(logPath string) {
-	fi, err := os.Stat(logPath)
+// Embed отправляет req.Inputs одним запросом в /v1/embeddings.
+func (p *mistralProvider) Embed(apiKey, model string, req *provider.Request) (*provider.Response, error) {
+	url := strings.TrimRight(p.baseURL, "/") + "/v1/embeddings"
+	jsonData, _ := json.Marshal(EmbeddingRequest{Model: model, Input: req.Inputs})
+	respBytes, err := provider.DoHTTP(apiKey, url, "application/json", jsonData, provider.DefaultHTTPTimeout)
 	if err != nil {
-		return
-	}
-
-	if fi.Size() > MaxLogSize {
-		backupPath := logPath + ".old"
-		_ = os.Remove(backupPath)
-		_ = os.Rename(logPath, backupPath)
+		return nil, err
 	}
-}
 
-func appendLog(level, format string, v ...interface{}) {
-	logPath := getLogFilePath()
-	if logPath == "" {
-		return
+	var resp EmbeddingResponse
+	if err := json.Unmarshal(respBytes, &resp); err != nil {
+		return nil, err
 	}
-
-	rotateLog(logPath)
-
-	msg := fmt.Sprintf(format, v...)
-	timestamp := time.Now().Format("2006/01/02 15:04:05")
-	logLine := fmt.Sprintf("[%s] [%s] %s\n", timestamp, level, msg)
-
-	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err == nil {
-		defer f.Close()
-		_, _ = f.WriteString(logLine)
+	if len(resp.Data) != len(req.Inputs) {
+		return nil, fmt.Errorf("embeddings: получено %d векторов вместо %d", len(resp.Data), len(req.Inputs))
 	}
-}
 
-func logVerbose(format string, v ...interface{}) {
-	appendLog("INFO", format, v...)
-	if flagVerbose {
-		fmt.Fprintf(os.Stderr, "[MistralCLI] "+format+"\n", v...)
+	vectors := make([][]float32, len(req.Inputs))
+	for _, d := range resp.Data {
+		if d.Index < 0 || d.Index >= len(vectors) {
+			return nil, fmt.Errorf("embeddings: неверный индекс %d", d.Index)
+		}
+		vectors[d.Index] = d.Embedding
 	}
+	return &provider.Response{Model: resp.Model, Embeddings: vectors, Usage: resp.Usage}, nil
 }
 
-func fatal(format string, v ...interface{}) {
-	appendLog("FATAL", format, v...)
-	fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", v...)
-	os.Exit(1)
+// embedItem один векторизуемый текст и его источник.
+type embedItem struct {
+	ID   string `json:"id"`             // путь к файлу, <файл>:<номер части> или stdin:<номер строки>
+	Text string `json:"text,omitempty"` // только для строк stdin
 }
 
-// --- Функции для работы с историей чата ---
-
-func getChatDir() (string, error) {
-	configDir, err := os.UserConfigDir()
-	if err != nil {
-		return "", err
-	}
-	chatDir := filepath.Join(configDir, ConfigDirName, "mistral_chats")
-	if _, err := os.Stat(chatDir); os.IsNotExist(err) {
-		_ = os.MkdirAll(chatDir, 0755)
-	}
-	return chatDir, nil
+// embedOutput вывод --embed в JSON и описание файла --embed-out.
+type embedOutput struct {
+	Model      string      `json:"model"`
+	Dimensions int         `json:"dimensions"`
+	Count      int         `json:"count"`
+	Format     string      `json:"format,omitempty"` // для --embed-out: float32le, строка на источник
+	Items      []embedItem `json:"items,omitempty"`
+	Vectors    []embedJSON `json:"vectors,omitempty"`
 }
 
-func getChatFilePath(chatID string) (string, error) {
-	chatDir, err := getChatDir()
-	if err != nil {
-		return "", err
-	}
-	return filepath.Join(chatDir, chatID+".json"), nil
+type embedJSON struct {
+	embedItem
+	Embedding []float32 `json:"embedding"`
 }
 
-func loadChatHistory(chatID string) (*ChatHistory, error) {
-	chatFilePath, err := getChatFilePath(chatID)
-	if err != nil {
-		return nil, err
+// collectEmbedItems: каждая непустая строка stdin и каждый текстовый файл
+// целиком; файлы длиннее EmbedItemChars режутся на части <файл>:<номер>.
+func collectEmbedItems(stdin string, files []provider.FileData) []embedItem {
+	var items []embedItem
+	for i, line := range strings.Split(stdin, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			items = append(items, embedItem{ID: fmt.Sprintf("stdin:%d", i+1), Text: line})
+		}
 	}
-
-	if _, err := os.Stat(chatFilePath); os.IsNotExist(err) {
-		// Если файла нет, создаем новую историю
-		return &ChatHistory{
-			ID:       chatID,
-			Messages: []ChatMessageHistory{},
-		}, nil
+	for _, f := range files {
+		if !f.IsText() {
+			logVerbose("embed: файл %s пропущен (%s)", f.Name, f.MimeType)
+			continue
+		}
+		id := f.Path
+		if id == "" {
+			id = f.Name
+		}
+		parts := provider.SplitText(string(f.Bytes()), EmbedItemChars)
+		if len(parts) == 1 {
+			items = append(items, embedItem{ID: id, Text: parts[0]})
+			continue
+		}
+		for i, part := range parts {
+			items = append(items, embedItem{ID: fmt.Sprintf("%s:%d", id, i+1), Text: part})
+		}
 	}
+	return items
+}
 
-	data, err := os.ReadFile(chatFilePath)
-	if err != nil {
-		return nil, err
+// embedBatches делит тексты на пачки по EmbedBatchSize и EmbedBatchChars.
+func embedBatches(items []embedItem) [][]embedItem {
+	var batches [][]embedItem
+	var current []embedItem
+	chars := 0
+	for _, item := range items {
+		n := len([]rune(item.Text))
+		if len(current) > 0 && (len(current) >= EmbedBatchSize || chars+n > EmbedBatchChars) {
+			batches = append(batches, current)
+			current, chars = nil, 0
+		}
+		current = append(current, item)
+		chars += n
 	}
-
-	var history ChatHistory
-	if err := json.Unmarshal(data, &history); err != nil {
-		return nil, err
+	if len(current) > 0 {
+		batches = append(batches, current)
 	}
-
-	return &history, nil
+	return batches
 }
 
-func saveChatHistory(history *ChatHistory) error {
-	chatFilePath, err := getChatFilePath(history.ID)
-	if err != nil {
-		return err
+// runEmbed векторизует входные данные пачками. Каждая пачка проходит
+// через Runner, поэтому ключи ротируются и отдыхают после 429 так же,
+// как в чате.
+func runEmbed(flags *provider.Flags, config *provider.Config, keys []string, stdin string, files []provider.FileData) {
+	items := collectEmbedItems(stdin, files)
+	if len(items) == 0 {
+		fatal("Нет текста для векторизации")
 	}
 
-	file, err := os.Create(chatFilePath)
-	if err != nil {
-		return err
+	models := config.Models["embed"]
+	if len(models) == 0 {
+		models = []string{DefaultEmbedModel}
 	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(history)
-}
-
-func clearChatHistory(chatID string) error {
-	chatFilePath, err := getChatFilePath(chatID)
-	if err != nil {
-		return err
+	runner := provider.Runner{
+		Provider: &mistralProvider{baseURL: config.BaseURL},
+		Keys:     keys,
+		Models:   models,
+		Backoff:  config.Backoff(),
 	}
 
-	// Удаляем файл истории чата
-	return os.Remove(chatFilePath)
-}
-
-func calculateMessageSize(content interface{}, imageCharCost int) int {
-	size := 0
-	switch v := content.(type) {
-	case string:
-		size = len(v)
-	case []ContentPart:
-		for _, part := range v {
-			switch part.Type {
-			case "text":
-				size += len(part.Text)
-			case "image_url":
-				// Изображения считаются за фиксированное количество символов (по умолчанию 2000)
-				size += imageCharCost
-			case "input_audio":
-				// Аудио тоже может занимать место, можно установить свою стоимость при необходимости
-				// Пока просто добавим длину текста и base64 данных
-				size += len(part.Text)
-				if part.InputAudio != nil && part.InputAudio.Data != "" {
-					size += len(part.InputAudio.Data) // Длина base64 данных
-				}
-			}
+	out := embedOutput{}
+	var vectors [][]float32
+	for i, batch := range embedBatches(items) {
+		req := &provider.Request{Mode: "embed"}
+		for _, item := range batch {
+			req.Inputs = append(req.Inputs, item.Text)
 		}
+		logVerbose("embed: пачка %d, текстов: %d", i+1, len(batch))
+		resp, err := runner.Run(req)
+		if err != nil {
+			fatal("Не удалось получить векторы после всех попыток. Последняя ошибка: %v", err)
+		}
+		out.Model = resp.Model
+		vectors = append(vectors, resp.Embeddings...)
 	}
-	return size
-}
-
-func updateChatHistory(history *ChatHistory, userMessage ChatMessage, assistantResponse string, config *Config) {
-	// Устанавливаем значения по умолчанию, если они не заданы
-	maxMessages := config.ChatHistoryMaxMessages
-	if maxMessages == 0 {
-		maxMessages = 30 // значение по умолчанию
-	}
-	maxChars := config.ChatHistoryMaxChars
-	if maxChars == 0 {
-		maxChars = 50000 // значение по умолчанию
-	}
-	imageCharCost := config.ImageCharCost
-	if imageCharCost == 0 {
-		imageCharCost = 2000 // значение по умолчанию
-	}
-
-	// Добавляем сообщение пользователя
-	userSize := calculateMessageSize(userMessage.Content, imageCharCost)
-	history.Messages = append(history.Messages, ChatMessageHistory{
-		Role:      userMessage.Role,
-		Content:   userMessage.Content,
-		Size:      userSize,
-		Timestamp: time.Now(),
-	})
-
-	// Добавляем ответ ассистента
-	assistantSize := len(assistantResponse)
-	history.Messages = append(history.Messages, ChatMessageHistory{
-		Role:      "assistant",
-		Content:   assistantResponse,
-		Size:      assistantSize,
-		Timestamp: time.Now(),
-	})
-
-	// Применяем ограничения
-	applyHistoryLimits(history, maxMessages, maxChars)
-}
-
-func applyHistoryLimits(history *ChatHistory, maxMessages, maxChars int) {
-	// Ограничиваем количество сообщений
-	if len(history.Messages) > maxMessages {
-		// Удаляем самые старые сообщения
-		history.Messages = history.Messages[len(history.Messages)-maxMessages:]
+	out.Count = len(vectors)
+	if len(vectors) > 0 {
+		out.Dimensions = len(vectors[0])
 	}
 
-	// Ограничиваем размер контекста
-	totalSize := 0
-	for _, msg := range history.Messages {
-		totalSize += msg.Size
+	if flags.EmbedOut != "" {
+		if err := writeEmbeddingsFile(flags.EmbedOut, out, items, vectors); err != nil {
+			fatal("Ошибка записи %s: %v", flags.EmbedOut, err)
+		}
+		fmt.Printf("Сохранено векторов: %d (размерность %d) в %s\n", out.Count, out.Dimensions, flags.EmbedOut)
+		return
 	}
 
-	for totalSize > maxChars && len(history.Messages) > 0 {
-		// Удаляем самое старое сообщение
-		removedMsg := history.Messages[0]
-		history.Messages = history.Messages[1:]
-		totalSize -= removedMsg.Size
+	for i, item := range items {
+		out.Vectors = append(out.Vectors, embedJSON{embedItem: item, Embedding: vectors[i]})
 	}
-}
-
-func getTavilyConfigPath() string {
-	configDir, err := os.UserConfigDir()
+	data, err := json.Marshal(out)
 	if err != nil {
-		return ""
+		fatal("Ошибка сериализации: %v", err)
 	}
-	return filepath.Join(configDir, "clipgen-m", "tavily.conf")
+	fmt.Println(string(data))
 }
 
-func addTavilyKey(newKey string) error {
-	configPath := getTavilyConfigPath()
-
-	// Ensure directory exists
-	configDir := filepath.Dir(configPath)
-	if _, err := os.Stat(configDir); os.IsNotExist(err) {
-		_ = os.MkdirAll(configDir, 0755)
-	}
-
-	// Load existing config or create new one
-	var config struct {
-		ApiKeys []string `json:"api_keys"`
+// writeEmbeddingsFile пишет векторы подряд как float32 little-endian
+// (count x dimensions), а источники — в <path>.json в том же порядке.
+func writeEmbeddingsFile(path string, out embedOutput, items []embedItem, vectors [][]float32) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
 	}
-
-	if _, err := os.Stat(configPath); !os.IsNotExist(err) {
-		// Read existing config
-		data, err := os.ReadFile(configPath)
-		if err != nil {
-			return err
+	w := bufio.NewWriter(f)
+	for i, v := range vectors {
+		if len(v) != out.Dimensions {
+			f.Close()
+			return fmt.Errorf("вектор %s: размерность %d вместо %d", items[i].ID, len(v), out.Dimensions)
 		}
-
-		if err := json.Unmarshal(data, &config); err != nil {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			f.Close()
 			return err
 		}
 	}
-
-	// Check if key already exists
-	for _, existingKey := range config.ApiKeys {
-		if existingKey == newKey {
-			return fmt.Errorf("ключ уже существует в конфигурации")
-		}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
 	}
-
-	// Add new key
-	config.ApiKeys = append(config.ApiKeys, newKey)
-
-	// Write back to file
-	file, err := os.Create(configPath)
-	if err != nil {
+	if err := f.Close(); err != nil {
 		return err
 	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(config)
-}
 
-// Helper function for min
-func min(a, b int) int {
-	if a < b {
-		return a
+	out.Format = "float32le"
+	out.Items = items
+	meta, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
 	}
-	return b
+	return os.WriteFile(path+".json", meta, 0644)
 }
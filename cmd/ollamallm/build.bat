@@ -0,0 +1 @@
+go build -o ollamallm.exe
\ No newline at end of file
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"ClipGen-m/internal/provider"
+)
+
+// --- Константы и настройки ---
+
+const (
+	ConfigFileName = "ollama.conf"
+	LogFileName    = "ollama_err.log"
+
+	DefaultBaseURL      = "http://localhost:11434"
+	DefaultSystemPrompt = "Ты полезный помощник. Отвечай на русском языке."
+	DefaultTemperature  = 0.7
+	DefaultKeepAlive    = "10m"
+
+	// Скачивание модели может занять долго (гигабайты)
+	PullTimeout = 6 * time.Hour
+)
+
+// Модели по режимам (-m). ocr использует vision-модели.
+var DefaultModels = map[string][]string{
+	"general": {"llama3.2"},
+	"code":    {"qwen2.5-coder", "llama3.2"},
+	"vision":  {"llama3.2-vision"},
+	"ocr":     {"llama3.2-vision"},
+}
+
+// DefaultModeRules выбор режима для --mode auto
+// (mode_rules в конфиге, порядок важен).
+var DefaultModeRules = []provider.ModeRule{
+	{Name: "audio", Attachments: []string{"audio"}, Mode: "audio"},
+	{Name: "images", Attachments: []string{"image"}, Mode: "vision"},
+	{Name: "default", Mode: "general"},
+}
+
+// Config формат ollama.conf: общие настройки provider.Config
+// (api_keys — если Ollama закрыта прокси с авторизацией; max_tokens —
+// num_predict, 0 — без ограничения) и параметры Ollama.
+type Config struct {
+	provider.Config
+	NumCtx    int    `json:"num_ctx"`    // размер контекста, 0 — по умолчанию модели
+	KeepAlive string `json:"keep_alive"` // сколько держать модель в памяти ("10m", "-1" — всегда)
+}
+
+var configDefaults = provider.Defaults{
+	BaseURL:      DefaultBaseURL,
+	SystemPrompt: DefaultSystemPrompt,
+	Temperature:  DefaultTemperature,
+	Models:       DefaultModels,
+	ModeRules:    DefaultModeRules,
+	Backoff:      provider.Backoff{BaseDelay: provider.DefaultRetryBaseDelay, MaxDelay: provider.DefaultRetryMaxDelay},
+}
+
+// loadConfig читает ollama.conf: общую часть через provider.LoadConfig,
+// num_ctx и keep_alive — отдельно. Если файла нет — создает его,
+// чтобы пользователь видел, какие модели назначены режимам.
+func loadConfig(path string) (*Config, error) {
+	base, err := provider.LoadConfig(path, configDefaults)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{Config: *base, KeepAlive: DefaultKeepAlive}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		logVerbose("Конфиг не найден, создаем %s", path)
+		if err := provider.SaveJSON(path, cfg); err != nil {
+			logVerbose("Не удалось сохранить конфигурацию: %v", err)
+		}
+		return cfg, nil
+	}
+
+	ext := struct {
+		NumCtx    int    `json:"num_ctx"`
+		KeepAlive string `json:"keep_alive"`
+	}{KeepAlive: DefaultKeepAlive}
+	if err := json.Unmarshal(data, &ext); err != nil {
+		return nil, fmt.Errorf("ошибка парсинга конфигурации: %v", err)
+	}
+	cfg.NumCtx, cfg.KeepAlive = ext.NumCtx, ext.KeepAlive
+	return cfg, nil
+}
+
+// --- Структуры Ollama API ---
+
+type Options struct {
+	Temperature float64 `json:"temperature"`
+	NumPredict  int     `json:"num_predict,omitempty"`
+	NumCtx      int     `json:"num_ctx,omitempty"`
+}
+
+type Message struct {
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"` // base64 без префикса data:
+}
+
+// ChatRequest /api/chat — используется, когда есть история чата
+type ChatRequest struct {
+	Model     string          `json:"model"`
+	Messages  []Message       `json:"messages"`
+	Stream    bool            `json:"stream"`           // по умолчанию Ollama стримит, поэтому false передаем явно
+	Format    json.RawMessage `json:"format,omitempty"` // "json" или JSON Schema
+	Options   Options         `json:"options"`
+	KeepAlive string          `json:"keep_alive,omitempty"`
+}
+
+// GenerateRequest /api/generate — разовый запрос без истории
+type GenerateRequest struct {
+	Model     string          `json:"model"`
+	Prompt    string          `json:"prompt"`
+	System    string          `json:"system,omitempty"`
+	Images    []string        `json:"images,omitempty"`
+	Stream    bool            `json:"stream"`
+	Format    json.RawMessage `json:"format,omitempty"`
+	Options   Options         `json:"options"`
+	KeepAlive string          `json:"keep_alive,omitempty"`
+}
+
+// OllamaResponse ответ (или одна строка потока) /api/chat и /api/generate
+type OllamaResponse struct {
+	Message         *Message `json:"message,omitempty"` // /api/chat
+	Response        string   `json:"response"`          // /api/generate
+	Done            bool     `json:"done"`
+	DoneReason      string   `json:"done_reason,omitempty"`
+	PromptEvalCount int      `json:"prompt_eval_count,omitempty"`
+	EvalCount       int      `json:"eval_count,omitempty"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// result текст и метаданные ответа. В потоке счетчики приходят в последней строке (done).
+func (r *OllamaResponse) result(text string) *provider.Response {
+	resp := &provider.Response{Text: text, FinishReason: r.DoneReason}
+	if r.Done {
+		resp.Usage = &provider.Usage{
+			PromptTokens:     r.PromptEvalCount,
+			CompletionTokens: r.EvalCount,
+			TotalTokens:      r.PromptEvalCount + r.EvalCount,
+		}
+	}
+	return resp
+}
+
+func (r *OllamaResponse) text() string {
+	if r.Message != nil {
+		return r.Message.Content
+	}
+	return r.Response
+}
+
+type TagsResponse struct {
+	Models []struct {
+		Name       string    `json:"name"`
+		Size       int64     `json:"size"`
+		ModifiedAt time.Time `json:"modified_at"`
+		Details    struct {
+			ParameterSize     string `json:"parameter_size"`
+			QuantizationLevel string `json:"quantization_level"`
+		} `json:"details"`
+	} `json:"models"`
+}
+
+type PullProgress struct {
+	Status    string `json:"status"`
+	Total     int64  `json:"total"`
+	Completed int64  `json:"completed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// --- Main ---
+
+func main() {
+	flags := provider.ParseArgs(os.Args[1:])
+	provider.SetupLog("[OllamaLLM]", LogFileName)
+	provider.Verbose = flags.Verbose
+
+	if flags.Help {
+		printHelp()
+		return
+	}
+
+	// Отчет по журналу расхода (общий для всех утилит)
+	if flags.UsageReport {
+		if err := provider.PrintUsageReport(flags.GroupBy, flags.OutputFormat); err != nil {
+			fatal("Ошибка построения отчета: %v", err)
+		}
+		return
+	}
+
+	configPath, err := provider.ConfigPath(ConfigFileName)
+	if err != nil {
+		fatal("Ошибка получения пути конфига: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fatal("Ошибка загрузки конфига: %v", err)
+	}
+
+	if flags.SaveKey != "" {
+		cfg.ApiKeys = provider.AppendKey(cfg.ApiKeys, flags.SaveKey)
+		if err := provider.SaveJSON(configPath, cfg); err != nil {
+			fatal("Ошибка сохранения ключа: %v", err)
+		}
+		fmt.Printf("Ключ сохранен в %s\n", configPath)
+		return
+	}
+
+	keys := cfg.Keys()
+
+	if flags.ResetKeys {
+		if err := provider.ResetKeyState("ollama"); err != nil {
+			fatal("Ошибка сброса состояния ключей: %v", err)
+		}
+		fmt.Println("Состояние ключей сброшено")
+		return
+	}
+	if flags.KeyStatus {
+		if err := provider.PrintKeyStatus("ollama", keys); err != nil {
+			fatal("Ошибка чтения состояния ключей: %v", err)
+		}
+		return
+	}
+
+	// Локальный сервер обычно работает без ключа
+	if len(keys) == 0 {
+		keys = []string{""}
+	}
+
+	// Управление моделями
+	if flags.ListModels {
+		if err := listModels(cfg, keys[0]); err != nil {
+			fatal("Ошибка получения списка моделей: %v", explainError(cfg, err))
+		}
+		return
+	}
+	if flags.Pull != "" {
+		if err := pullModel(cfg, keys[0], flags.Pull); err != nil {
+			fatal("Ошибка скачивания модели: %v", explainError(cfg, err))
+		}
+		fmt.Printf("Модель %s скачана\n", flags.Pull)
+		return
+	}
+
+	if flags.ClearChat != "" {
+		if err := provider.ClearChatHistory(flags.ClearChat); err != nil {
+			fatal("Ошибка очистки истории чата: %v", err)
+		}
+		fmt.Printf("История чата '%s' очищена\n", flags.ClearChat)
+		return
+	}
+
+	userPrompt := provider.ReadStdin()
+	filesData, att := provider.ProcessFiles(flags.Files, provider.DefaultFileOptions)
+	if userPrompt == "" && len(filesData) == 0 {
+		fatal("Нет входных данных (stdin или файлы)")
+	}
+
+	decision := cfg.ResolveMode(flags, userPrompt, filesData)
+	mode := decision.Mode
+	if mode == "audio" || att.Audio {
+		fatal("Ollama не распознает аудио. Используйте groqllm или mistral")
+	}
+
+	finalSystem := cfg.SystemPrompt
+	if flags.System != "" {
+		finalSystem = flags.System
+	}
+	finalTemp := cfg.Temperature
+	if flags.Temp != -1.0 {
+		finalTemp = flags.Temp
+	}
+
+	schema, err := provider.LoadSchema(flags.Schema)
+	if err != nil {
+		fatal("Ошибка чтения --schema: %v", err)
+	}
+
+	req := &provider.Request{
+		Mode:        mode,
+		System:      finalSystem,
+		Prompt:      userPrompt,
+		Files:       filesData,
+		Temperature: finalTemp,
+		MaxTokens:   cfg.MaxTokens,
+		JSON:        flags.Json,
+		Schema:      schema,
+	}
+
+	if flags.ChatID != "" {
+		req.History, err = provider.LoadChatHistory(flags.ChatID)
+		if err != nil {
+			fatal("Ошибка загрузки истории чата: %v", err)
+		}
+	}
+
+	// Потоковый вывод: текст печатается по мере генерации
+	var printer provider.StreamPrinter
+	if flags.Stream {
+		req.OnDelta = printer.Write
+	}
+
+	runner := provider.Runner{
+		Provider:         &ollamaProvider{baseURL: cfg.BaseURL, keepAlive: cfg.KeepAlive, numCtx: cfg.NumCtx},
+		Keys:             keys,
+		Models:           cfg.ModelsFor(decision),
+		Backoff:          cfg.Backoff(),
+		MaxContinuations: cfg.MaxContinuations,
+		Chunking:         cfg.Chunking(flags),
+	}
+
+	resp, err := runner.Run(req)
+	if err != nil {
+		fatal("Не удалось получить ответ от Ollama. Последняя ошибка: %v", explainError(cfg, err))
+	}
+
+	if req.History != nil {
+		if err := provider.SaveExchange(req.History, userPrompt, resp.Text, cfg.HistoryLimits()); err != nil {
+			logVerbose("Ошибка сохранения истории чата: %v", err)
+		}
+	}
+
+	printer.Finish(resp, flags)
+}
+
+// ollamaProvider реализует provider.Provider через нативный API Ollama.
+type ollamaProvider struct {
+	provider.Unsupported
+	baseURL   string
+	keepAlive string
+	numCtx    int
+}
+
+func (p *ollamaProvider) Name() string { return "ollama" }
+
+func (p *ollamaProvider) Chat(apiKey, model string, req *provider.Request) (*provider.Response, error) {
+	return requestOllama(apiKey, p, model, req)
+}
+
+// --- Логика запросов ---
+
+// requestOllama отправляет разовый запрос в /api/generate, а запрос
+// с историей чата — в /api/chat.
+func requestOllama(apiKey string, p *ollamaProvider, model string, req *provider.Request) (*provider.Response, error) {
+	prompt, images := buildPrompt(req.Prompt, req.Files)
+	options := Options{Temperature: req.Temperature, NumPredict: req.MaxTokens, NumCtx: p.numCtx}
+	var format json.RawMessage
+	switch {
+	case req.Schema != nil:
+		format = req.Schema.Raw
+	case req.JSON:
+		format = json.RawMessage(`"json"`)
+	}
+
+	var url string
+	var body interface{}
+	if req.History != nil {
+		messages := []Message{}
+		if req.System != "" {
+			messages = append(messages, Message{Role: "system", Content: req.System})
+		}
+		for _, msg := range req.History.Replay(false) {
+			// Ollama принимает в истории только текст: из составного контента
+			// других утилит берем текстовые части
+			if content := provider.ContentText(msg.Content); content != "" && (msg.Role == "user" || msg.Role == "assistant") {
+				messages = append(messages, Message{Role: msg.Role, Content: content})
+			}
+		}
+		messages = append(messages, Message{Role: "user", Content: prompt, Images: images})
+
+		url = strings.TrimRight(p.baseURL, "/") + "/api/chat"
+		body = ChatRequest{
+			Model:     model,
+			Messages:  messages,
+			Stream:    req.Streaming(),
+			Format:    format,
+			Options:   options,
+			KeepAlive: p.keepAlive,
+		}
+	} else {
+		url = strings.TrimRight(p.baseURL, "/") + "/api/generate"
+		body = GenerateRequest{
+			Model:     model,
+			Prompt:    prompt,
+			System:    req.System,
+			Images:    images,
+			Stream:    req.Streaming(),
+			Format:    format,
+			Options:   options,
+			KeepAlive: p.keepAlive,
+		}
+	}
+
+	jsonData, _ := json.Marshal(body)
+
+	if req.Streaming() {
+		var sb strings.Builder
+		var last OllamaResponse
+		err := provider.DoNDJSON(apiKey, url, jsonData, provider.DefaultHTTPTimeout, func(line []byte) error {
+			var chunk OllamaResponse
+			if err := json.Unmarshal(line, &chunk); err != nil {
+				return fmt.Errorf("stream parse error: %v | Data: %s", err, string(line))
+			}
+			if chunk.Error != "" {
+				return fmt.Errorf("ollama error: %s", chunk.Error)
+			}
+			if text := chunk.text(); text != "" {
+				sb.WriteString(text)
+				req.OnDelta(text)
+			}
+			last = chunk
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return last.result(sb.String()), nil
+	}
+
+	respBytes, err := provider.DoHTTP(apiKey, url, "application/json", jsonData, provider.DefaultHTTPTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp OllamaResponse
+	if err := json.Unmarshal(respBytes, &resp); err != nil {
+		return nil, fmt.Errorf("json parse error: %v | Body: %s", err, string(respBytes))
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("ollama error: %s", resp.Error)
+	}
+	return resp.result(resp.text()), nil
+}
+
+// buildPrompt добавляет текстовые файлы к промпту, а картинки отдает
+// отдельно — в поле images, как того требует Ollama.
+func buildPrompt(text string, files []provider.FileData) (string, []string) {
+	var images []string
+	var sb strings.Builder
+	sb.WriteString(text)
+	for _, f := range files {
+		switch {
+		case f.IsImage():
+			images = append(images, f.Base64Content)
+		case f.IsText():
+			sb.WriteString(fmt.Sprintf("\n--- File: %s ---\n%s\n", f.Name, string(f.Bytes())))
+		default:
+			logVerbose("Файл %s (%s) не поддерживается и пропущен", f.Name, f.MimeType)
+		}
+	}
+	return sb.String(), images
+}
+
+// --- Управление моделями ---
+
+// listModels выводит скачанные модели и проверяет модели из конфига.
+func listModels(cfg *Config, apiKey string) error {
+	local, err := fetchTags(cfg, apiKey)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Модели Ollama (%s):\n", cfg.BaseURL)
+	if len(local.Models) == 0 {
+		fmt.Println("  (нет скачанных моделей)")
+	}
+	installed := map[string]bool{}
+	for _, m := range local.Models {
+		installed[m.Name] = true
+		fmt.Printf("  %-36s %7.1f GB  %-6s %s\n", m.Name, float64(m.Size)/(1<<30),
+			m.Details.ParameterSize, m.Details.QuantizationLevel)
+	}
+
+	fmt.Printf("\nРежимы из %s:\n", ConfigFileName)
+	modes := make([]string, 0, len(cfg.Models))
+	for mode := range cfg.Models {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	for _, mode := range modes {
+		var list []string
+		for _, name := range cfg.Models[mode] {
+			if isInstalled(installed, name) {
+				list = append(list, name)
+			} else {
+				list = append(list, name+" (не скачана: --pull "+name+")")
+			}
+		}
+		fmt.Printf("  %-8s %s\n", mode+":", strings.Join(list, ", "))
+	}
+	return nil
+}
+
+func fetchTags(cfg *Config, apiKey string) (*TagsResponse, error) {
+	respBytes, err := provider.DoGet(apiKey, strings.TrimRight(cfg.BaseURL, "/")+"/api/tags", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	var tags TagsResponse
+	if err := json.Unmarshal(respBytes, &tags); err != nil {
+		return nil, fmt.Errorf("json parse error: %v", err)
+	}
+	return &tags, nil
+}
+
+// isInstalled учитывает, что Ollama добавляет тег ":latest" к именам без тега.
+func isInstalled(installed map[string]bool, name string) bool {
+	if installed[name] {
+		return true
+	}
+	return !strings.Contains(name, ":") && installed[name+":latest"]
+}
+
+// pullModel скачивает модель, выводя прогресс в stderr.
+func pullModel(cfg *Config, apiKey, model string) error {
+	url := strings.TrimRight(cfg.BaseURL, "/") + "/api/pull"
+	body, _ := json.Marshal(map[string]interface{}{"model": model, "stream": true})
+
+	lastStatus := ""
+	err := provider.DoNDJSON(apiKey, url, body, PullTimeout, func(line []byte) error {
+		var p PullProgress
+		if err := json.Unmarshal(line, &p); err != nil {
+			return nil // строки прогресса необязательны
+		}
+		if p.Error != "" {
+			return fmt.Errorf("ollama error: %s", p.Error)
+		}
+		// Новый этап — с новой строки, прогресс этапа перезаписывает строку
+		if p.Status != lastStatus && lastStatus != "" {
+			fmt.Fprintln(os.Stderr)
+		}
+		if p.Total > 0 {
+			fmt.Fprintf(os.Stderr, "\r%s: %5.1f%%", p.Status, float64(p.Completed)*100/float64(p.Total))
+		} else if p.Status != lastStatus {
+			fmt.Fprint(os.Stderr, p.Status)
+		}
+		lastStatus = p.Status
+		return nil
+	})
+	if lastStatus != "" {
+		fmt.Fprintln(os.Stderr)
+	}
+	return err
+}
+
+// --- Утилиты ---
+
+// explainError подсказывает, что делать, если сервер Ollama не запущен.
+func explainError(cfg *Config, err error) error {
+	if strings.Contains(err.Error(), "connection refused") || strings.Contains(err.Error(), "actively refused") {
+		return fmt.Errorf("Ollama не отвечает по адресу %s (запустите ollama serve): %v", cfg.BaseURL, err)
+	}
+	return err
+}
+
+func printHelp() {
+	fmt.Println(`Ollama CLI для ClipGen-m (локальные модели, без отправки данных в облако)
+
+Использование: ollamallm.exe [флаги] < input.txt
+
+  -f, --file <path>        Файл для анализа (картинки и текст, можно несколько)
+  -s, --system <text>      Системный промпт (переопределяет конфиг)
+  -j, --json               Принудительный JSON ответ
+  -m, --mode <mode>        Режим: auto, general, code, ocr, vision
+  -t, --temp <float>       Температура генерации (переопределяет конфиг)
+  -v, --verbose            Вывод логов в stderr
+      --chat <id>          ID чата для контекста (включает режим чата)
+      --clear-chat <id>    Очистить историю указанного чата
+      --stream             Выводить ответ по мере генерации
+      --schema <file.json> Ответ по JSON Schema (включает -j), при несоответствии повтор
+      --explain-mode       Показать в stderr, какое правило mode_rules выбрало режим
+      --chunk-size <n>     Части больших текстовых файлов в символах (по умолчанию chunk_size)
+      --strategy <name>    Обработка частей: map-reduce (по умолчанию) или refine
+      --output-format json Ответ с метаданными (модель, токены, попытки) в JSON
+      --usage-report       Отчет о расходе токенов (--group-by day,provider,model,key;
+                           --output-format csv|json)
+      --list-models        Показать скачанные модели и модели режимов
+      --pull <model>       Скачать модель и выйти
+      --save-key <key>     Сохранить ключ (если Ollama за прокси с авторизацией)
+      --key-status         Показать состояние ключей и выйти
+      --reset-keys         Сбросить сохраненное состояние ключей и выйти`)
+}
+
+// --- Логирование ---
+
+func logVerbose(format string, v ...interface{}) {
+	provider.Logf(format, v...)
+}
+
+func fatal(format string, v ...interface{}) {
+	provider.Fatalf(format, v...)
+}
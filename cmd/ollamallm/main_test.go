@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"ClipGen-m/internal/provider"
+)
+
+// captured запрос, который получил тестовый сервер.
+type captured struct {
+	path string
+	body map[string]interface{}
+}
+
+// serve поднимает сервер, отвечающий body, и запоминает последний запрос.
+func serve(t *testing.T, body string) (string, *captured) {
+	t.Helper()
+	got := &captured{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.path = r.URL.Path
+		data, _ := io.ReadAll(r.Body)
+		got.body = nil
+		_ = json.Unmarshal(data, &got.body)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, got
+}
+
+// captureOutput перехватывает stdout и stderr на время f.
+func captureOutput(t *testing.T, f func()) (stdout, stderr string) {
+	t.Helper()
+	read := func(target **os.File) func() string {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		orig := *target
+		*target = w
+		done := make(chan string)
+		go func() {
+			data, _ := io.ReadAll(r)
+			done <- string(data)
+		}()
+		return func() string {
+			w.Close()
+			*target = orig
+			return <-done
+		}
+	}
+	stopOut, stopErr := read(&os.Stdout), read(&os.Stderr)
+	f()
+	return stopOut(), stopErr()
+}
+
+func TestRequestOllama(t *testing.T) {
+	p := &ollamaProvider{keepAlive: "10m", numCtx: 4096}
+	image := provider.FileData{Name: "a.png", MimeType: "image/png", Base64Content: "AAAA"}
+	text := provider.FileData{Name: "n.txt", MimeType: "text/plain", Base64Content: "bm90ZQ=="} // "note"
+	history := &provider.ChatHistory{Messages: []provider.ChatMessageHistory{
+		{Role: "user", Content: "earlier"},
+		{Role: "assistant", Content: "answer"},
+	}}
+	schema := &provider.Schema{Name: "s", Raw: json.RawMessage(`{"type":"object"}`)}
+
+	tests := []struct {
+		name     string
+		req      *provider.Request
+		answer   string
+		wantPath string
+		want     map[string]string // поле запроса -> JSON
+	}{
+		{
+			name:     "generate with files",
+			req:      &provider.Request{System: "sys", Prompt: "look", Files: []provider.FileData{image, text}, Temperature: 0.5, MaxTokens: 100},
+			answer:   `{"response":"hi","done":true,"done_reason":"stop","prompt_eval_count":3,"eval_count":1}`,
+			wantPath: "/api/generate",
+			want: map[string]string{
+				"prompt":     `"look\n--- File: n.txt ---\nnote\n"`,
+				"system":     `"sys"`,
+				"images":     `["AAAA"]`,
+				"stream":     `false`,
+				"options":    `{"num_ctx":4096,"num_predict":100,"temperature":0.5}`,
+				"keep_alive": `"10m"`,
+			},
+		},
+		{
+			name:     "chat with history and json",
+			req:      &provider.Request{System: "sys", Prompt: "next", History: history, JSON: true},
+			answer:   `{"message":{"role":"assistant","content":"hi"},"done":true,"done_reason":"stop","prompt_eval_count":3,"eval_count":1}`,
+			wantPath: "/api/chat",
+			want: map[string]string{
+				"messages": `[{"content":"sys","role":"system"},{"content":"earlier","role":"user"},` +
+					`{"content":"answer","role":"assistant"},{"content":"next","role":"user"}]`,
+				"format": `"json"`,
+			},
+		},
+		{
+			name:     "schema as format",
+			req:      &provider.Request{Prompt: "x", JSON: true, Schema: schema},
+			answer:   `{"response":"hi","done":true,"done_reason":"stop","prompt_eval_count":3,"eval_count":1}`,
+			wantPath: "/api/generate",
+			want:     map[string]string{"format": `{"type":"object"}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, got := serve(t, tt.answer)
+			p.baseURL = url + "/"
+			resp, err := requestOllama("", p, "llama", tt.req)
+			if err != nil {
+				t.Fatalf("requestOllama error = %v", err)
+			}
+			if resp.Text != "hi" || resp.FinishReason != "stop" || resp.Usage == nil || resp.Usage.TotalTokens != 4 {
+				t.Errorf("response = %+v (usage %+v)", resp, resp.Usage)
+			}
+			if got.path != tt.wantPath || got.body["model"] != "llama" {
+				t.Errorf("path = %q, model = %v", got.path, got.body["model"])
+			}
+			for field, want := range tt.want {
+				if value := compact(got.body[field]); value != want {
+					t.Errorf("%s = %s, want %s", field, value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestOllamaHistory(t *testing.T) {
+	// История, в которую писали mistral/pollinationsllm (вложения — массивом
+	// частей) и geminillm (вызов калькулятора)
+	var h provider.ChatHistory
+	err := json.Unmarshal([]byte(`{"id":"mixed","messages":[
+		{"role":"user","content":[{"type":"text","text":"what is on the picture?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}}]},
+		{"role":"assistant","content":"a cat"},
+		{"role":"user","content":"2+2?"},
+		{"role":"assistant","content":"","tool_calls":[{"id":"abc123XYZ","name":"calculator","arguments":"{\"expression\":\"2+2\"}"}]},
+		{"role":"tool","content":"4","tool_call_id":"abc123XYZ","name":"calculator"},
+		{"role":"assistant","content":"4"}
+	]}`), &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url, got := serve(t, `{"message":{"role":"assistant","content":"hi"},"done":true}`)
+	if _, err := requestOllama("", &ollamaProvider{baseURL: url}, "llama", &provider.Request{Prompt: "next", History: &h}); err != nil {
+		t.Fatalf("requestOllama error = %v", err)
+	}
+	want := `[{"content":"what is on the picture?","role":"user"},{"content":"a cat","role":"assistant"},` +
+		`{"content":"2+2?","role":"user"},{"content":"4","role":"assistant"},{"content":"next","role":"user"}]`
+	if messages := compact(got.body["messages"]); messages != want {
+		t.Errorf("messages =\n%s\nwant\n%s", messages, want)
+	}
+}
+
+func TestRequestOllamaStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		history *provider.ChatHistory
+		body    string
+	}{
+		{"generate", nil, strings.Join([]string{
+			`{"response":"Hel","done":false}`,
+			`{"response":"lo","done":false}`,
+			`{"response":"","done":true,"done_reason":"length","prompt_eval_count":5,"eval_count":2}`,
+		}, "\n")},
+		{"chat", &provider.ChatHistory{}, strings.Join([]string{
+			`{"message":{"role":"assistant","content":"Hel"},"done":false}`,
+			`{"message":{"role":"assistant","content":"lo"},"done":false}`,
+			`{"message":{"role":"assistant","content":""},"done":true,"done_reason":"length","prompt_eval_count":5,"eval_count":2}`,
+		}, "\n")},
+	}
+	for _, tt := range tests {
+		url, got := serve(t, tt.body)
+		var deltas []string
+		req := &provider.Request{Prompt: "x", History: tt.history, OnDelta: func(s string) { deltas = append(deltas, s) }}
+		resp, err := requestOllama("", &ollamaProvider{baseURL: url}, "llama", req)
+		if err != nil {
+			t.Fatalf("%s: requestOllama error = %v", tt.name, err)
+		}
+		if got.body["stream"] != true {
+			t.Errorf("%s: stream = %v, want true", tt.name, got.body["stream"])
+		}
+		if resp.Text != "Hello" || resp.FinishReason != "length" || !reflect.DeepEqual(deltas, []string{"Hel", "lo"}) {
+			t.Errorf("%s: response = %+v, deltas = %q", tt.name, resp, deltas)
+		}
+		if resp.Usage == nil || resp.Usage.PromptTokens != 5 || resp.Usage.CompletionTokens != 2 {
+			t.Errorf("%s: usage = %+v", tt.name, resp.Usage)
+		}
+	}
+}
+
+func TestRequestOllamaErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream bool
+		body   string
+		want   string
+	}{
+		{"error field", false, `{"error":"model 'x' not found"}`, "ollama error: model 'x' not found"},
+		{"not json", false, `<html>`, "json parse error"},
+		{"error in stream", true, "{\"response\":\"a\"}\n{\"error\":\"out of memory\"}", "ollama error: out of memory"},
+		{"broken stream line", true, "{\"response\":", "stream parse error"},
+	}
+	for _, tt := range tests {
+		url, _ := serve(t, tt.body)
+		req := &provider.Request{Prompt: "x"}
+		if tt.stream {
+			req.OnDelta = func(string) {}
+		}
+		_, err := requestOllama("", &ollamaProvider{baseURL: url}, "llama", req)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestListModels(t *testing.T) {
+	url, got := serve(t, `{"models":[
+		{"name":"llama3.2:latest","size":2147483648,"details":{"parameter_size":"3B","quantization_level":"Q4_K_M"}},
+		{"name":"qwen2.5-coder:7b","size":1073741824,"details":{"parameter_size":"7B","quantization_level":"Q4_0"}}
+	]}`)
+	cfg := &Config{Config: provider.Config{BaseURL: url, Models: map[string][]string{
+		"general": {"llama3.2"},
+		"code":    {"qwen2.5-coder:7b", "qwen2.5-coder"},
+	}}}
+
+	var err error
+	stdout, _ := captureOutput(t, func() { err = listModels(cfg, "") })
+	if err != nil {
+		t.Fatalf("listModels error = %v", err)
+	}
+	if got.path != "/api/tags" {
+		t.Errorf("path = %q", got.path)
+	}
+	for _, want := range []string{
+		"llama3.2:latest", "2.0 GB", "3B", "Q4_K_M",
+		"code:    qwen2.5-coder:7b, qwen2.5-coder (не скачана: --pull qwen2.5-coder)",
+		"general: llama3.2\n",
+	} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("output has no %q:\n%s", want, stdout)
+		}
+	}
+}
+
+func TestIsInstalled(t *testing.T) {
+	installed := map[string]bool{"llama3.2:latest": true, "qwen2.5-coder:7b": true}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"llama3.2", true},
+		{"llama3.2:latest", true},
+		{"llama3.2:1b", false},
+		{"qwen2.5-coder", false},
+		{"qwen2.5-coder:7b", true},
+	}
+	for _, tt := range tests {
+		if got := isInstalled(installed, tt.name); got != tt.want {
+			t.Errorf("isInstalled(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPullModel(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantErr    string
+		wantStderr string
+	}{
+		{
+			name: "progress",
+			body: strings.Join([]string{
+				`{"status":"pulling manifest"}`,
+				`{"status":"pulling abc","total":200,"completed":50}`,
+				`not json`,
+				`{"status":"pulling abc","total":200,"completed":200}`,
+				`{"status":"success"}`,
+			}, "\n"),
+			wantStderr: "pulling manifest\n\rpulling abc:  25.0%\rpulling abc: 100.0%\nsuccess\n",
+		},
+		{
+			name:       "error",
+			body:       "{\"status\":\"pulling manifest\"}\n{\"error\":\"file does not exist\"}",
+			wantErr:    "ollama error: file does not exist",
+			wantStderr: "pulling manifest\n",
+		},
+	}
+	for _, tt := range tests {
+		url, got := serve(t, tt.body)
+		cfg := &Config{Config: provider.Config{BaseURL: url}}
+
+		var err error
+		_, stderr := captureOutput(t, func() { err = pullModel(cfg, "", "llama3.2") })
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+		if stderr != tt.wantStderr {
+			t.Errorf("%s: stderr = %q, want %q", tt.name, stderr, tt.wantStderr)
+		}
+		if got.path != "/api/pull" || got.body["model"] != "llama3.2" || got.body["stream"] != true {
+			t.Errorf("%s: request %s %v", tt.name, got.path, got.body)
+		}
+	}
+}
+
+func compact(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
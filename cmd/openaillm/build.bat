@@ -0,0 +1 @@
+go build -o openaillm.exe
\ No newline at end of file
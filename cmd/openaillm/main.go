@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"os"
+	"sort"
+	"strings"
+
+	"ClipGen-m/internal/provider"
+)
+
+// --- Константы и настройки ---
+
+const (
+	ConfigFileName = "openai.conf"
+	LogFileName    = "openai_err.log"
+
+	DefaultEndpoint     = "ollama"
+	DefaultSystemPrompt = "Ты полезный помощник. Отвечай на русском языке."
+	DefaultTemperature  = 0.7
+)
+
+// Endpoint именованный OpenAI-совместимый сервер (ollama, llama.cpp, vLLM, LM Studio, OpenRouter...)
+type Endpoint struct {
+	BaseURL      string              `json:"base_url"` // до /chat/completions, обычно оканчивается на /v1
+	ApiKeys      []string            `json:"api_keys"` // пусто — сервер без авторизации
+	Models       map[string][]string `json:"models"`
+	Capabilities Capabilities        `json:"capabilities"`
+}
+
+// Capabilities что умеет сервер. Неподдерживаемое не отправляется.
+type Capabilities struct {
+	Vision bool `json:"vision"` // картинки в image_url
+	Audio  bool `json:"audio"`  // /audio/transcriptions (Whisper-совместимый)
+	JSON   bool `json:"json"`   // response_format: json_object
+	Stream bool `json:"stream"` // SSE для --stream
+}
+
+// Config формат openai.conf: общие настройки (provider.Config — промпт,
+// температура, история, повторы) и список эндпоинтов. Верхнеуровневые
+// api_keys, base_url и models не используются — они задаются в эндпоинтах.
+type Config struct {
+	provider.Config
+	DefaultEndpoint string               `json:"default_endpoint"`
+	Endpoints       map[string]*Endpoint `json:"endpoints"`
+}
+
+// DefaultModeRules выбор режима для --mode auto
+// (mode_rules в конфиге, порядок важен).
+var DefaultModeRules = []provider.ModeRule{
+	{Name: "audio", Attachments: []string{"audio"}, Mode: "audio"},
+	{Name: "images", Attachments: []string{"image"}, Mode: "vision"},
+	{Name: "default", Mode: "general"},
+}
+
+var configDefaults = provider.Defaults{
+	SystemPrompt: DefaultSystemPrompt,
+	Temperature:  DefaultTemperature,
+	ModeRules:    DefaultModeRules,
+	Backoff:      provider.Backoff{BaseDelay: provider.DefaultRetryBaseDelay, MaxDelay: provider.DefaultRetryMaxDelay},
+}
+
+// defaultEndpoints популярные локальные серверы и OpenRouter
+func defaultEndpoints() map[string]*Endpoint {
+	return map[string]*Endpoint{
+		"ollama": {
+			BaseURL: "http://localhost:11434/v1",
+			ApiKeys: []string{},
+			Models: map[string][]string{
+				"general": {"llama3.2"},
+				"vision":  {"llama3.2-vision"},
+			},
+			Capabilities: Capabilities{Vision: true, JSON: true, Stream: true},
+		},
+		"llamacpp": {
+			BaseURL:      "http://localhost:8080/v1",
+			ApiKeys:      []string{},
+			Models:       map[string][]string{"general": {"default"}},
+			Capabilities: Capabilities{JSON: true, Stream: true},
+		},
+		"lmstudio": {
+			BaseURL:      "http://localhost:1234/v1",
+			ApiKeys:      []string{},
+			Models:       map[string][]string{"general": {"local-model"}},
+			Capabilities: Capabilities{Stream: true},
+		},
+		"vllm": {
+			BaseURL:      "http://localhost:8000/v1",
+			ApiKeys:      []string{},
+			Models:       map[string][]string{"general": {"Qwen/Qwen2.5-7B-Instruct"}},
+			Capabilities: Capabilities{JSON: true, Stream: true},
+		},
+		"openrouter": {
+			BaseURL: "https://openrouter.ai/api/v1",
+			ApiKeys: []string{},
+			Models: map[string][]string{
+				"general": {"openrouter/auto"},
+				"vision":  {"openrouter/auto"},
+			},
+			Capabilities: Capabilities{Vision: true, JSON: true, Stream: true},
+		},
+	}
+}
+
+// loadConfig читает openai.conf: общую часть через provider.LoadConfig,
+// эндпоинты — отдельно. Если файла нет — создает его с примерами
+// эндпоинтов, чтобы пользователю было что редактировать.
+func loadConfig(path string) (*Config, error) {
+	base, err := provider.LoadConfig(path, configDefaults)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{Config: *base, DefaultEndpoint: DefaultEndpoint}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		cfg.Endpoints = defaultEndpoints()
+		logVerbose("Конфиг не найден, создаем %s", path)
+		if err := provider.SaveJSON(path, cfg); err != nil {
+			logVerbose("Не удалось сохранить конфигурацию: %v", err)
+		}
+		return cfg, nil
+	}
+
+	ext := struct {
+		DefaultEndpoint string               `json:"default_endpoint"`
+		Endpoints       map[string]*Endpoint `json:"endpoints"`
+	}{DefaultEndpoint: DefaultEndpoint}
+	if err := json.Unmarshal(data, &ext); err != nil {
+		return nil, fmt.Errorf("ошибка парсинга конфигурации: %v", err)
+	}
+	cfg.DefaultEndpoint, cfg.Endpoints = ext.DefaultEndpoint, ext.Endpoints
+	if len(cfg.Endpoints) == 0 {
+		cfg.Endpoints = defaultEndpoints()
+	}
+	return cfg, nil
+}
+
+// endpoint возвращает эндпоинт по имени (пустое — default_endpoint).
+func (c *Config) endpoint(name string) (string, *Endpoint, error) {
+	if name == "" {
+		name = c.DefaultEndpoint
+	}
+	if ep, ok := c.Endpoints[name]; ok && ep != nil {
+		return name, ep, nil
+	}
+	return name, nil, fmt.Errorf("эндпоинт '%s' не найден в %s. Доступны: %s",
+		name, ConfigFileName, strings.Join(c.endpointNames(), ", "))
+}
+
+func (c *Config) endpointNames() []string {
+	names := make([]string, 0, len(c.Endpoints))
+	for name := range c.Endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// config общие настройки в виде provider.Config с ключами и моделями
+// эндпоинта — для Keys и SelectModels.
+func (e *Endpoint) config() *provider.Config {
+	return &provider.Config{ApiKeys: e.ApiKeys, BaseURL: e.BaseURL, Models: e.Models}
+}
+
+// --- Структуры API ---
+
+type ChatMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageUrl *ImageURL `json:"image_url,omitempty"`
+}
+
+type ImageURL struct {
+	Url string `json:"url"`
+}
+
+type ChatRequest struct {
+	Model          string                   `json:"model"`
+	Messages       []ChatMessage            `json:"messages"`
+	Temperature    float64                  `json:"temperature"`
+	MaxTokens      int                      `json:"max_tokens,omitempty"`
+	Stream         bool                     `json:"stream,omitempty"`
+	ResponseFormat *provider.ResponseFormat `json:"response_format,omitempty"`
+}
+
+type ChatResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *provider.Usage `json:"usage,omitempty"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+type AudioResponse struct {
+	Text  string `json:"text"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// --- Main ---
+
+func main() {
+	flags := provider.ParseArgs(os.Args[1:])
+	provider.SetupLog("[OpenAILLM]", LogFileName)
+	provider.Verbose = flags.Verbose
+
+	if flags.Help {
+		printHelp()
+		return
+	}
+
+	// Отчет по журналу расхода (общий для всех утилит)
+	if flags.UsageReport {
+		if err := provider.PrintUsageReport(flags.GroupBy, flags.OutputFormat); err != nil {
+			fatal("Ошибка построения отчета: %v", err)
+		}
+		return
+	}
+
+	configPath, err := provider.ConfigPath(ConfigFileName)
+	if err != nil {
+		fatal("Ошибка получения пути конфига: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fatal("Ошибка загрузки конфига: %v", err)
+	}
+
+	epName, ep, err := cfg.endpoint(flags.Endpoint)
+	if err != nil {
+		fatal("%v", err)
+	}
+	// Состояние ключей ведется отдельно для каждого эндпоинта
+	providerName := "openai-" + epName
+
+	if flags.SaveKey != "" {
+		ep.ApiKeys = provider.AppendKey(ep.ApiKeys, flags.SaveKey)
+		if err := provider.SaveJSON(configPath, cfg); err != nil {
+			fatal("Ошибка сохранения ключа: %v", err)
+		}
+		fmt.Printf("Ключ для '%s' сохранен в %s\n", epName, configPath)
+		return
+	}
+
+	keys := ep.config().Keys()
+
+	if flags.ResetKeys {
+		if err := provider.ResetKeyState(providerName); err != nil {
+			fatal("Ошибка сброса состояния ключей: %v", err)
+		}
+		fmt.Println("Состояние ключей сброшено")
+		return
+	}
+	if flags.KeyStatus {
+		if err := provider.PrintKeyStatus(providerName, keys); err != nil {
+			fatal("Ошибка чтения состояния ключей: %v", err)
+		}
+		return
+	}
+
+	// Локальные серверы обычно работают без ключа
+	if len(keys) == 0 {
+		keys = []string{""}
+	}
+
+	if flags.ClearChat != "" {
+		if err := provider.ClearChatHistory(flags.ClearChat); err != nil {
+			fatal("Ошибка очистки истории чата: %v", err)
+		}
+		fmt.Printf("История чата '%s' очищена\n", flags.ClearChat)
+		return
+	}
+
+	userPrompt := provider.ReadStdin()
+	filesData, att := provider.ProcessFiles(flags.Files, provider.DefaultFileOptions)
+	if userPrompt == "" && len(filesData) == 0 {
+		fatal("Нет входных данных (stdin или файлы)")
+	}
+
+	decision := cfg.ResolveMode(flags, userPrompt, filesData)
+	mode := decision.Mode
+	if mode == "audio" && !ep.Capabilities.Audio {
+		fatal("Эндпоинт '%s' не поддерживает распознавание аудио (capabilities.audio)", epName)
+	}
+	if att.Images && !ep.Capabilities.Vision {
+		fatal("Эндпоинт '%s' не поддерживает изображения (capabilities.vision)", epName)
+	}
+
+	finalSystem := cfg.SystemPrompt
+	if flags.System != "" {
+		finalSystem = flags.System
+	}
+	if flags.Json && !ep.Capabilities.JSON {
+		finalSystem += " Output strictly in JSON format."
+	}
+	finalTemp := cfg.Temperature
+	if flags.Temp != -1.0 {
+		finalTemp = flags.Temp
+	}
+
+	schema, err := provider.LoadSchema(flags.Schema)
+	if err != nil {
+		fatal("Ошибка чтения --schema: %v", err)
+	}
+	if schema != nil && !ep.Capabilities.JSON {
+		finalSystem += schema.Instruction()
+	}
+
+	req := &provider.Request{
+		Mode:        mode,
+		System:      finalSystem,
+		Prompt:      userPrompt,
+		Files:       filesData,
+		Temperature: finalTemp,
+		MaxTokens:   cfg.MaxTokens,
+		JSON:        flags.Json && ep.Capabilities.JSON,
+		Schema:      schema,
+	}
+
+	if flags.ChatID != "" && mode != "audio" {
+		req.History, err = provider.LoadChatHistory(flags.ChatID)
+		if err != nil {
+			fatal("Ошибка загрузки истории чата: %v", err)
+		}
+	}
+
+	// Потоковый вывод: текст печатается по мере генерации
+	var printer provider.StreamPrinter
+	if flags.Stream && ep.Capabilities.Stream {
+		req.OnDelta = printer.Write
+	}
+
+	runner := provider.Runner{
+		Provider:         &openaiProvider{name: providerName, baseURL: ep.BaseURL},
+		Keys:             keys,
+		Models:           ep.config().ModelsFor(decision),
+		Backoff:          cfg.Backoff(),
+		MaxContinuations: cfg.MaxContinuations,
+		Chunking:         cfg.Chunking(flags),
+	}
+
+	resp, err := runner.Run(req)
+	if err != nil {
+		fatal("Не удалось получить ответ от '%s'. Последняя ошибка: %v", epName, err)
+	}
+
+	if req.History != nil {
+		if err := provider.SaveExchange(req.History, userPrompt, resp.Text, cfg.HistoryLimits()); err != nil {
+			logVerbose("Ошибка сохранения истории чата: %v", err)
+		}
+	}
+
+	printer.Finish(resp, flags)
+}
+
+// openaiProvider реализует provider.Provider для любого OpenAI-совместимого сервера.
+type openaiProvider struct {
+	provider.Unsupported
+	name    string
+	baseURL string
+}
+
+func (p *openaiProvider) Name() string { return p.name }
+
+func (p *openaiProvider) Chat(apiKey, model string, req *provider.Request) (*provider.Response, error) {
+	return requestChat(apiKey, p.baseURL, model, req)
+}
+
+func (p *openaiProvider) Transcribe(apiKey, model string, req *provider.Request) (*provider.Response, error) {
+	for _, f := range req.Files {
+		if !f.IsAudio() {
+			continue
+		}
+		text, err := requestAudio(apiKey, p.baseURL, model, f)
+		if err != nil {
+			return nil, err
+		}
+		return &provider.Response{Text: text}, nil
+	}
+	return nil, fmt.Errorf("режим audio требует файл")
+}
+
+// --- Логика запросов ---
+
+func requestChat(apiKey, baseURL, model string, req *provider.Request) (*provider.Response, error) {
+	url := strings.TrimRight(baseURL, "/") + "/chat/completions"
+
+	messages := []ChatMessage{}
+	if req.System != "" {
+		messages = append(messages, ChatMessage{Role: "system", Content: req.System})
+	}
+	// Без инструментов: вызовы инструментов из истории других утилит пропускаются
+	for _, msg := range req.History.Replay(false) {
+		if msg.Role == "user" || msg.Role == "assistant" {
+			messages = append(messages, ChatMessage{Role: msg.Role, Content: msg.Content})
+		}
+	}
+	messages = append(messages, ChatMessage{Role: "user", Content: buildUserContent(req.Prompt, req.Files)})
+
+	reqBody := ChatRequest{
+		Model:       model,
+		Messages:    messages,
+		Temperature: req.Temperature,
+		MaxTokens:   req.MaxTokens,
+		Stream:      req.Streaming(),
+	}
+	// Без capabilities.json сервер получает схему только в промпте
+	if req.JSON {
+		reqBody.ResponseFormat = provider.JSONResponseFormat(req)
+	}
+
+	jsonData, _ := json.Marshal(reqBody)
+
+	if req.Streaming() {
+		result, err := provider.StreamChat(apiKey, url, jsonData, provider.DefaultHTTPTimeout, req.OnDelta)
+		if err != nil {
+			return nil, err
+		}
+		return result.Response(), nil
+	}
+
+	respBytes, err := provider.DoHTTP(apiKey, url, "application/json", jsonData, provider.DefaultHTTPTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp ChatResponse
+	if err := json.Unmarshal(respBytes, &resp); err != nil {
+		return nil, fmt.Errorf("json parse error: %v | Body: %s", err, string(respBytes))
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("api error: %s", resp.Error.Message)
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("пустой ответ от API")
+	}
+	choice := resp.Choices[0]
+	return &provider.Response{Text: choice.Message.Content, FinishReason: choice.FinishReason, Usage: resp.Usage}, nil
+}
+
+// buildUserContent собирает сообщение пользователя: текст, картинки и текстовые файлы.
+// Прочие вложения (PDF, офисные документы) локальные серверы не понимают — пропускаем.
+func buildUserContent(text string, files []provider.FileData) interface{} {
+	if len(files) == 0 {
+		return text
+	}
+
+	parts := []ContentPart{}
+	if text != "" {
+		parts = append(parts, ContentPart{Type: "text", Text: text})
+	}
+	for _, f := range files {
+		switch {
+		case f.IsImage():
+			parts = append(parts, ContentPart{Type: "image_url", ImageUrl: &ImageURL{Url: f.DataURL()}})
+		case f.IsText():
+			parts = append(parts, ContentPart{
+				Type: "text",
+				Text: fmt.Sprintf("\n--- File: %s ---\n%s\n", f.Name, string(f.Bytes())),
+			})
+		default:
+			logVerbose("Файл %s (%s) не поддерживается и пропущен", f.Name, f.MimeType)
+		}
+	}
+	return parts
+}
+
+func requestAudio(apiKey, baseURL, model string, file provider.FileData) (string, error) {
+	url := strings.TrimRight(baseURL, "/") + "/audio/transcriptions"
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("file", file.Name)
+	if err != nil {
+		return "", err
+	}
+	part.Write(file.Bytes())
+	writer.WriteField("model", model)
+	writer.WriteField("response_format", "json")
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	respBytes, err := provider.DoHTTP(apiKey, url, writer.FormDataContentType(), body.Bytes(), provider.DefaultHTTPTimeout)
+	if err != nil {
+		return "", err
+	}
+
+	var resp AudioResponse
+	if err := json.Unmarshal(respBytes, &resp); err != nil {
+		return "", fmt.Errorf("json parse error: %v", err)
+	}
+	if resp.Error != nil {
+		return "", fmt.Errorf("api error: %s", resp.Error.Message)
+	}
+	return strings.TrimSpace(resp.Text), nil
+}
+
+// --- Утилиты ---
+
+func printHelp() {
+	fmt.Println(`OpenAI-совместимый CLI для ClipGen-m (Ollama, llama.cpp, vLLM, LM Studio, OpenRouter)
+
+Использование: openaillm.exe [флаги] < input.txt
+
+  -f, --file <path>        Файл для анализа (можно несколько)
+  -s, --system <text>      Системный промпт (переопределяет конфиг)
+  -j, --json               Принудительный JSON ответ
+  -m, --mode <mode>        Режим: auto, general, code, audio, vision
+  -t, --temp <float>       Температура генерации (переопределяет конфиг)
+  -v, --verbose            Вывод логов в stderr
+      --endpoint <name>    Эндпоинт из openai.conf (по умолчанию default_endpoint)
+      --save-key <key>     Сохранить ключ для эндпоинта и выйти
+      --chat <id>          ID чата для контекста (включает режим чата)
+      --clear-chat <id>    Очистить историю указанного чата
+      --stream             Выводить ответ по мере генерации
+      --schema <file.json> Ответ по JSON Schema (включает -j), при несоответствии повтор
+      --explain-mode       Показать в stderr, какое правило mode_rules выбрало режим
+      --chunk-size <n>     Части больших текстовых файлов в символах (по умолчанию chunk_size)
+      --strategy <name>    Обработка частей: map-reduce (по умолчанию) или refine
+      --output-format json Ответ с метаданными (модель, токены, попытки) в JSON
+      --usage-report       Отчет о расходе токенов (--group-by day,provider,model,key;
+                           --output-format csv|json)
+      --key-status         Показать состояние ключей эндпоинта и выйти
+      --reset-keys         Сбросить сохраненное состояние ключей и выйти`)
+}
+
+// --- Логирование ---
+
+func logVerbose(format string, v ...interface{}) {
+	provider.Logf(format, v...)
+}
+
+func fatal(format string, v ...interface{}) {
+	provider.Fatalf(format, v...)
+}
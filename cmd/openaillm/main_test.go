@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"ClipGen-m/internal/provider"
+)
+
+// captured запрос, который получил тестовый сервер.
+type captured struct {
+	path string
+	auth string
+	body map[string]interface{}
+}
+
+// serve поднимает сервер, отвечающий body, и запоминает последний запрос.
+func serve(t *testing.T, body string) (string, *captured) {
+	t.Helper()
+	got := &captured{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.path = r.URL.Path
+		got.auth = r.Header.Get("Authorization")
+		data, _ := io.ReadAll(r.Body)
+		got.body = nil
+		_ = json.Unmarshal(data, &got.body)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/v1/", got
+}
+
+const chatAnswer = `{"choices":[{"message":{"content":"hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`
+
+func TestRequestChat(t *testing.T) {
+	image := provider.FileData{Name: "a.png", MimeType: "image/png", Base64Content: "AAAA"}
+	text := provider.FileData{Name: "n.txt", MimeType: "text/plain", Base64Content: "bm90ZQ=="} // "note"
+	pdf := provider.FileData{Name: "d.pdf", MimeType: "application/pdf", Base64Content: "AAAA"}
+	history := &provider.ChatHistory{Messages: []provider.ChatMessageHistory{
+		{Role: "user", Content: "earlier"},
+		{Role: "assistant", Content: "", ToolCalls: []provider.HistoryToolCall{{ID: "c1", Name: "calc"}}},
+		{Role: "tool", Content: "4", ToolCallID: "c1"},
+		{Role: "assistant", Content: "answer"},
+	}}
+
+	tests := []struct {
+		name         string
+		key          string
+		req          *provider.Request
+		wantMessages string
+		wantFormat   string
+	}{
+		{
+			name:         "plain prompt",
+			req:          &provider.Request{System: "sys", Prompt: "hello", Temperature: 0.5},
+			wantMessages: `[{"content":"sys","role":"system"},{"content":"hello","role":"user"}]`,
+		},
+		{
+			name: "files become content parts, unsupported skipped",
+			key:  "secret",
+			req:  &provider.Request{Prompt: "look", Files: []provider.FileData{image, text, pdf}},
+			wantMessages: `[{"content":[{"text":"look","type":"text"},` +
+				`{"image_url":{"url":"data:image/png;base64,AAAA"},"type":"image_url"},` +
+				`{"text":"\n--- File: n.txt ---\nnote\n","type":"text"}],"role":"user"}]`,
+		},
+		{
+			name: "history without tool turns",
+			req:  &provider.Request{Prompt: "next", History: history},
+			wantMessages: `[{"content":"earlier","role":"user"},{"content":"answer","role":"assistant"},` +
+				`{"content":"next","role":"user"}]`,
+		},
+		{
+			name:         "json mode",
+			req:          &provider.Request{Prompt: "list", JSON: true},
+			wantMessages: `[{"content":"list","role":"user"}]`,
+			wantFormat:   `{"type":"json_object"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, got := serve(t, chatAnswer)
+			resp, err := requestChat(tt.key, url, "m1", tt.req)
+			if err != nil {
+				t.Fatalf("requestChat error = %v", err)
+			}
+			if resp.Text != "hi" || resp.FinishReason != "stop" || resp.Usage == nil || resp.Usage.TotalTokens != 4 {
+				t.Errorf("response = %+v", resp)
+			}
+
+			if got.path != "/v1/chat/completions" {
+				t.Errorf("path = %q", got.path)
+			}
+			wantAuth := ""
+			if tt.key != "" {
+				wantAuth = "Bearer " + tt.key
+			}
+			if got.auth != wantAuth {
+				t.Errorf("Authorization = %q, want %q", got.auth, wantAuth)
+			}
+			if got.body["model"] != "m1" || got.body["temperature"] != tt.req.Temperature {
+				t.Errorf("model/temperature = %v/%v", got.body["model"], got.body["temperature"])
+			}
+			if messages := compact(got.body["messages"]); messages != tt.wantMessages {
+				t.Errorf("messages =\n%s\nwant\n%s", messages, tt.wantMessages)
+			}
+			format := ""
+			if f, ok := got.body["response_format"]; ok {
+				format = compact(f)
+			}
+			if format != tt.wantFormat {
+				t.Errorf("response_format = %s, want %s", format, tt.wantFormat)
+			}
+		})
+	}
+}
+
+func TestRequestChatErrors(t *testing.T) {
+	tests := []struct {
+		name, body, want string
+	}{
+		{"api error", `{"error":{"message":"model not loaded"}}`, "api error: model not loaded"},
+		{"no choices", `{"choices":[]}`, "пустой ответ"},
+		{"not json", `<html>`, "json parse error"},
+	}
+	for _, tt := range tests {
+		url, _ := serve(t, tt.body)
+		_, err := requestChat("", url, "m1", &provider.Request{Prompt: "x"})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestRequestChatStream(t *testing.T) {
+	url, got := serve(t, strings.Join([]string{
+		`data: {"choices":[{"delta":{"content":"Hel"}}]}`,
+		`data: {"choices":[{"delta":{"content":"lo"},"finish_reason":"length"}]}`,
+		`data: [DONE]`,
+	}, "\n\n")+"\n\n")
+
+	var deltas []string
+	req := &provider.Request{Prompt: "x", OnDelta: func(s string) { deltas = append(deltas, s) }}
+	resp, err := requestChat("", url, "m1", req)
+	if err != nil {
+		t.Fatalf("requestChat error = %v", err)
+	}
+	if got.body["stream"] != true {
+		t.Errorf("stream = %v, want true", got.body["stream"])
+	}
+	if resp.Text != "Hello" || resp.FinishReason != "length" || !reflect.DeepEqual(deltas, []string{"Hel", "lo"}) {
+		t.Errorf("response = %+v, deltas = %q", resp, deltas)
+	}
+}
+
+func TestRequestAudio(t *testing.T) {
+	var model, fileName, fileBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("ParseMultipartForm error = %v", err)
+		}
+		model = r.FormValue("model")
+		if f, h, err := r.FormFile("file"); err == nil {
+			data, _ := io.ReadAll(f)
+			fileName, fileBody = h.Filename, string(data)
+		}
+		_, _ = w.Write([]byte(`{"text":"  распознано \n"}`))
+	}))
+	defer srv.Close()
+
+	file := provider.FileData{Name: "v.mp3", MimeType: "audio/mpeg", Base64Content: "YXVkaW8="} // "audio"
+	text, err := requestAudio("", srv.URL, "whisper-1", file)
+	if err != nil {
+		t.Fatalf("requestAudio error = %v", err)
+	}
+	if text != "распознано" || model != "whisper-1" || fileName != "v.mp3" || fileBody != "audio" {
+		t.Errorf("text %q, model %q, file %q (%q)", text, model, fileName, fileBody)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ConfigFileName)
+
+	// Нет файла — создается с примерами эндпоинтов
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig error = %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("config file not created: %v", err)
+	}
+	if name, ep, err := cfg.endpoint(""); err != nil || name != DefaultEndpoint || ep.BaseURL == "" {
+		t.Errorf("endpoint(\"\") = %q, %+v, %v", name, ep, err)
+	}
+
+	data := `{"temperature":0.2,"default_endpoint":"local","endpoints":{"local":{"base_url":"http://h/v1","api_keys":["k"],"models":{"general":["m"]}}}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig error = %v", err)
+	}
+	name, ep, err := cfg.endpoint("")
+	if err != nil || name != "local" || ep.BaseURL != "http://h/v1" || cfg.Temperature != 0.2 {
+		t.Fatalf("endpoint(\"\") = %q, %+v, %v (temperature %v)", name, ep, err, cfg.Temperature)
+	}
+	if keys := ep.config().Keys(); !reflect.DeepEqual(keys, []string{"k"}) {
+		t.Errorf("keys = %q", keys)
+	}
+	if _, _, err := cfg.endpoint("missing"); err == nil || !strings.Contains(err.Error(), "local") {
+		t.Errorf("endpoint(missing) error = %v, want list of endpoints", err)
+	}
+}
+
+func compact(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -2,31 +2,21 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
-	"math/rand"
-	"mime"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
-	"unicode/utf8"
 
-	"golang.org/x/text/encoding/charmap"
+	"ClipGen-m/internal/provider"
 )
 
 // --- Константы ---
 
 const (
-	ConfigDirName  = "clipgen-m"
 	ConfigFileName = "pollinations.conf"
 	LogFileName    = "pollinations_err.log"
-	MaxLogSize     = 10 * 1024 * 1024 // 10 MB
 
 	DefaultBaseURL      = "https://gen.pollinations.ai/v1"
 	DefaultSystemPrompt = "Вы — ИИ-ассистент, интегрированный в инструмент ClipGen-m. Ваш вывод часто копируется в буфер обмена. Будьте лаконичны. Если это лог ошибки — объясните причину. Не используйте вводные фразы типа 'Вот ваш текст'. Пиши простой текст без маркдауна."
@@ -41,33 +31,39 @@ var DefaultModels = map[string][]string{
 	"audio":   {PrimaryModel},
 }
 
-// Глобальная переменная для управления подробным выводом в stderr
-var flagVerbose bool
-
-// --- Структуры данных ---
+// DefaultModeRules выбор режима для --mode auto
+// (mode_rules в конфиге, порядок важен).
+var DefaultModeRules = []provider.ModeRule{
+	{Name: "audio", Attachments: []string{"audio"}, Mode: "audio"},
+	{Name: "pdf", Attachments: []string{"pdf"}, Mode: "ocr"},
+	{Name: "images", Attachments: []string{"image"}, Mode: "vision"},
+	{Name: "default", Mode: "general"},
+}
 
-type Config struct {
-	ApiKeys                []string            `json:"api_keys"`
-	BaseURL                string              `json:"base_url"`
-	SystemPrompt           string              `json:"system_prompt"`
-	Temperature            float64             `json:"temperature"`
-	MaxTokens              int                 `json:"max_tokens"`
-	Models                 map[string][]string `json:"models"`
-	ChatHistoryMaxMessages int                 `json:"chat_history_max_messages"`
-	ChatHistoryMaxChars    int                 `json:"chat_history_max_chars"`
-	ImageCharCost          int                 `json:"image_char_cost"`
+var configDefaults = provider.Defaults{
+	BaseURL:      DefaultBaseURL,
+	SystemPrompt: DefaultSystemPrompt,
+	Temperature:  0.7,
+	MaxTokens:    8000,
+	Models:       DefaultModels,
+	ModeRules:    DefaultModeRules,
+	Backoff:      provider.Backoff{BaseDelay: provider.DefaultRetryBaseDelay, MaxDelay: provider.DefaultRetryMaxDelay},
 }
 
+// Перекодировка специфичных аудиоформатов в WAV перед отправкой
+var fileOptions = provider.FileOptions{Transcode: []string{".amr", ".opus", ".ogg"}}
+
+// --- Структуры данных ---
+
 type ChatRequest struct {
-	Model          string        `json:"model"`
-	Messages       []ChatMessage `json:"messages"`
-	Temperature    float64       `json:"temperature"`
-	MaxTokens      int           `json:"max_tokens,omitempty"`
-	Tools          []Tool        `json:"tools,omitempty"`
-	ToolChoice     string        `json:"tool_choice,omitempty"`
-	ResponseFormat *struct {
-		Type string `json:"type"`
-	} `json:"response_format,omitempty"`
+	Model          string                   `json:"model"`
+	Messages       []ChatMessage            `json:"messages"`
+	Temperature    float64                  `json:"temperature"`
+	MaxTokens      int                      `json:"max_tokens,omitempty"`
+	Tools          []provider.OpenAITool    `json:"tools,omitempty"`
+	ToolChoice     string                   `json:"tool_choice,omitempty"`
+	Stream         bool                     `json:"stream,omitempty"`
+	ResponseFormat *provider.ResponseFormat `json:"response_format,omitempty"`
 }
 
 type ChatMessage struct {
@@ -88,17 +84,6 @@ type ContentPart struct {
 	ImageUrl *ImageUrl `json:"image_url,omitempty"`
 }
 
-type Tool struct {
-	Type     string       `json:"type"`
-	Function ToolFunction `json:"function"`
-}
-
-type ToolFunction struct {
-	Name        string                 `json:"name"`
-	Description string                 `json:"description"`
-	Parameters  map[string]interface{} `json:"parameters"`
-}
-
 type ToolCall struct {
 	ID       string `json:"id"`
 	Type     string `json:"type"`
@@ -108,52 +93,28 @@ type ToolCall struct {
 	} `json:"function"`
 }
 
+type ChatChoice struct {
+	Message      ChatMessage `json:"message"`
+	FinishReason string      `json:"finish_reason"`
+}
+
 type ChatResponse struct {
-	Choices []struct {
-		Message ChatMessage `json:"message"`
-	} `json:"choices"`
-	Error *struct {
+	Choices []ChatChoice    `json:"choices"`
+	Usage   *provider.Usage `json:"usage,omitempty"`
+	Error   *struct {
 		Message string `json:"message"`
 	} `json:"error,omitempty"`
 }
 
-type ChatHistory struct {
-	ID       string               `json:"id"`
-	Messages []ChatMessageHistory `json:"messages"`
-}
-
-type ChatMessageHistory struct {
-	Role      string      `json:"role"`
-	Content   interface{} `json:"content"`
-	Size      int         `json:"size"`
-	Timestamp time.Time   `json:"timestamp"`
-}
-
-type FileData struct {
-	Name, MimeType, Base64Content string
-}
-
-type UnifiedFlags struct {
-	Files        []string
-	System       string
-	Json         bool
-	Mode         string
-	Temp         float64
-	Verbose      bool
-	SaveKey      string
-	AddTavilyKey string
-	ChatID       string
-	ClearChat    string
-	NoTools      bool
-}
-
 // --- Инструменты (Client-side Tools) ---
 
-func createTools() []Tool {
-	return []Tool{
+// builtinTools встроенные инструменты: калькулятор на Lua (в процессе,
+// в песочнице), веб-поиск (gemini-search с ключом запроса, при неудаче
+// Tavily) и чтение страниц fetch_url. К ним добавляются инструменты из tools.yaml.
+func builtinTools(apiKey string) []provider.Builtin {
+	return []provider.Builtin{
 		{
-			Type: "function",
-			Function: ToolFunction{
+			Spec: provider.ToolSpec{
 				Name:        "calculator",
 				Description: "Выполняет точные математические расчеты через Lua скрипты",
 				Parameters: map[string]interface{}{
@@ -164,10 +125,10 @@ func createTools() []Tool {
 					"required": []string{"expression"},
 				},
 			},
+			Run: provider.LuaTool,
 		},
 		{
-			Type: "function",
-			Function: ToolFunction{
+			Spec: provider.ToolSpec{
 				Name:        "tavily_search",
 				Description: "Поиск актуальной информации в интернете в режиме реального времени (новости, текущие события, факты, погода)",
 				Parameters: map[string]interface{}{
@@ -178,21 +139,35 @@ func createTools() []Tool {
 					"required": []string{"query"},
 				},
 			},
+			Run: func(args map[string]interface{}) (string, error) {
+				query, _ := args["query"].(string)
+				// Двухэтапный поиск: Pollinations Search (gemini-search) -> Tavily Fallback
+				res, err := executePollinationsSearch(apiKey, query)
+				if err == nil && res != "" {
+					return res, nil
+				}
+				logVerbose("Pollinations search failed, falling back to Tavily: %v", err)
+				return executeTavilySearch(query), nil
+			},
+		},
+		{
+			Spec: provider.ToolSpec{
+				Name:        "fetch_url",
+				Description: "Загружает веб-страницу по ссылке и возвращает ее основной текст (без скриптов, меню и подвалов). Для чтения конкретной страницы: ссылки пользователя или из результатов поиска",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"url":    map[string]interface{}{"type": "string", "description": "Адрес страницы http(s)"},
+						"format": map[string]interface{}{"type": "string", "enum": []string{provider.FetchMarkdown, provider.FetchText}, "description": "markdown (по умолчанию) или text"},
+					},
+					"required": []string{"url"},
+				},
+			},
+			Run: provider.FetchURLTool,
 		},
 	}
 }
 
-func executeCalculator(expression string) string {
-	logVerbose("Tool: Calculator -> %s", expression)
-	cmd := exec.Command("lua-executor.exe", expression)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	if err := cmd.Run(); err != nil {
-		return fmt.Sprintf("Error: %v", err)
-	}
-	return strings.TrimSpace(out.String())
-}
-
 // Новая функция для нативного поиска через модель gemini-search на Pollinations
 func executePollinationsSearch(apiKey, query string) (string, error) {
 	logVerbose("Tool: Pollinations Search (gemini-search) -> %s", query)
@@ -212,31 +187,9 @@ func executePollinationsSearch(apiKey, query string) (string, error) {
 		return "", err
 	}
 
-	hReq, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	respData, err := provider.DoHTTP(apiKey, url, "application/json", body, 60*time.Second)
 	if err != nil {
-		return "", err
-	}
-
-	hReq.Header.Set("Content-Type", "application/json")
-	if apiKey != "" {
-		hReq.Header.Set("Authorization", "Bearer "+apiKey)
-	}
-
-	client := &http.Client{Timeout: 60 * time.Second}
-	resp, err := client.Do(hReq)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("pollinations search failed with status %d", resp.StatusCode)
-	}
-
-	// Исправлено: чтение данных и обработка ошибки перед десериализацией JSON
-	respData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read search response: %v", err)
+		return "", fmt.Errorf("pollinations search failed: %v", err)
 	}
 
 	var cResp ChatResponse
@@ -253,19 +206,12 @@ func executePollinationsSearch(apiKey, query string) (string, error) {
 
 func executeTavilySearch(query string) string {
 	logVerbose("Tool: Tavily -> %s", query)
-	configDir, _ := os.UserConfigDir()
-	data, err := os.ReadFile(filepath.Join(configDir, ConfigDirName, "tavily.conf"))
+	keys, err := provider.LoadTavilyKeys()
 	if err != nil {
-		return "Error: tavily.conf not found"
-	}
-	var tCfg struct {
-		ApiKeys []string `json:"api_keys"`
-	}
-	if err := json.Unmarshal(data, &tCfg); err != nil || len(tCfg.ApiKeys) == 0 {
-		return "Error: invalid tavily.conf"
+		return "Error: " + err.Error()
 	}
 
-	apiKey := tCfg.ApiKeys[rand.Intn(len(tCfg.ApiKeys))]
+	apiKey := provider.RandomKey(keys, nil)
 	payload := map[string]interface{}{"api_key": apiKey, "query": query, "search_depth": "basic", "max_results": 3}
 	body, _ := json.Marshal(payload)
 	resp, err := http.Post("https://api.tavily.com/search", "application/json", bytes.NewBuffer(body))
@@ -296,139 +242,113 @@ func executeTavilySearch(query string) string {
 // --- Логика и Утилиты ---
 
 func logVerbose(f string, v ...interface{}) {
-	msg := fmt.Sprintf(f, v...)
-	if flagVerbose {
-		fmt.Fprintln(os.Stderr, "[PollinationsLLM]", msg)
-	}
-	configDir, _ := os.UserConfigDir()
-	path := filepath.Join(configDir, ConfigDirName, LogFileName)
-	if info, err := os.Stat(path); err == nil && info.Size() > MaxLogSize {
-		_ = os.Rename(path, path+".old")
-	}
-	file, _ := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if file != nil {
-		defer file.Close()
-		fmt.Fprintf(file, "[%s] %s\n", time.Now().Format("15:04:05"), msg)
-	}
+	provider.Logf(f, v...)
 }
 
 func fatal(f string, v ...interface{}) {
-	logVerbose("FATAL: "+f, v...)
-	fmt.Fprintf(os.Stderr, "ERROR: "+f+"\n", v...)
-	os.Exit(1)
+	provider.Fatalf(f, v...)
 }
 
-func printOutput(text string, isJson bool) {
-	text = strings.TrimSpace(text)
-	if isJson && strings.HasPrefix(text, "```") {
-		lines := strings.Split(text, "\n")
-		if len(lines) > 2 {
-			text = strings.Join(lines[1:len(lines)-1], "\n")
-		}
+// buildUserContent формирует контент сообщения пользователя: текст и файлы как image_url
+func buildUserContent(userPrompt string, files []provider.FileData) interface{} {
+	if len(files) == 0 {
+		return userPrompt
 	}
-	fmt.Println(strings.TrimSpace(text))
+	parts := []ContentPart{{Type: "text", Text: userPrompt}}
+	for _, f := range files {
+		parts = append(parts, ContentPart{
+			Type:     "image_url",
+			ImageUrl: &ImageUrl{Url: f.DataURL()},
+		})
+	}
+	return parts
 }
 
-// --- Управление Историей ---
-
-func calculateMessageSize(content interface{}, imageCharCost int) int {
-	size := 0
-	switch v := content.(type) {
-	case string:
-		size = len(v)
-	case []ContentPart:
-		for _, p := range v {
-			if p.Type == "text" {
-				size += len(p.Text)
-			}
-			if p.Type == "image_url" {
-				size += imageCharCost
-			}
+// --- Сетевой запрос с циклом Tool Calling ---
+
+// sendChat отправляет один запрос в chat/completions и возвращает ответ с первым вариантом.
+// Если задан onDelta, ответ читается потоком (SSE) и текст выводится по мере генерации.
+func sendChat(apiKey, url string, req ChatRequest, onDelta func(string)) (*ChatResponse, error) {
+	if onDelta != nil {
+		req.Stream = true
+		body, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		result, err := provider.StreamChat(apiKey, url, body, provider.DefaultHTTPTimeout, onDelta)
+		if err != nil {
+			return nil, err
+		}
+		msg := ChatMessage{Role: "assistant", Content: result.Text}
+		for _, tc := range result.ToolCalls {
+			call := ToolCall{ID: tc.ID, Type: "function"}
+			call.Function.Name = tc.Name
+			call.Function.Arguments = tc.Arguments
+			msg.ToolCalls = append(msg.ToolCalls, call)
 		}
+		return &ChatResponse{
+			Choices: []ChatChoice{{Message: msg, FinishReason: result.FinishReason}},
+			Usage:   result.Usage,
+		}, nil
 	}
-	return size
-}
-
-func getChatFilePath(id string) string {
-	dir, _ := os.UserConfigDir()
-	return filepath.Join(dir, ConfigDirName, "mistral_chats", id+".json")
-}
 
-func loadChatHistory(id string) (*ChatHistory, error) {
-	path := getChatFilePath(id)
-	data, err := os.ReadFile(path)
+	body, err := json.Marshal(req)
 	if err != nil {
-		return &ChatHistory{ID: id}, nil
+		return nil, err
 	}
-	var h ChatHistory
-	_ = json.Unmarshal(data, &h)
-	return &h, nil
-}
 
-func applyHistoryLimits(h *ChatHistory, maxMsg, maxChars int) {
-	if len(h.Messages) > maxMsg*2 {
-		h.Messages = h.Messages[len(h.Messages)-maxMsg*2:]
-	}
-	for {
-		total := 0
-		for _, m := range h.Messages {
-			total += m.Size
-		}
-		if total <= maxChars || len(h.Messages) == 0 {
-			break
-		}
-		h.Messages = h.Messages[1:]
+	rData, err := provider.DoHTTP(apiKey, url, "application/json", body, provider.DefaultHTTPTimeout)
+	if err != nil {
+		return nil, err
 	}
-}
 
-func updateAndSaveHistory(id string, h *ChatHistory, userCont interface{}, assistant string, cfg *Config) {
-	if strings.TrimSpace(assistant) == "" {
-		return
+	var cResp ChatResponse
+	if err := json.Unmarshal(rData, &cResp); err != nil {
+		return nil, err
+	}
+	if len(cResp.Choices) == 0 {
+		return nil, fmt.Errorf("empty response choices from API")
 	}
-	h.Messages = append(h.Messages, ChatMessageHistory{
-		Role: "user", Content: userCont, Timestamp: time.Now(),
-		Size: calculateMessageSize(userCont, cfg.ImageCharCost),
-	})
-	h.Messages = append(h.Messages, ChatMessageHistory{
-		Role: "assistant", Content: assistant, Timestamp: time.Now(), Size: len(assistant),
-	})
-	applyHistoryLimits(h, cfg.ChatHistoryMaxMessages, cfg.ChatHistoryMaxChars)
-	path := getChatFilePath(id)
-	_ = os.MkdirAll(filepath.Dir(path), 0755)
-	f, _ := os.Create(path)
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	_ = enc.Encode(h)
+	return &cResp, nil
 }
 
-// --- Сетевой запрос с циклом Tool Calling ---
-
-func requestPollinations(apiKey, baseURL, model, system string, userCont interface{}, temp float64, maxTokens int, isJson bool, history *ChatHistory, noTools bool) (string, error) {
+func requestPollinations(apiKey, baseURL, model, system string, userCont interface{}, temp float64, maxTokens int, format *provider.ResponseFormat, history *provider.ChatHistory, toolset *provider.Toolset, onDelta func(string)) (*provider.Response, error) {
 	url := strings.TrimSuffix(baseURL, "/") + "/chat/completions"
 
 	// Инициализация списка сообщений с системным промптом
 	var messages []ChatMessage
 	messages = append(messages, ChatMessage{Role: "system", Content: system})
 
-	// Добавление истории сообщений с проверкой на валидность контента ассистента
-	if history != nil {
-		for _, m := range history.Messages {
-			if m.Role == "assistant" {
-				if str, ok := m.Content.(string); ok && strings.TrimSpace(str) == "" {
-					continue
-				}
+	// Добавление истории сообщений с проверкой на валидность контента ассистента.
+	// С инструментами в нее входят прошлые вызовы и их результаты
+	for _, m := range history.Replay(toolset != nil) {
+		msg := ChatMessage{Role: m.Role, Content: m.Content, ToolCallID: m.ToolCallID, Name: m.Name}
+		for _, hc := range m.ToolCalls {
+			call := ToolCall{ID: hc.ID, Type: "function"}
+			call.Function.Name = hc.Name
+			call.Function.Arguments = hc.Arguments
+			msg.ToolCalls = append(msg.ToolCalls, call)
+		}
+		if m.Role == "assistant" && len(msg.ToolCalls) == 0 {
+			if str, ok := m.Content.(string); ok && strings.TrimSpace(str) == "" {
+				continue
 			}
-			messages = append(messages, ChatMessage{Role: m.Role, Content: m.Content})
 		}
+		messages = append(messages, msg)
 	}
 	messages = append(messages, ChatMessage{Role: "user", Content: userCont})
 
-	var tools []Tool
-	if !noTools {
-		tools = createTools()
+	var tools []provider.OpenAITool
+	if toolset != nil {
+		tools = toolset.OpenAI()
 	}
 
+	// Расход токенов и вызовы инструментов копятся по всем итерациям,
+	// вызовы с результатами — еще и для истории чата
+	var usage *provider.Usage
+	var calls []provider.ToolCall
+	var toolMessages []provider.ChatMessageHistory
+
 	// Цикл Tool Calling (макс 5 итераций), аналогично логике mistral.exe
 	for iter := 0; iter < 5; iter++ {
 		req := ChatRequest{
@@ -438,97 +358,56 @@ func requestPollinations(apiKey, baseURL, model, system string, userCont interfa
 			MaxTokens:   maxTokens,
 		}
 
-		// теги анонимной структуры должны точно совпадать с определением в ChatRequest
-		if isJson {
-			req.ResponseFormat = &struct {
-				Type string `json:"type"`
-			}{Type: "json_object"}
-		}
+		req.ResponseFormat = format
 
-		if !noTools {
+		if len(tools) > 0 {
 			req.Tools = tools
 			req.ToolChoice = "auto"
 		}
 
-		body, err := json.Marshal(req)
+		resp, err := sendChat(apiKey, url, req, onDelta)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-
-		hReq, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
-		if err != nil {
-			return "", err
-		}
-		hReq.Header.Set("Content-Type", "application/json")
-		if apiKey != "" {
-			hReq.Header.Set("Authorization", "Bearer "+apiKey)
-		}
-
-		client := &http.Client{Timeout: 300 * time.Second}
-		resp, err := client.Do(hReq)
-		if err != nil {
-			return "", err
-		}
-		defer resp.Body.Close()
-
-		// Чтение тела ответа с обработкой ошибки (исправление TooManyValues)
-		rData, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return "", fmt.Errorf("failed to read response: %v", err)
-		}
-
-		if resp.StatusCode != 200 {
-			return "", fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(rData))
-		}
-
-		var cResp ChatResponse
-		if err := json.Unmarshal(rData, &cResp); err != nil {
-			return "", err
-		}
-		if len(cResp.Choices) == 0 {
-			return "", fmt.Errorf("empty response choices from API")
-		}
-
-		msg := cResp.Choices[0].Message
+		usage = usage.Add(resp.Usage)
+		msg := resp.Choices[0].Message
 
 		// Если вызовов инструментов нет — возвращаем очищенный текст
 		if len(msg.ToolCalls) == 0 {
 			if msg.Content == nil {
-				return "", fmt.Errorf("API returned nil content")
+				return nil, fmt.Errorf("API returned nil content")
 			}
 			// Удаление мусора транскрибации Whisper
-			return removeDimaTorzok(fmt.Sprintf("%v", msg.Content)), nil
+			return &provider.Response{
+				Text:         removeDimaTorzok(provider.ContentText(msg.Content)),
+				FinishReason: resp.Choices[0].FinishReason,
+				Usage:        usage,
+				ToolCalls:    calls,
+				ToolMessages: toolMessages,
+			}, nil
 		}
 
 		// Добавляем сообщение ассистента с запросами инструментов в контекст
 		messages = append(messages, msg)
-
-		// Обработка вызовов инструментов через switch (рекомендация линтера QF1003)
+		assistant := provider.ChatMessageHistory{Role: "assistant", Content: ""}
+		if text, ok := msg.Content.(string); ok {
+			assistant.Content = text
+		}
 		for _, tc := range msg.ToolCalls {
-			var toolResult string
-			switch tc.Function.Name {
-			case "calculator":
-				var args struct {
-					Expression string `json:"expression"`
-				}
-				_ = json.Unmarshal([]byte(tc.Function.Arguments), &args)
-				toolResult = executeCalculator(args.Expression)
+			assistant.ToolCalls = append(assistant.ToolCalls, provider.HistoryToolCall{ID: tc.ID, Name: tc.Function.Name, Arguments: tc.Function.Arguments})
+		}
+		toolMessages = append(toolMessages, assistant)
 
-			case "tavily_search":
-				var args struct {
-					Query string `json:"query"`
-				}
-				_ = json.Unmarshal([]byte(tc.Function.Arguments), &args)
+		// Вызовы одного хода выполняются параллельно, результаты — в порядке вызовов
+		turn := make([]provider.ToolCall, len(msg.ToolCalls))
+		for i, tc := range msg.ToolCalls {
+			turn[i] = provider.ToolCall{Name: tc.Function.Name, Arguments: tc.Function.Arguments}
+		}
+		calls = append(calls, turn...)
+		results := toolset.CallAll(turn)
 
-				// Двухэтапный поиск: Pollinations Search (gemini-search) -> Tavily Fallback
-				res, err := executePollinationsSearch(apiKey, args.Query)
-				if err == nil && res != "" {
-					toolResult = res
-				} else {
-					logVerbose("Pollinations search failed, falling back to Tavily: %v", err)
-					toolResult = executeTavilySearch(args.Query)
-				}
-			}
+		for i, tc := range msg.ToolCalls {
+			toolResult := results[i]
 
 			// Добавляем результат работы инструмента в историю сообщений текущего запроса
 			messages = append(messages, ChatMessage{
@@ -537,77 +416,105 @@ func requestPollinations(apiKey, baseURL, model, system string, userCont interfa
 				Name:       tc.Function.Name,
 				Content:    toolResult,
 			})
+			toolMessages = append(toolMessages, provider.ChatMessageHistory{Role: "tool", Content: toolResult, ToolCallID: tc.ID, Name: tc.Function.Name})
 		}
 		// Переход к следующей итерации для получения финального ответа модели по результатам инструментов
 	}
 
-	return "", fmt.Errorf("exceeded maximum tool calling iterations (5)")
+	return nil, fmt.Errorf("exceeded maximum tool calling iterations (5)")
+}
+
+// pollinationsProvider реализует provider.Provider для Pollinations (OpenAI-совместимый API).
+// Все вложения уходят в chat/completions, поэтому отдельных OCR и транскрибации нет.
+type pollinationsProvider struct {
+	provider.Unsupported
+	baseURL    string
+	userTools  []provider.ToolSpec // инструменты из tools.yaml
+	toolRoots  []string            // папки файловых инструментов (tool_roots)
+	toolLimits provider.ToolLimits // tool_workers и tool_timeout_sec
+}
+
+func (p *pollinationsProvider) Name() string { return "pollinations" }
+
+func (p *pollinationsProvider) Chat(apiKey, model string, req *provider.Request) (*provider.Response, error) {
+	// Поиск gemini-search идет с ключом текущей попытки, поэтому набор
+	// инструментов собирается на каждый запрос
+	var toolset *provider.Toolset
+	if !req.NoTools {
+		toolset = provider.NewToolset(p.userTools, append(builtinTools(apiKey), provider.FileTools(p.toolRoots)...)...).WithLimits(p.toolLimits)
+	}
+	return requestPollinations(apiKey, p.baseURL, model, req.System, buildUserContent(req.Prompt, req.Files),
+		req.Temperature, req.MaxTokens, provider.JSONResponseFormat(req), req.History, toolset, req.OnDelta)
 }
 
 // --- Main ---
 
-// Функция полностью переписана для исправления ошибок компиляции и добавления логики Tavily/Chat
 func main() {
-	flags := parseArgs()
-	flagVerbose = flags.Verbose
+	flags := provider.ParseArgs(os.Args[1:])
+	provider.SetupLog("[PollinationsLLM]", LogFileName)
+	provider.Verbose = flags.Verbose
+
+	if flags.Help {
+		printHelp()
+		return
+	}
+
+	// Отчет по журналу расхода (общий для всех утилит)
+	if flags.UsageReport {
+		if err := provider.PrintUsageReport(flags.GroupBy, flags.OutputFormat); err != nil {
+			fatal("Ошибка построения отчета: %v", err)
+		}
+		return
+	}
 
 	// Добавлена обработка ключа Tavily, как в mistral.exe
-	if flags.AddTavilyKey != "" {
-		err := addTavilyKey(flags.AddTavilyKey)
-		if err != nil {
+	if flags.SaveTavilyKey != "" {
+		if err := provider.AddTavilyKey(flags.SaveTavilyKey); err != nil {
 			fatal("Ошибка добавления Tavily ключа: %v", err)
 		}
-		fmt.Printf("Tavily ключ добавлен в %s\n", getTavilyConfigPath())
+		fmt.Printf("Tavily ключ добавлен в %s\n", provider.TavilyConfigPath())
 		return
 	}
 
-	configPath, err := getConfigPath()
+	configPath, err := provider.ConfigPath(ConfigFileName)
 	if err != nil {
 		fatal("Path error: %v", err)
 	}
 
 	if flags.SaveKey != "" {
-		_ = addKeyToConfig(configPath, flags.SaveKey)
+		if err := provider.AddKeyToConfig(configPath, flags.SaveKey, configDefaults); err != nil {
+			fatal("Ошибка сохранения ключа: %v", err)
+		}
 		fmt.Println("Ключ сохранен.")
 		return
 	}
 	if flags.ClearChat != "" {
-		_ = os.Remove(getChatFilePath(flags.ClearChat))
+		_ = provider.ClearChatHistory(flags.ClearChat)
 		fmt.Printf("История чата %s очищена.\n", flags.ClearChat)
 		return
 	}
 
-	cfg, err := loadConfig(configPath)
+	cfg, err := provider.LoadConfig(configPath, configDefaults)
 	if err != nil {
 		fatal("Config error: %v", err)
 	}
 
-	userPrompt := readStdin()
+	userPrompt := provider.ReadStdin()
 	// Проверка на команду очистки внутри чата
 	if flags.ChatID != "" && strings.TrimSpace(userPrompt) == "/clear" {
-		_ = os.Remove(getChatFilePath(flags.ChatID))
+		_ = provider.ClearChatHistory(flags.ChatID)
 		fmt.Println("История очищена.")
 		return
 	}
 
-	files, hasImg, hasAudio, hasPdf := processFiles(flags.Files)
+	files, _ := provider.ProcessFiles(flags.Files, fileOptions)
 	if userPrompt == "" && len(files) == 0 {
 		printHelp()
 		return
 	}
 
-	mode := flags.Mode
-	if mode == "auto" {
-		if hasAudio {
-			mode = "audio"
-		} else if hasPdf {
-			mode = "ocr"
-		} else if hasImg {
-			mode = "vision"
-		} else {
-			mode = "general"
-		}
-	}
+	decision := cfg.ResolveMode(flags, userPrompt, files)
+	mode := decision.Mode
 
 	// Дефолтные промпты для файлов без текста
 	if userPrompt == "" {
@@ -621,28 +528,6 @@ func main() {
 		}
 	}
 
-	modelName := PrimaryModel
-	if list, ok := cfg.Models[mode]; ok && len(list) > 0 {
-		modelName = list[0]
-	}
-
-	// Исправлено формирование контента: теперь используются ранее объявленные ContentPart и ImageUrl
-	var currentUserContent interface{}
-	if len(files) == 0 {
-		currentUserContent = userPrompt
-	} else {
-		parts := []ContentPart{{Type: "text", Text: userPrompt}}
-		for _, f := range files {
-			parts = append(parts, ContentPart{
-				Type: "image_url",
-				ImageUrl: &ImageUrl{
-					Url: fmt.Sprintf("data:%s;base64,%s", f.MimeType, f.Base64Content),
-				},
-			})
-		}
-		currentUserContent = parts
-	}
-
 	finalSys := cfg.SystemPrompt
 	if flags.System != "" {
 		finalSys = flags.System
@@ -652,135 +537,86 @@ func main() {
 		finalTemp = flags.Temp
 	}
 
-	var history *ChatHistory
-	if flags.ChatID != "" {
-		history, _ = loadChatHistory(flags.ChatID)
+	schema, err := provider.LoadSchema(flags.Schema)
+	if err != nil {
+		fatal("Ошибка чтения --schema: %v", err)
 	}
 
-	// Ротация ключей Pollinations
-	keys := make([]string, 0)
-	for _, k := range cfg.ApiKeys {
-		if strings.TrimSpace(k) != "" {
-			keys = append(keys, k)
-		}
+	req := &provider.Request{
+		Mode:        mode,
+		System:      finalSys,
+		Prompt:      userPrompt,
+		Files:       files,
+		Temperature: finalTemp,
+		MaxTokens:   cfg.MaxTokens,
+		JSON:        flags.Json,
+		Schema:      schema,
+		NoTools:     flags.NoTools,
 	}
-
-	if len(keys) == 0 {
-		// Pollinations может работать без ключа, но мы следуем логике конфига
-		keys = []string{""}
+	if flags.ChatID != "" {
+		req.History, _ = provider.LoadChatHistory(flags.ChatID)
 	}
 
-	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	// Потоковый вывод: текст печатается по мере генерации
+	var printer provider.StreamPrinter
+	if flags.Stream {
+		req.OnDelta = printer.Write
+	}
 
-	var lastErr error
-	for _, key := range keys {
-		suffix := "none"
-		if len(key) > 4 {
-			suffix = "..." + key[len(key)-4:]
-		}
-		logVerbose("Запрос: модель=%s, режим=%s, ключ=%s", modelName, mode, suffix)
+	// Pollinations может работать без ключа
+	keys := cfg.Keys()
 
-		res, err := requestPollinations(key, cfg.BaseURL, modelName, finalSys, currentUserContent, finalTemp, cfg.MaxTokens, flags.Json, history, flags.NoTools)
-		if err == nil {
-			if flags.ChatID != "" {
-				updateAndSaveHistory(flags.ChatID, history, currentUserContent, res, cfg)
-			}
-			printOutput(res, flags.Json)
-			return
+	if flags.ResetKeys {
+		if err := provider.ResetKeyState("pollinations"); err != nil {
+			fatal("Ошибка сброса состояния ключей: %v", err)
 		}
-		lastErr = err
-		// Если ошибка 401 или 429 — пробуем следующий ключ
-		if strings.Contains(err.Error(), "401") || strings.Contains(err.Error(), "429") {
-			continue
+		fmt.Println("Состояние ключей сброшено")
+		return
+	}
+	if flags.KeyStatus {
+		if err := provider.PrintKeyStatus("pollinations", keys); err != nil {
+			fatal("Ошибка чтения состояния ключей: %v", err)
 		}
-		break
+		return
 	}
-	fatal("Ошибка: %v", lastErr)
-}
-
-// --- Остальные утилиты ---
 
-// Унифицированный парсер аргументов, поддерживающий -flag и --flag (как в geminillm)
-func parseArgs() *UnifiedFlags {
-	flags := &UnifiedFlags{
-		Mode: "auto",
-		Temp: -1.0,
+	if len(keys) == 0 {
+		keys = []string{""}
 	}
 
-	args := os.Args[1:]
-	for i := 0; i < len(args); i++ {
-		arg := args[i]
-
-		// Обработка --flag и -flag
-		isLong := strings.HasPrefix(arg, "--")
-		isShort := !isLong && strings.HasPrefix(arg, "-")
-
-		if !isLong && !isShort {
-			continue
+	// Инструменты из tools.yaml (встроенные добавляются на каждый запрос)
+	var userTools []provider.ToolSpec
+	if !flags.NoTools {
+		userTools, err = provider.LoadTools()
+		if err != nil {
+			fatal("Ошибка чтения %s: %v", provider.ToolsFileName, err)
 		}
+	}
 
-		key := strings.TrimPrefix(arg, "--")
-		if isShort {
-			key = strings.TrimPrefix(arg, "-")
-		}
+	runner := provider.Runner{
+		Provider:         &pollinationsProvider{baseURL: cfg.BaseURL, userTools: userTools, toolRoots: cfg.ToolRoots, toolLimits: cfg.ToolLimits()},
+		Keys:             keys,
+		Models:           cfg.ModelsFor(decision),
+		Backoff:          cfg.Backoff(),
+		MaxContinuations: cfg.MaxContinuations,
+		Chunking:         cfg.Chunking(flags),
+	}
 
-		switch key {
-		case "h", "help", "?":
-			printHelp()
-			os.Exit(0)
-		case "f", "file":
-			i++
-			if i < len(args) {
-				flags.Files = append(flags.Files, args[i])
-			}
-		case "s", "system", "system-prompt":
-			i++
-			if i < len(args) {
-				flags.System = args[i]
-			}
-		case "j", "json":
-			flags.Json = true
-		case "m", "mode":
-			i++
-			if i < len(args) {
-				flags.Mode = args[i]
-			}
-		case "t", "temp", "temperature":
-			i++
-			if i < len(args) {
-				if val, err := strconv.ParseFloat(args[i], 64); err == nil {
-					flags.Temp = val
-				}
-			}
-		case "v", "verbose":
-			flags.Verbose = true
-		case "save-key":
-			i++
-			if i < len(args) {
-				flags.SaveKey = args[i]
-			}
-		case "add-tavily-key":
-			i++
-			if i < len(args) {
-				flags.AddTavilyKey = args[i]
-			}
-		case "chat", "chat-id":
-			i++
-			if i < len(args) {
-				flags.ChatID = args[i]
-			}
-		case "clear-chat":
-			i++
-			if i < len(args) {
-				flags.ClearChat = args[i]
-			}
-		case "no-tools":
-			flags.NoTools = true
+	res, err := runner.Run(req)
+	if err != nil {
+		fatal("Ошибка: %v", err)
+	}
+
+	if req.History != nil && strings.TrimSpace(res.Text) != "" {
+		if err := provider.SaveToolExchange(req.History, buildUserContent(userPrompt, files), res.ToolMessages, res.Text, cfg.HistoryLimits()); err != nil {
+			logVerbose("Ошибка сохранения истории чата: %v", err)
 		}
 	}
-	return flags
+	printer.Finish(res, flags)
 }
 
+// --- Остальные утилиты ---
+
 func printHelp() {
 	fmt.Printf("Pollinations CLI Utility (plnllm) v0.19\n\n")
 	fmt.Printf("Использование:\n")
@@ -792,259 +628,23 @@ func printHelp() {
 	fmt.Printf("  -m, --mode <режим>         Режим: auto (default), general, code, vision, audio, ocr\n")
 	fmt.Printf("  -j, --json                 Форсировать ответ в формате JSON\n")
 	fmt.Printf("  -t, --temp <число>         Температура генерации (0.0 - 2.0)\n")
-	fmt.Printf("  -v, --verbose              Подробный вывод в stderr и лог\n\n")
+	fmt.Printf("  -v, --verbose              Подробный вывод в stderr и лог\n")
+	fmt.Printf("  --stream                   Выводить ответ по мере генерации\n")
+	fmt.Printf("  --schema <file.json>       Ответ по JSON Schema (включает -j), при несоответствии повтор\n")
+	fmt.Printf("  --explain-mode             Показать в stderr, какое правило mode_rules выбрало режим\n")
+	fmt.Printf("  --chunk-size <n>           Части больших текстовых файлов в символах (по умолчанию chunk_size)\n")
+	fmt.Printf("  --strategy <name>          Обработка частей: map-reduce (по умолчанию) или refine\n")
+	fmt.Printf("  --output-format json       Ответ с метаданными (модель, токены, попытки) в JSON\n")
+	fmt.Printf("  --usage-report             Отчет о расходе токенов (--group-by, --output-format csv|json)\n\n")
 	fmt.Printf("Управление чатом:\n")
 	fmt.Printf("  -chat, --chat-id <id>      Идентификатор чата для сохранения истории\n")
 	fmt.Printf("  --clear-chat <id>          Очистить историю указанного чата\n\n")
 	fmt.Printf("Инструменты и ключи:\n")
 	fmt.Printf("  --no-tools                 Отключить вызов инструментов (Calculator/Search)\n")
 	fmt.Printf("  --save-key <ключ>          Сохранить API ключ Pollinations в конфиг\n")
-	fmt.Printf("  --add-tavily-key <ключ>    Добавить API ключ Tavily для поиска\n")
-}
-
-// Функция обновлена для поддержки миграций, лимитов истории и автоматического заполнения полей
-func loadConfig(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
-	var cfg Config
-
-	if err != nil {
-		// Если файла нет, создаем дефолтный конфиг
-		cfg = Config{
-			BaseURL:                DefaultBaseURL,
-			SystemPrompt:           DefaultSystemPrompt,
-			Temperature:            0.7,
-			MaxTokens:              8000,
-			Models:                 DefaultModels,
-			ChatHistoryMaxMessages: 30,
-			ChatHistoryMaxChars:    50000,
-			ImageCharCost:          2000,
-			ApiKeys:                []string{""},
-		}
-		_ = saveConfig(path, &cfg)
-		return &cfg, nil
-	}
-
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("ошибка парсинга конфигурации: %v", err)
-	}
-
-	// Валидация и заполнение отсутствующих полей
-	dirty := false
-
-	if cfg.BaseURL == "" {
-		cfg.BaseURL = DefaultBaseURL
-		dirty = true
-	}
-	if cfg.SystemPrompt == "" {
-		cfg.SystemPrompt = DefaultSystemPrompt
-		dirty = true
-	}
-	if cfg.MaxTokens == 0 {
-		cfg.MaxTokens = 8000
-		dirty = true
-	}
-	if cfg.ChatHistoryMaxMessages == 0 {
-		cfg.ChatHistoryMaxMessages = 30
-		dirty = true
-	}
-	if cfg.ChatHistoryMaxChars == 0 {
-		cfg.ChatHistoryMaxChars = 50000
-		dirty = true
-	}
-	if cfg.ImageCharCost == 0 {
-		cfg.ImageCharCost = 2000
-		dirty = true
-	}
-
-	if cfg.Models == nil {
-		cfg.Models = make(map[string][]string)
-		dirty = true
-	}
-
-	// Проверяем каждую категорию моделей
-	for k, v := range DefaultModels {
-		if list, exists := cfg.Models[k]; !exists || len(list) == 0 {
-			cfg.Models[k] = v
-			dirty = true
-		}
-	}
-
-	// Если мы обновили структуру, сохраним её
-	if dirty && len(cfg.ApiKeys) > 0 {
-		_ = saveConfig(path, &cfg)
-	}
-
-	return &cfg, nil
-}
-
-func saveConfig(path string, cfg *Config) error {
-	f, _ := os.Create(path)
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	return enc.Encode(cfg)
-}
-
-func addKeyToConfig(path, key string) error {
-	cfg, _ := loadConfig(path)
-	newK := []string{}
-	for _, k := range cfg.ApiKeys {
-		if strings.TrimSpace(k) != "" && k != key {
-			newK = append(newK, k)
-		}
-	}
-	cfg.ApiKeys = append(newK, key)
-	return saveConfig(path, cfg)
-}
-
-func readStdin() string {
-	stat, _ := os.Stdin.Stat()
-	if (stat.Mode() & os.ModeCharDevice) != 0 {
-		return ""
-	}
-	b, _ := io.ReadAll(os.Stdin)
-	if utf8.Valid(b) {
-		return strings.TrimSpace(string(b))
-	}
-	dec, _ := charmap.CodePage866.NewDecoder().Bytes(b)
-	return strings.TrimSpace(string(dec))
-}
-
-// Функция обновлена для поддержки транскрибации и перекодировки сложных форматов (AMR и др.)
-func processFiles(paths []string) (res []FileData, hasImg, hasAudio, hasPdf bool) {
-	for _, p := range paths {
-		data, err := os.ReadFile(p)
-		if err != nil {
-			continue
-		}
-
-		ext := strings.ToLower(filepath.Ext(p))
-		mt := mime.TypeByExtension(ext)
-
-		// Авто-определение и перекодировка специфичных форматов
-		if ext == ".amr" || ext == ".opus" || ext == ".ogg" {
-			if transcoded, err := transcodeAudioWithFFmpeg(p); err == nil {
-				data = transcoded
-				mt = "audio/wav"
-			}
-		}
-
-		if mt == "" || mt == "application/octet-stream" {
-			switch ext {
-			case ".mp3":
-				mt = "audio/mpeg"
-			case ".wav":
-				mt = "audio/wav"
-			case ".pdf":
-				mt = "application/pdf"
-			default:
-				if utf8.Valid(data) {
-					mt = "text/plain"
-				}
-			}
-		}
-
-		if strings.HasPrefix(mt, "image/") {
-			hasImg = true
-		}
-		if strings.HasPrefix(mt, "audio/") {
-			hasAudio = true
-		}
-		if mt == "application/pdf" {
-			hasPdf = true
-		}
-
-		res = append(res, FileData{
-			Name:          filepath.Base(p),
-			MimeType:      mt,
-			Base64Content: base64.StdEncoding.EncodeToString(data),
-		})
-	}
-	return
-}
-
-// Базовая функция для получения пути к папке данных приложения в AppData
-func getAppDataDir() (string, error) {
-	configDir, err := os.UserConfigDir()
-	if err != nil {
-		return "", err
-	}
-	path := filepath.Join(configDir, ConfigDirName)
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		_ = os.MkdirAll(path, 0755)
-	}
-	return path, nil
-}
-
-// Добавлены функции путей для устранения ошибок компиляции и унификации с mistral
-// getConfigPath возвращает путь к основному файлу конфигурации pollinations.conf
-func getConfigPath() (string, error) {
-	dir, err := getAppDataDir()
-	if err != nil {
-		return "", err
-	}
-	return filepath.Join(dir, ConfigFileName), nil
-}
-
-// getLogFilePath возвращает путь к файлу логов для функции appendLog
-func getLogFilePath() string {
-	dir, err := getAppDataDir()
-	if err != nil {
-		return ""
-	}
-	return filepath.Join(dir, LogFileName)
-}
-
-// Добавлены функции управления ключами Tavily для работы инструментов поиска
-// getTavilyConfigPath возвращает путь к общему конфигу Tavily
-func getTavilyConfigPath() string {
-	configDir, err := os.UserConfigDir()
-	if err != nil {
-		return ""
-	}
-	return filepath.Join(configDir, "clipgen-m", "tavily.conf")
-}
-
-// addTavilyKey добавляет новый API ключ Tavily в конфигурацию, создавая файл при необходимости
-func addTavilyKey(newKey string) error {
-	configPath := getTavilyConfigPath()
-
-	configDir := filepath.Dir(configPath)
-	if _, err := os.Stat(configDir); os.IsNotExist(err) {
-		_ = os.MkdirAll(configDir, 0755)
-	}
-
-	var config struct {
-		ApiKeys []string `json:"api_keys"`
-	}
-
-	if _, err := os.Stat(configPath); !os.IsNotExist(err) {
-		data, err := os.ReadFile(configPath)
-		if err != nil {
-			return err
-		}
-		if err := json.Unmarshal(data, &config); err != nil {
-			return err
-		}
-	}
-
-	for _, existingKey := range config.ApiKeys {
-		if existingKey == newKey {
-			return fmt.Errorf("ключ уже существует в конфигурации")
-		}
-	}
-
-	config.ApiKeys = append(config.ApiKeys, newKey)
-
-	file, err := os.Create(configPath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(config)
+	fmt.Printf("  --save-tavily-key <ключ>   Добавить API ключ Tavily для поиска\n")
+	fmt.Printf("  --key-status               Показать состояние ключей (баны, лимиты)\n")
+	fmt.Printf("  --reset-keys               Сбросить сохраненное состояние ключей\n")
 }
 
 // Добавлена очистка галлюцинаций Whisper, как в groqllm
@@ -1061,21 +661,3 @@ func removeDimaTorzok(text string) string {
 	}
 	return strings.TrimSpace(text)
 }
-
-// Добавлена перекодировка аудио через ffmpeg для поддержки всех форматов, как в geminillm
-func transcodeAudioWithFFmpeg(inputPath string) ([]byte, error) {
-	tempOutput, err := os.CreateTemp("", "transcoded_*.wav")
-	if err != nil {
-		return nil, err
-	}
-	tempPath := tempOutput.Name()
-	tempOutput.Close()
-	defer os.Remove(tempPath)
-
-	// Стандартные параметры для ИИ: 16kHz, моно, 64k
-	cmd := exec.Command("ffmpeg", "-i", inputPath, "-ar", "16000", "-ac", "1", "-b:a", "64k", "-y", tempPath)
-	if err := cmd.Run(); err != nil {
-		return nil, err
-	}
-	return os.ReadFile(tempPath)
-}
@@ -6,9 +6,11 @@ require (
 	github.com/getlantern/systray v1.2.2
 	github.com/micmonay/keybd_event v1.1.2
 	github.com/ncruces/zenity v0.10.14
+	github.com/yuin/gopher-lua v1.1.1
 	golang.design/x/clipboard v0.7.1
 	golang.design/x/hotkey v0.4.1
 	golang.org/x/image v0.34.0
+	golang.org/x/net v0.47.0
 	golang.org/x/text v0.32.0
 	gopkg.in/yaml.v3 v3.0.1
 )
@@ -28,5 +30,5 @@ require (
 	github.com/randall77/makefat v0.0.0-20210315173500-7ddd0e42c844 // indirect
 	golang.org/x/exp/shiny v0.0.0-20250606033433-dcc06ee1d476 // indirect
 	golang.org/x/mobile v0.0.0-20250606033058-a2a15c67f36f // indirect
-	golang.org/x/sys v0.33.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
 )
@@ -0,0 +1,53 @@
+package provider
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Значения повторов по умолчанию (если провайдер не задал свои)
+const (
+	DefaultRetryBaseDelay = 1 * time.Second
+	DefaultRetryMaxDelay  = 30 * time.Second
+)
+
+// Backoff политика пауз между попытками после 429/5xx.
+type Backoff struct {
+	// MaxAttempts сколько всего запросов может сделать Runner (0 — без ограничения).
+	MaxAttempts int
+	// BaseDelay пауза перед первым повтором, дальше удваивается (0 — без пауз).
+	BaseDelay time.Duration
+	// MaxDelay потолок паузы, в том числе для Retry-After от сервера.
+	MaxDelay time.Duration
+}
+
+// Delay возвращает паузу перед повтором номер retry (с нуля):
+// экспонента с полным джиттером, но не меньше, чем просит сервер (hint).
+func (b Backoff) Delay(retry int, hint time.Duration) time.Duration {
+	if b.BaseDelay <= 0 {
+		return 0
+	}
+	maxDelay := b.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultRetryMaxDelay
+	}
+
+	ceiling := b.BaseDelay
+	for i := 0; i < retry && ceiling < maxDelay; i++ {
+		ceiling *= 2
+	}
+	if ceiling > maxDelay {
+		ceiling = maxDelay
+	}
+
+	// Половина фиксирована, половина случайна: паузы не схлопываются в ноль,
+	// а параллельные запуски не стучатся в API одновременно
+	delay := ceiling/2 + time.Duration(rand.Int63n(int64(ceiling/2)+1))
+	if hint > delay {
+		delay = hint
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
@@ -0,0 +1,88 @@
+package provider
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{BaseDelay: time.Second, MaxDelay: 8 * time.Second}
+
+	tests := []struct {
+		name     string
+		backoff  Backoff
+		retry    int
+		hint     time.Duration
+		min, max time.Duration
+	}{
+		{"first retry", b, 0, 0, 500 * time.Millisecond, time.Second},
+		{"exponent", b, 2, 0, 2 * time.Second, 4 * time.Second},
+		{"ceiling", b, 10, 0, 4 * time.Second, 8 * time.Second},
+		{"retry-after wins", b, 0, 5 * time.Second, 5 * time.Second, 5 * time.Second},
+		{"retry-after capped", b, 0, time.Minute, 8 * time.Second, 8 * time.Second},
+		{"short hint ignored", b, 3, time.Millisecond, 4 * time.Second, 8 * time.Second},
+		{"disabled", Backoff{}, 3, 5 * time.Second, 0, 0},
+		{"default ceiling", Backoff{BaseDelay: time.Second}, 0, time.Hour, DefaultRetryMaxDelay, DefaultRetryMaxDelay},
+	}
+	for _, tt := range tests {
+		// Половина паузы случайна — проверяем границы несколько раз
+		for i := 0; i < 20; i++ {
+			got := tt.backoff.Delay(tt.retry, tt.hint)
+			if got < tt.min || got > tt.max {
+				t.Errorf("%s: Delay(%d, %v) = %v, want in [%v, %v]", tt.name, tt.retry, tt.hint, got, tt.min, tt.max)
+				break
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   time.Duration
+	}{
+		{"none", nil, 0},
+		{"seconds", map[string]string{"Retry-After": "7"}, 7 * time.Second},
+		{"fractional seconds", map[string]string{"Retry-After": "1.5"}, 1500 * time.Millisecond},
+		{"http date", map[string]string{"Retry-After": now.Add(30 * time.Second).Format(http.TimeFormat)}, 30 * time.Second},
+		{"date in the past", map[string]string{"Retry-After": now.Add(-time.Minute).Format(http.TimeFormat)}, 0},
+		{"groq durations, longest wins", map[string]string{
+			"X-Ratelimit-Reset-Requests": "2.5s",
+			"X-Ratelimit-Reset-Tokens":   "1m2s",
+		}, 62 * time.Second},
+		{"unix reset time", map[string]string{"X-Ratelimit-Reset": "1767366305"}, 60 * time.Second},
+		{"garbage", map[string]string{"Retry-After": "soon", "X-Ratelimit-Reset": "later"}, 0},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		for k, v := range tt.header {
+			h.Set(k, v)
+		}
+		if got := parseRetryAfter(h, now); got != tt.want {
+			t.Errorf("%s: parseRetryAfter = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfterOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want time.Duration
+	}{
+		{"http error", &HTTPError{StatusCode: 429, RetryAfter: 3 * time.Second}, 3 * time.Second},
+		{"gemini retryDelay", errors.New(`API Error: {"retryDelay": "36s"}`), 36 * time.Second},
+		{"groq text", errors.New("Rate limit reached. Please try again in 7.66s."), 7660 * time.Millisecond},
+		{"nothing", errors.New("connection reset"), 0},
+	}
+	for _, tt := range tests {
+		if got := RetryAfterOf(tt.err); got != tt.want {
+			t.Errorf("%s: RetryAfterOf = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
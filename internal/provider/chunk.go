@@ -0,0 +1,311 @@
+package provider
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Обработка текстовых вложений, которые не помещаются в контекст модели:
+// текст режется на части, каждая отправляется с промптом пользователя,
+// ответы по частям сводятся в один.
+
+// DefaultChunkSize размер части в символах (chunk_size в *.conf), если
+// для модели не задан context_budgets.
+const DefaultChunkSize = 60000
+
+// ChunkWorkers сколько частей map-шага обрабатывается одновременно.
+const ChunkWorkers = 4
+
+// Стратегии обработки частей (--strategy).
+const (
+	StrategyMapReduce = "map-reduce" // части параллельно, затем сведение ответов
+	StrategyRefine    = "refine"     // части по очереди, ответ уточняется с каждой
+)
+
+// Chunking настройки разбиения для Runner. Size 0 — не разбивать.
+type Chunking struct {
+	Size     int
+	Budgets  map[string]int // размер части для отдельных моделей (context_budgets)
+	Strategy string
+}
+
+// Chunking настройки разбиения из флагов и конфига: --chunk-size важнее
+// context_budgets и chunk_size. Неизвестная стратегия фатальна.
+func (c *Config) Chunking(flags *Flags) Chunking {
+	strategy := flags.Strategy
+	if strategy == "" {
+		strategy = StrategyMapReduce
+	}
+	if strategy != StrategyMapReduce && strategy != StrategyRefine {
+		Fatalf("Неизвестная стратегия --strategy %s (допустимы: %s, %s)", strategy, StrategyMapReduce, StrategyRefine)
+	}
+	if flags.ChunkSize > 0 {
+		return Chunking{Size: flags.ChunkSize, Strategy: strategy}
+	}
+	return Chunking{Size: c.ChunkSize, Budgets: c.ContextBudgets, Strategy: strategy}
+}
+
+// sizeFor размер части для списка моделей: бюджет первой (приоритетной)
+// модели, иначе общий Size. Разбиение делается до перебора моделей.
+func (c Chunking) sizeFor(models []string) int {
+	if len(models) > 0 {
+		if budget, ok := c.Budgets[models[0]]; ok {
+			return budget
+		}
+	}
+	return c.Size
+}
+
+// textAttachments разделяет файлы на текстовые (они режутся на части)
+// и остальные и считает объем текста в символах.
+func textAttachments(files []FileData) (texts, other []FileData, chars int) {
+	for _, f := range files {
+		if f.IsText() {
+			texts = append(texts, f)
+			chars += utf8.RuneCount(f.Bytes())
+		} else {
+			other = append(other, f)
+		}
+	}
+	return texts, other, chars
+}
+
+// needChunking true, если текстовые вложения больше размера части.
+func (r *Runner) needChunking(req *Request) bool {
+	size := r.Chunking.sizeFor(r.Models)
+	if size <= 0 || len(req.Files) == 0 {
+		return false
+	}
+	_, _, chars := textAttachments(req.Files)
+	return chars > size
+}
+
+// SplitText режет текст на части не длиннее size символов. Граница
+// переносится на конец строки, если он есть во второй половине части.
+func SplitText(text string, size int) []string {
+	if size <= 0 {
+		return []string{text}
+	}
+	var chunks []string
+	for utf8.RuneCountInString(text) > size {
+		// Байтовая позиция size-го символа
+		cut := len(text)
+		n := 0
+		for i := range text {
+			if n == size {
+				cut = i
+				break
+			}
+			n++
+		}
+		if nl := strings.LastIndexByte(text[:cut], '\n'); nl >= cut/2 {
+			cut = nl + 1
+		}
+		chunks = append(chunks, text[:cut])
+		text = text[cut:]
+	}
+	if text != "" {
+		chunks = append(chunks, text)
+	}
+	return chunks
+}
+
+// splitAttachments склеивает текстовые файлы (с заголовками имен) и режет
+// результат на части-вложения.
+func splitAttachments(texts []FileData, size int) []FileData {
+	var sb strings.Builder
+	for _, f := range texts {
+		fmt.Fprintf(&sb, "--- %s ---\n", f.Name)
+		sb.Write(f.Bytes())
+		sb.WriteString("\n")
+	}
+
+	parts := SplitText(sb.String(), size)
+	files := make([]FileData, len(parts))
+	for i, part := range parts {
+		files[i] = FileData{
+			Name:          fmt.Sprintf("part-%d-of-%d.txt", i+1, len(parts)),
+			MimeType:      "text/plain",
+			Base64Content: base64.StdEncoding.EncodeToString([]byte(part)),
+		}
+	}
+	return files
+}
+
+// chunkRequest запрос по одной части: без истории, потока, схемы
+// и инструментов — это промежуточный шаг.
+func chunkRequest(req *Request, prompt string, files []FileData) *Request {
+	part := *req
+	part.Prompt = prompt
+	part.Files = files
+	part.History = nil
+	part.OnDelta = nil
+	part.JSON = false
+	part.Schema = nil
+	part.NoTools = true
+	return &part
+}
+
+// finalRequest запрос последнего шага: ответ пользователю, поэтому
+// с историей, потоком, схемой и нетекстовыми вложениями исходного запроса.
+func finalRequest(req *Request, prompt string, files []FileData) *Request {
+	final := *req
+	final.Prompt = prompt
+	final.Files = files
+	return &final
+}
+
+// runChunked обрабатывает запрос с текстом больше размера части
+// по стратегии Chunking.Strategy. Каждый шаг — отдельный Run со своими
+// попытками и записью в журнал расхода.
+func (r *Runner) runChunked(req *Request) (*Response, error) {
+	size := r.Chunking.sizeFor(r.Models)
+	texts, other, chars := textAttachments(req.Files)
+	parts := splitAttachments(texts, size)
+	Logf("Текст вложений (%d символов) больше части (%d): %d частей, стратегия %s",
+		chars, size, len(parts), r.Chunking.Strategy)
+
+	start := time.Now()
+	var resp *Response
+	var err error
+	if r.Chunking.Strategy == StrategyRefine {
+		resp, err = r.runRefine(req, parts, other)
+	} else {
+		resp, err = r.runMapReduce(req, parts, other)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Latency = time.Since(start)
+	return resp, nil
+}
+
+// step выполняет один шаг отдельным Runner без разбиения (Run не
+// потокобезопасен, поэтому у каждой части своя копия).
+func (r *Runner) step(req *Request) (*Response, error) {
+	sub := Runner{
+		Provider:         r.Provider,
+		Keys:             r.Keys,
+		Models:           r.Models,
+		KeyMajor:         r.KeyMajor,
+		MaxFailedKeys:    r.MaxFailedKeys,
+		Backoff:          r.Backoff,
+		MaxContinuations: r.MaxContinuations,
+	}
+	return sub.Run(req)
+}
+
+func (r *Runner) runMapReduce(req *Request, parts, other []FileData) (*Response, error) {
+	answers := make([]string, len(parts))
+	results := make([]*Response, len(parts))
+	errs := make([]error, len(parts))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	done := 0
+	sem := make(chan struct{}, ChunkWorkers)
+	for i := range parts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			prompt := req.Prompt + fmt.Sprintf(MapPrompt, i+1, len(parts))
+			results[i], errs[i] = r.step(chunkRequest(req, prompt, parts[i:i+1]))
+			if errs[i] == nil {
+				answers[i] = results[i].Text
+			}
+
+			mu.Lock()
+			done++
+			if errs[i] != nil {
+				Logf("Часть %d/%d: ошибка (завершено %d из %d)", i+1, len(parts), done, len(parts))
+			} else {
+				Logf("Часть %d/%d обработана (завершено %d из %d)", i+1, len(parts), done, len(parts))
+			}
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("часть %d/%d: %w", i+1, len(parts), err)
+		}
+	}
+
+	var sb strings.Builder
+	for i, answer := range answers {
+		fmt.Fprintf(&sb, "\n\n### Part %d/%d\n%s", i+1, len(parts), strings.TrimSpace(answer))
+	}
+	Logf("Сводим ответы %d частей", len(parts))
+	resp, err := r.step(finalRequest(req, req.Prompt+fmt.Sprintf(ReducePrompt, len(parts))+sb.String(), other))
+	if err != nil {
+		return nil, fmt.Errorf("сведение ответов: %w", err)
+	}
+	return mergeStats(resp, results), nil
+}
+
+func (r *Runner) runRefine(req *Request, parts, other []FileData) (*Response, error) {
+	var results []*Response
+	answer := ""
+	for i := range parts {
+		Logf("Уточнение: часть %d/%d", i+1, len(parts))
+		prompt := req.Prompt + fmt.Sprintf(MapPrompt, i+1, len(parts))
+		if i > 0 {
+			prompt = req.Prompt + fmt.Sprintf(RefinePrompt, i, strings.TrimSpace(answer), i+1, len(parts))
+		}
+
+		var stepReq *Request
+		if i == len(parts)-1 {
+			stepReq = finalRequest(req, prompt, append(append([]FileData(nil), other...), parts[i]))
+		} else {
+			stepReq = chunkRequest(req, prompt, parts[i:i+1])
+		}
+		resp, err := r.step(stepReq)
+		if err != nil {
+			return nil, fmt.Errorf("часть %d/%d: %w", i+1, len(parts), err)
+		}
+		results = append(results, resp)
+		answer = resp.Text
+	}
+	last := results[len(results)-1]
+	return mergeStats(last, results[:len(results)-1]), nil
+}
+
+// mergeStats добавляет к итоговому ответу расход, попытки и вызовы
+// инструментов промежуточных шагов. Сообщения инструментов шагов идут
+// в историю раньше сообщений итогового ответа — в порядке выполнения.
+func mergeStats(final *Response, steps []*Response) *Response {
+	var toolMessages []ChatMessageHistory
+	for _, s := range steps {
+		final.Usage = final.Usage.Add(s.Usage)
+		final.Attempts += s.Attempts
+		final.ToolCalls = append(final.ToolCalls, s.ToolCalls...)
+		toolMessages = append(toolMessages, s.ToolMessages...)
+	}
+	if len(toolMessages) > 0 {
+		final.ToolMessages = append(toolMessages, final.ToolMessages...)
+	}
+	return final
+}
+
+// Промпты шагов. Дописываются к промпту пользователя.
+const (
+	// MapPrompt: номер части, всего частей
+	MapPrompt = "\n\nThe attached text is too long and is given in parts. This is part %d of %d. " +
+		"Answer the request above using only this part. If the part has nothing relevant, say so in one sentence."
+	// ReducePrompt: всего частей; дальше идут ответы по частям
+	ReducePrompt = "\n\nThe attached text was too long and was processed in %d parts. " +
+		"Below are the answers for each part. Combine them into one final answer to the request above, " +
+		"without mentioning the parts and without repeating the same facts."
+	// RefinePrompt: обработано частей, текущий ответ, номер части, всего частей
+	RefinePrompt = "\n\nThe attached text is too long and is given in parts. " +
+		"Here is the current answer based on the first %d part(s):\n\n%s\n\n" +
+		"Now part %d of %d is attached. Refine the answer with it and return the complete updated answer."
+)
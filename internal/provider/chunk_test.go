@@ -0,0 +1,170 @@
+package provider
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		size int
+		want []string
+	}{
+		{"fits", "abc", 5, []string{"abc"}},
+		{"exact", "abcdef", 3, []string{"abc", "def"}},
+		{"no size", "abcdef", 0, []string{"abcdef"}},
+		{"line boundary", "abc\ndefgh", 6, []string{"abc\n", "defgh"}},
+		{"early newline ignored", "ab\ncdef\ngh", 6, []string{"ab\ncde", "f\ngh"}},
+		{"runes not bytes", "привет мир", 4, []string{"прив", "ет м", "ир"}},
+		{"empty", "", 3, nil},
+	}
+	for _, tt := range tests {
+		got := SplitText(tt.text, tt.size)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: SplitText(%q, %d) = %q, want %q", tt.name, tt.text, tt.size, got, tt.want)
+		}
+		if strings.Join(got, "") != tt.text {
+			t.Errorf("%s: parts do not add up to the text", tt.name)
+		}
+	}
+}
+
+// chunkProvider отвечает текстом приложенной части (или "final")
+// и запоминает все запросы; вызывается параллельно.
+type chunkProvider struct {
+	Unsupported
+	mu   sync.Mutex
+	reqs []*Request
+}
+
+func (p *chunkProvider) Name() string { return "chunk" }
+
+func (p *chunkProvider) Chat(apiKey, model string, req *Request) (*Response, error) {
+	p.mu.Lock()
+	p.reqs = append(p.reqs, req)
+	p.mu.Unlock()
+
+	text := "final"
+	for _, f := range req.Files {
+		if f.IsText() {
+			text = "<" + strings.TrimSpace(string(f.Bytes())) + ">"
+		}
+	}
+	return &Response{Text: text, Usage: &Usage{TotalTokens: 1}}, nil
+}
+
+func TestRunChunked(t *testing.T) {
+	files := []FileData{
+		file("a.txt", "text/plain", "line1\nline2\nline3\nline4\n"),
+		file("pic.png", "image/png", "PNG"),
+	}
+	history := &ChatHistory{ID: "c"}
+
+	tests := []struct {
+		name      string
+		chunking  Chunking
+		wantCalls int
+		wantText  string
+		check     func(t *testing.T, reqs []*Request)
+	}{
+		{
+			name:      "small attachments are sent as is",
+			chunking:  Chunking{Size: 100, Strategy: StrategyMapReduce},
+			wantCalls: 1,
+			wantText:  "<line1\nline2\nline3\nline4>",
+		},
+		{
+			name:      "budget of the first model wins",
+			chunking:  Chunking{Size: 100, Budgets: map[string]int{"m": 20}, Strategy: StrategyMapReduce},
+			wantCalls: 3,
+			wantText:  "final",
+		},
+		{
+			name:      "map-reduce",
+			chunking:  Chunking{Size: 20, Strategy: StrategyMapReduce},
+			wantCalls: 3,
+			wantText:  "final",
+			check: func(t *testing.T, reqs []*Request) {
+				final := reqs[len(reqs)-1]
+				if !strings.Contains(final.Prompt, "<--- a.txt ---\nline1>") || !strings.Contains(final.Prompt, "<line2\nline3\nline4>") {
+					t.Errorf("reduce prompt = %q", final.Prompt)
+				}
+				if len(final.Files) != 1 || final.Files[0].Name != "pic.png" || final.History != history || !final.JSON {
+					t.Errorf("reduce request = %+v", final)
+				}
+				for _, r := range reqs[:2] {
+					if r.History != nil || r.JSON || !r.NoTools || len(r.Files) != 1 || !strings.Contains(r.Prompt, "of 2") {
+						t.Errorf("map request = %+v", r)
+					}
+				}
+			},
+		},
+		{
+			name:      "refine",
+			chunking:  Chunking{Size: 20, Strategy: StrategyRefine},
+			wantCalls: 2,
+			wantText:  "<line2\nline3\nline4>",
+			check: func(t *testing.T, reqs []*Request) {
+				if !strings.Contains(reqs[1].Prompt, "<--- a.txt ---\nline1>") || len(reqs[1].Files) != 2 || reqs[1].History != history {
+					t.Errorf("refine request = %+v", reqs[1])
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempConfig(t)
+			p := &chunkProvider{}
+			r := Runner{Provider: p, Keys: []string{"k"}, Models: []string{"m"}, Chunking: tt.chunking}
+
+			resp, err := r.Run(&Request{Mode: "general", Prompt: "sum up", Files: files, JSON: true, History: history})
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if resp.Text != tt.wantText || len(p.reqs) != tt.wantCalls {
+				t.Fatalf("Run() = %q after %d calls, want %q after %d", resp.Text, len(p.reqs), tt.wantText, tt.wantCalls)
+			}
+			if resp.Usage.TotalTokens != tt.wantCalls || resp.Attempts != tt.wantCalls {
+				t.Errorf("usage %d, attempts %d, want %d", resp.Usage.TotalTokens, resp.Attempts, tt.wantCalls)
+			}
+			if tt.check != nil {
+				// Ответы map-шага приходят в любом порядке, сведение — последним
+				tt.check(t, p.reqs)
+			}
+		})
+	}
+}
+
+func TestMergeStats(t *testing.T) {
+	toolTurn := func(id string) []ChatMessageHistory {
+		return []ChatMessageHistory{
+			{Role: "assistant", ToolCalls: []HistoryToolCall{{ID: id, Name: "calc"}}},
+			{Role: "tool", ToolCallID: id, Content: "4"},
+		}
+	}
+	final := &Response{Text: "final", Attempts: 1, Usage: &Usage{TotalTokens: 1},
+		ToolCalls: []ToolCall{{Name: "final"}}, ToolMessages: toolTurn("final")}
+	steps := []*Response{
+		{Attempts: 2, Usage: &Usage{TotalTokens: 2}, ToolCalls: []ToolCall{{Name: "first"}}, ToolMessages: toolTurn("first")},
+		{Attempts: 1},
+		{Attempts: 1, Usage: &Usage{TotalTokens: 3}, ToolCalls: []ToolCall{{Name: "third"}}, ToolMessages: toolTurn("third")},
+	}
+
+	got := mergeStats(final, steps)
+	if got.Usage.TotalTokens != 6 || got.Attempts != 5 || len(got.ToolCalls) != 3 {
+		t.Errorf("mergeStats = usage %+v, attempts %d, tool calls %+v", got.Usage, got.Attempts, got.ToolCalls)
+	}
+	var ids []string
+	for _, m := range got.ToolMessages {
+		if m.Role == "tool" {
+			ids = append(ids, m.ToolCallID)
+		}
+	}
+	if want := []string{"first", "third", "final"}; !reflect.DeepEqual(ids, want) || len(got.ToolMessages) != 6 {
+		t.Errorf("tool messages = %v (%d), want %v", ids, len(got.ToolMessages), want)
+	}
+}
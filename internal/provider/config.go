@@ -0,0 +1,421 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ConfigDirName папка в %APPDATA%, общая для всех утилит ClipGen-m
+const ConfigDirName = "clipgen-m"
+
+// Значения истории чата по умолчанию
+const (
+	DefaultChatHistoryMaxMessages = 30
+	DefaultChatHistoryMaxChars    = 50000
+	DefaultImageCharCost          = 2000
+	DefaultChatHistoryToolChars   = 4000
+)
+
+// DefaultMaxContinuations сколько раз дозапрашивать ответ, оборванный
+// лимитом токенов (max_continuations, 0 — не продолжать).
+const DefaultMaxContinuations = 3
+
+// Config общий формат <provider>.conf.
+// Поля, отсутствующие в файле, заполняются из Defaults при загрузке.
+type Config struct {
+	ApiKeys                []string            `json:"api_keys"`
+	BaseURL                string              `json:"base_url"`
+	SystemPrompt           string              `json:"system_prompt"`
+	Temperature            float64             `json:"temperature"`
+	MaxTokens              int                 `json:"max_tokens"`
+	Models                 map[string][]string `json:"models"`
+	ChatHistoryMaxMessages int                 `json:"chat_history_max_messages"`      // максимальное количество сообщений
+	ChatHistoryMaxChars    int                 `json:"chat_history_max_chars"`         // максимальное количество символов
+	ImageCharCost          int                 `json:"image_char_cost"`                // стоимость изображения в символах
+	ChatHistoryToolChars   int                 `json:"chat_history_tool_chars"`        // результат инструмента в истории, символов (0 — не сохранять вызовы)
+	RetryMaxAttempts       int                 `json:"retry_max_attempts"`             // максимум запросов на один вызов (0 — без ограничения)
+	RetryBaseDelayMs       int                 `json:"retry_base_delay_ms"`            // первая пауза после 429/5xx, дальше удваивается (0 — без пауз)
+	RetryMaxDelayMs        int                 `json:"retry_max_delay_ms"`             // потолок паузы, в том числе для Retry-After
+	MaxContinuations       int                 `json:"max_continuations"`              // продолжений ответа, оборванного лимитом токенов (0 — выкл.)
+	ModeRules              []ModeRule          `json:"mode_rules"`                     // правила выбора режима для --mode auto
+	ChunkSize              int                 `json:"chunk_size"`                     // часть больших текстовых вложений в символах (0 — не разбивать)
+	ContextBudgets         map[string]int      `json:"context_budgets,omitempty"`      // размер части для отдельных моделей, модель -> символы
+	ModerationThreshold    *float64            `json:"moderation_threshold,omitempty"` // порог --moderate (mistral), nil — по умолчанию
+	ToolRoots              []string            `json:"tool_roots,omitempty"`           // папки, доступные файловым инструментам (read_file, list_dir, grep_files)
+	ToolWorkers            int                 `json:"tool_workers"`                   // одновременных вызовов инструментов за ход модели
+	ToolTimeoutSec         int                 `json:"tool_timeout_sec"`               // время одного вызова инструмента, секунд
+}
+
+// Defaults значения по умолчанию конкретного провайдера.
+type Defaults struct {
+	BaseURL      string
+	SystemPrompt string
+	Temperature  float64
+	MaxTokens    int
+	Models       map[string][]string
+	ModeRules    []ModeRule
+	Backoff      Backoff
+}
+
+// AppDataDir возвращает (и создает при необходимости) %APPDATA%\clipgen-m
+func AppDataDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(configDir, ConfigDirName)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		_ = os.MkdirAll(path, 0755)
+	}
+	return path, nil
+}
+
+// ConfigPath возвращает путь к файлу в папке конфигов.
+func ConfigPath(fileName string) (string, error) {
+	dir, err := AppDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fileName), nil
+}
+
+func copyModels(src map[string][]string) map[string][]string {
+	dst := make(map[string][]string, len(src))
+	for k, v := range src {
+		dst[k] = append([]string(nil), v...)
+	}
+	return dst
+}
+
+func copyModeRules(src []ModeRule) []ModeRule {
+	dst := make([]ModeRule, len(src))
+	copy(dst, src)
+	return dst
+}
+
+func newConfig(d Defaults) *Config {
+	return &Config{
+		ApiKeys:                []string{},
+		BaseURL:                d.BaseURL,
+		SystemPrompt:           d.SystemPrompt,
+		Temperature:            d.Temperature,
+		MaxTokens:              d.MaxTokens,
+		Models:                 copyModels(d.Models),
+		ChatHistoryMaxMessages: DefaultChatHistoryMaxMessages,
+		ChatHistoryMaxChars:    DefaultChatHistoryMaxChars,
+		ImageCharCost:          DefaultImageCharCost,
+		ChatHistoryToolChars:   DefaultChatHistoryToolChars,
+		ToolWorkers:            DefaultToolWorkers,
+		ToolTimeoutSec:         int(DefaultToolTimeout / time.Second),
+		RetryMaxAttempts:       d.Backoff.MaxAttempts,
+		RetryBaseDelayMs:       int(d.Backoff.BaseDelay / time.Millisecond),
+		RetryMaxDelayMs:        int(d.Backoff.MaxDelay / time.Millisecond),
+		MaxContinuations:       DefaultMaxContinuations,
+		ModeRules:              copyModeRules(d.ModeRules),
+		ChunkSize:              DefaultChunkSize,
+	}
+}
+
+// LoadConfig читает конфиг и дополняет его значениями по умолчанию.
+// Если файла нет — возвращает дефолтный конфиг без записи на диск.
+// Если в существующем файле не хватало полей — файл перезаписывается,
+// чтобы пользователь видел новые настройки.
+func LoadConfig(path string, d Defaults) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return newConfig(d), nil
+		}
+		return nil, err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("ошибка парсинга конфигурации: %v", err)
+	}
+
+	// Для temperature 0.0 валидное значение, поэтому проверяем наличие ключа
+	var raw map[string]json.RawMessage
+	_ = json.Unmarshal(data, &raw)
+
+	dirty := false
+
+	if cfg.BaseURL == "" && d.BaseURL != "" {
+		cfg.BaseURL = d.BaseURL
+		dirty = true
+	}
+	if cfg.SystemPrompt == "" && d.SystemPrompt != "" {
+		cfg.SystemPrompt = d.SystemPrompt
+		dirty = true
+	}
+	if _, ok := raw["temperature"]; !ok {
+		cfg.Temperature = d.Temperature
+		dirty = true
+	}
+	if cfg.MaxTokens == 0 && d.MaxTokens != 0 {
+		cfg.MaxTokens = d.MaxTokens
+		dirty = true
+	}
+
+	if cfg.Models == nil {
+		cfg.Models = make(map[string][]string)
+		dirty = true
+	}
+	for k, v := range d.Models {
+		if list, exists := cfg.Models[k]; !exists || len(list) == 0 {
+			cfg.Models[k] = append([]string(nil), v...)
+			dirty = true
+		}
+	}
+
+	if cfg.ChatHistoryMaxMessages == 0 {
+		cfg.ChatHistoryMaxMessages = DefaultChatHistoryMaxMessages
+		dirty = true
+	}
+	if cfg.ChatHistoryMaxChars == 0 {
+		cfg.ChatHistoryMaxChars = DefaultChatHistoryMaxChars
+		dirty = true
+	}
+	if cfg.ImageCharCost == 0 {
+		cfg.ImageCharCost = DefaultImageCharCost
+		dirty = true
+	}
+	// 0 выключает сохранение вызовов инструментов, поэтому проверяем ключ
+	if _, ok := raw["chat_history_tool_chars"]; !ok {
+		cfg.ChatHistoryToolChars = DefaultChatHistoryToolChars
+		dirty = true
+	}
+
+	if cfg.ToolWorkers <= 0 {
+		cfg.ToolWorkers = DefaultToolWorkers
+		dirty = true
+	}
+	if cfg.ToolTimeoutSec <= 0 {
+		cfg.ToolTimeoutSec = int(DefaultToolTimeout / time.Second)
+		dirty = true
+	}
+
+	// 0 — допустимые значения для повторов, поэтому тоже проверяем наличие ключа
+	if _, ok := raw["retry_max_attempts"]; !ok {
+		cfg.RetryMaxAttempts = d.Backoff.MaxAttempts
+		dirty = true
+	}
+	if _, ok := raw["retry_base_delay_ms"]; !ok {
+		cfg.RetryBaseDelayMs = int(d.Backoff.BaseDelay / time.Millisecond)
+		dirty = true
+	}
+	if _, ok := raw["retry_max_delay_ms"]; !ok {
+		cfg.RetryMaxDelayMs = int(d.Backoff.MaxDelay / time.Millisecond)
+		dirty = true
+	}
+
+	if _, ok := raw["max_continuations"]; !ok {
+		cfg.MaxContinuations = DefaultMaxContinuations
+		dirty = true
+	}
+	// Пустой список — тоже настройка (всегда general), поэтому проверяем ключ
+	if _, ok := raw["mode_rules"]; !ok {
+		cfg.ModeRules = copyModeRules(d.ModeRules)
+		dirty = true
+	}
+	if _, ok := raw["chunk_size"]; !ok {
+		cfg.ChunkSize = DefaultChunkSize
+		dirty = true
+	}
+
+	if dirty {
+		Logf("Конфигурация дополнена значениями по умолчанию. Сохранение в %s", path)
+		if err := saveConfigKeeping(path, &cfg, raw); err != nil {
+			Logf("Не удалось сохранить конфигурацию: %v", err)
+		}
+	}
+
+	return &cfg, nil
+}
+
+// saveConfigKeeping перезаписывает конфиг, сохраняя поля, которых нет
+// в Config: собственные настройки утилит (endpoints у openaillm,
+// num_ctx у ollamallm), читающих общую часть через LoadConfig.
+func saveConfigKeeping(path string, cfg *Config, raw map[string]json.RawMessage) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return err
+	}
+	extra := false
+	for k, v := range raw {
+		if _, known := merged[k]; !known {
+			merged[k] = v
+			extra = true
+		}
+	}
+	if !extra {
+		return SaveConfig(path, cfg)
+	}
+	return SaveJSON(path, merged)
+}
+
+// SaveConfig записывает конфиг с отступами для ручного редактирования.
+func SaveConfig(path string, cfg *Config) error {
+	return SaveJSON(path, cfg)
+}
+
+// SaveJSON записывает v в файл в виде JSON с отступами.
+func SaveJSON(path string, v interface{}) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// AddKeyToConfig добавляет ключ в конфиг (без дублей) и сохраняет файл.
+func AddKeyToConfig(path, key string, d Defaults) error {
+	cfg, err := LoadConfig(path, d)
+	if err != nil {
+		return err
+	}
+	cfg.ApiKeys = AppendKey(cfg.ApiKeys, key)
+	return SaveConfig(path, cfg)
+}
+
+// AppendKey убирает пустые шаблоны и добавляет ключ, если его еще нет.
+func AppendKey(keys []string, key string) []string {
+	result := []string{}
+	exists := false
+	for _, k := range keys {
+		if strings.TrimSpace(k) == "" {
+			continue
+		}
+		if k == key {
+			exists = true
+		}
+		result = append(result, k)
+	}
+	if !exists {
+		result = append(result, key)
+	}
+	return result
+}
+
+// Keys возвращает непустые ключи из конфига.
+func (c *Config) Keys() []string {
+	var keys []string
+	for _, k := range c.ApiKeys {
+		if strings.TrimSpace(k) != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// SelectModels возвращает список моделей для режима с фолбэком на general.
+func (c *Config) SelectModels(mode string) []string {
+	if list, ok := c.Models[mode]; ok && len(list) > 0 {
+		return list
+	}
+	return c.Models["general"]
+}
+
+// HistoryLimits лимиты истории чата из конфига.
+func (c *Config) HistoryLimits() HistoryLimits {
+	return HistoryLimits{
+		MaxMessages:   c.ChatHistoryMaxMessages,
+		MaxChars:      c.ChatHistoryMaxChars,
+		ImageCharCost: c.ImageCharCost,
+		ToolChars:     c.ChatHistoryToolChars,
+	}
+}
+
+// ToolLimits параллельность и время вызовов инструментов из конфига.
+func (c *Config) ToolLimits() ToolLimits {
+	return ToolLimits{
+		Workers: c.ToolWorkers,
+		Timeout: time.Duration(c.ToolTimeoutSec) * time.Second,
+	}
+}
+
+// Backoff политика повторов из конфига.
+func (c *Config) Backoff() Backoff {
+	return Backoff{
+		MaxAttempts: c.RetryMaxAttempts,
+		BaseDelay:   time.Duration(c.RetryBaseDelayMs) * time.Millisecond,
+		MaxDelay:    time.Duration(c.RetryMaxDelayMs) * time.Millisecond,
+	}
+}
+
+// --- Tavily (общий для всех утилит конфиг веб-поиска) ---
+
+// TavilyConfigPath возвращает путь к tavily.conf
+func TavilyConfigPath() string {
+	path, err := ConfigPath("tavily.conf")
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// LoadTavilyKeys читает ключи Tavily.
+func LoadTavilyKeys() ([]string, error) {
+	configPath := TavilyConfigPath()
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("tavily.conf не найден в %s", configPath)
+		}
+		return nil, err
+	}
+
+	var config struct {
+		ApiKeys []string `json:"api_keys"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("ошибка парсинга tavily.conf: %v", err)
+	}
+
+	var keys []string
+	for _, k := range config.ApiKeys {
+		if strings.TrimSpace(k) != "" {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("список API ключей пуст в tavily.conf")
+	}
+	return keys, nil
+}
+
+// AddTavilyKey добавляет ключ Tavily, создавая файл при необходимости.
+func AddTavilyKey(newKey string) error {
+	configPath := TavilyConfigPath()
+
+	var config struct {
+		ApiKeys []string `json:"api_keys"`
+	}
+
+	if data, err := os.ReadFile(configPath); err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return err
+		}
+	}
+
+	for _, existingKey := range config.ApiKeys {
+		if existingKey == newKey {
+			return fmt.Errorf("ключ уже существует в конфигурации")
+		}
+	}
+
+	config.ApiKeys = AppendKey(config.ApiKeys, newKey)
+	return SaveJSON(configPath, config)
+}
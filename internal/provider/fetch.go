@@ -0,0 +1,449 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+)
+
+// Инструмент fetch_url: загрузка страницы и извлечение основного текста.
+// Скрипты, стили, меню и подвалы выбрасываются, остальное превращается
+// в обычный текст или markdown.
+
+// Ограничения fetch_url.
+const (
+	FetchTimeout  = 20 * time.Second
+	FetchMaxBytes = 2 * 1024 * 1024 // больше страница не скачивается
+)
+
+// Форматы результата fetch_url.
+const (
+	FetchText     = "text"
+	FetchMarkdown = "markdown"
+)
+
+// fetchUserAgent часть сайтов не отдает страницы клиентам без User-Agent.
+const fetchUserAgent = "Mozilla/5.0 (compatible; ClipGen-m)"
+
+// FetchURLTool выполняет fetch_url: аргументы url и format (text или
+// markdown, по умолчанию markdown).
+func FetchURLTool(args map[string]interface{}) (string, error) {
+	rawURL, ok := args["url"].(string)
+	if !ok || rawURL == "" {
+		return "", fmt.Errorf("не указан url")
+	}
+	format, _ := args["format"].(string)
+	if format == "" {
+		format = FetchMarkdown
+	}
+	if format != FetchText && format != FetchMarkdown {
+		return "", fmt.Errorf("неизвестный format %q (допустимы: %s, %s)", format, FetchText, FetchMarkdown)
+	}
+	return fetchURL(rawURL, format, FetchTimeout)
+}
+
+func fetchURL(rawURL, format string, timeout time.Duration) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("неверный url %q: нужен адрес http(s)", rawURL)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", fetchUserAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,text/plain;q=0.9,*/*;q=0.5")
+
+	Logf("fetch_url: %s", u)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("%s: превышено время ожидания (%v)", u, timeout)
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("%s: HTTP %d", u, resp.StatusCode)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	isHTML := mediaType == "" || mediaType == "text/html" || mediaType == "application/xhtml+xml"
+	if !isHTML && !strings.HasPrefix(mediaType, "text/") && mediaType != "application/json" && mediaType != "application/xml" {
+		return "", fmt.Errorf("%s: %s не текстовая страница", u, mediaType)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, FetchMaxBytes+1))
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("%s: превышено время ожидания (%v)", u, timeout)
+		}
+		return "", err
+	}
+	truncated := len(raw) > FetchMaxBytes
+	if truncated {
+		raw = raw[:FetchMaxBytes]
+	}
+
+	// Кодировка из заголовка, <meta charset> или по содержимому (windows-1251 и т.п.)
+	body, err := charset.NewReader(bytes.NewReader(raw), contentType)
+	if err != nil {
+		body = bytes.NewReader(raw)
+	}
+
+	final := resp.Request.URL
+	var title, text string
+	if isHTML {
+		doc, err := html.Parse(body)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", u, err)
+		}
+		title, text = htmlToText(doc, final, format == FetchMarkdown)
+	} else {
+		data, _ := io.ReadAll(body)
+		text = strings.TrimSpace(string(data))
+	}
+	Logf("fetch_url: %s: %d байт, текст %d символов", final, len(raw), len(text))
+
+	var sb strings.Builder
+	if title != "" {
+		fmt.Fprintf(&sb, "Title: %s\n", title)
+	}
+	fmt.Fprintf(&sb, "URL: %s\n\n%s", final, text)
+	if truncated {
+		fmt.Fprintf(&sb, "\n...[страница больше %d байт, прочитано начало]", FetchMaxBytes)
+	}
+	return sb.String(), nil
+}
+
+// skipTags элементы, которые не относятся к содержимому страницы.
+var skipTags = map[atom.Atom]bool{
+	atom.Head: true, atom.Script: true, atom.Style: true, atom.Noscript: true,
+	atom.Template: true, atom.Svg: true, atom.Canvas: true, atom.Iframe: true,
+	atom.Nav: true, atom.Aside: true,
+	atom.Form: true, atom.Button: true, atom.Select: true, atom.Input: true,
+	atom.Textarea: true, atom.Dialog: true, atom.Object: true, atom.Embed: true,
+}
+
+// skipRoles ARIA-роли меню, шапок и подвалов.
+var skipRoles = map[string]bool{
+	"navigation": true, "banner": true, "contentinfo": true, "complementary": true,
+	"search": true, "menu": true, "menubar": true, "dialog": true, "alert": true,
+}
+
+// htmlToText извлекает заголовок и основной текст страницы: содержимое
+// <main> (или role=main), иначе первого <article>, иначе <body>. base
+// нужен, чтобы ссылки в markdown были абсолютными.
+func htmlToText(doc *html.Node, base *url.URL, markdown bool) (title, text string) {
+	if t := findNode(doc, func(n *html.Node) bool { return n.DataAtom == atom.Title }); t != nil {
+		title = strings.Join(strings.Fields(nodeText(t)), " ")
+	}
+
+	w := &textWriter{markdown: markdown, base: base, content: true}
+	root := findNode(doc, func(n *html.Node) bool { return n.DataAtom == atom.Main || attr(n, "role") == "main" })
+	if root == nil {
+		root = findNode(doc, func(n *html.Node) bool { return n.DataAtom == atom.Article })
+	}
+	if root == nil {
+		w.content = false
+		root = findNode(doc, func(n *html.Node) bool { return n.DataAtom == atom.Body })
+	}
+	if root == nil {
+		root = doc
+	}
+
+	w.children(root)
+	return title, strings.TrimSpace(w.sb.String())
+}
+
+func findNode(n *html.Node, match func(*html.Node) bool) *html.Node {
+	if n.Type == html.ElementNode && match(n) {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findNode(c, match); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(nodeText(c))
+	}
+	return sb.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// textWriter собирает текст: пробелы схлопываются, блочные элементы
+// разделяются переводами строк, в markdown добавляется разметка.
+type textWriter struct {
+	sb       strings.Builder
+	markdown bool
+	base     *url.URL
+	newlines int   // сколько переводов строк уже в конце текста
+	space    bool  // перед следующим словом нужен пробел
+	pre      int   // глубина <pre>
+	lists    []int // номера пунктов вложенных списков, -1 — маркированный
+	content  bool  // текст берется из <main> или <article>
+}
+
+// block завершает текущую строку и добавляет пустые строки до n переводов.
+func (w *textWriter) block(n int) {
+	w.space = false
+	if w.sb.Len() == 0 {
+		return
+	}
+	for w.newlines < n {
+		w.sb.WriteByte('\n')
+		w.newlines++
+	}
+}
+
+// open пишет разметку перед словом (с отложенным пробелом).
+func (w *textWriter) open(s string) {
+	if w.space && w.newlines == 0 && w.sb.Len() > 0 && !strings.HasSuffix(w.sb.String(), " ") {
+		w.sb.WriteByte(' ')
+	}
+	w.space = false
+	w.sb.WriteString(s)
+	w.newlines = 0
+}
+
+// close пишет разметку сразу после слова.
+func (w *textWriter) close(s string) {
+	w.sb.WriteString(s)
+	w.newlines = 0
+}
+
+func (w *textWriter) text(s string) {
+	if w.pre > 0 {
+		w.sb.WriteString(s)
+		if strings.HasSuffix(s, "\n") {
+			w.newlines = 1
+		} else if s != "" {
+			w.newlines = 0
+		}
+		return
+	}
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		if s != "" {
+			w.space = true
+		}
+		return
+	}
+	if s[0] == ' ' || s[0] == '\t' || s[0] == '\n' || s[0] == '\r' {
+		w.space = true
+	}
+	for _, word := range words {
+		w.open(word)
+		w.space = true
+	}
+	last := s[len(s)-1]
+	w.space = last == ' ' || last == '\t' || last == '\n' || last == '\r'
+}
+
+// skip true для служебных элементов. Шапка и подвал внутри <main> или
+// <article> — часть содержимого (заголовок статьи, автор), снаружи — нет.
+func (w *textWriter) skip(n *html.Node) bool {
+	if n.DataAtom == atom.Header || n.DataAtom == atom.Footer {
+		return !w.content
+	}
+	return skipTags[n.DataAtom] || skipRoles[attr(n, "role")] ||
+		hasAttr(n, "hidden") || attr(n, "aria-hidden") == "true"
+}
+
+func (w *textWriter) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.node(c)
+	}
+}
+
+func (w *textWriter) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		w.children(n)
+		return
+	}
+	if w.skip(n) {
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Br:
+		w.sb.WriteByte('\n')
+		w.newlines++
+		w.space = false
+	case atom.Hr:
+		w.block(2)
+		if w.markdown {
+			w.open("---")
+		}
+		w.block(2)
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		w.block(2)
+		if w.markdown {
+			w.open(strings.Repeat("#", int(n.Data[1]-'0')) + " ")
+		}
+		w.children(n)
+		w.block(2)
+	case atom.P, atom.Blockquote, atom.Table, atom.Figure, atom.Dl:
+		w.block(2)
+		if w.markdown && n.DataAtom == atom.Blockquote {
+			w.open("> ")
+		}
+		w.children(n)
+		w.block(2)
+	case atom.Ul, atom.Ol:
+		w.block(1)
+		start := -1
+		if n.DataAtom == atom.Ol {
+			start = 0
+			if v, err := strconv.Atoi(attr(n, "start")); err == nil {
+				start = v - 1
+			}
+		}
+		w.lists = append(w.lists, start)
+		w.children(n)
+		w.lists = w.lists[:len(w.lists)-1]
+		w.block(1)
+	case atom.Li:
+		w.block(1)
+		marker := "- "
+		if depth := len(w.lists); depth > 0 {
+			if w.lists[depth-1] >= 0 {
+				w.lists[depth-1]++
+				marker = strconv.Itoa(w.lists[depth-1]) + ". "
+			}
+			marker = strings.Repeat("  ", depth-1) + marker
+		}
+		w.open(marker)
+		w.children(n)
+		w.block(1)
+	case atom.Pre:
+		w.block(2)
+		if w.markdown {
+			w.open("```\n")
+		}
+		w.pre++
+		w.children(n)
+		w.pre--
+		if w.markdown {
+			w.block(1)
+			w.open("```")
+		}
+		w.block(2)
+	case atom.Code:
+		if w.markdown && w.pre == 0 {
+			w.open("`")
+			w.children(n)
+			w.close("`")
+			return
+		}
+		w.children(n)
+	case atom.Strong, atom.B:
+		w.inline(n, "**")
+	case atom.Em, atom.I:
+		w.inline(n, "*")
+	case atom.A:
+		href := w.link(attr(n, "href"))
+		if !w.markdown || href == "" || strings.TrimSpace(nodeText(n)) == "" {
+			w.children(n)
+			return
+		}
+		w.open("[")
+		w.children(n)
+		w.close("](" + href + ")")
+	case atom.Img:
+		if alt := strings.TrimSpace(attr(n, "alt")); alt != "" && w.markdown {
+			w.open("[" + alt + "]")
+		}
+	case atom.Tr:
+		w.block(1)
+		w.children(n)
+		w.block(1)
+	case atom.Td, atom.Th:
+		if w.newlines == 0 && w.sb.Len() > 0 {
+			w.close(" |")
+			w.space = true
+		}
+		w.children(n)
+	case atom.Div, atom.Section, atom.Article, atom.Main, atom.Header, atom.Footer, atom.Dt, atom.Dd,
+		atom.Address, atom.Details, atom.Summary, atom.Figcaption, atom.Caption:
+		w.block(1)
+		w.children(n)
+		w.block(1)
+	default:
+		w.children(n)
+	}
+}
+
+// inline оборачивает содержимое в разметку markdown (**, *).
+func (w *textWriter) inline(n *html.Node, mark string) {
+	if !w.markdown || strings.TrimSpace(nodeText(n)) == "" {
+		w.children(n)
+		return
+	}
+	w.open(mark)
+	w.children(n)
+	w.close(mark)
+}
+
+// link абсолютная ссылка для markdown; якоря и javascript: не нужны.
+func (w *textWriter) link(href string) string {
+	href = strings.TrimSpace(href)
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+		return ""
+	}
+	u, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+	if w.base != nil {
+		u = w.base.ResolveReference(u)
+	}
+	return u.String()
+}
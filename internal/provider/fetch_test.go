@@ -0,0 +1,164 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestHTMLToText(t *testing.T) {
+	base, _ := url.Parse("https://example.com/blog/post")
+	tests := []struct {
+		name     string
+		html     string
+		markdown bool
+		want     string
+		title    string
+	}{
+		{
+			name: "scripts and navigation",
+			html: `<html><head><title> My  page </title><style>p{}</style></head><body>
+				<header>Site name</header><nav><a href="/">Home</a></nav>
+				<script>alert(1)</script><p>Hello   <b>world</b>!</p>
+				<div role="navigation">Menu</div><footer>(c) 2024</footer></body></html>`,
+			want:  "Hello world!",
+			title: "My page",
+		},
+		{
+			name: "main wins over body",
+			html: `<body><div>Sidebar</div><main><h1>Title</h1><header>By Ann</header><p>Text</p></main></body>`,
+			want: "Title\n\nBy Ann\n\nText",
+		},
+		{
+			name: "article without main",
+			html: `<body><aside>Ads</aside><article><p>One</p><p>Two</p></article><p>Comments</p></body>`,
+			want: "One\n\nTwo",
+		},
+		{
+			name:     "markdown",
+			html:     `<main><h2>Intro</h2><p>See <a href="../docs">the <em>docs</em></a> and <code>go run</code>.</p><ul><li>a</li><li>b<ol><li>x</li><li>y</li></ol></li></ul></main>`,
+			markdown: true,
+			want:     "## Intro\n\nSee [the *docs*](https://example.com/docs) and `go run`.\n\n- a\n- b\n  1. x\n  2. y",
+		},
+		{
+			name:     "markdown pre",
+			html:     "<main><p>Code:</p><pre>if x {\n  y()\n}</pre></main>",
+			markdown: true,
+			want:     "Code:\n\n```\nif x {\n  y()\n}\n```",
+		},
+		{
+			name: "text links and anchors",
+			html: `<main><p><a href="#top">Top</a> <a href="javascript:void(0)">Click</a> <a href="/x">X</a></p></main>`,
+			want: "Top Click X",
+		},
+		{
+			name: "hidden",
+			html: `<main><p hidden>secret</p><p aria-hidden="true">icon</p><p>shown</p></main>`,
+			want: "shown",
+		},
+		{
+			name: "table",
+			html: `<main><table><tr><th>Name</th><th>Age</th></tr><tr><td>Ann</td><td>30</td></tr></table></main>`,
+			want: "Name | Age\nAnn | 30",
+		},
+		{
+			name: "br",
+			html: `<main><p>line one<br>line two</p></main>`,
+			want: "line one\nline two",
+		},
+	}
+	for _, tt := range tests {
+		doc, err := html.Parse(strings.NewReader(tt.html))
+		if err != nil {
+			t.Fatal(err)
+		}
+		title, got := htmlToText(doc, base, tt.markdown)
+		if got != tt.want || title != tt.title {
+			t.Errorf("%s: htmlToText = %q, %q, want %q, %q", tt.name, title, got, tt.title, tt.want)
+		}
+	}
+}
+
+func TestFetchURL(t *testing.T) {
+	withTempConfig(t)
+	cp1251, _ := charmap.Windows1251.NewEncoder().String("<html><head><meta charset=\"windows-1251\"><title>Новости</title></head><body><p>Привет, мир</p></body></html>")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			if r.Header.Get("User-Agent") == "" {
+				http.Error(w, "no agent", http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, `<html><head><title>Page</title></head><body><nav>Menu</nav><main><p>Main text</p></main></body></html>`)
+		case "/redirect":
+			http.Redirect(w, r, "/page", http.StatusFound)
+		case "/cp1251":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, cp1251)
+		case "/plain":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprint(w, "  just text  ")
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			fmt.Fprint(w, "\x89PNG")
+		case "/big":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, strings.Repeat("a", FetchMaxBytes+10))
+		case "/slow":
+			time.Sleep(time.Second)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name, path string
+		want       []string
+		wantErr    string
+	}{
+		{name: "page", path: "/page", want: []string{"Title: Page\n", "URL: " + srv.URL + "/page\n\nMain text"}},
+		{name: "redirect shows final url", path: "/redirect", want: []string{"URL: " + srv.URL + "/page\n"}},
+		{name: "windows-1251", path: "/cp1251", want: []string{"Title: Новости", "Привет, мир"}},
+		{name: "plain text", path: "/plain", want: []string{"\n\njust text"}},
+		{name: "big page", path: "/big", want: []string{"прочитано начало"}},
+		{name: "not text", path: "/image", wantErr: "не текстовая"},
+		{name: "http status", path: "/missing", wantErr: "HTTP 404"},
+		{name: "timeout", path: "/slow", wantErr: "время ожидания"},
+	}
+	for _, tt := range tests {
+		got, err := fetchURL(srv.URL+tt.path, FetchMarkdown, 300*time.Millisecond)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want mention of %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", tt.name, err)
+			continue
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%s: %q does not contain %q", tt.name, got[:min(len(got), 300)], w)
+			}
+		}
+	}
+
+	for _, args := range []map[string]interface{}{
+		{},
+		{"url": "file:///etc/passwd"},
+		{"url": srv.URL + "/page", "format": "pdf"},
+	} {
+		if _, err := FetchURLTool(args); err == nil {
+			t.Errorf("FetchURLTool(%v): no error", args)
+		}
+	}
+}
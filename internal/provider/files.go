@@ -0,0 +1,246 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// FileData вложение, готовое к отправке в API.
+type FileData struct {
+	Name          string
+	Path          string
+	MimeType      string
+	Base64Content string
+}
+
+// IsImage, IsAudio, IsVideo, IsText — классификация по MIME-типу.
+func (f FileData) IsImage() bool { return strings.HasPrefix(f.MimeType, "image/") }
+func (f FileData) IsAudio() bool { return strings.HasPrefix(f.MimeType, "audio/") }
+func (f FileData) IsVideo() bool { return strings.HasPrefix(f.MimeType, "video/") }
+func (f FileData) IsText() bool {
+	return strings.HasPrefix(f.MimeType, "text/") || f.MimeType == "application/json"
+}
+
+// IsDocument возвращает true для PDF и офисных документов.
+func (f FileData) IsDocument() bool {
+	return f.MimeType == "application/pdf" || documentMimeTypes[f.MimeType]
+}
+
+// Bytes декодирует содержимое файла.
+func (f FileData) Bytes() []byte {
+	data, _ := base64.StdEncoding.DecodeString(f.Base64Content)
+	return data
+}
+
+// DataURL возвращает содержимое в виде data:<mime>;base64,<...>
+func (f FileData) DataURL() string {
+	return fmt.Sprintf("data:%s;base64,%s", f.MimeType, f.Base64Content)
+}
+
+// Attachments сводка по типам вложений, используется при выборе режима.
+type Attachments struct {
+	Images    bool
+	Audio     bool
+	Video     bool
+	Pdf       bool
+	Documents bool // docx, xlsx, doc, xls, rtf
+}
+
+var documentMimeTypes = map[string]bool{
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": true, // .docx
+	"application/msword": true, // .doc
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": true, // .xlsx
+	"application/vnd.ms-excel": true, // .xls
+	"application/rtf":          true,
+	"application/x-rtf":        true,
+}
+
+// Таблица на случай, если mime.TypeByExtension ничего не знает о расширении
+// (в Windows это зависит от реестра).
+var extMimeTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".webp": "image/webp",
+	".bmp":  "image/bmp",
+	".pdf":  "application/pdf",
+	".mp3":  "audio/mpeg",
+	".wav":  "audio/wav",
+	".m4a":  "audio/mp4",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".flac": "audio/flac",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".rtf":  "application/rtf",
+	".html": "text/html",
+	".txt":  "text/plain",
+	".go":   "text/plain",
+	".js":   "text/plain",
+	".json": "application/json",
+	".md":   "text/plain",
+	".py":   "text/plain",
+}
+
+// FileOptions параметры обработки файлов.
+type FileOptions struct {
+	// Transcode расширения аудио, которые перекодируются в WAV через ffmpeg
+	// перед отправкой (например ".amr"). Если ffmpeg недоступен — отправляется оригинал.
+	Transcode []string
+}
+
+// DefaultFileOptions перекодирует только AMR, который не понимает ни один API.
+var DefaultFileOptions = FileOptions{Transcode: []string{".amr"}}
+
+// ProcessFiles читает файлы, определяет MIME-тип и кодирует в base64.
+// Нечитаемые файлы пропускаются с записью в лог.
+func ProcessFiles(paths []string, opts FileOptions) ([]FileData, Attachments) {
+	var result []FileData
+	var att Attachments
+
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			Logf("Ошибка чтения файла %s: %v", p, err)
+			continue
+		}
+
+		ext := strings.ToLower(filepath.Ext(p))
+		mt := detectMimeType(ext, data)
+
+		for _, t := range opts.Transcode {
+			if ext != t {
+				continue
+			}
+			transcoded, err := TranscodeAudioWithFFmpeg(p)
+			if err != nil {
+				Logf("Не удалось перекодировать %s: %v. Используем исходный файл.", p, err)
+				break
+			}
+			data = transcoded
+			mt = "audio/wav"
+			break
+		}
+
+		f := FileData{
+			Name:          filepath.Base(p),
+			Path:          p,
+			MimeType:      mt,
+			Base64Content: base64.StdEncoding.EncodeToString(data),
+		}
+
+		switch {
+		case f.IsImage():
+			att.Images = true
+		case f.IsAudio():
+			att.Audio = true
+		case f.IsVideo():
+			att.Video = true
+		case f.MimeType == "application/pdf":
+			att.Pdf = true
+		case f.IsDocument():
+			att.Documents = true
+		}
+
+		result = append(result, f)
+	}
+	return result, att
+}
+
+func detectMimeType(ext string, data []byte) string {
+	mt := mime.TypeByExtension(ext)
+	if i := strings.Index(mt, ";"); i >= 0 {
+		mt = strings.TrimSpace(mt[:i])
+	}
+	contentType := http.DetectContentType(data)
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = strings.TrimSpace(contentType[:i])
+	}
+
+	// Определение по содержимому надежнее для аудио без правильного расширения
+	if !strings.HasPrefix(mt, "audio/") && strings.HasPrefix(contentType, "audio/") {
+		mt = contentType
+	}
+	if mt == "" || mt == "application/octet-stream" {
+		if known, ok := extMimeTypes[ext]; ok {
+			mt = known
+		} else if contentType != "application/octet-stream" {
+			mt = contentType
+		} else if utf8.Valid(data) {
+			mt = "text/plain"
+		} else {
+			mt = "application/octet-stream"
+		}
+	}
+
+	// OGG/Opus контейнеры почти всегда аудио
+	if mt == "application/ogg" || mt == "application/opus" {
+		mt = "audio/ogg"
+	}
+
+	if strings.HasPrefix(mt, "audio/") {
+		switch ext {
+		case ".mp3":
+			mt = "audio/mpeg"
+		case ".wav":
+			mt = "audio/wav"
+		case ".m4a", ".mp4":
+			mt = "audio/mp4"
+		case ".ogg", ".opus":
+			mt = "audio/ogg"
+		case ".flac":
+			mt = "audio/flac"
+		}
+	}
+
+	if strings.HasPrefix(mt, "video/") {
+		switch ext {
+		case ".mov", ".qt":
+			mt = "video/quicktime"
+		case ".avi":
+			mt = "video/x-msvideo"
+		case ".wmv":
+			mt = "video/x-ms-wmv"
+		case ".webm":
+			mt = "video/webm"
+		case ".mkv":
+			mt = "video/x-matroska"
+		default:
+			mt = "video/mp4"
+		}
+	}
+
+	return mt
+}
+
+// TranscodeAudioWithFFmpeg перекодирует аудио в WAV 16kHz моно.
+func TranscodeAudioWithFFmpeg(inputPath string) ([]byte, error) {
+	tempOutput, err := os.CreateTemp("", "transcoded_*.wav")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %v", err)
+	}
+	tempPath := tempOutput.Name()
+	tempOutput.Close()
+	defer os.Remove(tempPath)
+
+	cmd := exec.Command("ffmpeg", "-i", inputPath, "-ar", "16000", "-ac", "1", "-b:a", "64k", "-y", tempPath)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %v, stderr: %s", err, stderr.String())
+	}
+
+	return os.ReadFile(tempPath)
+}
@@ -0,0 +1,373 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Файловые инструменты (read_file, list_dir, grep_files): модель сама
+// читает файлы, но только внутри разрешенных папок из tool_roots в *.conf.
+// Каждое обращение пишется в лог.
+
+// Ограничения файловых инструментов.
+const (
+	ReadFileLimit    = 48 * 1024        // байт за один вызов read_file, дальше — с offset
+	ListDirLimit     = 500              // записей в ответе list_dir
+	GrepMaxMatches   = 200              // совпадений в ответе grep_files
+	GrepMaxFiles     = 5000             // файлов, просматриваемых grep_files
+	GrepMaxFileSize  = 10 * 1024 * 1024 // файлы больше пропускаются
+	grepMaxLineChars = 300              // длина строки совпадения в ответе
+)
+
+// FileTools файловые инструменты с доступом к папкам roots. Без папок
+// инструментов нет: модель не должна видеть то, чем не сможет воспользоваться.
+func FileTools(roots []string) []Builtin {
+	if len(roots) == 0 {
+		return nil
+	}
+	fsys := fileRoots(roots)
+	rootList := strings.Join(roots, ", ")
+	return []Builtin{
+		{
+			Spec: ToolSpec{
+				Name:        "read_file",
+				Description: "Reads a text file from the user's allowed folders (" + rootList + "). Long files are returned in parts: call again with the offset from the end of the previous part.",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path":   map[string]interface{}{"type": "string", "description": "Absolute file path or a path relative to the first allowed folder"},
+						"offset": map[string]interface{}{"type": "integer", "description": "Byte offset to start reading from (default 0)"},
+					},
+					"required": []string{"path"},
+				},
+			},
+			Run: fsys.readFile,
+		},
+		{
+			Spec: ToolSpec{
+				Name:        "list_dir",
+				Description: "Lists files and subfolders of a folder inside the user's allowed folders (" + rootList + ") with file sizes.",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path": map[string]interface{}{"type": "string", "description": "Folder path; empty to list the allowed folders themselves"},
+					},
+				},
+			},
+			Run: fsys.listDir,
+		},
+		{
+			Spec: ToolSpec{
+				Name:        "grep_files",
+				Description: "Searches text files in a folder inside the user's allowed folders (" + rootList + ") recursively for a regular expression and returns matching lines as path:line: text.",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"pattern":     map[string]interface{}{"type": "string", "description": "Regular expression (RE2 syntax)"},
+						"path":        map[string]interface{}{"type": "string", "description": "Folder or file to search; empty for the first allowed folder"},
+						"glob":        map[string]interface{}{"type": "string", "description": "File name filter, e.g. *.log"},
+						"ignore_case": map[string]interface{}{"type": "boolean", "description": "Case-insensitive search"},
+					},
+					"required": []string{"pattern"},
+				},
+			},
+			Run: fsys.grepFiles,
+		},
+	}
+}
+
+// fileRoots разрешенные папки.
+type fileRoots []string
+
+// resolve приводит путь из аргументов к абсолютному и проверяет, что он
+// (после раскрытия символических ссылок) лежит внутри одной из папок.
+// Относительный путь считается от первой папки, пустой — это она сама.
+func (roots fileRoots) resolve(path string) (string, error) {
+	if path == "" {
+		path = roots[0]
+	} else if !filepath.IsAbs(path) {
+		path = filepath.Join(roots[0], path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	// Сначала проверка самого пути: модель не должна узнавать даже,
+	// существует ли файл снаружи
+	if !roots.contain(abs) {
+		return "", roots.denied(abs)
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", abs, unwrapPathError(err))
+	}
+	if !roots.contain(real) {
+		return "", roots.denied(abs)
+	}
+	return real, nil
+}
+
+func (roots fileRoots) contain(path string) bool {
+	for _, root := range roots {
+		if within(path, root) {
+			return true
+		}
+	}
+	return false
+}
+
+func (roots fileRoots) denied(path string) error {
+	Logf("Файлы: доступ запрещен: %s", path)
+	return fmt.Errorf("доступ запрещен: %s вне разрешенных папок (tool_roots)", path)
+}
+
+// within true, если path — это root или путь внутри него. Папка
+// сравнивается и как задана, и после раскрытия ссылок.
+func within(path, root string) bool {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return false
+	}
+	candidates := []string{root}
+	if real, err := filepath.EvalSymlinks(root); err == nil && real != root {
+		candidates = append(candidates, real)
+	}
+	for _, dir := range candidates {
+		rel, err := filepath.Rel(dir, path)
+		if err == nil && (rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))) {
+			return true
+		}
+	}
+	return false
+}
+
+// unwrapPathError убирает из ошибки повтор пути (он уже есть в сообщении).
+func unwrapPathError(err error) error {
+	if pe, ok := err.(*fs.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
+
+func (roots fileRoots) readFile(args map[string]interface{}) (string, error) {
+	arg, _ := args["path"].(string)
+	if arg == "" {
+		return "", fmt.Errorf("не указан path")
+	}
+	offset := int64(0)
+	if v, ok := args["offset"].(float64); ok && v > 0 {
+		offset = int64(v)
+	}
+
+	path, err := roots.resolve(arg)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", path, unwrapPathError(err))
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s — папка, используйте list_dir", path)
+	}
+	Logf("Файлы: read_file %s (offset %d, размер %d)", path, offset, info.Size())
+	if offset >= info.Size() {
+		return fmt.Sprintf("[конец файла, размер %d байт]", info.Size()), nil
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	buf := make([]byte, ReadFileLimit)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	data := buf[:n]
+	if bytes.IndexByte(data, 0) >= 0 {
+		return "", fmt.Errorf("%s — двоичный файл", path)
+	}
+
+	// Часть не должна начинаться или заканчиваться посреди символа UTF-8
+	start := 0
+	for start < len(data) && start < utf8.UTFMax && !utf8.RuneStart(data[start]) {
+		start++
+	}
+	end := len(data)
+	if offset+int64(end) < info.Size() {
+		for cut := end - 1; cut > start && cut >= end-utf8.UTFMax; cut-- {
+			if utf8.RuneStart(data[cut]) {
+				if !utf8.FullRune(data[cut:end]) {
+					end = cut
+				}
+				break
+			}
+		}
+	}
+
+	text := string(data[start:end])
+	if next := offset + int64(end); next < info.Size() {
+		text += fmt.Sprintf("\n...[прочитано %d из %d байт, продолжение: offset=%d]", next, info.Size(), next)
+	}
+	return text, nil
+}
+
+func (roots fileRoots) listDir(args map[string]interface{}) (string, error) {
+	arg, _ := args["path"].(string)
+	if arg == "" && len(roots) > 1 {
+		Logf("Файлы: list_dir (разрешенные папки)")
+		return "Allowed folders:\n" + strings.Join(roots, "\n"), nil
+	}
+
+	path, err := roots.resolve(arg)
+	if err != nil {
+		return "", err
+	}
+	Logf("Файлы: list_dir %s", path)
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", path, unwrapPathError(err))
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s:\n", path)
+	for i, e := range entries {
+		if i == ListDirLimit {
+			fmt.Fprintf(&sb, "...[показано %d из %d записей]\n", ListDirLimit, len(entries))
+			break
+		}
+		if e.IsDir() {
+			fmt.Fprintf(&sb, "%s%c\n", e.Name(), filepath.Separator)
+			continue
+		}
+		size := int64(0)
+		if info, err := e.Info(); err == nil {
+			size = info.Size()
+		}
+		fmt.Fprintf(&sb, "%s\t%d\n", e.Name(), size)
+	}
+	if len(entries) == 0 {
+		sb.WriteString("(пусто)\n")
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
+
+func (roots fileRoots) grepFiles(args map[string]interface{}) (string, error) {
+	pattern, _ := args["pattern"].(string)
+	if pattern == "" {
+		return "", fmt.Errorf("не указан pattern")
+	}
+	if ignoreCase, _ := args["ignore_case"].(bool); ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("неверное регулярное выражение: %v", err)
+	}
+	glob, _ := args["glob"].(string)
+	if _, err := filepath.Match(glob, ""); err != nil {
+		return "", fmt.Errorf("неверный glob %q: %v", glob, err)
+	}
+
+	arg, _ := args["path"].(string)
+	path, err := roots.resolve(arg)
+	if err != nil {
+		return "", err
+	}
+	Logf("Файлы: grep_files %q в %s (glob %q)", pattern, path, glob)
+
+	var sb strings.Builder
+	matches, files := 0, 0
+	truncated := ""
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Недоступная папка не прерывает поиск по остальным
+			Logf("Файлы: grep_files пропущено %s: %v", p, err)
+			return nil
+		}
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+		if glob != "" {
+			if ok, _ := filepath.Match(glob, d.Name()); !ok {
+				return nil
+			}
+		}
+		if info, err := d.Info(); err != nil || info.Size() > GrepMaxFileSize {
+			return nil
+		}
+		if files == GrepMaxFiles {
+			truncated = fmt.Sprintf("просмотрено %d файлов", GrepMaxFiles)
+			return fs.SkipAll
+		}
+		files++
+
+		n, err := grepFile(p, re, GrepMaxMatches-matches, &sb)
+		matches += n
+		if err != nil {
+			Logf("Файлы: grep_files пропущено %s: %v", p, err)
+		}
+		if matches >= GrepMaxMatches {
+			truncated = fmt.Sprintf("показано %d совпадений", GrepMaxMatches)
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if matches == 0 {
+		return fmt.Sprintf("Совпадений нет (просмотрено файлов: %d)", files), nil
+	}
+	if truncated != "" {
+		fmt.Fprintf(&sb, "...[%s, уточните pattern, path или glob]\n", truncated)
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
+
+// grepFile пишет в sb до limit совпадений из файла и возвращает их число.
+// Двоичные файлы пропускаются.
+func grepFile(path string, re *regexp.Regexp, limit int, sb *strings.Builder) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if head, _ := r.Peek(8000); bytes.IndexByte(head, 0) >= 0 {
+		return 0, nil
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	n := 0
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if !re.MatchString(text) {
+			continue
+		}
+		if utf8.RuneCountInString(text) > grepMaxLineChars {
+			text = string([]rune(text)[:grepMaxLineChars]) + "…"
+		}
+		fmt.Fprintf(sb, "%s:%d: %s\n", path, line, text)
+		n++
+		if n == limit {
+			break
+		}
+	}
+	return n, scanner.Err()
+}
@@ -0,0 +1,136 @@
+package provider
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fileToolsDir создает разрешенную папку с файлами и папку рядом с ней.
+func fileToolsDir(t *testing.T) (root, outside string) {
+	t.Helper()
+	base := t.TempDir()
+	root = filepath.Join(base, "root")
+	outside = filepath.Join(base, "outside")
+	files := map[string]string{
+		"root/app.log":         "start\nERROR disk full\nok\nerror: retry\n",
+		"root/notes.txt":       "привет\nError in notes\n",
+		"root/sub/deep.log":    "ERROR deep\n",
+		"root/bin.dat":         "ERROR\x00binary",
+		"outside/secret.txt":   "ERROR secret\n",
+		"root/sub/empty/.keep": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(base, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, outside
+}
+
+func TestFileTools(t *testing.T) {
+	withTempConfig(t)
+	root, outside := fileToolsDir(t)
+	if FileTools(nil) != nil {
+		t.Errorf("FileTools without roots has tools")
+	}
+	ts := NewToolset(nil, FileTools([]string{root})...)
+
+	tests := []struct {
+		name, tool, args string
+		want             []string // подстроки ответа
+		notWant          []string
+		wantErr          string
+	}{
+		{name: "read absolute", tool: "read_file", args: `{"path":` + strconv.Quote(filepath.Join(root, "app.log")) + `}`, want: []string{"ERROR disk full"}},
+		{name: "read relative", tool: "read_file", args: `{"path":"notes.txt"}`, want: []string{"привет"}},
+		{name: "read offset", tool: "read_file", args: `{"path":"app.log","offset":6}`, want: []string{"ERROR disk full"}, notWant: []string{"start"}},
+		{name: "read past end", tool: "read_file", args: `{"path":"app.log","offset":1000}`, want: []string{"конец файла"}},
+		{name: "read outside", tool: "read_file", args: `{"path":` + strconv.Quote(filepath.Join(outside, "secret.txt")) + `}`, wantErr: "доступ запрещен"},
+		{name: "read dotdot", tool: "read_file", args: `{"path":"../outside/secret.txt"}`, wantErr: "доступ запрещен"},
+		{name: "read missing outside", tool: "read_file", args: `{"path":"../outside/nope.txt"}`, wantErr: "доступ запрещен"},
+		{name: "read missing", tool: "read_file", args: `{"path":"nope.txt"}`, wantErr: "nope.txt"},
+		{name: "read dir", tool: "read_file", args: `{"path":"sub"}`, wantErr: "list_dir"},
+		{name: "read binary", tool: "read_file", args: `{"path":"bin.dat"}`, wantErr: "двоичный"},
+		{name: "read no path", tool: "read_file", args: `{}`, wantErr: "path"},
+		{name: "list root", tool: "list_dir", args: `{}`, want: []string{"app.log\t38", "sub" + string(filepath.Separator)}},
+		{name: "list sub", tool: "list_dir", args: `{"path":"sub"}`, want: []string{"deep.log", "empty"}},
+		{name: "list outside", tool: "list_dir", args: `{"path":` + strconv.Quote(outside) + `}`, wantErr: "доступ запрещен"},
+		{name: "grep", tool: "grep_files", args: `{"pattern":"ERROR"}`, want: []string{"app.log:2: ERROR disk full", "deep.log:1: ERROR deep"}, notWant: []string{"bin.dat", "secret", "error: retry"}},
+		{name: "grep ignore case", tool: "grep_files", args: `{"pattern":"error","ignore_case":true}`, want: []string{"app.log:4: error: retry", "notes.txt:2"}},
+		{name: "grep glob", tool: "grep_files", args: `{"pattern":"ERROR","glob":"*.txt"}`, want: []string{"Совпадений нет"}},
+		{name: "grep file", tool: "grep_files", args: `{"pattern":"ok","path":"app.log"}`, want: []string{"app.log:3: ok"}},
+		{name: "grep bad regexp", tool: "grep_files", args: `{"pattern":"("}`, wantErr: "регулярное"},
+		{name: "grep outside", tool: "grep_files", args: `{"pattern":"ERROR","path":"../outside"}`, wantErr: "доступ запрещен"},
+	}
+	for _, tt := range tests {
+		got, err := ts.Run(tt.tool, tt.args)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want mention of %q (got %q)", tt.name, err, tt.wantErr, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", tt.name, err)
+			continue
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%s: %q does not contain %q", tt.name, got, w)
+			}
+		}
+		for _, w := range tt.notWant {
+			if strings.Contains(got, w) {
+				t.Errorf("%s: %q contains %q", tt.name, got, w)
+			}
+		}
+	}
+
+	// Символическая ссылка наружу (на Windows создать ее может не получиться)
+	if os.Symlink(outside, filepath.Join(root, "escape")) == nil {
+		if _, err := ts.Run("read_file", `{"path":"escape/secret.txt"}`); err == nil || !strings.Contains(err.Error(), "доступ запрещен") {
+			t.Errorf("read through symlink: error = %v", err)
+		}
+	}
+}
+
+func TestReadFileParts(t *testing.T) {
+	withTempConfig(t)
+	root := t.TempDir()
+	// Граница части приходится на середину двухбайтового символа
+	content := strings.Repeat("a", ReadFileLimit-1) + strings.Repeat("я", 10)
+	if err := os.WriteFile(filepath.Join(root, "big.txt"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	roots := fileRoots{root}
+
+	var sb strings.Builder
+	offset := 0.0
+	for i := 0; i < 5; i++ {
+		got, err := roots.readFile(map[string]interface{}{"path": "big.txt", "offset": offset})
+		if err != nil {
+			t.Fatal(err)
+		}
+		part, rest, more := strings.Cut(got, "\n...[прочитано ")
+		sb.WriteString(part)
+		if !more {
+			break
+		}
+		var next int
+		if _, err := fmt.Sscanf(rest[strings.Index(rest, "offset=")+len("offset="):], "%d]", &next); err != nil {
+			t.Fatalf("part %d: no offset in %q", i, rest)
+		}
+		offset = float64(next)
+	}
+	if sb.String() != content {
+		t.Errorf("parts joined: %d bytes, want %d", sb.Len(), len(content))
+	}
+}
@@ -0,0 +1,286 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Форматы вывода (--output-format)
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+	OutputCSV  = "csv" // только для --usage-report
+)
+
+// Flags унифицированные флаги всех LLM-утилит (см. UNIFIED_FLAGS.md).
+// Флаги, которые конкретная утилита не поддерживает, просто игнорируются.
+type Flags struct {
+	Files            []string
+	System           string
+	Json             bool
+	Schema           string // файл JSON Schema ответа (включает Json)
+	Mode             string
+	Temp             float64 // -1, если не задана
+	Verbose          bool
+	SaveKey          string
+	SaveTavilyKey    string
+	ChatID           string
+	ClearChat        string
+	NoTools          bool
+	ExplainMode      bool   // печатать в stderr, какое правило mode_rules выбрало режим
+	ChunkSize        int    // размер части больших текстовых вложений в символах, 0 — из конфига
+	Strategy         string // обработка частей: map-reduce (по умолчанию) или refine
+	Srt              bool
+	Vtt              bool   // субтитры WebVTT для транскрибации
+	Language         string // язык аудио (ISO 639-1) для транскрибации, пусто — определить
+	Stream           bool
+	KeyStatus        bool
+	ResetKeys        bool
+	Endpoint         string  // именованный эндпоинт (openaillm)
+	ListModels       bool    // показать доступные модели и выйти (ollamallm)
+	Pull             string  // скачать модель и выйти (ollamallm)
+	OutputFormat     string  // text (по умолчанию) или json — конверт с метаданными
+	UsageReport      bool    // отчет по usage.jsonl и выход
+	GroupBy          string  // поля группировки отчета: day,provider,model,key
+	Pages            string  // страницы для OCR: "1-3,7" (mistral)
+	ImagesDir        string  // куда сохранять картинки страниц при OCR (mistral)
+	OCRFormat        string  // вывод OCR: markdown (по умолчанию), text, json (mistral)
+	AnnotationSchema string  // JSON Schema для структурированного OCR (mistral)
+	Embed            bool    // векторизовать строки stdin и текстовые файлы (mistral)
+	EmbedOut         string  // файл float32 для --embed, пусто — JSON в stdout
+	Prefix           string  // файл с кодом до курсора для -m fim (mistral)
+	Suffix           string  // файл с кодом после курсора для -m fim (mistral)
+	Moderate         bool    // оценить текст модерацией и выйти (mistral)
+	Threshold        float64 // порог модерации, -1 — из конфига
+	Help             bool
+}
+
+// ParseArgs разбирает аргументы командной строки.
+// Поддерживаются оба префикса (-flag и --flag) и запись --flag=value.
+func ParseArgs(args []string) *Flags {
+	flags := &Flags{
+		Mode:         "auto",
+		Temp:         -1.0,
+		Threshold:    -1.0,
+		OutputFormat: OutputText,
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+
+		key := strings.TrimLeft(arg, "-")
+		inlineValue, hasInline := "", false
+		if eq := strings.Index(key, "="); eq >= 0 {
+			key, inlineValue, hasInline = key[:eq], key[eq+1:], true
+		}
+
+		// value возвращает значение флага: после "=" или следующий аргумент
+		value := func() (string, bool) {
+			if hasInline {
+				return inlineValue, true
+			}
+			if i+1 < len(args) {
+				i++
+				return args[i], true
+			}
+			return "", false
+		}
+
+		switch key {
+		case "h", "help", "?":
+			flags.Help = true
+		case "f", "file":
+			if v, ok := value(); ok {
+				flags.Files = append(flags.Files, v)
+			}
+		case "s", "system", "system-prompt":
+			if v, ok := value(); ok {
+				flags.System = v
+			}
+		case "j", "json":
+			flags.Json = true
+		case "schema":
+			if v, ok := value(); ok {
+				flags.Schema = v
+			}
+		case "m", "mode":
+			if v, ok := value(); ok {
+				flags.Mode = v
+			}
+		case "t", "temp", "temperature":
+			if v, ok := value(); ok {
+				if val, err := strconv.ParseFloat(v, 64); err == nil {
+					flags.Temp = val
+				}
+			}
+		case "v", "verbose":
+			flags.Verbose = true
+		case "save-key":
+			if v, ok := value(); ok {
+				flags.SaveKey = v
+			}
+		case "save-tavily-key", "add-tavily-key":
+			if v, ok := value(); ok {
+				flags.SaveTavilyKey = v
+			}
+		case "chat", "chat-id":
+			if v, ok := value(); ok {
+				flags.ChatID = v
+			}
+		case "clear-chat":
+			if v, ok := value(); ok {
+				flags.ClearChat = v
+			}
+		case "explain-mode":
+			flags.ExplainMode = true
+		case "chunk-size":
+			if v, ok := value(); ok {
+				if n, err := strconv.Atoi(v); err == nil && n > 0 {
+					flags.ChunkSize = n
+				}
+			}
+		case "strategy":
+			if v, ok := value(); ok {
+				flags.Strategy = strings.ToLower(strings.TrimSpace(v))
+			}
+		case "no-tools":
+			flags.NoTools = true
+		case "tools":
+			// устаревший флаг: инструменты включены по умолчанию
+		case "srt":
+			flags.Srt = true
+		case "vtt":
+			flags.Vtt = true
+		case "language", "lang":
+			if v, ok := value(); ok {
+				flags.Language = strings.ToLower(strings.TrimSpace(v))
+			}
+		case "stream":
+			flags.Stream = true
+		case "key-status":
+			flags.KeyStatus = true
+		case "reset-keys":
+			flags.ResetKeys = true
+		case "endpoint":
+			if v, ok := value(); ok {
+				flags.Endpoint = v
+			}
+		case "list-models":
+			flags.ListModels = true
+		case "pull":
+			if v, ok := value(); ok {
+				flags.Pull = v
+			}
+		case "usage-report":
+			flags.UsageReport = true
+		case "group-by":
+			if v, ok := value(); ok {
+				flags.GroupBy = v
+			}
+		case "pages":
+			if v, ok := value(); ok {
+				flags.Pages = v
+			}
+		case "images-dir":
+			if v, ok := value(); ok {
+				flags.ImagesDir = v
+			}
+		case "ocr-format":
+			if v, ok := value(); ok {
+				flags.OCRFormat = strings.ToLower(v)
+			}
+		case "annotation-schema":
+			if v, ok := value(); ok {
+				flags.AnnotationSchema = v
+			}
+		case "embed":
+			flags.Embed = true
+		case "embed-out":
+			if v, ok := value(); ok {
+				flags.EmbedOut = v
+			}
+		case "prefix":
+			if v, ok := value(); ok {
+				flags.Prefix = v
+			}
+		case "suffix":
+			if v, ok := value(); ok {
+				flags.Suffix = v
+			}
+		case "moderate":
+			flags.Moderate = true
+		case "threshold":
+			if v, ok := value(); ok {
+				if val, err := strconv.ParseFloat(v, 64); err == nil {
+					flags.Threshold = val
+				}
+			}
+		case "output-format":
+			if v, ok := value(); ok {
+				flags.OutputFormat = strings.ToLower(v)
+			}
+		}
+	}
+
+	// Конверт печатается целиком в конце, поток текста его бы испортил
+	if flags.OutputFormat == OutputJSON {
+		flags.Stream = false
+		JSONErrors = true
+	}
+	// Ответ по схеме проверяется целиком и может быть запрошен повторно
+	if flags.Schema != "" {
+		flags.Json = true
+		flags.Stream = false
+	}
+
+	return flags
+}
+
+// MaxPage наибольший номер страницы в --pages: защита от диапазонов
+// вроде 1-2000000000, которые иначе разворачиваются в миллиарды номеров.
+const MaxPage = 10000
+
+// ParsePages разбирает список страниц вида "1-3,7" (нумерация с 1) и
+// возвращает отсортированные номера с нуля, как их ждут OCR API.
+// Пустая строка — все страницы (nil).
+func ParsePages(value string) ([]int, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	seen := map[int]bool{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			from, to = strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+		}
+		first, err1 := strconv.Atoi(from)
+		last, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || first < 1 || last < first {
+			return nil, fmt.Errorf("неверный диапазон страниц '%s' (пример: 1-3,7)", part)
+		}
+		if last > MaxPage {
+			return nil, fmt.Errorf("номер страницы в '%s' больше %d", part, MaxPage)
+		}
+		for n := first; n <= last; n++ {
+			seen[n-1] = true
+		}
+	}
+	if len(seen) == 0 {
+		return nil, fmt.Errorf("пустой список страниц '%s'", value)
+	}
+	pages := make([]int, 0, len(seen))
+	for n := range seen {
+		pages = append(pages, n)
+	}
+	sort.Ints(pages)
+	return pages, nil
+}
@@ -0,0 +1,73 @@
+package provider
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParsePages(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []int
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "  ", want: nil},
+		{value: "1", want: []int{0}},
+		{value: "1-3,7", want: []int{0, 1, 2, 6}},
+		{value: "7, 2-3 ,2", want: []int{1, 2, 6}},
+		{value: "3-3", want: []int{2}},
+		{value: fmt.Sprintf("%d", MaxPage), want: []int{MaxPage - 1}},
+		{value: fmt.Sprintf("%d-%d", MaxPage+1, MaxPage+2), wantErr: true},
+		{value: "1-2000000000", wantErr: true},
+		{value: "0", wantErr: true},
+		{value: "3-1", wantErr: true},
+		{value: "-2", wantErr: true},
+		{value: "a-b", wantErr: true},
+		{value: ",", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePages(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePages(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParsePages(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	defer func() { JSONErrors = false }()
+
+	tests := []struct {
+		name  string
+		args  []string
+		check func(f *Flags) bool
+	}{
+		{"defaults", nil, func(f *Flags) bool {
+			return f.Mode == "auto" && f.Temp == -1 && f.Threshold == -1 && f.OutputFormat == OutputText
+		}},
+		{"inline and separate values", []string{"--file=a.txt", "-f", "b.txt", "-m", "code"}, func(f *Flags) bool {
+			return reflect.DeepEqual(f.Files, []string{"a.txt", "b.txt"}) && f.Mode == "code"
+		}},
+		{"temperature", []string{"-t", "0.3"}, func(f *Flags) bool { return f.Temp == 0.3 }},
+		{"bad temperature keeps default", []string{"-t", "hot"}, func(f *Flags) bool { return f.Temp == -1 }},
+		{"chat alias", []string{"--chat-id", "work"}, func(f *Flags) bool { return f.ChatID == "work" }},
+		{"positional arguments ignored", []string{"hello", "-j"}, func(f *Flags) bool { return f.Json }},
+		{"json output disables stream", []string{"--stream", "--output-format", "JSON"}, func(f *Flags) bool {
+			return !f.Stream && f.OutputFormat == OutputJSON
+		}},
+		{"schema implies json", []string{"--stream", "--schema", "s.json"}, func(f *Flags) bool {
+			return f.Json && !f.Stream && f.Schema == "s.json"
+		}},
+		{"missing value", []string{"-s"}, func(f *Flags) bool { return f.System == "" }},
+	}
+	for _, tt := range tests {
+		if f := ParseArgs(tt.args); !tt.check(f) {
+			t.Errorf("%s: ParseArgs(%q) = %+v", tt.name, tt.args, f)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package provider
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ChatDirName папка с историями чатов. Формат исторически пришел из mistral
+// и общий для всех утилит, поэтому чат можно продолжать с другим провайдером.
+const ChatDirName = "mistral_chats"
+
+// ChatMessageHistory одно сохраненное сообщение.
+// Content — строка или массив частей в формате OpenAI (text / image_url / input_audio).
+// Кроме user и assistant в истории бывают вызовы инструментов: assistant
+// с ToolCalls и ответы на них с ролью tool.
+type ChatMessageHistory struct {
+	Role       string            `json:"role"`
+	Content    interface{}       `json:"content"`
+	ToolCalls  []HistoryToolCall `json:"tool_calls,omitempty"`   // вызовы инструментов (assistant)
+	ToolCallID string            `json:"tool_call_id,omitempty"` // на какой вызов ответ (tool)
+	Name       string            `json:"name,omitempty"`         // имя инструмента (tool)
+	Size       int               `json:"size"`
+	Timestamp  time.Time         `json:"timestamp"`
+}
+
+// HistoryToolCall вызов инструмента в истории чата.
+type HistoryToolCall struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	// Signature thoughtSignature Gemini: без нее Gemini 3 не принимает
+	// свой вызов функции обратно
+	Signature string `json:"thought_signature,omitempty"`
+}
+
+// ChatHistory файл истории одного чата.
+type ChatHistory struct {
+	ID       string               `json:"id"`
+	Messages []ChatMessageHistory `json:"messages"`
+}
+
+// HistoryLimits ограничения размера истории.
+type HistoryLimits struct {
+	MaxMessages   int
+	MaxChars      int
+	ImageCharCost int
+	ToolChars     int // результат инструмента в истории, символов (0 — вызовы не сохраняются)
+}
+
+// ChatDir возвращает папку историй, создавая ее при необходимости.
+func ChatDir() (string, error) {
+	dir, err := AppDataDir()
+	if err != nil {
+		return "", err
+	}
+	chatDir := filepath.Join(dir, ChatDirName)
+	if _, err := os.Stat(chatDir); os.IsNotExist(err) {
+		_ = os.MkdirAll(chatDir, 0755)
+	}
+	return chatDir, nil
+}
+
+// ChatFilePath возвращает путь к файлу истории чата.
+func ChatFilePath(chatID string) (string, error) {
+	chatDir, err := ChatDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(chatDir, chatID+".json"), nil
+}
+
+// LoadChatHistory загружает историю. Если файла нет — возвращает пустую.
+func LoadChatHistory(chatID string) (*ChatHistory, error) {
+	chatFilePath, err := ChatFilePath(chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(chatFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &ChatHistory{ID: chatID, Messages: []ChatMessageHistory{}}, nil
+		}
+		return nil, err
+	}
+
+	var history ChatHistory
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, err
+	}
+	if history.ID == "" {
+		history.ID = chatID
+	}
+
+	return &history, nil
+}
+
+// SaveChatHistory записывает историю на диск.
+func SaveChatHistory(history *ChatHistory) error {
+	chatFilePath, err := ChatFilePath(history.ID)
+	if err != nil {
+		return err
+	}
+	return SaveJSON(chatFilePath, history)
+}
+
+// ClearChatHistory удаляет файл истории чата.
+func ClearChatHistory(chatID string) error {
+	chatFilePath, err := ChatFilePath(chatID)
+	if err != nil {
+		return err
+	}
+	return os.Remove(chatFilePath)
+}
+
+// Append добавляет сообщение в историю, вычисляя его "вес".
+func (h *ChatHistory) Append(role string, content interface{}, imageCharCost int) {
+	h.AppendMessage(ChatMessageHistory{Role: role, Content: content}, imageCharCost)
+}
+
+// AppendMessage добавляет готовое сообщение (в том числе с вызовами
+// инструментов), вычисляя его "вес" и время.
+func (h *ChatHistory) AppendMessage(msg ChatMessageHistory, imageCharCost int) {
+	msg.Size = MessageSize(msg.Content, imageCharCost)
+	for _, call := range msg.ToolCalls {
+		msg.Size += len(call.Name) + len(call.Arguments)
+	}
+	msg.Timestamp = time.Now()
+	h.Messages = append(h.Messages, msg)
+}
+
+// Replay сообщения истории для запроса к модели. Без инструментов
+// (--no-tools, утилиты без function calling) вызовы и их результаты
+// пропускаются: API не примет tool-сообщения без описания инструментов,
+// а итоговый ответ ассистента в истории все равно есть.
+func (h *ChatHistory) Replay(tools bool) []ChatMessageHistory {
+	if h == nil {
+		return nil
+	}
+	var out []ChatMessageHistory
+	for _, msg := range h.Messages {
+		if !tools {
+			if msg.Role == "tool" {
+				continue
+			}
+			if len(msg.ToolCalls) > 0 {
+				if text, ok := msg.Content.(string); ok && strings.TrimSpace(text) == "" {
+					continue
+				}
+				msg.ToolCalls = nil
+			}
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+// ApplyLimits удаляет самые старые сообщения, пока история не влезет в лимиты.
+func (h *ChatHistory) ApplyLimits(limits HistoryLimits) {
+	maxMessages := limits.MaxMessages
+	if maxMessages == 0 {
+		maxMessages = DefaultChatHistoryMaxMessages
+	}
+	maxChars := limits.MaxChars
+	if maxChars == 0 {
+		maxChars = DefaultChatHistoryMaxChars
+	}
+
+	if len(h.Messages) > maxMessages {
+		h.Messages = h.Messages[len(h.Messages)-maxMessages:]
+	}
+
+	totalSize := 0
+	for _, msg := range h.Messages {
+		totalSize += msg.Size
+	}
+
+	for totalSize > maxChars && len(h.Messages) > 0 {
+		totalSize -= h.Messages[0].Size
+		h.Messages = h.Messages[1:]
+	}
+
+	// История начинается с вопроса пользователя: ответ или результат
+	// инструмента без своего вызова API не примет
+	for len(h.Messages) > 0 && h.Messages[0].Role != "user" {
+		h.Messages = h.Messages[1:]
+	}
+}
+
+// SaveExchange добавляет пару "вопрос-ответ", применяет лимиты и сохраняет файл.
+func SaveExchange(h *ChatHistory, userContent interface{}, answer string, limits HistoryLimits) error {
+	return SaveToolExchange(h, userContent, nil, answer, limits)
+}
+
+// SaveToolExchange как SaveExchange, но между вопросом и ответом сохраняет
+// вызовы инструментов и их результаты (Response.ToolMessages), чтобы
+// в следующих репликах модель их видела. Результаты длиннее
+// limits.ToolChars обрезаются; при ToolChars 0 вызовы не сохраняются,
+// а текст ходов с вызовами (с --stream пользователь его уже видел)
+// дописывается перед ответом.
+func SaveToolExchange(h *ChatHistory, userContent interface{}, toolMessages []ChatMessageHistory, answer string, limits HistoryLimits) error {
+	imageCharCost := limits.ImageCharCost
+	if imageCharCost == 0 {
+		imageCharCost = DefaultImageCharCost
+	}
+	h.Append("user", userContent, imageCharCost)
+	var shown string
+	for _, msg := range toolMessages {
+		if limits.ToolChars <= 0 {
+			if msg.Role == "assistant" {
+				shown += ContentText(msg.Content)
+			}
+			continue
+		}
+		if text, ok := msg.Content.(string); ok && msg.Role == "tool" {
+			msg.Content = truncateToolResult(text, limits.ToolChars)
+		}
+		h.AppendMessage(msg, imageCharCost)
+	}
+	h.Append("assistant", shown+answer, imageCharCost)
+	h.ApplyLimits(limits)
+	return SaveChatHistory(h)
+}
+
+// truncateToolResult обрезает результат инструмента до maxChars символов.
+func truncateToolResult(text string, maxChars int) string {
+	if utf8.RuneCountInString(text) <= maxChars {
+		return text
+	}
+	return string([]rune(text)[:maxChars]) + "\n...[обрезано при сохранении в историю]"
+}
+
+// ContentText возвращает текст сообщения истории: строку как есть, а из
+// массива частей (так user-сообщения с вложениями сохраняют mistral
+// и pollinationsllm) — текстовые части через перевод строки.
+// Картинки и аудио пропускаются — для провайдеров, которые принимают
+// в истории только текст.
+func ContentText(content interface{}) string {
+	if s, ok := content.(string); ok {
+		return s
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return ""
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return ""
+	}
+	var texts []string
+	for _, part := range parts {
+		if part.Type == "text" && part.Text != "" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// MessageSize оценивает размер сообщения в символах.
+// Изображения считаются за фиксированную стоимость, аудио — по длине base64.
+func MessageSize(content interface{}, imageCharCost int) int {
+	if s, ok := content.(string); ok {
+		return len(s)
+	}
+
+	// Части контента могут быть типизированными структурами провайдера
+	// или уже распарсенными map, поэтому приводим к общему виду через JSON.
+	data, err := json.Marshal(content)
+	if err != nil {
+		return 0
+	}
+	var parts []struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		InputAudio *struct {
+			Data string `json:"data"`
+		} `json:"input_audio"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return len(data)
+	}
+
+	size := 0
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			size += len(part.Text)
+		case "image_url":
+			size += imageCharCost
+		case "input_audio":
+			if part.InputAudio != nil {
+				size += len(part.InputAudio.Data)
+			}
+		}
+	}
+	return size
+}
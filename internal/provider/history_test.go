@@ -0,0 +1,192 @@
+package provider
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// toolExchange вызов инструмента и его результат, как их собирает CLI.
+func toolExchange(result string) []ChatMessageHistory {
+	return []ChatMessageHistory{
+		{Role: "assistant", Content: "", ToolCalls: []HistoryToolCall{{ID: "abc123XYZ", Name: "calculator", Arguments: `{"expression":"2+2"}`}}},
+		{Role: "tool", Content: result, ToolCallID: "abc123XYZ", Name: "calculator"},
+	}
+}
+
+func roles(msgs []ChatMessageHistory) string {
+	var r []string
+	for _, m := range msgs {
+		r = append(r, m.Role)
+	}
+	return strings.Join(r, ",")
+}
+
+func TestSaveToolExchange(t *testing.T) {
+	withTempConfig(t)
+	tests := []struct {
+		name       string
+		toolChars  int
+		result     string
+		wantRoles  string
+		wantResult string
+	}{
+		{name: "saved", toolChars: 100, result: "4", wantRoles: "user,assistant,tool,assistant", wantResult: "4"},
+		{name: "truncated", toolChars: 3, result: "абвгд", wantRoles: "user,assistant,tool,assistant", wantResult: "абв\n...[обрезано при сохранении в историю]"},
+		{name: "disabled", toolChars: 0, result: "4", wantRoles: "user,assistant"},
+	}
+	for _, tt := range tests {
+		h := &ChatHistory{ID: "tools-" + tt.name}
+		exchange := toolExchange(tt.result)
+		exchange[0].Content = "Считаю. "
+		if err := SaveToolExchange(h, "2+2?", exchange, "4", HistoryLimits{ToolChars: tt.toolChars}); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		loaded, err := LoadChatHistory(h.ID)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := roles(loaded.Messages); got != tt.wantRoles {
+			t.Errorf("%s: roles = %s, want %s", tt.name, got, tt.wantRoles)
+			continue
+		}
+		// Текст хода с вызовом (при --stream уже выведенный) не теряется
+		if tt.wantResult == "" {
+			if answer := loaded.Messages[1].Content; answer != "Считаю. 4" {
+				t.Errorf("%s: answer = %q, want text of the tool turn kept", tt.name, answer)
+			}
+			continue
+		}
+		call, tool := loaded.Messages[1], loaded.Messages[2]
+		if call.Content != "Считаю. " {
+			t.Errorf("%s: call content = %q", tt.name, call.Content)
+		}
+		if !reflect.DeepEqual(call.ToolCalls, toolExchange("")[0].ToolCalls) || call.Size == 0 {
+			t.Errorf("%s: call = %+v", tt.name, call)
+		}
+		if tool.Content != tt.wantResult || tool.ToolCallID != "abc123XYZ" || tool.Name != "calculator" {
+			t.Errorf("%s: tool = %+v, want content %q", tt.name, tool, tt.wantResult)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	h := &ChatHistory{Messages: []ChatMessageHistory{{Role: "user", Content: "q1"}}}
+	h.Messages = append(h.Messages, toolExchange("4")...)
+	h.Messages = append(h.Messages,
+		ChatMessageHistory{Role: "assistant", Content: "a1"},
+		ChatMessageHistory{Role: "user", Content: "q2"},
+		ChatMessageHistory{Role: "assistant", Content: "checking", ToolCalls: []HistoryToolCall{{ID: "def456XYZ", Name: "fetch_url"}}},
+		ChatMessageHistory{Role: "tool", Content: "page", ToolCallID: "def456XYZ", Name: "fetch_url"},
+		ChatMessageHistory{Role: "assistant", Content: "a2"},
+	)
+
+	tests := []struct {
+		name      string
+		h         *ChatHistory
+		tools     bool
+		wantRoles string
+	}{
+		{name: "with tools", h: h, tools: true, wantRoles: "user,assistant,tool,assistant,user,assistant,tool,assistant"},
+		{name: "without tools", h: h, tools: false, wantRoles: "user,assistant,user,assistant,assistant"},
+		{name: "nil history", h: nil, tools: true, wantRoles: ""},
+	}
+	for _, tt := range tests {
+		got := tt.h.Replay(tt.tools)
+		if r := roles(got); r != tt.wantRoles {
+			t.Errorf("%s: roles = %s, want %s", tt.name, r, tt.wantRoles)
+			continue
+		}
+		if tt.tools {
+			continue
+		}
+		for _, m := range got {
+			if len(m.ToolCalls) > 0 {
+				t.Errorf("%s: %+v still has tool calls", tt.name, m)
+			}
+		}
+	}
+	if len(h.Messages[5].ToolCalls) == 0 {
+		t.Errorf("Replay modified the history")
+	}
+}
+
+func TestApplyLimitsStartsWithUser(t *testing.T) {
+	h := &ChatHistory{}
+	h.Append("user", "q1", 0)
+	for _, m := range toolExchange("4") {
+		h.AppendMessage(m, 0)
+	}
+	h.Append("assistant", "a1", 0)
+	h.Append("user", "q2", 0)
+	h.Append("assistant", "a2", 0)
+
+	tests := []struct {
+		maxMessages int
+		wantRoles   string
+	}{
+		{maxMessages: 10, wantRoles: "user,assistant,tool,assistant,user,assistant"},
+		{maxMessages: 5, wantRoles: "user,assistant"},
+		{maxMessages: 2, wantRoles: "user,assistant"},
+	}
+	for _, tt := range tests {
+		c := &ChatHistory{Messages: append([]ChatMessageHistory(nil), h.Messages...)}
+		c.ApplyLimits(HistoryLimits{MaxMessages: tt.maxMessages})
+		if got := roles(c.Messages); got != tt.wantRoles {
+			t.Errorf("MaxMessages %d: roles = %s, want %s", tt.maxMessages, got, tt.wantRoles)
+		}
+	}
+}
+
+func TestNewToolCallID(t *testing.T) {
+	re := regexp.MustCompile(`^[a-zA-Z0-9]{9}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id := NewToolCallID()
+		if !re.MatchString(id) {
+			t.Fatalf("NewToolCallID() = %q", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) < 99 {
+		t.Errorf("NewToolCallID repeats: %d unique of 100", len(seen))
+	}
+}
+
+// mixedHistory история, в которую писали разные утилиты: mistral и
+// pollinationsllm сохраняют сообщение с вложениями массивом частей.
+const mixedHistory = `{"id":"mixed","messages":[
+	{"role":"user","content":[{"type":"text","text":"what is on the picture?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}},{"type":"text","text":"--- File: n.txt ---"}]},
+	{"role":"assistant","content":"a cat"},
+	{"role":"user","content":[{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}}]},
+	{"role":"assistant","content":"","tool_calls":[{"id":"abc123XYZ","name":"calculator","arguments":"{\"expression\":\"2+2\"}"}]},
+	{"role":"tool","content":"4","tool_call_id":"abc123XYZ","name":"calculator"},
+	{"role":"assistant","content":"4"}
+]}`
+
+func TestContentText(t *testing.T) {
+	var h ChatHistory
+	if err := json.Unmarshal([]byte(mixedHistory), &h); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"what is on the picture?\n--- File: n.txt ---", "a cat", "", "", "4", "4"}
+	for i, m := range h.Messages {
+		if got := ContentText(m.Content); got != want[i] {
+			t.Errorf("message %d: ContentText = %q, want %q", i, got, want[i])
+		}
+	}
+
+	// Части в виде структур провайдера, а не распарсенного JSON
+	typed := []struct {
+		Type string `json:"type"`
+		Text string `json:"text,omitempty"`
+	}{{Type: "text", Text: "typed"}, {Type: "input_audio"}}
+	if got := ContentText(typed); got != "typed" {
+		t.Errorf("ContentText(typed parts) = %q", got)
+	}
+	if got := ContentText(nil); got != "" {
+		t.Errorf("ContentText(nil) = %q", got)
+	}
+}
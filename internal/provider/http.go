@@ -0,0 +1,211 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultHTTPTimeout таймаут запроса, если провайдер не задал свой.
+const DefaultHTTPTimeout = 300 * time.Second
+
+// HTTPError ответ API со статусом >= 400.
+// Решения о повторах принимаются по StatusCode и Code, а не по тексту ошибки.
+type HTTPError struct {
+	StatusCode int
+	Code       string // код ошибки провайдера из тела (error.code / error.status / error.type)
+	Message    string // error.message из тела, если удалось разобрать
+	Body       string
+	// RetryAfter сколько сервер просит подождать (Retry-After,
+	// x-ratelimit-reset-*, retryDelay в теле). 0 — неизвестно.
+	RetryAfter time.Duration
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body)
+}
+
+// AsHTTPError достает HTTPError из цепочки ошибок.
+func AsHTTPError(err error) (*HTTPError, bool) {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr, true
+	}
+	return nil, false
+}
+
+// RetryAfterOf возвращает подсказку сервера о времени ожидания или 0.
+func RetryAfterOf(err error) time.Duration {
+	if httpErr, ok := AsHTTPError(err); ok {
+		return httpErr.RetryAfter
+	}
+	return retryDelayFromText(err.Error())
+}
+
+// newHTTPError разбирает статус, заголовки и тело ответа с ошибкой.
+func newHTTPError(resp *http.Response, body []byte) *HTTPError {
+	e := &HTTPError{
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+	}
+	e.Code, e.Message = parseErrorBody(body)
+	e.RetryAfter = parseRetryAfter(resp.Header, time.Now())
+	if e.RetryAfter == 0 {
+		e.RetryAfter = retryDelayFromText(e.Body)
+	}
+	return e
+}
+
+// parseErrorBody понимает оба распространенных формата:
+// {"error": {"code", "status", "type", "message"}} (OpenAI, Gemini, Azure)
+// и плоский {"code", "type", "message"} (Mistral).
+func parseErrorBody(body []byte) (code, message string) {
+	type errorFields struct {
+		Code    interface{} `json:"code"`
+		Status  string      `json:"status"`
+		Type    string      `json:"type"`
+		Message string      `json:"message"`
+	}
+	var parsed struct {
+		errorFields
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(body, &parsed) != nil {
+		return "", ""
+	}
+
+	fields := parsed.errorFields
+	var nested errorFields
+	if len(parsed.Error) > 0 && json.Unmarshal(parsed.Error, &nested) == nil {
+		fields = nested
+	} else if len(parsed.Error) > 0 {
+		// {"error": "текст"}
+		var text string
+		if json.Unmarshal(parsed.Error, &text) == nil {
+			fields.Message = text
+		}
+	}
+
+	// Строковый код информативнее числового (Gemini: code 429, status RESOURCE_EXHAUSTED)
+	textCode, _ := fields.Code.(string)
+	switch {
+	case textCode != "":
+		code = textCode
+	case fields.Status != "":
+		code = fields.Status
+	case fields.Type != "":
+		code = fields.Type
+	case fields.Code != nil:
+		code = fmt.Sprint(fields.Code)
+	}
+	return code, fields.Message
+}
+
+// parseRetryAfter читает Retry-After (секунды или HTTP-дата) и
+// x-ratelimit-reset-* (Groq/OpenAI: "7.66s", "1m2s", "20ms").
+func parseRetryAfter(h http.Header, now time.Time) time.Duration {
+	if v := strings.TrimSpace(h.Get("Retry-After")); v != "" {
+		if sec, err := strconv.ParseFloat(v, 64); err == nil && sec > 0 {
+			return time.Duration(sec * float64(time.Second))
+		}
+		if t, err := http.ParseTime(v); err == nil && t.After(now) {
+			return t.Sub(now)
+		}
+	}
+
+	// Берем наибольшее из ограничений: по запросам и по токенам
+	var longest time.Duration
+	for _, name := range []string{"X-Ratelimit-Reset-Requests", "X-Ratelimit-Reset-Tokens", "X-Ratelimit-Reset"} {
+		v := strings.TrimSpace(h.Get(name))
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			sec, ferr := strconv.ParseFloat(v, 64)
+			if ferr != nil {
+				continue
+			}
+			if sec > 1e9 {
+				// Unix-время сброса лимита
+				d = time.Unix(int64(sec), 0).Sub(now)
+			} else {
+				d = time.Duration(sec * float64(time.Second))
+			}
+		}
+		if d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
+
+// Время ожидания из текста ошибки: Gemini ("retryDelay": "36s"),
+// Groq/OpenAI ("try again in 7.66s")
+var retryDelayRe = regexp.MustCompile(`(?i)(?:retrydelay"?\s*:\s*"|try again in\s+)([\d.]+)s`)
+
+func retryDelayFromText(text string) time.Duration {
+	if m := retryDelayRe.FindStringSubmatch(text); m != nil {
+		if sec, err := strconv.ParseFloat(m[1], 64); err == nil && sec > 0 {
+			return time.Duration(sec * float64(time.Second))
+		}
+	}
+	return 0
+}
+
+// DoHTTP выполняет POST-запрос и возвращает тело ответа.
+// Если apiKey пустой, заголовок Authorization не ставится
+// (Gemini передает ключ в URL, Pollinations работает без ключа).
+// При статусе >= 400 возвращает *HTTPError.
+func DoHTTP(apiKey, url, contentType string, body []byte, timeout time.Duration) ([]byte, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return doRequest(req, apiKey, timeout)
+}
+
+// DoGet выполняет GET-запрос (списки моделей и т.п.) и возвращает тело ответа.
+func DoGet(apiKey, url string, timeout time.Duration) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return doRequest(req, apiKey, timeout)
+}
+
+func doRequest(req *http.Request, apiKey string, timeout time.Duration) ([]byte, error) {
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	if timeout == 0 {
+		timeout = DefaultHTTPTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		return nil, newHTTPError(resp, respBody)
+	}
+
+	return respBody, nil
+}
@@ -0,0 +1,57 @@
+package provider
+
+import (
+	"math/rand"
+	"regexp"
+	"strings"
+)
+
+// RandomKey возвращает случайный ключ, которого нет в exclude, или "".
+func RandomKey(keys []string, exclude map[string]bool) string {
+	validKeys := []string{}
+	for _, k := range keys {
+		if !exclude[k] {
+			validKeys = append(validKeys, k)
+		}
+	}
+	if len(validKeys) == 0 {
+		return ""
+	}
+	return validKeys[rand.Intn(len(validKeys))]
+}
+
+// ShuffleKeys возвращает перемешанную копию списка ключей.
+func ShuffleKeys(keys []string) []string {
+	shuffled := make([]string, len(keys))
+	copy(shuffled, keys)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
+
+// MaskKey оставляет от ключа только последние 4 символа для логов.
+func MaskKey(k string) string {
+	if k == "" {
+		return "none"
+	}
+	if len(k) <= 4 {
+		return "..."
+	}
+	return "..." + k[len(k)-4:]
+}
+
+// keyParam ключ в query-параметрах URL (Gemini передает его как ?key=...)
+var keyParam = regexp.MustCompile(`(?i)([?&](?:key|api_key|apikey|access_token|token)=)[^&\s"']+`)
+
+// RedactKeys убирает из текста ошибки ключи: значения параметров key=
+// в URL и известные ключи целиком (заменяются на MaskKey).
+func RedactKeys(msg string, keys ...string) string {
+	msg = keyParam.ReplaceAllString(msg, "${1}***")
+	for _, k := range keys {
+		if len(k) > 4 {
+			msg = strings.ReplaceAll(msg, k, MaskKey(k))
+		}
+	}
+	return msg
+}
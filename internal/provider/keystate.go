@@ -0,0 +1,289 @@
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimitCooldown сколько ключ отдыхает после 429,
+// если сервер не сообщил точное время ожидания.
+const DefaultRateLimitCooldown = 60 * time.Second
+
+// keyStateMu упорядочивает Save параллельных Runner одного процесса.
+var keyStateMu sync.Mutex
+
+// KeyHealth состояние одного ключа между запусками утилиты.
+type KeyHealth struct {
+	Masked        string    `json:"masked"` // для --key-status, сам ключ в файл не пишется
+	Banned        bool      `json:"banned,omitempty"`
+	CooldownUntil time.Time `json:"cooldown_until,omitempty"`
+	LastSuccess   time.Time `json:"last_success,omitempty"`
+	LastFailure   time.Time `json:"last_failure,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+	Successes     int       `json:"successes"`
+	Failures      int       `json:"failures"`
+}
+
+// KeyState файл <provider>_keystate.json в папке конфигов.
+// Ключи хранятся по отпечатку (sha256), а не в открытом виде.
+type KeyState struct {
+	Keys map[string]*KeyHealth `json:"keys"`
+
+	path    string
+	pending []func(*KeyState) // изменения этого запуска, см. Save
+}
+
+// KeyStatePath возвращает путь к файлу состояния ключей провайдера.
+func KeyStatePath(providerName string) (string, error) {
+	return ConfigPath(providerName + "_keystate.json")
+}
+
+// LoadKeyState загружает состояние ключей. Если файла нет — возвращает пустое.
+func LoadKeyState(providerName string) (*KeyState, error) {
+	path, err := KeyStatePath(providerName)
+	if err != nil {
+		return &KeyState{Keys: map[string]*KeyHealth{}}, err
+	}
+	return loadKeyStateFile(path)
+}
+
+func loadKeyStateFile(path string) (*KeyState, error) {
+	state := &KeyState{Keys: map[string]*KeyHealth{}, path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return &KeyState{Keys: map[string]*KeyHealth{}, path: path}, err
+	}
+	if state.Keys == nil {
+		state.Keys = map[string]*KeyHealth{}
+	}
+	return state, nil
+}
+
+// Save записывает состояние на диск. Перед записью файл перечитывается и
+// изменения этого запуска накладываются поверх: параллельно запущенные
+// утилиты одного провайдера не затирают друг другу результаты.
+func (s *KeyState) Save() error {
+	if s.path == "" || len(s.pending) == 0 {
+		return nil
+	}
+	// Части больших вложений идут параллельно, у каждой свой KeyState
+	keyStateMu.Lock()
+	defer keyStateMu.Unlock()
+
+	fresh, err := loadKeyStateFile(s.path)
+	if err != nil {
+		Logf("Файл состояния ключей поврежден, создаем заново: %v", err)
+	}
+	for _, apply := range s.pending {
+		apply(fresh)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := SaveJSON(tmpPath, fresh); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+	s.Keys = fresh.Keys
+	s.pending = nil
+	return nil
+}
+
+// ResetKeyState удаляет файл состояния ключей провайдера.
+func ResetKeyState(providerName string) error {
+	path, err := KeyStatePath(providerName)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *KeyState) health(key string) *KeyHealth {
+	id := keyFingerprint(key)
+	h, ok := s.Keys[id]
+	if !ok {
+		h = &KeyHealth{}
+		s.Keys[id] = h
+	}
+	h.Masked = MaskKey(key)
+	return h
+}
+
+// update применяет изменение сразу и запоминает его для Save.
+// Пустой ключ (провайдеры без авторизации) не отслеживается.
+func (s *KeyState) update(key string, apply func(h *KeyHealth)) {
+	if key == "" {
+		return
+	}
+	change := func(st *KeyState) { apply(st.health(key)) }
+	change(s)
+	s.pending = append(s.pending, change)
+}
+
+// Available сообщает, можно ли сейчас использовать ключ.
+func (s *KeyState) Available(key string, now time.Time) bool {
+	h, ok := s.Keys[keyFingerprint(key)]
+	if !ok {
+		return true
+	}
+	return !h.Banned && !now.Before(h.CooldownUntil)
+}
+
+// Filter возвращает ключи, которые не забанены и не ждут окончания лимита.
+func (s *KeyState) Filter(keys []string) []string {
+	now := time.Now()
+	var result []string
+	for _, k := range keys {
+		if s.Available(k, now) {
+			result = append(result, k)
+		}
+	}
+	return result
+}
+
+// RecordSuccess отмечает успешный запрос: ключ снова считается здоровым.
+func (s *KeyState) RecordSuccess(key string) {
+	now := time.Now()
+	s.update(key, func(h *KeyHealth) {
+		h.Successes++
+		h.LastSuccess = now
+		h.Banned = false
+		h.CooldownUntil = time.Time{}
+	})
+}
+
+// RecordBan отмечает ключ как невалидный (401/403) до сброса состояния.
+func (s *KeyState) RecordBan(key string, err error) {
+	s.recordFailure(key, err, func(h *KeyHealth) { h.Banned = true })
+}
+
+// RecordRateLimit отправляет ключ отдыхать на cooldown (429).
+func (s *KeyState) RecordRateLimit(key string, cooldown time.Duration, err error) {
+	until := time.Now().Add(cooldown)
+	s.recordFailure(key, err, func(h *KeyHealth) {
+		if until.After(h.CooldownUntil) {
+			h.CooldownUntil = until
+		}
+	})
+}
+
+// RecordFailure учитывает прочую ошибку без блокировки ключа.
+func (s *KeyState) RecordFailure(key string, err error) {
+	s.recordFailure(key, err, nil)
+}
+
+func (s *KeyState) recordFailure(key string, err error, extra func(h *KeyHealth)) {
+	now := time.Now()
+	msg := ""
+	if err != nil {
+		// Текст ошибки печатается в --key-status и лежит в файле,
+		// ключ в нем оставлять нельзя (Gemini: ...?key=...)
+		msg = RedactKeys(err.Error(), key)
+		if r := []rune(msg); len(r) > 200 {
+			msg = string(r[:200]) + "..."
+		}
+	}
+	s.update(key, func(h *KeyHealth) {
+		h.Failures++
+		h.LastFailure = now
+		h.LastError = msg
+		if extra != nil {
+			extra(h)
+		}
+	})
+}
+
+// PrintKeyStatus печатает состояние ключей провайдера (флаг --key-status).
+func PrintKeyStatus(providerName string, keys []string) error {
+	state, err := LoadKeyState(providerName)
+	if err != nil {
+		return err
+	}
+	path, _ := KeyStatePath(providerName)
+	fmt.Printf("Состояние ключей %s (%s):\n", providerName, path)
+	fmt.Print(state.Report(keys))
+	return nil
+}
+
+// Report формирует текстовый отчет о ключах из конфига для --key-status.
+func (s *KeyState) Report(keys []string) string {
+	var sb strings.Builder
+	now := time.Now()
+	const timeFormat = "02.01.2006 15:04:05"
+
+	if len(keys) == 0 {
+		return "Нет API ключей в конфиге.\n"
+	}
+
+	known := map[string]bool{}
+	for _, k := range keys {
+		id := keyFingerprint(k)
+		known[id] = true
+
+		status := "OK"
+		h, ok := s.Keys[id]
+		if !ok {
+			fmt.Fprintf(&sb, "%-10s %-24s запросов не было\n", MaskKey(k), status)
+			continue
+		}
+		switch {
+		case h.Banned:
+			status = "ЗАБЛОКИРОВАН"
+		case now.Before(h.CooldownUntil):
+			status = "ЛИМИТ до " + h.CooldownUntil.Format("15:04:05")
+		}
+		fmt.Fprintf(&sb, "%-10s %-24s успехов: %d, ошибок: %d", MaskKey(k), status, h.Successes, h.Failures)
+		if !h.LastSuccess.IsZero() {
+			fmt.Fprintf(&sb, ", последний успех: %s", h.LastSuccess.Format(timeFormat))
+		}
+		sb.WriteString("\n")
+		// Файлы старых версий могли сохранить ключ в тексте ошибки
+		if h.LastError != "" && (h.LastSuccess.IsZero() || h.LastFailure.After(h.LastSuccess)) {
+			fmt.Fprintf(&sb, "           последняя ошибка (%s): %s\n", h.LastFailure.Format(timeFormat), RedactKeys(h.LastError, keys...))
+		}
+	}
+
+	// Записи о ключах, которых уже нет в конфиге
+	var stale []string
+	for id := range s.Keys {
+		if !known[id] {
+			stale = append(stale, s.Keys[id].Masked)
+		}
+	}
+	if len(stale) > 0 {
+		sort.Strings(stale)
+		fmt.Fprintf(&sb, "Устаревшие записи (ключей нет в конфиге): %s\n", strings.Join(stale, ", "))
+	}
+	return sb.String()
+}
+
+// rateLimitCooldown определяет, на сколько отложить ключ после 429.
+func rateLimitCooldown(err error) time.Duration {
+	if d := RetryAfterOf(err); d > 0 {
+		return d + time.Second
+	}
+	return DefaultRateLimitCooldown
+}
@@ -0,0 +1,196 @@
+package provider
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyStateFilter(t *testing.T) {
+	now := time.Now()
+	state := &KeyState{Keys: map[string]*KeyHealth{
+		keyFingerprint("banned"):  {Banned: true},
+		keyFingerprint("cooling"): {CooldownUntil: now.Add(time.Minute)},
+		keyFingerprint("rested"):  {CooldownUntil: now.Add(-time.Second)},
+		keyFingerprint("healthy"): {Successes: 3},
+	}}
+
+	got := state.Filter([]string{"banned", "cooling", "rested", "healthy", "new"})
+	want := []string{"rested", "healthy", "new"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Filter() = %q, want %q", got, want)
+	}
+
+	// Отдых закончился — ключ снова доступен
+	if !state.Available("cooling", now.Add(2*time.Minute)) {
+		t.Error("Available() after cooldown = false, want true")
+	}
+}
+
+func TestRunAllKeysCooling(t *testing.T) {
+	withTempConfig(t)
+	p := &fakeProvider{}
+
+	state, err := LoadKeyState(p.Name())
+	if err != nil {
+		t.Fatalf("LoadKeyState error = %v", err)
+	}
+	state.RecordRateLimit("a", time.Hour, httpErr(429))
+	state.RecordBan("b", httpErr(401))
+	if err := state.Save(); err != nil {
+		t.Fatalf("Save error = %v", err)
+	}
+
+	// Все ключи отдыхают или забанены — пробуем все, а не падаем без запроса
+	r := Runner{Provider: p, Keys: []string{"a", "b"}, Models: []string{"pro"}}
+	if _, err := r.Run(&Request{Mode: "general"}); err != nil {
+		t.Fatalf("Run() error = %v, want success", err)
+	}
+	if p.calls != 1 {
+		t.Errorf("calls = %d, want 1", p.calls)
+	}
+
+	// Успех снимает лимит
+	state, _ = LoadKeyState(p.Name())
+	if got := state.Filter([]string{"a", "b"}); len(got) != 1 {
+		t.Errorf("Filter() after success = %q, want one key", got)
+	}
+}
+
+func TestKeyStateSaveMerge(t *testing.T) {
+	withTempConfig(t)
+
+	// Два запуска прочитали файл одновременно
+	first, err := LoadKeyState("fake")
+	if err != nil {
+		t.Fatalf("LoadKeyState error = %v", err)
+	}
+	second, _ := LoadKeyState("fake")
+
+	first.RecordSuccess("key-one")
+	first.RecordSuccess("key-two")
+	if err := first.Save(); err != nil {
+		t.Fatalf("first Save error = %v", err)
+	}
+
+	second.RecordFailure("key-two", errors.New("boom"))
+	second.RecordBan("key-three", httpErr(403))
+	if err := second.Save(); err != nil {
+		t.Fatalf("second Save error = %v", err)
+	}
+
+	state, err := LoadKeyState("fake")
+	if err != nil {
+		t.Fatalf("LoadKeyState error = %v", err)
+	}
+	tests := []struct {
+		key                 string
+		successes, failures int
+		banned              bool
+	}{
+		{"key-one", 1, 0, false},
+		{"key-two", 1, 1, false},
+		{"key-three", 0, 1, true},
+	}
+	for _, tt := range tests {
+		h := state.Keys[keyFingerprint(tt.key)]
+		if h == nil {
+			t.Errorf("%s: no record after merge", tt.key)
+			continue
+		}
+		if h.Successes != tt.successes || h.Failures != tt.failures || h.Banned != tt.banned {
+			t.Errorf("%s: %+v, want successes %d, failures %d, banned %v", tt.key, h, tt.successes, tt.failures, tt.banned)
+		}
+	}
+
+	// Сохраненные изменения не накладываются повторно
+	if len(second.pending) != 0 {
+		t.Errorf("pending after Save = %d, want 0", len(second.pending))
+	}
+}
+
+func TestRecordRateLimit(t *testing.T) {
+	state := &KeyState{Keys: map[string]*KeyHealth{}}
+	key := "AIzaSECRETKEY"
+
+	state.RecordRateLimit(key, time.Hour, errors.New(`Post "https://x/?key=`+key+`": 429`))
+	until := state.Keys[keyFingerprint(key)].CooldownUntil
+
+	// Более короткий лимит не сокращает уже назначенный отдых
+	state.RecordRateLimit(key, time.Second, errors.New(strings.Repeat("x", 300)))
+	h := state.Keys[keyFingerprint(key)]
+	if !h.CooldownUntil.Equal(until) {
+		t.Errorf("CooldownUntil = %v, want %v", h.CooldownUntil, until)
+	}
+	if h.Failures != 2 || h.Masked != MaskKey(key) {
+		t.Errorf("health = %+v, want 2 failures and masked key", h)
+	}
+	if n := len([]rune(h.LastError)); n != 203 {
+		t.Errorf("len(LastError) = %d, want 200 + ...", n)
+	}
+	if state.Available(key, time.Now()) {
+		t.Error("Available() = true, want false during cooldown")
+	}
+
+	state.RecordRateLimit(key, 2*time.Hour, errors.New("key="+key))
+	h = state.Keys[keyFingerprint(key)]
+	if !h.CooldownUntil.After(until) {
+		t.Errorf("CooldownUntil = %v, want later than %v", h.CooldownUntil, until)
+	}
+	if strings.Contains(h.LastError, key) {
+		t.Errorf("LastError = %q, key is not redacted", h.LastError)
+	}
+
+	// Ключ без авторизации не отслеживается
+	state.RecordRateLimit("", time.Hour, nil)
+	if len(state.Keys) != 1 {
+		t.Errorf("keys = %d, want 1", len(state.Keys))
+	}
+}
+
+func TestKeyStateReport(t *testing.T) {
+	now := time.Now()
+	state := &KeyState{Keys: map[string]*KeyHealth{
+		keyFingerprint("banned-key"): {Banned: true, Failures: 1, LastFailure: now,
+			LastError: "Post https://x/?key=banned-key: 401"},
+		keyFingerprint("cooling-key"): {CooldownUntil: now.Add(time.Minute), Successes: 2, LastSuccess: now.Add(-time.Hour),
+			Failures: 1, LastFailure: now, LastError: "rate limit"},
+		keyFingerprint("healthy-key"): {Successes: 5, LastSuccess: now, LastFailure: now.Add(-time.Hour), LastError: "old"},
+		keyFingerprint("removed-key"): {Masked: "...dkey"},
+	}}
+
+	report := state.Report([]string{"banned-key", "cooling-key", "healthy-key", "unused-key"})
+	lines := strings.Split(strings.TrimSuffix(report, "\n"), "\n")
+
+	tests := []struct {
+		line int
+		want []string
+	}{
+		{0, []string{MaskKey("banned-key"), "ЗАБЛОКИРОВАН", "ошибок: 1"}},
+		{1, []string{"последняя ошибка", "key=***"}},
+		{2, []string{"ЛИМИТ до", "успехов: 2", "последний успех"}},
+		{3, []string{"последняя ошибка", "rate limit"}},
+		{4, []string{"OK", "успехов: 5"}},
+		{5, []string{MaskKey("unused-key"), "запросов не было"}},
+		{6, []string{"Устаревшие записи", "...dkey"}},
+	}
+	if len(lines) != len(tests) {
+		t.Fatalf("Report() has %d lines, want %d:\n%s", len(lines), len(tests), report)
+	}
+	for _, tt := range tests {
+		for _, w := range tt.want {
+			if !strings.Contains(lines[tt.line], w) {
+				t.Errorf("line %d = %q, want %q in it", tt.line, lines[tt.line], w)
+			}
+		}
+	}
+	if strings.Contains(report, "banned-key:") {
+		t.Errorf("Report() leaks the key:\n%s", report)
+	}
+
+	if got := state.Report(nil); got != "Нет API ключей в конфиге.\n" {
+		t.Errorf("Report(nil) = %q", got)
+	}
+}
@@ -0,0 +1,105 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MaxLogSize размер лога, после которого он переименовывается в *.old
+const MaxLogSize = 10 * 1024 * 1024 // 10 MB
+
+var (
+	logPrefix   = "[LLM]"
+	logFileName = "llm_err.log"
+
+	// Verbose включает дублирование логов в stderr (флаг -v)
+	Verbose bool
+	// JSONErrors Fatalf печатает ошибку JSON-конвертом в stdout
+	// (--output-format json), чтобы вызывающий разбирал и неудачи
+	JSONErrors bool
+)
+
+// SetupLog задает префикс для stderr и имя файла лога в папке конфигов.
+func SetupLog(prefix, fileName string) {
+	logPrefix = prefix
+	logFileName = fileName
+}
+
+// LogFilePath возвращает полный путь к файлу лога текущей утилиты.
+func LogFilePath() string {
+	dir, err := AppDataDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, logFileName)
+}
+
+func rotateLog(logPath string) {
+	fi, err := os.Stat(logPath)
+	if err != nil {
+		return
+	}
+
+	if fi.Size() > MaxLogSize {
+		backupPath := logPath + ".old"
+		_ = os.Remove(backupPath)
+		_ = os.Rename(logPath, backupPath)
+	}
+}
+
+// AppendLog дописывает строку в файл лога без вывода в stderr.
+func AppendLog(level, format string, v ...interface{}) {
+	logPath := LogFilePath()
+	if logPath == "" {
+		return
+	}
+
+	rotateLog(logPath)
+
+	msg := fmt.Sprintf(format, v...)
+	timestamp := time.Now().Format("2006/01/02 15:04:05")
+	logLine := fmt.Sprintf("[%s] [%s] %s\n", timestamp, level, msg)
+
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err == nil {
+		defer f.Close()
+		_, _ = f.WriteString(logLine)
+	}
+}
+
+// Logf пишет сообщение в лог и, если включен Verbose, в stderr.
+func Logf(format string, v ...interface{}) {
+	AppendLog("INFO", format, v...)
+	if Verbose {
+		fmt.Fprintf(os.Stderr, logPrefix+" "+format+"\n", v...)
+	}
+}
+
+// Warnf пишет предупреждение в лог и всегда в stderr (независимо от -v):
+// ответ получен, но пользователю стоит об этом знать.
+func Warnf(format string, v ...interface{}) {
+	AppendLog("WARN", format, v...)
+	fmt.Fprintf(os.Stderr, "WARNING: "+format+"\n", v...)
+}
+
+// Fatalf пишет ошибку в лог и stderr и завершает процесс с кодом 1.
+// С JSONErrors в stdout дополнительно уходит {"ok":false,"error":...}.
+// Ключи из параметров URL в тексте ошибки заменяются на ***.
+func Fatalf(format string, v ...interface{}) {
+	msg := RedactKeys(fmt.Sprintf(format, v...))
+	AppendLog("FATAL", "%s", msg)
+	fmt.Fprintln(os.Stderr, "ERROR: "+msg)
+	if JSONErrors {
+		fmt.Println(errorEnvelope(msg))
+	}
+	os.Exit(1)
+}
+
+// errorEnvelope JSON-конверт ошибки для stdout.
+func errorEnvelope(msg string) string {
+	data, _ := json.Marshal(ErrorResult{Error: msg})
+	return string(data)
+}
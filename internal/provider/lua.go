@@ -0,0 +1,278 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"runtime/metrics"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Встроенный калькулятор: скрипты Lua (gopher-lua) выполняются в процессе
+// утилиты, в песочнице без доступа к файлам и процессам. Тот же код
+// использует lua-executor.
+
+// Значения ограничений песочницы по умолчанию
+const (
+	DefaultLuaTimeout   = 5 * time.Second
+	DefaultLuaMaxOutput = 64 * 1024 // байт на value и на вывод print
+	DefaultLuaMaxMemory = 64 << 20  // байт прироста кучи за время скрипта
+	maxLuaValueDepth    = 10        // вложенность таблиц при переводе в JSON
+
+	// luaMemoryPoll как часто проверяется куча. Склеивание s = s .. s
+	// удваивает строку на каждом шаге, за это время она не успевает
+	// вырасти больше чем в несколько раз.
+	luaMemoryPoll = 5 * time.Millisecond
+)
+
+// LuaResult ответ исполнителя: ok и value при успехе, error при ошибке.
+// В output попадает вывод print.
+type LuaResult struct {
+	OK     bool        `json:"ok"`
+	Value  interface{} `json:"value"`
+	Error  string      `json:"error,omitempty"`
+	Output string      `json:"output,omitempty"`
+}
+
+// LuaLimits ограничения одного запуска.
+type LuaLimits struct {
+	Timeout   time.Duration
+	MaxOutput int
+	MaxMemory int  // прирост кучи процесса за время скрипта, 0 — без ограничения
+	Unsafe    bool // все библиотеки, как раньше (os.execute, io...)
+}
+
+// unsafeBaseFuncs функции базовой библиотеки, дающие доступ к файлам,
+// загрузке кода и окружению функций.
+var unsafeBaseFuncs = []string{
+	"dofile", "loadfile", "load", "loadstring", "require", "module",
+	"collectgarbage", "getfenv", "setfenv", "_printregs", "newproxy",
+}
+
+// safeOsFuncs функции os, доступные в песочнице.
+var safeOsFuncs = []string{"time", "date", "clock", "difftime"}
+
+// DefaultLuaLimits песочница с ограничениями по умолчанию.
+var DefaultLuaLimits = LuaLimits{Timeout: DefaultLuaTimeout, MaxOutput: DefaultLuaMaxOutput, MaxMemory: DefaultLuaMaxMemory}
+
+// RunLua выполняет код как выражение, а если он не компилируется как
+// выражение — как скрипт. Результат — значение на вершине стека.
+func RunLua(code string, limits LuaLimits) LuaResult {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    !limits.Unsafe,
+		CallStackSize:   256,
+		RegistrySize:    1024 * 20,
+		RegistryMaxSize: 1024 * 80,
+	})
+	defer L.Close()
+
+	var output strings.Builder
+	if !limits.Unsafe {
+		openSandbox(L, limits.MaxOutput)
+	}
+	capturePrint(L, &output, limits.MaxOutput)
+
+	ctx, cancel := context.WithTimeout(context.Background(), limits.Timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	memoryExceeded := watchMemory(ctx, cancel, limits.MaxMemory)
+
+	fn, err := L.LoadString("return (" + code + ")")
+	if err != nil {
+		if fn, err = L.LoadString(code); err != nil {
+			return LuaResult{Error: strings.TrimSpace(err.Error())}
+		}
+	}
+
+	L.Push(fn)
+	if err := L.PCall(0, 1, nil); err != nil {
+		if memoryExceeded.Load() {
+			return LuaResult{Error: fmt.Sprintf("превышен лимит памяти (%d МБ)", limits.MaxMemory>>20), Output: output.String()}
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return LuaResult{Error: fmt.Sprintf("превышено время выполнения (%v)", limits.Timeout), Output: output.String()}
+		}
+		// Без stack traceback: модели нужен только текст ошибки
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			return LuaResult{Error: apiErr.Object.String(), Output: output.String()}
+		}
+		return LuaResult{Error: err.Error(), Output: output.String()}
+	}
+
+	value, err := luaToJSON(L.Get(-1), 0)
+	if err == nil {
+		if data, _ := json.Marshal(value); len(data) > limits.MaxOutput {
+			err = fmt.Errorf("результат длиннее %d байт", limits.MaxOutput)
+		}
+	}
+	if err != nil {
+		return LuaResult{Error: err.Error(), Output: output.String()}
+	}
+	return LuaResult{OK: true, Value: value, Output: output.String()}
+}
+
+// watchMemory следит за кучей процесса, пока выполняется скрипт:
+// gopher-lua память не ограничивает, а скрипт работает внутри утилиты,
+// и local s='x' for i=1,40 do s=s..s end уронил бы ее целиком. Если куча
+// выросла больше чем на limit от размера на старте, отменяет ctx — VM
+// останавливается на следующей инструкции. Куча общая для процесса, так
+// что параллельные вызовы инструментов тоже учитываются: лимит с запасом.
+func watchMemory(ctx context.Context, cancel context.CancelFunc, limit int) *atomic.Bool {
+	exceeded := &atomic.Bool{}
+	if limit <= 0 {
+		return exceeded
+	}
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	heap := func() uint64 {
+		metrics.Read(sample)
+		return sample[0].Value.Uint64()
+	}
+	max := heap() + uint64(limit)
+
+	go func() {
+		ticker := time.NewTicker(luaMemoryPoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if heap() > max {
+					exceeded.Store(true)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return exceeded
+}
+
+// openSandbox открывает только base, table, string, math и безопасную
+// часть os.
+func openSandbox(L *lua.LState, maxOutput int) {
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+		{lua.OsLibName, lua.OpenOs},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	for _, name := range unsafeBaseFuncs {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	full := L.GetGlobal(lua.OsLibName).(*lua.LTable)
+	osLib := L.NewTable()
+	for _, name := range safeOsFuncs {
+		osLib.RawSetString(name, full.RawGetString(name))
+	}
+	L.SetGlobal(lua.OsLibName, osLib)
+
+	// string.rep — самый короткий путь занять гигабайты памяти
+	str := L.GetGlobal(lua.StringLibName).(*lua.LTable)
+	rep := str.RawGetString("rep").(*lua.LFunction)
+	str.RawSetString("rep", L.NewFunction(func(L *lua.LState) int {
+		s := L.CheckString(1)
+		n := L.CheckInt(2)
+		if n > 0 && len(s) > 0 && n > maxOutput/len(s) {
+			L.RaiseError("string.rep: результат длиннее %d байт", maxOutput)
+		}
+		L.Push(rep)
+		L.Push(lua.LString(s))
+		L.Push(lua.LNumber(n))
+		L.Call(2, 1)
+		return 1
+	}))
+}
+
+// capturePrint направляет print в output (не больше maxOutput байт):
+// stdout исполнителя занят JSON-ответом.
+func capturePrint(L *lua.LState, output *strings.Builder, maxOutput int) {
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		var parts []string
+		for i := 1; i <= L.GetTop(); i++ {
+			parts = append(parts, L.ToStringMeta(L.Get(i)).String())
+		}
+		line := strings.Join(parts, "\t") + "\n"
+		if output.Len()+len(line) > maxOutput {
+			L.RaiseError("print: вывод длиннее %d байт", maxOutput)
+		}
+		output.WriteString(line)
+		return 0
+	}))
+}
+
+// luaToJSON переводит значение Lua в значение для encoding/json. Таблица
+// с ключами 1..n становится массивом, остальные — объектом.
+func luaToJSON(v lua.LValue, depth int) (interface{}, error) {
+	switch v := v.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		f := float64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Sprint(f), nil
+		}
+		return f, nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		if depth >= maxLuaValueDepth {
+			return nil, fmt.Errorf("вложенность таблиц больше %d", maxLuaValueDepth)
+		}
+		if n := v.Len(); n > 0 {
+			arr := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				item, err := luaToJSON(v.RawGetInt(i), depth+1)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, item)
+			}
+			return arr, nil
+		}
+		obj := map[string]interface{}{}
+		var err error
+		v.ForEach(func(key, val lua.LValue) {
+			if err != nil {
+				return
+			}
+			obj[key.String()], err = luaToJSON(val, depth+1)
+		})
+		return obj, err
+	}
+	// Функции, корутины и userdata передаются строкой
+	return v.String(), nil
+}
+
+// LuaTool встроенный инструмент calculator: выполняет expression
+// в песочнице и возвращает модели JSON {ok, value, error}.
+func LuaTool(args map[string]interface{}) (string, error) {
+	expression, ok := args["expression"].(string)
+	if !ok {
+		return "", fmt.Errorf("expression argument is not a string")
+	}
+	var buf strings.Builder
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // "<string>:1: ..." в ошибках Lua
+	err := enc.Encode(RunLua(expression, DefaultLuaLimits))
+	return strings.TrimSpace(buf.String()), err
+}
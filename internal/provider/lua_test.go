@@ -0,0 +1,79 @@
+package provider
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunLua(t *testing.T) {
+	limits := LuaLimits{Timeout: 500 * time.Millisecond, MaxOutput: 1024, MaxMemory: 16 << 20}
+
+	tests := []struct {
+		name       string
+		code       string
+		want       interface{}
+		wantOutput string
+		wantErr    string
+	}{
+		{name: "expression", code: "2 + 3 * 4", want: 14.0},
+		{name: "negative number is not a flag", code: "-5 + 3", want: -2.0},
+		{name: "script", code: "x = 5; return x * 2", want: 10.0},
+		{name: "no return", code: "x = 1", want: nil},
+		{name: "math and string", code: "string.format('%.2f', math.sqrt(2))", want: "1.41"},
+		{name: "safe os", code: "os.date('!%Y', 0)", want: "1970"},
+		{name: "array", code: "{1, 'a', true}", want: []interface{}{1.0, "a", true}},
+		{name: "object", code: "{a = {b = 1}}", want: map[string]interface{}{"a": map[string]interface{}{"b": 1.0}}},
+		{name: "print captured", code: "print('hi', 1) return 2", want: 2.0, wantOutput: "hi\t1\n"},
+		{name: "os.execute blocked", code: "os.execute('echo x')", wantErr: "non-function"},
+		{name: "io blocked", code: "io.open('x')", wantErr: "non-table"},
+		{name: "require blocked", code: "require('os')", wantErr: "non-function"},
+		{name: "load blocked", code: "load('return 1')", wantErr: "non-function"},
+		{name: "runtime error without traceback", code: "error('boom')", wantErr: "boom"},
+		{name: "syntax error", code: "1 +", wantErr: "syntax error"},
+		{name: "timeout", code: "while true do end", wantErr: "время выполнения"},
+		{name: "string.rep cap", code: "string.rep('x', 1e9)", wantErr: "string.rep"},
+		{name: "method rep cap", code: "('x'):rep(2000)", wantErr: "string.rep"},
+		{name: "print cap", code: "for i = 1, 1000 do print('line') end", wantErr: "print"},
+		{name: "result cap", code: "local t = {} for i = 1, 1000 do t[i] = i end return t", wantErr: "длиннее"},
+		{name: "concat bomb", code: "local s = 'x' for i = 1, 40 do s = s .. s end return #s", wantErr: "лимит памяти"},
+		{name: "table bomb", code: "local t = {} for i = 1, 1e9 do t[i] = i end", wantErr: "лимит памяти"},
+		{name: "deep table", code: "local t = {} local c = t for i = 1, 20 do c.x = {} c = c.x end return t", wantErr: "вложенность"},
+	}
+	for _, tt := range tests {
+		got := RunLua(tt.code, limits)
+		if tt.wantErr != "" {
+			if got.OK || !strings.Contains(got.Error, tt.wantErr) || strings.Contains(got.Error, "stack traceback") {
+				t.Errorf("%s: RunLua = %+v, want error with %q", tt.name, got, tt.wantErr)
+			}
+			continue
+		}
+		if !got.OK || !reflect.DeepEqual(got.Value, tt.want) || got.Output != tt.wantOutput {
+			t.Errorf("%s: RunLua = %+v, want value %#v, output %q", tt.name, got, tt.want, tt.wantOutput)
+		}
+	}
+
+	if got := RunLua("io ~= nil and os.getenv ~= nil", LuaLimits{Timeout: time.Second, MaxOutput: 1024, Unsafe: true}); got.Value != true {
+		t.Errorf("unsafe mode: RunLua = %+v, want all libraries", got)
+	}
+}
+
+func TestLuaTool(t *testing.T) {
+	tests := []struct {
+		args map[string]interface{}
+		want string
+	}{
+		{map[string]interface{}{"expression": "6 * 7"}, `{"ok":true,"value":42}`},
+		{map[string]interface{}{"expression": "error('x')"}, `{"ok":false,"value":null,"error":"<string>:1: x"}`},
+	}
+	for _, tt := range tests {
+		got, err := LuaTool(tt.args)
+		if err != nil || got != tt.want {
+			t.Errorf("LuaTool(%v) = %s, %v, want %s", tt.args, got, err, tt.want)
+		}
+	}
+	if _, err := LuaTool(map[string]interface{}{"expression": 1}); err == nil {
+		t.Errorf("LuaTool with a non-string expression: no error")
+	}
+}
@@ -0,0 +1,201 @@
+package provider
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ModeRule одно правило автоопределения режима (mode_rules в *.conf).
+// Правила проверяются по порядку, срабатывает первое, у которого выполнены
+// все заданные условия. Правило без условий срабатывает всегда, поэтому
+// его ставят последним как режим по умолчанию.
+type ModeRule struct {
+	Name        string   `json:"name,omitempty"`
+	Keywords    []string `json:"keywords,omitempty"`    // любое из слов в промпте, без учета регистра
+	Regex       string   `json:"regex,omitempty"`       // регулярное выражение по промпту
+	Attachments []string `json:"attachments,omitempty"` // любой из типов вложений: audio, image, video, pdf, document, text
+	MinSize     int      `json:"min_size,omitempty"`    // размер промпта и файлов в байтах, не меньше
+	MaxSize     int      `json:"max_size,omitempty"`    // размер промпта и файлов в байтах, не больше
+	Mode        string   `json:"mode"`
+	Models      []string `json:"models,omitempty"` // свой список моделей вместо models[mode]
+}
+
+// ModeAttachmentTypes допустимые значения ModeRule.Attachments.
+var ModeAttachmentTypes = []string{"audio", "image", "video", "pdf", "document", "text"}
+
+// ModeDecision выбранный режим и причина выбора (для --explain-mode).
+type ModeDecision struct {
+	Mode   string
+	Models []string // непустой, если модели задало правило
+	Reason string
+}
+
+// DetectMode выбирает режим: явный --mode, иначе первое сработавшее правило,
+// иначе general. Ошибка — правило с неверным regex или без режима.
+func DetectMode(flagMode string, rules []ModeRule, prompt string, files []FileData) (ModeDecision, error) {
+	if flagMode != "" && flagMode != "auto" {
+		return ModeDecision{Mode: flagMode, Reason: "задан флагом --mode"}, nil
+	}
+
+	size := -1 // считается при первом правиле с условием на размер
+	for i, rule := range rules {
+		if rule.Mode == "" {
+			return ModeDecision{}, fmt.Errorf("mode_rules[%d]: не указан mode", i)
+		}
+		ok, err := rule.match(prompt, files, &size)
+		if err != nil {
+			return ModeDecision{}, fmt.Errorf("mode_rules[%d]: %v", i, err)
+		}
+		if ok {
+			return ModeDecision{Mode: rule.Mode, Models: rule.Models, Reason: rule.describe(i)}, nil
+		}
+	}
+	return ModeDecision{Mode: "general", Reason: "ни одно правило mode_rules не сработало"}, nil
+}
+
+func (r ModeRule) match(prompt string, files []FileData, size *int) (bool, error) {
+	if len(r.Keywords) > 0 {
+		lower := strings.ToLower(prompt)
+		found := false
+		for _, kw := range r.Keywords {
+			if kw != "" && strings.Contains(lower, strings.ToLower(kw)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+
+	if r.Regex != "" {
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return false, fmt.Errorf("неверный regex: %v", err)
+		}
+		if !re.MatchString(prompt) {
+			return false, nil
+		}
+	}
+
+	for _, kind := range r.Attachments {
+		if !slices.Contains(ModeAttachmentTypes, strings.ToLower(kind)) {
+			return false, fmt.Errorf("неизвестный тип вложения %q (допустимы: %s)", kind, strings.Join(ModeAttachmentTypes, ", "))
+		}
+	}
+	if len(r.Attachments) > 0 && !hasAttachment(files, r.Attachments) {
+		return false, nil
+	}
+
+	if r.MinSize > 0 || r.MaxSize > 0 {
+		if *size < 0 {
+			*size = inputSize(prompt, files)
+		}
+		if r.MinSize > 0 && *size < r.MinSize {
+			return false, nil
+		}
+		if r.MaxSize > 0 && *size > r.MaxSize {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// hasAttachment есть ли среди файлов вложение хотя бы одного из типов.
+func hasAttachment(files []FileData, kinds []string) bool {
+	for _, f := range files {
+		for _, kind := range kinds {
+			if attachmentIs(f, kind) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// attachmentIs проверяет тип вложения по имени из ModeAttachmentTypes.
+func attachmentIs(f FileData, kind string) bool {
+	switch strings.ToLower(kind) {
+	case "audio":
+		return f.IsAudio()
+	case "image":
+		return f.IsImage()
+	case "video":
+		return f.IsVideo()
+	case "pdf":
+		return f.MimeType == "application/pdf"
+	case "document":
+		return documentMimeTypes[f.MimeType]
+	case "text":
+		return f.IsText()
+	}
+	return false
+}
+
+// inputSize размер промпта и содержимого файлов в байтах.
+func inputSize(prompt string, files []FileData) int {
+	size := len(prompt)
+	for _, f := range files {
+		size += len(f.Bytes())
+	}
+	return size
+}
+
+// describe текст правила для --explain-mode.
+func (r ModeRule) describe(index int) string {
+	var conds []string
+	if len(r.Keywords) > 0 {
+		conds = append(conds, "keywords "+strings.Join(r.Keywords, ", "))
+	}
+	if r.Regex != "" {
+		conds = append(conds, "regex "+r.Regex)
+	}
+	if len(r.Attachments) > 0 {
+		conds = append(conds, "attachments "+strings.Join(r.Attachments, ", "))
+	}
+	if r.MinSize > 0 {
+		conds = append(conds, fmt.Sprintf("min_size %d", r.MinSize))
+	}
+	if r.MaxSize > 0 {
+		conds = append(conds, fmt.Sprintf("max_size %d", r.MaxSize))
+	}
+	if len(conds) == 0 {
+		conds = append(conds, "без условий")
+	}
+
+	name := fmt.Sprintf("mode_rules[%d]", index)
+	if r.Name != "" {
+		name += " \"" + r.Name + "\""
+	}
+	desc := fmt.Sprintf("%s (%s)", name, strings.Join(conds, "; "))
+	if len(r.Models) > 0 {
+		desc += ", модели: " + strings.Join(r.Models, ", ")
+	}
+	return desc
+}
+
+// ModelsFor список моделей для выбранного режима: из правила, если оно
+// их задало, иначе models[mode].
+func (c *Config) ModelsFor(d ModeDecision) []string {
+	if len(d.Models) > 0 {
+		return d.Models
+	}
+	return c.SelectModels(d.Mode)
+}
+
+// ResolveMode выбирает режим по флагам и mode_rules конфига. С --explain-mode
+// печатает в stderr, какое правило сработало. Ошибка в правилах фатальна.
+func (c *Config) ResolveMode(flags *Flags, prompt string, files []FileData) ModeDecision {
+	d, err := DetectMode(flags.Mode, c.ModeRules, prompt, files)
+	if err != nil {
+		Fatalf("Ошибка в mode_rules: %v", err)
+	}
+	Logf("Режим %s: %s", d.Mode, d.Reason)
+	if flags.ExplainMode {
+		fmt.Fprintf(os.Stderr, "Режим: %s — %s\n", d.Mode, d.Reason)
+	}
+	return d
+}
@@ -0,0 +1,109 @@
+package provider
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func file(name, mime, content string) FileData {
+	return FileData{Name: name, MimeType: mime, Base64Content: base64.StdEncoding.EncodeToString([]byte(content))}
+}
+
+func TestDetectMode(t *testing.T) {
+	rules := []ModeRule{
+		{Name: "audio", Attachments: []string{"audio"}, Mode: "audio"},
+		{Name: "docs", Attachments: []string{"pdf", "document"}, Mode: "ocr"},
+		{Name: "big", Attachments: []string{"text"}, MinSize: 20, Mode: "long", Models: []string{"long-ctx"}},
+		{Name: "sql", Regex: `(?i)\bselect\b.+\bfrom\b`, Mode: "code"},
+		{Name: "code", Keywords: []string{"Код", "script"}, Mode: "code"},
+		{Name: "short", MaxSize: 3, Mode: "quick"},
+		{Mode: "chat"},
+	}
+
+	tests := []struct {
+		name       string
+		flag       string
+		prompt     string
+		files      []FileData
+		wantMode   string
+		wantModels []string
+		wantReason string
+	}{
+		{"flag wins", "vision", "код", nil, "vision", nil, "--mode"},
+		{"attachment", "auto", "", []FileData{file("a.mp3", "audio/mpeg", "x")}, "audio", nil, `"audio"`},
+		{"any of attachment types", "auto", "", []FileData{file("a.docx", "application/msword", "x")}, "ocr", nil, "pdf, document"},
+		{"size with models", "auto", "summarize", []FileData{file("a.txt", "text/plain", "0123456789abcdef")}, "long", []string{"long-ctx"}, "min_size 20"},
+		{"small text file", "auto", "summarize please", []FileData{file("a.txt", "text/plain", "x")}, "chat", nil, "без условий"},
+		{"regex", "auto", "SELECT id FROM users", nil, "code", nil, "regex"},
+		{"keyword case-insensitive", "", "Напиши КОД", nil, "code", nil, `"code"`},
+		{"max size", "auto", "hi", nil, "quick", nil, "max_size 3"},
+		{"fallback rule", "auto", "hello there", nil, "chat", nil, "mode_rules[6]"},
+	}
+	for _, tt := range tests {
+		got, err := DetectMode(tt.flag, rules, tt.prompt, tt.files)
+		if err != nil {
+			t.Errorf("%s: DetectMode error = %v", tt.name, err)
+			continue
+		}
+		if got.Mode != tt.wantMode || !reflect.DeepEqual(got.Models, tt.wantModels) || !strings.Contains(got.Reason, tt.wantReason) {
+			t.Errorf("%s: DetectMode = %+v, want mode %s, models %v, reason with %q", tt.name, got, tt.wantMode, tt.wantModels, tt.wantReason)
+		}
+	}
+}
+
+func TestDetectModeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []ModeRule
+		want  string
+	}{
+		{"no rules", nil, ""},
+		{"bad regex", []ModeRule{{Regex: "(", Mode: "code"}}, "regex"},
+		{"no mode", []ModeRule{{Keywords: []string{"x"}}}, "mode"},
+		{"unknown attachment", []ModeRule{{Attachments: []string{"images"}, Mode: "vision"}}, "images"},
+	}
+	for _, tt := range tests {
+		got, err := DetectMode("auto", tt.rules, "x", nil)
+		if tt.want == "" {
+			if err != nil || got.Mode != "general" {
+				t.Errorf("%s: DetectMode = %+v, %v, want general", tt.name, got, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: DetectMode error = %v, want mention of %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigModeRules(t *testing.T) {
+	withTempConfig(t)
+	defaults := Defaults{ModeRules: []ModeRule{{Attachments: []string{"image"}, Mode: "vision"}, {Mode: "general"}}}
+
+	tests := []struct {
+		name string
+		data string
+		want int
+	}{
+		{"missing key gets defaults", `{"api_keys":[]}`, 2},
+		{"empty list kept", `{"mode_rules":[]}`, 0},
+		{"own rules kept", `{"mode_rules":[{"keywords":["sql"],"mode":"code"}]}`, 1},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "test.conf")
+		if err := os.WriteFile(path, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(path, defaults)
+		if err != nil {
+			t.Fatalf("%s: LoadConfig error = %v", tt.name, err)
+		}
+		if len(cfg.ModeRules) != tt.want {
+			t.Errorf("%s: mode_rules = %+v, want %d rules", tt.name, cfg.ModeRules, tt.want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Package provider содержит общую часть всех LLM-утилит ClipGen-m:
+// интерфейс провайдера, единый цикл перебора ключей и моделей,
+// обработку файлов, конфиг, историю чатов, ввод/вывод и логирование.
+//
+// Каждая утилита в cmd/* реализует только сетевую логику своего API
+// (интерфейс Provider), всё остальное берётся отсюда.
+package provider
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrUnsupported возвращается методами провайдера, которые он не реализует.
+// Dispatch в этом случае откатывается на обычный Chat.
+var ErrUnsupported = errors.New("операция не поддерживается провайдером")
+
+// Request описывает один запрос к модели, независимо от провайдера.
+type Request struct {
+	Mode             string
+	System           string
+	Prompt           string
+	Files            []FileData
+	Temperature      float64
+	MaxTokens        int
+	JSON             bool
+	Schema           *Schema // JSON Schema ответа (--schema), nil — без схемы
+	NoTools          bool
+	Srt              bool         // субтитры для транскрибации (если провайдер умеет)
+	Vtt              bool         // субтитры WebVTT вместо SRT
+	Language         string       // язык аудио для транскрибации, пусто — определить
+	Pages            []int        // страницы для OCR (с нуля), nil — все
+	ImagesDir        string       // каталог для картинок страниц при OCR, пусто — не сохранять
+	OCRFormat        string       // формат вывода OCR: markdown, text, json
+	AnnotationSchema []byte       // json_schema для структурированного OCR, nil — без аннотации
+	Inputs           []string     // тексты для режима embed
+	Suffix           string       // код после курсора для режима fim (Prompt — код до курсора)
+	History          *ChatHistory // nil, если режим чата выключен
+
+	// OnDelta, если задан, включает потоковый режим: провайдер передает
+	// в него куски текста по мере генерации. Провайдеры без потоковой
+	// поддержки просто возвращают весь ответ в Response.
+	OnDelta func(text string)
+}
+
+// Streaming возвращает true, если запрошен потоковый вывод.
+func (r *Request) Streaming() bool {
+	return r.OnDelta != nil
+}
+
+// Response результат успешного запроса.
+type Response struct {
+	Text         string
+	Model        string
+	Usage        *Usage               // nil, если API не сообщил расход токенов
+	FinishReason string               // причина остановки генерации (stop, length...)
+	ToolCalls    []ToolCall           // инструменты, вызванные моделью по ходу ответа
+	ToolMessages []ChatMessageHistory // те же вызовы с результатами, для истории чата (SaveToolExchange)
+	Embeddings   [][]float32          // векторы режима embed, в порядке Request.Inputs
+	Moderation   []ModerationResult   // оценки режима moderate, в порядке Request.Inputs
+
+	// Заполняются Runner.Run
+	Provider string
+	Mode     string
+	Key      string        // последние символы ключа (MaskKey), пусто без ключа
+	Attempts int           // сколько запросов понадобилось, включая повторы
+	Latency  time.Duration // время всего Run, с паузами между попытками
+}
+
+// Truncated сообщает, что генерация оборвалась на лимите токенов
+// (length у OpenAI-совместимых API и Ollama, MAX_TOKENS у Gemini).
+func (r *Response) Truncated() bool {
+	switch strings.ToLower(r.FinishReason) {
+	case "length", "max_tokens":
+		return true
+	}
+	return false
+}
+
+// ModerationFlaggedExitCode код выхода --moderate, если порог превышен
+// (1 — ошибка). По нему clipgen-m отличает отказ модерации от сбоя.
+const ModerationFlaggedExitCode = 2
+
+// ModerationResult оценки одного текста по категориям модерации (0..1).
+type ModerationResult struct {
+	Scores map[string]float64 `json:"category_scores"`
+}
+
+// Usage расход токенов. Поля, которые API не вернул, остаются нулевыми.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Add суммирует расход нескольких запросов (циклы с инструментами).
+// Если сообщать нечего, возвращает u без изменений.
+func (u *Usage) Add(other *Usage) *Usage {
+	if other == nil {
+		return u
+	}
+	if u == nil {
+		u = &Usage{}
+	}
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.TotalTokens += other.TotalTokens
+	return u
+}
+
+// ToolCall вызов инструмента моделью (для --output-format json).
+type ToolCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// Provider интерфейс, который реализует каждая утилита.
+// Методы Transcribe и OCR могут вернуть ErrUnsupported.
+type Provider interface {
+	Name() string
+	Chat(apiKey, model string, req *Request) (*Response, error)
+	Transcribe(apiKey, model string, req *Request) (*Response, error)
+	OCR(apiKey, model string, req *Request) (*Response, error)
+}
+
+// Unsupported встраивается в провайдеры, у которых нет отдельных
+// эндпоинтов для транскрибации или OCR.
+type Unsupported struct{}
+
+func (Unsupported) Transcribe(apiKey, model string, req *Request) (*Response, error) {
+	return nil, ErrUnsupported
+}
+
+func (Unsupported) OCR(apiKey, model string, req *Request) (*Response, error) {
+	return nil, ErrUnsupported
+}
+
+// Embedder реализуют провайдеры с API эмбеддингов (режим embed).
+type Embedder interface {
+	Embed(apiKey, model string, req *Request) (*Response, error)
+}
+
+// Dispatch выбирает метод провайдера по режиму запроса.
+// Если специализированный метод не поддерживается, используется Chat
+// (кроме embed: чат векторы не вернет).
+func Dispatch(p Provider, apiKey, model string, req *Request) (*Response, error) {
+	var resp *Response
+	err := ErrUnsupported
+
+	switch req.Mode {
+	case "embed":
+		e, ok := p.(Embedder)
+		if !ok {
+			return nil, ErrUnsupported
+		}
+		resp, err = e.Embed(apiKey, model, req)
+		if err != nil {
+			return nil, err
+		}
+	case "ocr":
+		resp, err = p.OCR(apiKey, model, req)
+	case "audio":
+		resp, err = p.Transcribe(apiKey, model, req)
+	}
+
+	if errors.Is(err, ErrUnsupported) {
+		resp, err = p.Chat(apiKey, model, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Model == "" {
+		resp.Model = model
+	}
+	return resp, nil
+}
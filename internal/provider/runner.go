@@ -0,0 +1,480 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Runner единый цикл перебора моделей и ключей для всех утилит.
+//
+// По умолчанию внешний цикл идет по моделям (первая модель — приоритетная),
+// внутренний — по случайным ключам. С KeyMajor порядок обратный: для каждого
+// ключа сначала перебираются все модели (так работают лимиты Gemini — они
+// считаются на пару ключ+модель).
+type Runner struct {
+	Provider Provider
+	Keys     []string
+	Models   []string
+
+	KeyMajor bool
+	// MaxFailedKeys сколько ключей подряд могут провалиться на всех моделях,
+	// прежде чем KeyMajor-цикл сдастся (0 — без ограничения).
+	MaxFailedKeys int
+	// Backoff паузы после 429/5xx и общий лимит попыток (из *.conf).
+	Backoff Backoff
+	// MaxContinuations сколько раз дозапросить ответ, оборванный лимитом
+	// токенов (max_continuations из *.conf, 0 — вернуть как есть).
+	MaxContinuations int
+	// Chunking разбиение больших текстовых вложений на части (см. chunk.go).
+	Chunking Chunking
+
+	// state состояние ключей между запусками (<provider>_keystate.json)
+	state *KeyState
+	// attempts и retries счетчики текущего Run: всего запросов
+	// и повторов подряд после 429/5xx (для экспоненты)
+	attempts int
+	retries  int
+}
+
+// errAttemptsExhausted исчерпан лимит попыток Backoff.MaxAttempts
+var errAttemptsExhausted = errors.New("исчерпан лимит попыток")
+
+type errorKind int
+
+const (
+	errOther     errorKind = iota
+	errAuth                // ключ невалиден — больше его не используем
+	errRateLimit           // лимит — пробуем другой ключ
+	errServer              // модель/сервер лежит — пробуем другой ключ, потом другую модель
+	errModel               // модель не существует или недоступна — следующая модель
+	errFatal               // повторять бессмысленно
+)
+
+func classifyError(err error) errorKind {
+	if errors.Is(err, ErrUnsupported) {
+		return errModel
+	}
+	if errors.Is(err, ErrPartialStream) {
+		return errFatal
+	}
+	if httpErr, ok := AsHTTPError(err); ok {
+		return classifyHTTPError(httpErr)
+	}
+
+	// Ошибки без HTTP-статуса: сеть, ошибки в теле ответа 200 (Gemini, Pollinations)
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "content management policy"):
+		return errFatal
+	case strings.Contains(msg, "http 401"), strings.Contains(msg, "http 403"),
+		strings.Contains(msg, "unauthorized"), strings.Contains(msg, "bad credentials"):
+		return errAuth
+	case strings.Contains(msg, "http 429"), strings.Contains(msg, "rate limit"),
+		strings.Contains(msg, "too many requests"):
+		return errRateLimit
+	case strings.Contains(msg, "http 500"), strings.Contains(msg, "http 502"),
+		strings.Contains(msg, "http 503"), strings.Contains(msg, "service unavailable"):
+		return errServer
+	case strings.Contains(msg, "model"), strings.Contains(msg, "not found"):
+		return errModel
+	}
+	return errOther
+}
+
+// classifyHTTPError решает по статусу и коду провайдера. Текст тела
+// не анализируется: в нем может встретиться что угодно, от "500" до "model".
+func classifyHTTPError(e *HTTPError) errorKind {
+	code := strings.ToLower(e.Code)
+	switch {
+	case code == "content_filter" || strings.Contains(strings.ToLower(e.Message), "content management policy"):
+		return errFatal
+	case e.StatusCode == 401 || e.StatusCode == 403:
+		return errAuth
+	case e.StatusCode == 429:
+		return errRateLimit
+	case e.StatusCode == 408 || e.StatusCode >= 500:
+		return errServer
+	case e.StatusCode == 404:
+		return errModel
+	case e.StatusCode == 400 && (strings.Contains(code, "model") || strings.Contains(strings.ToLower(e.Message), "model")):
+		// Модель не поддерживает запрос (vision, tools, размер контекста)
+		return errModel
+	}
+	return errOther
+}
+
+// pause ждет перед повтором после 429/5xx по политике Backoff.
+func (r *Runner) pause(err error) {
+	delay := r.Backoff.Delay(r.retries, RetryAfterOf(err))
+	r.retries++
+	if delay <= 0 {
+		return
+	}
+	Logf("Лимит или ошибка сервера. Ждем %v и пробуем снова...", delay.Round(time.Millisecond))
+	time.Sleep(delay)
+}
+
+// Run выполняет запрос, перебирая модели и ключи, пока не получит ответ.
+// Ключи из текста итоговой ошибки вырезаются: она уходит в stderr, лог
+// и JSON-конверт, а Gemini, например, передает ключ в URL.
+func (r *Runner) Run(req *Request) (*Response, error) {
+	resp, err := r.runAll(req)
+	if err != nil {
+		return nil, &redactedError{msg: RedactKeys(err.Error(), r.Keys...), err: err}
+	}
+	return resp, nil
+}
+
+// redactedError ошибка с текстом без ключей; errors.Is/As видят исходную.
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.err }
+
+func (r *Runner) runAll(req *Request) (*Response, error) {
+	if len(r.Keys) == 0 {
+		return nil, fmt.Errorf("нет API ключей")
+	}
+	if len(r.Models) == 0 {
+		return nil, fmt.Errorf("пустой список моделей для режима %s", req.Mode)
+	}
+	if r.needChunking(req) {
+		return r.runChunked(req)
+	}
+
+	state, err := LoadKeyState(r.Provider.Name())
+	if err != nil {
+		Logf("Не удалось прочитать состояние ключей: %v", err)
+	}
+	r.state = state
+	r.attempts, r.retries = 0, 0
+	defer func() {
+		if err := r.state.Save(); err != nil {
+			Logf("Не удалось сохранить состояние ключей: %v", err)
+		}
+	}()
+
+	// Забаненные и отдыхающие после 429 ключи пропускаем. Если таких все,
+	// пробуем все подряд: лимит мог уже сняться раньше срока.
+	keys := state.Filter(r.Keys)
+	if len(keys) == 0 {
+		Logf("Все ключи заблокированы или на лимите (см. --key-status), пробуем все")
+		keys = r.Keys
+	} else if skipped := len(r.Keys) - len(keys); skipped > 0 {
+		Logf("Пропущено ключей по сохраненному состоянию: %d", skipped)
+	}
+
+	start := time.Now()
+	resp, err := r.runValidated(keys, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Provider = r.Provider.Name()
+	resp.Mode = req.Mode
+	resp.Attempts = r.attempts
+	resp.Latency = time.Since(start)
+
+	if err := RecordUsage(resp, req); err != nil {
+		Logf("Не удалось записать расход в журнал: %v", err)
+	}
+	return resp, nil
+}
+
+func (r *Runner) run(keys []string, req *Request) (*Response, error) {
+	if r.KeyMajor {
+		return r.runKeyMajor(keys, req)
+	}
+	return r.runModelMajor(keys, req)
+}
+
+// runValidated проверяет ответ по req.Schema и при ошибке переспрашивает
+// модель, добавив к промпту текст ошибки (не больше SchemaRetries раз).
+func (r *Runner) runValidated(keys []string, req *Request) (*Response, error) {
+	resp, err := r.runContinued(keys, req)
+	if err != nil || req.Schema == nil {
+		return resp, err
+	}
+
+	usage := resp.Usage
+	for retry := 0; ; retry++ {
+		verr := req.Schema.Validate(resp.Text)
+		if verr == nil {
+			resp.Usage = usage
+			return resp, nil
+		}
+		if retry >= SchemaRetries {
+			return nil, fmt.Errorf("ответ не соответствует схеме после %d повторов: %w", SchemaRetries, verr)
+		}
+		Logf("Ответ не прошел проверку схемы: %v. Повторяем запрос...", verr)
+
+		fix := *req
+		fix.Prompt = req.Prompt + req.Schema.FixPrompt(resp.Text, verr)
+		resp, err = r.runContinued(keys, &fix)
+		if err != nil {
+			return nil, err
+		}
+		usage = usage.Add(resp.Usage)
+	}
+}
+
+// ContinuePrompt реплика пользователя, с которой дозапрашивается
+// оборванный ответ.
+const ContinuePrompt = "Your previous answer was cut off by the output token limit. " +
+	"Continue exactly where you stopped, mid-word if needed. " +
+	"Do not repeat what you already wrote and do not add any introduction or comments."
+
+// runContinued дозапрашивает ответ, оборванный лимитом токенов: в историю
+// уходят исходный промпт и полученная часть ответа, модель просят продолжить,
+// части склеиваются. Не больше MaxContinuations раз, затем — предупреждение
+// в stderr и ответ как есть.
+func (r *Runner) runContinued(keys []string, req *Request) (*Response, error) {
+	resp, err := r.run(keys, req)
+	if err != nil || r.MaxContinuations <= 0 || !resp.Truncated() {
+		return resp, err
+	}
+
+	text, usage, toolCalls, toolMessages := resp.Text, resp.Usage, resp.ToolCalls, resp.ToolMessages
+	for n := 1; resp.Truncated(); n++ {
+		if n > r.MaxContinuations {
+			Warnf("Ответ оборван лимитом токенов, достигнут предел продолжений (max_continuations = %d)", r.MaxContinuations)
+			break
+		}
+		Logf("Ответ оборван лимитом токенов (%s), продолжение %d/%d", resp.FinishReason, n, r.MaxContinuations)
+
+		next, err := r.run(keys, continuation(req, text))
+		if err != nil {
+			Warnf("Ответ оборван лимитом токенов, продолжить не удалось: %v", err)
+			break
+		}
+		resp = next
+		text += resp.Text
+		usage = usage.Add(resp.Usage)
+		toolCalls = append(toolCalls, resp.ToolCalls...)
+		toolMessages = append(toolMessages, resp.ToolMessages...)
+	}
+
+	resp.Text, resp.Usage, resp.ToolCalls, resp.ToolMessages = text, usage, toolCalls, toolMessages
+	return resp, nil
+}
+
+// continuation строит запрос продолжения: копия истории (файл чата
+// не меняется) с исходным промптом и ответом до обрыва, для FIM — префикс
+// с дописанным кодом. Файлы остаются
+// у последней реплики, чтобы модель их видела. JSON-режим и схема
+// отключаются: API начал бы новый объект вместо хвоста старого.
+func continuation(req *Request, answer string) *Request {
+	next := *req
+	if req.Mode == "fim" {
+		// FIM продолжается дописыванием полученного кода к префиксу
+		next.Prompt = req.Prompt + answer
+		return &next
+	}
+
+	history := &ChatHistory{}
+	if req.History != nil {
+		history.ID = req.History.ID
+		history.Messages = append(history.Messages, req.History.Messages...)
+	}
+	history.Append("user", req.Prompt, 0)
+	history.Append("assistant", answer, 0)
+	next.History = history
+	next.Prompt = ContinuePrompt
+	next.JSON = false
+	next.Schema = nil
+	next.NoTools = true
+	return &next
+}
+
+func (r *Runner) attempt(apiKey, model string, req *Request) (*Response, error) {
+	if r.Backoff.MaxAttempts > 0 && r.attempts >= r.Backoff.MaxAttempts {
+		return nil, errAttemptsExhausted
+	}
+	r.attempts++
+	Logf("Попытка: Модель [%s], Режим [%s], Ключ [%s]", model, req.Mode, MaskKey(apiKey))
+
+	// Если часть потока уже выведена, повтор задублирует текст
+	emitted := false
+	if onDelta := req.OnDelta; onDelta != nil {
+		req.OnDelta = func(text string) {
+			emitted = true
+			onDelta(text)
+		}
+		defer func() { req.OnDelta = onDelta }()
+	}
+
+	resp, err := Dispatch(r.Provider, apiKey, model, req)
+	if err != nil {
+		if emitted {
+			err = fmt.Errorf("%w: %v", ErrPartialStream, err)
+		}
+		Logf("Ошибка (модель %s, ключ %s): %s", model, MaskKey(apiKey), RedactKeys(err.Error(), apiKey))
+	}
+	if err == nil {
+		r.retries = 0
+		if apiKey != "" {
+			resp.Key = MaskKey(apiKey)
+		}
+	}
+	r.recordKey(apiKey, err)
+	return resp, err
+}
+
+// recordKey запоминает результат попытки в состоянии ключей.
+// Ошибки модели и фатальные ошибки к ключу отношения не имеют.
+func (r *Runner) recordKey(apiKey string, err error) {
+	if r.state == nil {
+		return
+	}
+	if err == nil {
+		r.state.RecordSuccess(apiKey)
+		return
+	}
+	switch classifyError(err) {
+	case errAuth:
+		r.state.RecordBan(apiKey, err)
+	case errRateLimit:
+		// В KeyMajor лимиты считаются на пару ключ+модель: ключ уходит
+		// на отдых, только если лимит на всех моделях (см. runKeyMajor)
+		if !r.KeyMajor {
+			r.state.RecordRateLimit(apiKey, rateLimitCooldown(err), err)
+		}
+	case errServer, errOther:
+		r.state.RecordFailure(apiKey, err)
+	}
+}
+
+func (r *Runner) runModelMajor(keys []string, req *Request) (*Response, error) {
+	var lastErr error
+	bannedKeys := make(map[string]bool)
+
+	for _, model := range r.Models {
+		usedKeys := make(map[string]bool)
+		for k := range bannedKeys {
+			usedKeys[k] = true
+		}
+
+	keyLoop:
+		for {
+			// Пустой ключ валиден (провайдеры без авторизации), поэтому
+			// исчерпание проверяем по списку, а не по результату RandomKey
+			if allKeysUsed(keys, usedKeys) {
+				Logf("Все ключи исчерпаны для модели %s, пробуем следующую модель...", model)
+				break
+			}
+			apiKey := RandomKey(keys, usedKeys)
+
+			resp, err := r.attempt(apiKey, model, req)
+			if err == nil {
+				return resp, nil
+			}
+			if err == errAttemptsExhausted {
+				return nil, r.exhausted(lastErr)
+			}
+			lastErr = err
+			usedKeys[apiKey] = true
+
+			switch classifyError(err) {
+			case errAuth:
+				bannedKeys[apiKey] = true
+				Logf("Ключ %s невалиден, пробуем другой...", MaskKey(apiKey))
+			case errRateLimit, errServer:
+				r.pause(err)
+			case errFatal:
+				return nil, err
+			default:
+				Logf("Модель %s недоступна, переходим к следующей...", model)
+				break keyLoop
+			}
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("все ключи заблокированы")
+	}
+	return nil, lastErr
+}
+
+// exhausted формирует ошибку при исчерпании лимита попыток.
+func (r *Runner) exhausted(lastErr error) error {
+	Logf("Достигнут лимит попыток (%d). Прекращаем.", r.Backoff.MaxAttempts)
+	if lastErr == nil {
+		return errAttemptsExhausted
+	}
+	return fmt.Errorf("%w (%d): %v", errAttemptsExhausted, r.Backoff.MaxAttempts, lastErr)
+}
+
+func allKeysUsed(keys []string, used map[string]bool) bool {
+	for _, k := range keys {
+		if !used[k] {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Runner) runKeyMajor(keys []string, req *Request) (*Response, error) {
+	var lastErr error
+	failedKeysCount := 0
+
+	for _, apiKey := range ShuffleKeys(keys) {
+		rateLimited, failedModels := 0, 0
+		var cooldown time.Duration
+	modelLoop:
+		for _, model := range r.Models {
+			resp, err := r.attempt(apiKey, model, req)
+			if err == nil {
+				return resp, nil
+			}
+			if err == errAttemptsExhausted {
+				return nil, r.exhausted(lastErr)
+			}
+			lastErr = err
+
+			kind := classifyError(err)
+			if kind != errAuth {
+				failedModels++
+			}
+			switch kind {
+			case errRateLimit:
+				rateLimited++
+				if c := rateLimitCooldown(err); c > cooldown {
+					cooldown = c
+				}
+				r.pause(err)
+			case errServer:
+				r.pause(err)
+			case errAuth:
+				// Ключ невалиден целиком — нет смысла пробовать другие модели
+				Logf("Ключ %s невалиден. Переход к следующему ключу.", MaskKey(apiKey))
+				break modelLoop
+			case errFatal:
+				return nil, err
+			}
+		}
+
+		// Ни одна модель не ответила на этом ключе
+		if rateLimited == len(r.Models) && r.state != nil {
+			r.state.RecordRateLimit(apiKey, cooldown, lastErr)
+		}
+		// Провалившимся считается ключ, на котором отказали все модели.
+		// Ключ, отвергнутый по 401/403, сбрасывает серию: он невалиден,
+		// а не исчерпан, и о доступности остальных ключей ничего не говорит.
+		if failedModels < len(r.Models) {
+			failedKeysCount = 0
+			continue
+		}
+		failedKeysCount++
+		if r.MaxFailedKeys > 0 && failedKeysCount >= r.MaxFailedKeys {
+			Logf("%d ключа подряд полностью провалились. Прекращаем попытки.", failedKeysCount)
+			break
+		}
+	}
+
+	return nil, lastErr
+}
@@ -0,0 +1,316 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeProvider отвечает по таблице "ключ/модель" -> ошибка (nil — успех)
+// и запоминает, сколько было запросов.
+type fakeProvider struct {
+	Unsupported
+	errs  map[string]error
+	mu    sync.Mutex
+	calls int
+}
+
+func (p *fakeProvider) Name() string { return "fake" }
+
+func (p *fakeProvider) Chat(apiKey, model string, req *Request) (*Response, error) {
+	p.mu.Lock()
+	p.calls++
+	p.mu.Unlock()
+	if err, ok := p.errs[apiKey+"/"+model]; ok && err != nil {
+		return nil, err
+	}
+	return &Response{Text: "ok " + apiKey}, nil
+}
+
+// withTempConfig уводит состояние ключей и журнал расхода во временный каталог.
+func withTempConfig(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("APPDATA", dir)
+	t.Setenv("HOME", dir)
+}
+
+func httpErr(status int) error {
+	return &HTTPError{StatusCode: status, Body: fmt.Sprintf("status %d", status)}
+}
+
+func TestRunKeyMajorFailedKeys(t *testing.T) {
+	models := []string{"pro", "flash"}
+
+	tests := []struct {
+		name      string
+		errs      map[string]error
+		wantOK    bool
+		wantCalls int // 0 — не проверять (зависит от порядка ключей)
+	}{
+		{
+			name: "two exhausted keys stop the loop",
+			errs: map[string]error{
+				"a/pro": httpErr(429), "a/flash": httpErr(429),
+				"b/pro": httpErr(429), "b/flash": httpErr(429),
+				"c/pro": httpErr(429), "c/flash": httpErr(429),
+			},
+			wantCalls: 4,
+		},
+		{
+			name: "invalid keys are not counted as failed",
+			errs: map[string]error{
+				"a/pro": httpErr(401),
+				"b/pro": httpErr(403),
+			},
+			wantOK: true,
+		},
+		{
+			name: "key with an auth break resets the series",
+			errs: map[string]error{
+				"a/pro": httpErr(429), "a/flash": httpErr(401),
+				"b/pro": httpErr(500), "b/flash": httpErr(403),
+			},
+			wantOK: true,
+		},
+		{
+			name: "all keys invalid",
+			errs: map[string]error{
+				"a/pro": httpErr(401), "b/pro": httpErr(401), "c/pro": httpErr(401),
+			},
+			wantCalls: 3,
+		},
+		{
+			name: "fatal error stops at once",
+			errs: map[string]error{
+				"a/pro": &HTTPError{StatusCode: 400, Code: "content_filter"},
+				"b/pro": &HTTPError{StatusCode: 400, Code: "content_filter"},
+				"c/pro": &HTTPError{StatusCode: 400, Code: "content_filter"},
+			},
+			wantCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Ключи перемешиваются — прогоняем несколько раз
+			for i := 0; i < 20; i++ {
+				withTempConfig(t)
+				p := &fakeProvider{errs: tt.errs}
+				r := Runner{Provider: p, Keys: []string{"a", "b", "c"}, Models: models, KeyMajor: true, MaxFailedKeys: 2}
+
+				resp, err := r.Run(&Request{Mode: "general"})
+				if tt.wantOK && err != nil {
+					t.Fatalf("Run() error = %v, want success", err)
+				}
+				if !tt.wantOK && err == nil {
+					t.Fatalf("Run() = %q, want error", resp.Text)
+				}
+				if tt.wantCalls > 0 && p.calls != tt.wantCalls {
+					t.Fatalf("calls = %d, want %d", p.calls, tt.wantCalls)
+				}
+			}
+		})
+	}
+}
+
+func TestRunModelMajorFallback(t *testing.T) {
+	withTempConfig(t)
+	p := &fakeProvider{errs: map[string]error{
+		"a/pro": httpErr(404), "b/pro": httpErr(404),
+		"a/flash": httpErr(401),
+	}}
+	r := Runner{Provider: p, Keys: []string{"a", "b"}, Models: []string{"pro", "flash"}}
+
+	resp, err := r.Run(&Request{Mode: "general"})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if resp.Text != "ok b" || resp.Model != "flash" {
+		t.Errorf("Run() = %q (%s), want answer of key b on flash", resp.Text, resp.Model)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want errorKind
+	}{
+		{"401", httpErr(401), errAuth},
+		{"403", httpErr(403), errAuth},
+		{"429", httpErr(429), errRateLimit},
+		{"500", httpErr(500), errServer},
+		{"503", httpErr(503), errServer},
+		{"408", httpErr(408), errServer},
+		{"404", httpErr(404), errModel},
+		{"400 model code", &HTTPError{StatusCode: 400, Code: "model_not_supported"}, errModel},
+		{"400 model message", &HTTPError{StatusCode: 400, Message: "Model does not support images"}, errModel},
+		{"400 other", &HTTPError{StatusCode: 400, Body: "bad model"}, errOther},
+		{"content filter", &HTTPError{StatusCode: 400, Code: "content_filter"}, errFatal},
+		{"wrapped", fmt.Errorf("gemini: %w", httpErr(429)), errRateLimit},
+		{"unsupported", ErrUnsupported, errModel},
+		{"partial stream", fmt.Errorf("%w: eof", ErrPartialStream), errFatal},
+		{"text 401", errors.New("API error: HTTP 401 Unauthorized"), errAuth},
+		{"text rate limit", errors.New("Rate limit exceeded"), errRateLimit},
+		{"text 503", errors.New("HTTP 503: Service Unavailable"), errServer},
+		{"text model", errors.New("model not found"), errModel},
+		{"network", errors.New("connection refused"), errOther},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.err); got != tt.want {
+			t.Errorf("%s: classifyError(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrorBody(t *testing.T) {
+	tests := []struct {
+		body, code, message string
+	}{
+		{`{"error":{"code":429,"status":"RESOURCE_EXHAUSTED","message":"quota"}}`, "RESOURCE_EXHAUSTED", "quota"},
+		{`{"error":{"code":"rate_limit_exceeded","type":"tokens","message":"slow down"}}`, "rate_limit_exceeded", "slow down"},
+		{`{"object":"error","type":"invalid_model","message":"no such model","code":"1500"}`, "1500", "no such model"},
+		{`{"error":"model not found"}`, "", "model not found"},
+		{`{"error":{"code":500}}`, "500", ""},
+		{`not json`, "", ""},
+	}
+	for _, tt := range tests {
+		code, message := parseErrorBody([]byte(tt.body))
+		if code != tt.code || message != tt.message {
+			t.Errorf("parseErrorBody(%s) = (%q, %q), want (%q, %q)", tt.body, code, message, tt.code, tt.message)
+		}
+	}
+}
+
+func TestRedactKeys(t *testing.T) {
+	tests := []struct {
+		msg  string
+		keys []string
+		want string
+	}{
+		{`Post "https://x/v1beta/models/pro:generateContent?key=AIzaSECRET": EOF`, nil,
+			`Post "https://x/v1beta/models/pro:generateContent?key=***": EOF`},
+		{"https://x/?alt=sse&key=AIza123&x=1", nil, "https://x/?alt=sse&key=***&x=1"},
+		{"bad key sk-abcdef123456 rejected", []string{"sk-abcdef123456"}, "bad key ...3456 rejected"},
+		{"short key abc", []string{"abc"}, "short key abc"},
+	}
+	for _, tt := range tests {
+		if got := RedactKeys(tt.msg, tt.keys...); got != tt.want {
+			t.Errorf("RedactKeys(%q) = %q, want %q", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestRunErrorRedacted(t *testing.T) {
+	withTempConfig(t)
+	key := "AIzaSECRETKEY123"
+	netErr := &url.Error{
+		Op:  "Post",
+		URL: "https://x/v1beta/models/pro:generateContent?key=" + key,
+		Err: errors.New("dial tcp: connection refused"),
+	}
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"key in url", netErr},
+		{"bare key", fmt.Errorf("key %s rejected: %w", key, httpErr(500))},
+	}
+	for _, tt := range tests {
+		p := &fakeProvider{errs: map[string]error{key + "/pro": tt.err}}
+		r := Runner{Provider: p, Keys: []string{key}, Models: []string{"pro"}}
+		_, err := r.Run(&Request{Mode: "general"})
+		if err == nil {
+			t.Fatalf("%s: Run() error = nil", tt.name)
+		}
+		if envelope := errorEnvelope(err.Error()); strings.Contains(envelope, key) {
+			t.Errorf("%s: envelope leaks the key: %s", tt.name, envelope)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: errors.Is(err, original) = false", tt.name)
+		}
+	}
+}
+
+// partsProvider отдает ответ по частям: все, кроме последней, оборваны
+// лимитом токенов. Запоминает запросы продолжения.
+type partsProvider struct {
+	Unsupported
+	parts  []string
+	reason string
+	reqs   []*Request
+}
+
+func (p *partsProvider) Name() string { return "parts" }
+
+func (p *partsProvider) Chat(apiKey, model string, req *Request) (*Response, error) {
+	p.reqs = append(p.reqs, req)
+	n := len(p.reqs) - 1
+	resp := &Response{Text: p.parts[n], FinishReason: "stop", Usage: &Usage{TotalTokens: 1}}
+	if n < len(p.parts)-1 {
+		resp.FinishReason = p.reason
+	}
+	return resp, nil
+}
+
+func TestRunContinued(t *testing.T) {
+	tests := []struct {
+		name      string
+		parts     []string
+		reason    string
+		max       int
+		mode      string
+		wantText  string
+		wantCalls int
+	}{
+		{"stitched", []string{"Hel", "lo, wor", "ld"}, "length", 3, "general", "Hello, world", 3},
+		{"gemini max tokens", []string{"a", "b"}, "MAX_TOKENS", 3, "general", "ab", 2},
+		{"limit reached", []string{"a", "b", "c", "d"}, "length", 2, "general", "abc", 3},
+		{"disabled", []string{"a", "b"}, "length", 0, "general", "a", 1},
+		{"not truncated", []string{"a"}, "length", 3, "general", "a", 1},
+		{"fim", []string{"x :=", " 1"}, "length", 1, "fim", "x := 1", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempConfig(t)
+			p := &partsProvider{parts: tt.parts, reason: tt.reason}
+			r := Runner{Provider: p, Keys: []string{"a"}, Models: []string{"m"}, MaxContinuations: tt.max}
+			history := &ChatHistory{ID: "c", Messages: []ChatMessageHistory{{Role: "user", Content: "old"}}}
+
+			resp, err := r.Run(&Request{Mode: tt.mode, Prompt: "func f() {", JSON: true, History: history})
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if resp.Text != tt.wantText || len(p.reqs) != tt.wantCalls {
+				t.Fatalf("Run() = %q after %d calls, want %q after %d", resp.Text, len(p.reqs), tt.wantText, tt.wantCalls)
+			}
+			if resp.Usage.TotalTokens != tt.wantCalls {
+				t.Errorf("usage total = %d, want %d", resp.Usage.TotalTokens, tt.wantCalls)
+			}
+			if len(history.Messages) != 1 {
+				t.Errorf("chat history changed: %+v", history.Messages)
+			}
+			if len(p.reqs) < 2 {
+				return
+			}
+
+			last := p.reqs[len(p.reqs)-1]
+			if tt.mode == "fim" {
+				if last.Prompt != "func f() {x :=" {
+					t.Errorf("fim prefix = %q", last.Prompt)
+				}
+				return
+			}
+			msgs := last.History.Messages
+			if last.Prompt != ContinuePrompt || last.JSON || !last.NoTools || len(msgs) != 3 ||
+				msgs[1].Content != "func f() {" || msgs[2].Role != "assistant" ||
+				msgs[2].Content != strings.Join(tt.parts[:len(p.reqs)-1], "") {
+				t.Errorf("continuation request = %+v, history %+v", last, msgs)
+			}
+		})
+	}
+}
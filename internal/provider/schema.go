@@ -0,0 +1,394 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// SchemaRetries сколько раз переспросить модель, если ответ не прошел проверку --schema
+const SchemaRetries = 2
+
+// Schema JSON Schema ответа (--schema). Провайдеры передают ее в API
+// (response_format json_schema, responseSchema, format), а Runner
+// проверяет ответ локально.
+type Schema struct {
+	Name   string          // имя для response_format, по умолчанию имя файла
+	Raw    json.RawMessage // сама схема
+	Strict bool            // strict из файла-обертки
+
+	root interface{}
+}
+
+// ResponseFormat поле response_format OpenAI-совместимых API.
+type ResponseFormat struct {
+	Type       string            `json:"type"` // json_object или json_schema
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat описание схемы для response_format json_schema.
+type JSONSchemaFormat struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+	Strict bool            `json:"strict,omitempty"`
+}
+
+var schemaNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// LoadSchema читает --schema. Файл может содержать саму JSON Schema или
+// обертку в стиле OpenAI ({"name", "schema", "strict"}). Пустой путь — nil.
+func LoadSchema(path string) (*Schema, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var wrapper struct {
+		Name   string          `json:"name"`
+		Schema json.RawMessage `json:"schema"`
+		Strict bool            `json:"strict"`
+	}
+	if err := json.Unmarshal(data, &wrapper); err != nil {
+		return nil, fmt.Errorf("файл схемы не является JSON объектом: %w", err)
+	}
+
+	s := &Schema{Raw: json.RawMessage(data)}
+	if len(wrapper.Schema) > 0 {
+		s.Raw, s.Name, s.Strict = wrapper.Schema, wrapper.Name, wrapper.Strict
+	}
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	s.Name = schemaNameInvalid.ReplaceAllString(s.Name, "_")
+
+	if err := json.Unmarshal(s.Raw, &s.root); err != nil {
+		return nil, err
+	}
+	if _, ok := s.root.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("схема должна быть JSON объектом")
+	}
+	return s, nil
+}
+
+// JSONResponseFormat возвращает response_format для запроса: json_schema
+// со схемой, json_object для -j или nil, если JSON не запрошен.
+func JSONResponseFormat(req *Request) *ResponseFormat {
+	switch {
+	case req.Schema != nil:
+		return &ResponseFormat{
+			Type:       "json_schema",
+			JSONSchema: &JSONSchemaFormat{Name: req.Schema.Name, Schema: req.Schema.Raw, Strict: req.Schema.Strict},
+		}
+	case req.JSON:
+		return &ResponseFormat{Type: "json_object"}
+	}
+	return nil
+}
+
+// maxRefDepth защита от циклических $ref при развертывании
+const maxRefDepth = 16
+
+// Inline возвращает схему с подставленными локальными $ref — для API,
+// которые ссылок не понимают (Gemini responseSchema).
+func (s *Schema) Inline() interface{} {
+	return s.inline(s.root, 0)
+}
+
+func (s *Schema) inline(node interface{}, depth int) interface{} {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		if ref, ok := v["$ref"].(string); ok && depth < maxRefDepth {
+			if target, err := s.resolve(ref); err == nil {
+				return s.inline(target, depth+1)
+			}
+		}
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[k] = s.inline(item, depth)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = s.inline(item, depth)
+		}
+		return out
+	}
+	return node
+}
+
+// Instruction текст схемы для промпта — для моделей без поддержки схемы в API.
+func (s *Schema) Instruction() string {
+	return "\nThe JSON must match this JSON Schema:\n" + string(s.Raw)
+}
+
+// FixPrompt дописывается к промпту при повторе после неудачной проверки.
+func (s *Schema) FixPrompt(answer string, verr error) string {
+	return fmt.Sprintf("\n\nYour previous answer did not match the required JSON Schema.\n"+
+		"Validation error: %v\nPrevious answer:\n%s\n%s\nReturn only the corrected JSON.",
+		verr, answer, s.Instruction())
+}
+
+// Validate проверяет ответ модели (ограждение ```json допускается).
+func (s *Schema) Validate(text string) error {
+	var value interface{}
+	if err := json.Unmarshal([]byte(StripCodeFence(text)), &value); err != nil {
+		return fmt.Errorf("ответ не является JSON: %v", err)
+	}
+	return s.validate(s.root, value, "$", nil)
+}
+
+// validate поддерживает основное подмножество JSON Schema: type, enum,
+// const, properties/required/additionalProperties, items, ограничения
+// длины, чисел и pattern, anyOf/oneOf/allOf и локальные $ref.
+// refs — $ref, уже пройденные для этого значения: повторный переход по
+// той же ссылке без спуска к вложенному значению — цикл ({"$ref":"#"}).
+func (s *Schema) validate(node, value interface{}, path string, refs []string) error {
+	schema, ok := node.(map[string]interface{})
+	if !ok {
+		// true/false как схема
+		if b, isBool := node.(bool); isBool && !b {
+			return fmt.Errorf("%s: значение не допускается схемой", path)
+		}
+		return nil
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		for _, seen := range refs {
+			if seen == ref {
+				return fmt.Errorf("%s: циклический $ref %s", path, ref)
+			}
+		}
+		target, err := s.resolve(ref)
+		if err != nil {
+			return err
+		}
+		return s.validate(target, value, path, append(refs[:len(refs):len(refs)], ref))
+	}
+
+	if types := schemaTypes(schema); len(types) > 0 {
+		actual := jsonType(value)
+		matched := false
+		for _, t := range types {
+			if t == actual || (t == "number" && actual == "integer") {
+				matched = true
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: ожидался %s, получен %s", path, strings.Join(types, " или "), actual)
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, value) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: значение %s не из списка enum", path, compactJSON(value))
+		}
+	}
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, value) {
+		return fmt.Errorf("%s: ожидалось %s", path, compactJSON(c))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if err := s.validateObject(schema, v, path); err != nil {
+			return err
+		}
+	case []interface{}:
+		if n, ok := schemaNumber(schema, "minItems"); ok && float64(len(v)) < n {
+			return fmt.Errorf("%s: элементов %d, минимум %v", path, len(v), n)
+		}
+		if n, ok := schemaNumber(schema, "maxItems"); ok && float64(len(v)) > n {
+			return fmt.Errorf("%s: элементов %d, максимум %v", path, len(v), n)
+		}
+		if items, ok := schema["items"]; ok {
+			for i, item := range v {
+				if err := s.validate(items, item, fmt.Sprintf("%s[%d]", path, i), nil); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if n, ok := schemaNumber(schema, "minLength"); ok && length < n {
+			return fmt.Errorf("%s: длина %v, минимум %v", path, length, n)
+		}
+		if n, ok := schemaNumber(schema, "maxLength"); ok && length > n {
+			return fmt.Errorf("%s: длина %v, максимум %v", path, length, n)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err == nil && !re.MatchString(v) {
+				return fmt.Errorf("%s: %q не подходит под pattern %s", path, v, pattern)
+			}
+		}
+	case float64:
+		if n, ok := schemaNumber(schema, "minimum"); ok && v < n {
+			return fmt.Errorf("%s: %v меньше минимума %v", path, v, n)
+		}
+		if n, ok := schemaNumber(schema, "maximum"); ok && v > n {
+			return fmt.Errorf("%s: %v больше максимума %v", path, v, n)
+		}
+		if n, ok := schemaNumber(schema, "exclusiveMinimum"); ok && v <= n {
+			return fmt.Errorf("%s: %v должно быть больше %v", path, v, n)
+		}
+		if n, ok := schemaNumber(schema, "exclusiveMaximum"); ok && v >= n {
+			return fmt.Errorf("%s: %v должно быть меньше %v", path, v, n)
+		}
+	}
+
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			if err := s.validate(sub, value, path, refs); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		if s.countMatches(anyOf, value, path, refs) == 0 {
+			return fmt.Errorf("%s: значение не подходит ни под один вариант anyOf", path)
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		if n := s.countMatches(oneOf, value, path, refs); n != 1 {
+			return fmt.Errorf("%s: значение подходит под %d вариантов oneOf вместо одного", path, n)
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(schema, obj map[string]interface{}, path string) error {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, present := obj[name]; !present {
+				return fmt.Errorf("%s: нет обязательного поля %q", path, name)
+			}
+		}
+	}
+
+	props, _ := schema["properties"].(map[string]interface{})
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // стабильный порядок сообщений об ошибках
+
+	for _, k := range keys {
+		fieldPath := path + "." + k
+		if sub, ok := props[k]; ok {
+			if err := s.validate(sub, obj[k], fieldPath, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		switch extra := schema["additionalProperties"].(type) {
+		case bool:
+			if !extra {
+				return fmt.Errorf("%s: лишнее поле", fieldPath)
+			}
+		case map[string]interface{}:
+			if err := s.validate(extra, obj[k], fieldPath, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) countMatches(variants []interface{}, value interface{}, path string, refs []string) int {
+	n := 0
+	for _, sub := range variants {
+		if s.validate(sub, value, path, refs) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// resolve находит локальную ссылку вида #/$defs/Item.
+func (s *Schema) resolve(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("внешние $ref не поддерживаются: %s", ref)
+	}
+	node := s.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("не найден $ref %s", ref)
+		}
+		if node, ok = m[part]; !ok {
+			return nil, fmt.Errorf("не найден $ref %s", ref)
+		}
+	}
+	return node, nil
+}
+
+// schemaTypes читает type (строка или список) и nullable из OpenAPI.
+func schemaTypes(schema map[string]interface{}) []string {
+	var types []string
+	switch t := schema["type"].(type) {
+	case string:
+		types = []string{t}
+	case []interface{}:
+		for _, item := range t {
+			if name, ok := item.(string); ok {
+				types = append(types, name)
+			}
+		}
+	}
+	if nullable, _ := schema["nullable"].(bool); nullable && len(types) > 0 {
+		types = append(types, "null")
+	}
+	return types
+}
+
+func schemaNumber(schema map[string]interface{}, key string) (float64, bool) {
+	n, ok := schema[key].(float64)
+	return n, ok
+}
+
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func compactJSON(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,280 @@
+package provider
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeSchema сохраняет схему во временный файл и возвращает путь.
+func writeSchema(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// mustSchema загружает схему из текста или завершает тест.
+func mustSchema(t *testing.T, data string) *Schema {
+	t.Helper()
+	s, err := LoadSchema(writeSchema(t, "schema.json", data))
+	if err != nil {
+		t.Fatalf("LoadSchema(%s) error = %v", data, err)
+	}
+	return s
+}
+
+func TestLoadSchema(t *testing.T) {
+	tests := []struct {
+		name, file, data string
+		wantName         string
+		wantRaw          string
+		wantStrict       bool
+		wantErr          bool
+	}{
+		{
+			name: "bare schema named after the file", file: "invoice.json",
+			data:     `{"type":"object"}`,
+			wantName: "invoice", wantRaw: `{"type":"object"}`,
+		},
+		{
+			name: "openai wrapper", file: "w.json",
+			data:     `{"name":"Person","strict":true,"schema":{"type":"object"}}`,
+			wantName: "Person", wantRaw: `{"type":"object"}`, wantStrict: true,
+		},
+		{
+			name: "wrapper without name", file: "list.schema.json",
+			data:     `{"schema":{"type":"array"}}`,
+			wantName: "list_schema", wantRaw: `{"type":"array"}`,
+		},
+		{
+			name: "name sanitised", file: "w.json",
+			data:     `{"name":"my schema/v1.0","schema":{"type":"object"}}`,
+			wantName: "my_schema_v1_0", wantRaw: `{"type":"object"}`,
+		},
+		{name: "not json", file: "bad.json", data: `type: object`, wantErr: true},
+		{name: "array is not a schema", file: "arr.json", data: `[1]`, wantErr: true},
+		{name: "wrapped schema is not an object", file: "w.json", data: `{"schema":"string"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		s, err := LoadSchema(writeSchema(t, tt.file, tt.data))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: LoadSchema error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if s.Name != tt.wantName || string(s.Raw) != tt.wantRaw || s.Strict != tt.wantStrict {
+			t.Errorf("%s: LoadSchema = {%q %s %v}, want {%q %s %v}", tt.name, s.Name, s.Raw, s.Strict, tt.wantName, tt.wantRaw, tt.wantStrict)
+		}
+	}
+
+	if s, err := LoadSchema(""); s != nil || err != nil {
+		t.Errorf("LoadSchema(\"\") = %v, %v, want nil", s, err)
+	}
+	if _, err := LoadSchema(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("LoadSchema(missing) error = nil")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	person := `{
+		"type": "object",
+		"required": ["name", "role"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"role": {"enum": ["admin", "user"]},
+			"tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}},
+			"contact": {"anyOf": [{"type": "string", "pattern": "@"}, {"type": "null"}]},
+			"id": {"oneOf": [{"type": "integer"}, {"type": "number"}]},
+			"manager": {"$ref": "#/$defs/ref"}
+		},
+		"$defs": {"ref": {"type": "object", "required": ["name"], "properties": {"manager": {"$ref": "#/$defs/ref"}}}}
+	}`
+
+	tests := []struct {
+		name   string
+		schema string
+		answer string
+		want   string // подстрока ошибки, пусто — ответ проходит
+	}{
+		{"valid", person, `{"name":"Ann","role":"admin","age":30,"tags":["a"],"contact":null,"id":1.5}`, ""},
+		{"fenced answer", person, "```json\n{\"name\":\"Ann\",\"role\":\"user\"}\n```", ""},
+		{"not json", person, `Ann, admin`, "не является JSON"},
+		{"wrong type", person, `{"name":"Ann","role":"user","age":"30"}`, "$.age: ожидался integer, получен string"},
+		{"number is not integer", person, `{"name":"Ann","role":"user","age":1.5}`, "$.age: ожидался integer"},
+		{"enum", person, `{"name":"Ann","role":"root"}`, `$.role: значение "root" не из списка enum`},
+		{"required", person, `{"name":"Ann"}`, `нет обязательного поля "role"`},
+		{"additional property", person, `{"name":"Ann","role":"user","x":1}`, "$.x: лишнее поле"},
+		{"minimum", person, `{"name":"Ann","role":"user","age":-1}`, "меньше минимума"},
+		{"items", person, `{"name":"Ann","role":"user","tags":["a",1]}`, "$.tags[1]: ожидался string"},
+		{"maxItems", person, `{"name":"Ann","role":"user","tags":["a","b","c"]}`, "максимум 2"},
+		{"anyOf", person, `{"name":"Ann","role":"user","contact":"phone"}`, "ни под один вариант anyOf"},
+		{"oneOf", person, `{"name":"Ann","role":"user","id":1}`, "подходит под 2 вариантов oneOf"},
+		{"recursive $ref", person, `{"name":"Ann","role":"user","manager":{"name":"Bob","manager":{"name":"Eve"}}}`, ""},
+		{"recursive $ref error", person, `{"name":"Ann","role":"user","manager":{"name":"Bob","manager":{}}}`,
+			`$.manager.manager: нет обязательного поля "name"`},
+		{"root array", `{"type":"array","items":{"type":"number"}}`, `[1, 2.5]`, ""},
+		{"nullable", `{"type":"string","nullable":true}`, `null`, ""},
+		{"false schema", `{"properties":{"x":false}}`, `{"x":1}`, "$.x: значение не допускается схемой"},
+		{"missing $ref", `{"$ref":"#/$defs/none"}`, `{}`, "не найден $ref #/$defs/none"},
+		{"external $ref", `{"$ref":"other.json"}`, `{}`, "внешние $ref не поддерживаются"},
+		{"cyclic $ref to root", `{"$ref":"#"}`, `{}`, "циклический $ref #"},
+		{"cyclic $ref through $defs", `{"$ref":"#/$defs/a","$defs":{"a":{"$ref":"#/$defs/b"},"b":{"allOf":[{"$ref":"#/$defs/a"}]}}}`,
+			`{}`, "циклический $ref #/$defs/a"},
+		{"cyclic $ref in anyOf", `{"anyOf":[{"$ref":"#"},{"type":"string"}]}`, `"x"`, ""},
+	}
+	for _, tt := range tests {
+		err := mustSchema(t, tt.schema).Validate(tt.answer)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: Validate error = %v, want nil", tt.name, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: Validate error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestInline(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		want   string
+	}{
+		{
+			name:   "local refs replaced",
+			schema: `{"type":"object","properties":{"item":{"$ref":"#/$defs/item"}},"$defs":{"item":{"type":"string"}}}`,
+			want:   `{"$defs":{"item":{"type":"string"}},"properties":{"item":{"type":"string"}},"type":"object"}`,
+		},
+		{
+			name:   "unknown ref kept",
+			schema: `{"items":{"$ref":"#/none"}}`,
+			want:   `{"items":{"$ref":"#/none"}}`,
+		},
+	}
+	for _, tt := range tests {
+		got, _ := json.Marshal(mustSchema(t, tt.schema).Inline())
+		if string(got) != tt.want {
+			t.Errorf("%s: Inline() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// Цикл разворачивается до maxRefDepth и останавливается на $ref
+	cyclic := mustSchema(t, `{"type":"object","properties":{"next":{"$ref":"#"}}}`).Inline()
+	depth := 0
+	for node, ok := cyclic.(map[string]interface{}); ok; node, ok = node["properties"].(map[string]interface{})["next"].(map[string]interface{}) {
+		if _, isRef := node["$ref"]; isRef {
+			break
+		}
+		depth++
+	}
+	if depth != maxRefDepth+1 {
+		t.Errorf("cyclic Inline() depth = %d, want %d", depth, maxRefDepth+1)
+	}
+}
+
+func TestJSONResponseFormat(t *testing.T) {
+	schema := &Schema{Name: "person", Raw: json.RawMessage(`{"type":"object"}`), Strict: true}
+	tests := []struct {
+		name string
+		req  *Request
+		want string
+	}{
+		{"none", &Request{}, `null`},
+		{"json object", &Request{JSON: true}, `{"type":"json_object"}`},
+		{"schema", &Request{JSON: true, Schema: schema},
+			`{"type":"json_schema","json_schema":{"name":"person","schema":{"type":"object"},"strict":true}}`},
+		{"schema not strict", &Request{Schema: &Schema{Name: "s", Raw: json.RawMessage(`{}`)}},
+			`{"type":"json_schema","json_schema":{"name":"s","schema":{}}}`},
+	}
+	for _, tt := range tests {
+		got, _ := json.Marshal(JSONResponseFormat(tt.req))
+		if string(got) != tt.want {
+			t.Errorf("%s: JSONResponseFormat = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// answersProvider отвечает заготовленными ответами по очереди
+// и запоминает промпты запросов.
+type answersProvider struct {
+	Unsupported
+	answers []string
+	prompts []string
+}
+
+func (p *answersProvider) Name() string { return "answers" }
+
+func (p *answersProvider) Chat(apiKey, model string, req *Request) (*Response, error) {
+	p.prompts = append(p.prompts, req.Prompt)
+	text := p.answers[len(p.prompts)-1]
+	return &Response{Text: text, Usage: &Usage{TotalTokens: 10}}, nil
+}
+
+func TestRunValidated(t *testing.T) {
+	schema := `{"type":"object","required":["n"],"properties":{"n":{"type":"integer"}}}`
+
+	tests := []struct {
+		name      string
+		answers   []string
+		wantText  string
+		wantErr   string
+		wantCalls int
+	}{
+		{"valid at once", []string{`{"n":1}`}, `{"n":1}`, "", 1},
+		{"fixed on retry", []string{`{"n":"one"}`, `not json`, `{"n":1}`}, `{"n":1}`, "", 3},
+		{"gives up", []string{`{}`, `{}`, `{"n":"one"}`}, "", `после 2 повторов: $.n: ожидался integer`, SchemaRetries + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempConfig(t)
+			p := &answersProvider{answers: tt.answers}
+			r := Runner{Provider: p, Keys: []string{"k"}, Models: []string{"m"}}
+
+			resp, err := r.Run(&Request{Mode: "general", Prompt: "count", Schema: mustSchema(t, schema)})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Run() error = %v, want %q", err, tt.wantErr)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Run() error = %v", err)
+				}
+				if resp.Text != tt.wantText || resp.Usage.TotalTokens != 10*tt.wantCalls {
+					t.Errorf("Run() = %q (usage %+v), want %q", resp.Text, resp.Usage, tt.wantText)
+				}
+			}
+			if len(p.prompts) != tt.wantCalls {
+				t.Fatalf("calls = %d, want %d", len(p.prompts), tt.wantCalls)
+			}
+
+			// Повтор несет исходный промпт, ошибку проверки и прошлый ответ
+			for i, prompt := range p.prompts[1:] {
+				for _, want := range []string{"count", "Validation error:", tt.answers[i], "Return only the corrected JSON."} {
+					if !strings.Contains(prompt, want) {
+						t.Errorf("retry %d prompt has no %q:\n%s", i+1, want, prompt)
+					}
+				}
+			}
+		})
+	}
+
+	// Без схемы ответ не проверяется
+	withTempConfig(t)
+	p := &answersProvider{answers: []string{"plain text"}}
+	r := Runner{Provider: p, Keys: []string{"k"}, Models: []string{"m"}}
+	if resp, err := r.Run(&Request{Mode: "general"}); err != nil || resp.Text != "plain text" {
+		t.Errorf("Run() without schema = %v, %v", resp, err)
+	}
+	if !reflect.DeepEqual(p.prompts, []string{""}) {
+		t.Errorf("prompts = %q, want a single request", p.prompts)
+	}
+}
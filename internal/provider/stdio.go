@@ -0,0 +1,110 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// ReadStdin читает весь stdin (если он не терминал) и приводит его к UTF-8.
+// Консоль Windows может прислать текст в CP866 или CP1251.
+func ReadStdin() string {
+	stat, _ := os.Stdin.Stat()
+	if (stat.Mode() & os.ModeCharDevice) != 0 {
+		return ""
+	}
+
+	inputBytes, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return ""
+	}
+
+	if utf8.Valid(inputBytes) {
+		return strings.TrimSpace(string(inputBytes))
+	}
+
+	decoded, err := charmap.CodePage866.NewDecoder().Bytes(inputBytes)
+	if err == nil {
+		return strings.TrimSpace(string(decoded))
+	}
+
+	decoded1251, err := charmap.Windows1251.NewDecoder().Bytes(inputBytes)
+	if err == nil {
+		return strings.TrimSpace(string(decoded1251))
+	}
+
+	return strings.TrimSpace(string(inputBytes))
+}
+
+// PrintOutput печатает ответ модели. В JSON-режиме срезает обертку ```json ... ```.
+func PrintOutput(text string, jsonMode bool) {
+	if jsonMode {
+		text = StripCodeFence(text)
+	}
+	fmt.Println(strings.TrimSpace(text))
+}
+
+// Result JSON-конверт ответа для --output-format json.
+type Result struct {
+	OK           bool       `json:"ok"`
+	Text         string     `json:"text"`
+	Provider     string     `json:"provider"`
+	Model        string     `json:"model"`
+	Mode         string     `json:"mode"`
+	Usage        *Usage     `json:"usage"`
+	FinishReason string     `json:"finish_reason"`
+	Attempts     int        `json:"attempts"`
+	LatencyMs    int64      `json:"latency_ms"`
+	ToolCalls    []ToolCall `json:"tool_calls"`
+	Key          string     `json:"key,omitempty"`
+}
+
+// ErrorResult JSON-конверт ошибки для --output-format json (см. Fatalf).
+type ErrorResult struct {
+	OK    bool   `json:"ok"` // всегда false
+	Error string `json:"error"`
+}
+
+// PrintResult печатает ответ с метаданными одной JSON-строкой.
+func PrintResult(resp *Response, jsonMode bool) {
+	text := strings.TrimSpace(resp.Text)
+	if jsonMode {
+		text = StripCodeFence(text)
+	}
+	toolCalls := resp.ToolCalls
+	if toolCalls == nil {
+		toolCalls = []ToolCall{}
+	}
+
+	data, err := json.Marshal(Result{
+		OK:           true,
+		Text:         text,
+		Provider:     resp.Provider,
+		Model:        resp.Model,
+		Mode:         resp.Mode,
+		Usage:        resp.Usage,
+		FinishReason: resp.FinishReason,
+		Attempts:     resp.Attempts,
+		LatencyMs:    resp.Latency.Milliseconds(),
+		ToolCalls:    toolCalls,
+		Key:          resp.Key,
+	})
+	if err != nil {
+		Fatalf("Ошибка формирования JSON: %v", err)
+	}
+	fmt.Println(string(data))
+}
+
+// StripCodeFence убирает markdown-ограждение кода вокруг ответа.
+func StripCodeFence(text string) string {
+	text = strings.TrimSpace(text)
+	text = strings.TrimPrefix(text, "```json")
+	text = strings.TrimPrefix(text, "```")
+	text = strings.TrimSuffix(text, "```")
+	return strings.TrimSpace(text)
+}
@@ -0,0 +1,255 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrPartialStream оборачивает ошибку, случившуюся после того, как часть
+// ответа уже выведена. Повторять такой запрос нельзя — текст задублируется.
+var ErrPartialStream = errors.New("поток прерван после начала вывода")
+
+// openStream выполняет POST-запрос и возвращает ответ для чтения по частям.
+// Тело ответа закрывает вызывающий.
+func openStream(apiKey, url string, body []byte, timeout time.Duration, accept string) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", accept)
+
+	if timeout == 0 {
+		timeout = DefaultHTTPTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, newHTTPError(resp, respBody)
+	}
+	return resp, nil
+}
+
+// DoNDJSON выполняет POST-запрос и читает ответ как JSON по строке на объект
+// (потоковый формат Ollama). Для каждой непустой строки вызывается onLine.
+func DoNDJSON(apiKey, url string, body []byte, timeout time.Duration, onLine func(line []byte) error) error {
+	resp, err := openStream(apiKey, url, body, timeout, "application/x-ndjson")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			if err := onLine(trimmed); err != nil {
+				return err
+			}
+		}
+		if readErr != nil {
+			if readErr == io.EOF {
+				return nil
+			}
+			return readErr
+		}
+	}
+}
+
+// DoSSE выполняет POST-запрос и читает ответ как Server-Sent Events.
+// Для каждого события "data: ..." вызывается onData; "[DONE]" завершает поток.
+func DoSSE(apiKey, url string, body []byte, timeout time.Duration, onData func(data []byte) error) error {
+	resp, err := openStream(apiKey, url, body, timeout, "text/event-stream")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	var event bytes.Buffer
+
+	flush := func() error {
+		if event.Len() == 0 {
+			return nil
+		}
+		data := bytes.TrimSpace(event.Bytes())
+		event.Reset()
+		if string(data) == "[DONE]" {
+			return io.EOF
+		}
+		return onData(data)
+	}
+
+	for {
+		line, readErr := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			// Пустая строка — конец события
+			if err := flush(); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		case strings.HasPrefix(line, "data:"):
+			if event.Len() > 0 {
+				event.WriteByte('\n')
+			}
+			event.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// Комментарии (":") и поля event/id/retry не используются
+
+		if readErr != nil {
+			if readErr == io.EOF {
+				if err := flush(); err != nil && err != io.EOF {
+					return err
+				}
+				return nil
+			}
+			return readErr
+		}
+	}
+}
+
+// StreamToolCall вызов инструмента, собранный из дельт потока.
+type StreamToolCall struct {
+	ID        string
+	Name      string
+	Arguments string
+}
+
+// StreamResult итог потокового ответа OpenAI-совместимого API.
+type StreamResult struct {
+	Text         string
+	FinishReason string
+	ToolCalls    []StreamToolCall
+	Usage        *Usage // из последнего чанка, если API его присылает
+}
+
+// Response переносит собранный поток в Response.
+func (r *StreamResult) Response() *Response {
+	resp := &Response{Text: r.Text, FinishReason: r.FinishReason, Usage: r.Usage}
+	for _, tc := range r.ToolCalls {
+		resp.ToolCalls = append(resp.ToolCalls, ToolCall{Name: tc.Name, Arguments: tc.Arguments})
+	}
+	return resp
+}
+
+type chatChunk struct {
+	Choices []struct {
+		Index int `json:"index"`
+		Delta struct {
+			Content   string `json:"content"`
+			ToolCalls []struct {
+				Index    int    `json:"index"`
+				ID       string `json:"id"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *Usage `json:"usage,omitempty"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// StreamChat отправляет запрос в chat/completions с "stream": true
+// и собирает ответ из дельт. Каждый кусок текста передается в onDelta.
+// body должен уже содержать "stream": true.
+func StreamChat(apiKey, url string, body []byte, timeout time.Duration, onDelta func(string)) (*StreamResult, error) {
+	result := &StreamResult{}
+	toolIndex := map[int]int{}
+
+	err := DoSSE(apiKey, url, body, timeout, func(data []byte) error {
+		var chunk chatChunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return fmt.Errorf("stream parse error: %v | Data: %s", err, string(data))
+		}
+		if chunk.Error != nil {
+			return fmt.Errorf("api error: %s", chunk.Error.Message)
+		}
+		if chunk.Usage != nil {
+			result.Usage = chunk.Usage
+		}
+		if len(chunk.Choices) == 0 {
+			return nil
+		}
+
+		choice := chunk.Choices[0]
+		if choice.Delta.Content != "" {
+			result.Text += choice.Delta.Content
+			if onDelta != nil {
+				onDelta(choice.Delta.Content)
+			}
+		}
+		for _, tc := range choice.Delta.ToolCalls {
+			i, ok := toolIndex[tc.Index]
+			if !ok {
+				i = len(result.ToolCalls)
+				toolIndex[tc.Index] = i
+				result.ToolCalls = append(result.ToolCalls, StreamToolCall{})
+			}
+			if tc.ID != "" {
+				result.ToolCalls[i].ID = tc.ID
+			}
+			result.ToolCalls[i].Name += tc.Function.Name
+			result.ToolCalls[i].Arguments += tc.Function.Arguments
+		}
+		if choice.FinishReason != "" {
+			result.FinishReason = choice.FinishReason
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// StreamPrinter печатает потоковый ответ в stdout и помнит, было ли
+// что-то уже выведено (OCR и транскрибация потоков не отдают).
+type StreamPrinter struct {
+	started bool
+}
+
+// Write выводит кусок ответа сразу, без буферизации.
+func (p *StreamPrinter) Write(text string) {
+	p.started = true
+	_, _ = os.Stdout.WriteString(text)
+}
+
+// Finish завершает вывод: с --output-format json печатает JSON-конверт,
+// после потока — перевод строки, иначе весь ответ обычным образом.
+func (p *StreamPrinter) Finish(resp *Response, flags *Flags) {
+	switch {
+	case flags.OutputFormat == OutputJSON:
+		PrintResult(resp, flags.Json)
+	case p.started:
+		fmt.Println()
+	default:
+		PrintOutput(resp.Text, flags.Json)
+	}
+}
@@ -0,0 +1,120 @@
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// serve поднимает сервер, отдающий body с заданным статусом.
+func serve(t *testing.T, status int, body string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestDoSSE(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"events", "data: {\"a\":1}\n\ndata: {\"a\":2}\n\n", []string{`{"a":1}`, `{"a":2}`}},
+		{"crlf and no space", "data:one\r\n\r\ndata: two\r\n\r\n", []string{"one", "two"}},
+		{"multiline event", "data: first\ndata: second\n\n", []string{"first\nsecond"}},
+		{"comments and fields skipped", ": ping\nevent: delta\nid: 1\ndata: x\n\n", []string{"x"}},
+		{"done stops the stream", "data: x\n\ndata: [DONE]\n\ndata: after\n\n", []string{"x"}},
+		{"last event without blank line", "data: x\n\ndata: tail", []string{"x", "tail"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		err := DoSSE("", serve(t, 200, tt.body), []byte("{}"), 0, func(data []byte) error {
+			got = append(got, string(data))
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: DoSSE error = %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: events = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDoSSEHTTPError(t *testing.T) {
+	err := DoSSE("", serve(t, 429, `{"error":{"message":"slow"}}`), []byte("{}"), 0, func([]byte) error { return nil })
+	httpErr, ok := AsHTTPError(err)
+	if !ok || httpErr.StatusCode != 429 || httpErr.Message != "slow" {
+		t.Errorf("DoSSE error = %v, want HTTP 429 with message", err)
+	}
+}
+
+func TestDoNDJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"lines", "{\"a\":1}\n{\"a\":2}\n", []string{`{"a":1}`, `{"a":2}`}},
+		{"blank lines and crlf", "{\"a\":1}\r\n\r\n  \n{\"a\":2}", []string{`{"a":1}`, `{"a":2}`}},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		err := DoNDJSON("", serve(t, 200, tt.body), []byte("{}"), 0, func(line []byte) error {
+			got = append(got, string(line))
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: DoNDJSON error = %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: lines = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStreamChat(t *testing.T) {
+	body := strings.Join([]string{
+		`data: {"choices":[{"delta":{"content":"Hel"}}]}`,
+		`data: {"choices":[{"delta":{"content":"lo"}}]}`,
+		`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"id":"c1","function":{"name":"calc","arguments":"{\"x\":"}}]}}]}`,
+		`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"1}"}}]},"finish_reason":"tool_calls"}]}`,
+		`data: {"choices":[],"usage":{"prompt_tokens":5,"completion_tokens":2,"total_tokens":7}}`,
+		`data: [DONE]`,
+	}, "\n\n") + "\n\n"
+
+	var deltas []string
+	result, err := StreamChat("", serve(t, 200, body), []byte("{}"), 0, func(s string) { deltas = append(deltas, s) })
+	if err != nil {
+		t.Fatalf("StreamChat error = %v", err)
+	}
+	if result.Text != "Hello" || !reflect.DeepEqual(deltas, []string{"Hel", "lo"}) {
+		t.Errorf("text = %q, deltas = %q", result.Text, deltas)
+	}
+	wantCalls := []StreamToolCall{{ID: "c1", Name: "calc", Arguments: `{"x":1}`}}
+	if !reflect.DeepEqual(result.ToolCalls, wantCalls) {
+		t.Errorf("tool calls = %+v, want %+v", result.ToolCalls, wantCalls)
+	}
+	if result.FinishReason != "tool_calls" {
+		t.Errorf("finish reason = %q", result.FinishReason)
+	}
+	if result.Usage == nil || result.Usage.TotalTokens != 7 {
+		t.Errorf("usage = %+v, want total 7", result.Usage)
+	}
+}
+
+func TestStreamChatErrorChunk(t *testing.T) {
+	_, err := StreamChat("", serve(t, 200, "data: {\"error\":{\"message\":\"overloaded\"}}\n\n"), []byte("{}"), 0, nil)
+	if err == nil || !strings.Contains(err.Error(), "overloaded") {
+		t.Errorf("StreamChat error = %v, want api error", err)
+	}
+}
@@ -0,0 +1,65 @@
+package provider
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Segment фрагмент транскрибации с таймкодами в секундах.
+type Segment struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+// Subtitles возвращает субтитры по запросу: WebVTT с req.Vtt,
+// SRT с req.Srt, иначе пустую строку (нужен обычный текст).
+func Subtitles(req *Request, segments []Segment) string {
+	switch {
+	case req.Vtt:
+		return FormatVTT(segments)
+	case req.Srt:
+		return FormatSRT(segments)
+	}
+	return ""
+}
+
+// FormatSRT собирает субтитры SRT. Пустые сегменты пропускаются,
+// нумерация при этом остается сплошной.
+func FormatSRT(segments []Segment) string {
+	var sb strings.Builder
+	n := 0
+	for _, seg := range segments {
+		text := strings.TrimSpace(seg.Text)
+		if text == "" {
+			continue
+		}
+		n++
+		fmt.Fprintf(&sb, "%d\n%s --> %s\n%s\n\n", n, subtitleTime(seg.Start, ","), subtitleTime(seg.End, ","), text)
+	}
+	return sb.String()
+}
+
+// FormatVTT собирает субтитры WebVTT.
+func FormatVTT(segments []Segment) string {
+	var sb strings.Builder
+	sb.WriteString("WEBVTT\n\n")
+	for _, seg := range segments {
+		text := strings.TrimSpace(seg.Text)
+		if text == "" {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s --> %s\n%s\n\n", subtitleTime(seg.Start, "."), subtitleTime(seg.End, "."), text)
+	}
+	return sb.String()
+}
+
+// subtitleTime переводит секунды в 00:01:02,345 (SRT) или 00:01:02.345 (VTT).
+func subtitleTime(seconds float64, sep string) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
@@ -0,0 +1,45 @@
+package provider
+
+import "testing"
+
+func TestSubtitleTime(t *testing.T) {
+	tests := []struct {
+		seconds float64
+		sep     string
+		want    string
+	}{
+		{0, ",", "00:00:00,000"},
+		{5.123, ",", "00:00:05,123"},
+		{62.5, ".", "00:01:02.500"},
+		{3725.0009, ",", "01:02:05,001"},
+		{1.9999, ",", "00:00:02,000"},
+		{-1, ".", "00:00:00.000"},
+	}
+	for _, tt := range tests {
+		if got := subtitleTime(tt.seconds, tt.sep); got != tt.want {
+			t.Errorf("subtitleTime(%v) = %q, want %q", tt.seconds, got, tt.want)
+		}
+	}
+}
+
+func TestSubtitles(t *testing.T) {
+	segments := []Segment{
+		{Start: 0, End: 1.5, Text: " Привет "},
+		{Start: 1.5, End: 2, Text: "  "},
+		{Start: 2, End: 3.25, Text: "мир"},
+	}
+	tests := []struct {
+		name string
+		req  Request
+		want string
+	}{
+		{"srt", Request{Srt: true}, "1\n00:00:00,000 --> 00:00:01,500\nПривет\n\n2\n00:00:02,000 --> 00:00:03,250\nмир\n\n"},
+		{"vtt wins", Request{Srt: true, Vtt: true}, "WEBVTT\n\n00:00:00.000 --> 00:00:01.500\nПривет\n\n00:00:02.000 --> 00:00:03.250\nмир\n\n"},
+		{"plain text", Request{}, ""},
+	}
+	for _, tt := range tests {
+		if got := Subtitles(&tt.req, segments); got != tt.want {
+			t.Errorf("%s: Subtitles = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
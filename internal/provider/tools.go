@@ -0,0 +1,389 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Инструменты (function calling), общие для всех утилит с инструментами:
+// встроенные (calculator, tavily_search, fetch_url) регистрирует утилита, свои
+// пользователь описывает в tools.yaml. Модель видит их одинаково,
+// вызовы выполняет Toolset.
+
+// ToolsFileName файл пользовательских инструментов в папке конфигов.
+const ToolsFileName = "tools.yaml"
+
+// DefaultToolTimeout сколько ждать ответа инструмента, если в *.conf не
+// задан tool_timeout_sec, а в tools.yaml — timeout_sec.
+const DefaultToolTimeout = 30 * time.Second
+
+// DefaultToolWorkers сколько вызовов одного хода модели выполняется
+// одновременно, если в *.conf не задан tool_workers.
+const DefaultToolWorkers = 4
+
+// ToolOutputLimit максимальный размер результата инструмента в байтах:
+// все, что длиннее, обрезается, чтобы не переполнить контекст модели.
+const ToolOutputLimit = 64 * 1024
+
+// ToolSpec описание инструмента. У пользовательского инструмента задан
+// ровно один из Command и URL: программа получает JSON аргументов в stdin
+// и отвечает в stdout, HTTP-эндпоинт получает его телом POST.
+type ToolSpec struct {
+	Name        string                 `yaml:"name"`
+	Description string                 `yaml:"description"`
+	Parameters  map[string]interface{} `yaml:"parameters"`  // JSON Schema аргументов (type: object)
+	Command     []string               `yaml:"command"`     // программа и ее аргументы
+	URL         string                 `yaml:"url"`         // эндпоинт для POST
+	Headers     map[string]string      `yaml:"headers"`     // заголовки запроса, ${VAR} берется из окружения
+	TimeoutSec  int                    `yaml:"timeout_sec"` // 0 — ToolLimits.Timeout
+}
+
+// ToolLimits параллельность и время вызовов инструментов (tool_workers и
+// tool_timeout_sec в *.conf).
+type ToolLimits struct {
+	Workers int           // одновременных вызовов за ход модели (0 — DefaultToolWorkers)
+	Timeout time.Duration // на один вызов (0 — DefaultToolTimeout)
+}
+
+// ToolFunc выполняет встроенный инструмент с разобранными аргументами.
+type ToolFunc func(args map[string]interface{}) (string, error)
+
+// Builtin встроенный инструмент утилиты.
+type Builtin struct {
+	Spec ToolSpec
+	Run  ToolFunc
+}
+
+// Toolset инструменты одного запроса: встроенные и из tools.yaml.
+type Toolset struct {
+	specs  []ToolSpec
+	funcs  map[string]ToolFunc
+	limits ToolLimits
+}
+
+var toolNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// LoadTools читает tools.yaml из папки конфигов. Нет файла — нет
+// пользовательских инструментов.
+func LoadTools() ([]ToolSpec, error) {
+	path, err := ConfigPath(ToolsFileName)
+	if err != nil {
+		return nil, err
+	}
+	return ReadTools(path)
+}
+
+// ReadTools читает и проверяет файл инструментов.
+func ReadTools(path string) ([]ToolSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var file struct {
+		Tools []ToolSpec `yaml:"tools"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("ошибка парсинга %s: %v", ToolsFileName, err)
+	}
+
+	seen := map[string]bool{}
+	for i := range file.Tools {
+		spec := &file.Tools[i]
+		if err := spec.validate(); err != nil {
+			return nil, fmt.Errorf("%s, tools[%d]: %v", ToolsFileName, i, err)
+		}
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("%s: инструмент %s описан дважды", ToolsFileName, spec.Name)
+		}
+		seen[spec.Name] = true
+		if spec.Parameters == nil {
+			spec.Parameters = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+		}
+	}
+	return file.Tools, nil
+}
+
+func (s *ToolSpec) validate() error {
+	if !toolNameRe.MatchString(s.Name) {
+		return fmt.Errorf("неверное имя %q (латиница, цифры, _ и -, до 64 символов)", s.Name)
+	}
+	if s.Description == "" {
+		return fmt.Errorf("%s: не указан description", s.Name)
+	}
+	if (len(s.Command) > 0) == (s.URL != "") {
+		return fmt.Errorf("%s: нужно указать ровно одно из command и url", s.Name)
+	}
+	if t, ok := s.Parameters["type"]; s.Parameters != nil && (!ok || t != "object") {
+		return fmt.Errorf("%s: parameters должны быть схемой с type: object", s.Name)
+	}
+	return nil
+}
+
+// NewToolset собирает инструменты запроса. Пользовательский инструмент
+// с именем встроенного заменяет его.
+func NewToolset(user []ToolSpec, builtins ...Builtin) *Toolset {
+	t := &Toolset{funcs: map[string]ToolFunc{}}
+	userNames := map[string]bool{}
+	for _, spec := range user {
+		userNames[spec.Name] = true
+	}
+	for _, b := range builtins {
+		if userNames[b.Spec.Name] {
+			Logf("Инструмент %s из %s заменяет встроенный", b.Spec.Name, ToolsFileName)
+			continue
+		}
+		t.specs = append(t.specs, b.Spec)
+		t.funcs[b.Spec.Name] = b.Run
+	}
+	t.specs = append(t.specs, user...)
+	return t
+}
+
+// WithLimits задает параллельность и время вызовов; без него действуют
+// значения по умолчанию.
+func (t *Toolset) WithLimits(limits ToolLimits) *Toolset {
+	t.limits = limits
+	return t
+}
+
+// Specs описания всех инструментов (для провайдеров со своим форматом).
+// У nil Toolset (инструменты выключены) их нет.
+func (t *Toolset) Specs() []ToolSpec {
+	if t == nil {
+		return nil
+	}
+	return t.specs
+}
+
+// OpenAITool инструмент в формате tools OpenAI-совместимых API.
+type OpenAITool struct {
+	Type     string         `json:"type"`
+	Function OpenAIFunction `json:"function"`
+}
+
+// OpenAIFunction описание функции для OpenAITool.
+type OpenAIFunction struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Parameters  map[string]interface{} `json:"parameters"`
+}
+
+// OpenAI инструменты в формате chat/completions.
+func (t *Toolset) OpenAI() []OpenAITool {
+	specs := t.Specs()
+	tools := make([]OpenAITool, len(specs))
+	for i, spec := range specs {
+		tools[i] = OpenAITool{
+			Type:     "function",
+			Function: OpenAIFunction{Name: spec.Name, Description: spec.Description, Parameters: spec.Parameters},
+		}
+	}
+	return tools
+}
+
+// Call выполняет вызов инструмента и возвращает текст для модели:
+// ошибка тоже уходит модели ("Error: ..."), чтобы она могла ответить без
+// инструмента или исправить аргументы.
+func (t *Toolset) Call(name, arguments string) string {
+	Logf("Инструмент %s: %s", name, arguments)
+	result, err := t.Run(name, arguments)
+	if err != nil {
+		Logf("Инструмент %s: ошибка: %v", name, err)
+		return "Error: " + err.Error()
+	}
+	Logf("Инструмент %s: %s", name, result[:min(len(result), 500)])
+	return result
+}
+
+// CallAll выполняет вызовы одного хода модели (например, несколько
+// поисков) одновременно, не больше ToolLimits.Workers за раз, и возвращает
+// результаты в порядке вызовов.
+func (t *Toolset) CallAll(calls []ToolCall) []string {
+	results := make([]string, len(calls))
+	workers := DefaultToolWorkers
+	if t != nil && t.limits.Workers > 0 {
+		workers = t.limits.Workers
+	}
+	workers = min(workers, len(calls))
+	if workers > 1 {
+		Logf("Инструменты: вызовов за ход %d, одновременно до %d", len(calls), workers)
+	}
+
+	sem := make(chan struct{}, max(workers, 1))
+	var wg sync.WaitGroup
+	for i, call := range calls {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = t.Call(call.Name, call.Arguments)
+			<-sem
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// Run выполняет вызов инструмента: встроенного — функцией утилиты,
+// пользовательского — программой или HTTP-запросом. Дольше
+// ToolLimits.Timeout (у пользовательского — timeout_sec) вызов не ждет.
+func (t *Toolset) Run(name, arguments string) (string, error) {
+	if t == nil {
+		return "", fmt.Errorf("инструменты отключены")
+	}
+	args := map[string]interface{}{}
+	if strings.TrimSpace(arguments) != "" {
+		if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+			return "", fmt.Errorf("неверные аргументы %s: %v", name, err)
+		}
+	}
+
+	timeout := t.limits.Timeout
+	if timeout <= 0 {
+		timeout = DefaultToolTimeout
+	}
+	if run, ok := t.funcs[name]; ok {
+		out, err := runBuiltin(name, run, args, timeout)
+		return limitToolOutput(out), err
+	}
+	for _, spec := range t.specs {
+		if spec.Name == name {
+			// Аргументы передаются заново сериализованными: модель иногда
+			// присылает пустую строку вместо {}
+			input, _ := json.Marshal(args)
+			out, err := spec.execute(input, spec.timeout(timeout))
+			return limitToolOutput(out), err
+		}
+	}
+	return "", fmt.Errorf("неизвестный инструмент %s", name)
+}
+
+// runBuiltin ждет встроенный инструмент не дольше timeout. Прервать
+// функцию нельзя: она доработает в фоне, а ее результат пропадет.
+func runBuiltin(name string, run ToolFunc, args map[string]interface{}, timeout time.Duration) (string, error) {
+	type result struct {
+		out string
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		out, err := run(args)
+		done <- result{out, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.out, r.err
+	case <-timer.C:
+		return "", fmt.Errorf("%s: превышено время ожидания (%v)", name, timeout)
+	}
+}
+
+// timeout время вызова: timeout_sec из tools.yaml, иначе общее.
+func (s *ToolSpec) timeout(fallback time.Duration) time.Duration {
+	if s.TimeoutSec > 0 {
+		return time.Duration(s.TimeoutSec) * time.Second
+	}
+	return fallback
+}
+
+func (s *ToolSpec) execute(input []byte, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var out string
+	var err error
+	if len(s.Command) > 0 {
+		out, err = s.runCommand(ctx, input)
+	} else {
+		out, err = s.post(ctx, input)
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "", fmt.Errorf("%s: превышено время ожидания (%v)", s.Name, timeout)
+	}
+	return out, err
+}
+
+func (s *ToolSpec) runCommand(ctx context.Context, input []byte) (string, error) {
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %v, stderr: %s", s.Name, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (s *ToolSpec) post(ctx context.Context, input []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.URL, bytes.NewReader(input))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.Headers {
+		req.Header.Set(k, os.ExpandEnv(v))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", s.Name, err)
+	}
+	defer resp.Body.Close()
+
+	// Читаем чуть больше лимита, чтобы limitToolOutput отметил обрезку
+	body, err := io.ReadAll(io.LimitReader(resp.Body, ToolOutputLimit+1))
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", s.Name, err)
+	}
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("%s: HTTP %d: %s", s.Name, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// NewToolCallID идентификатор вызова для API, которые его не выдают
+// (Gemini): 9 латинских букв и цифр — такой формат требует Mistral,
+// а история чата общая для всех утилит.
+func NewToolCallID() string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	id := make([]byte, 9)
+	for i := range id {
+		id[i] = alphabet[rand.IntN(len(alphabet))]
+	}
+	return string(id)
+}
+
+// limitToolOutput обрезает результат до ToolOutputLimit байт.
+func limitToolOutput(out string) string {
+	if len(out) <= ToolOutputLimit {
+		return out
+	}
+	cut := ToolOutputLimit
+	for cut > 0 && !utf8.RuneStart(out[cut]) {
+		cut--
+	}
+	return out[:cut] + "\n...[результат обрезан]"
+}
@@ -0,0 +1,271 @@
+package provider
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadTools(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []string // имена инструментов
+		wantErr string
+	}{
+		{"command and url", `
+tools:
+  - name: weather
+    description: Погода
+    url: http://localhost/weather
+    parameters:
+      type: object
+      properties:
+        city: {type: string}
+      required: [city]
+  - name: wc
+    description: Считает слова
+    command: [wc, -w]
+`, []string{"weather", "wc"}, ""},
+		{"empty file", "", nil, ""},
+		{"bad name", "tools:\n  - {name: 'my tool', description: x, url: http://a}", nil, "неверное имя"},
+		{"no description", "tools:\n  - {name: a, url: http://a}", nil, "description"},
+		{"both command and url", "tools:\n  - {name: a, description: x, url: http://a, command: [ls]}", nil, "ровно одно"},
+		{"neither command nor url", "tools:\n  - {name: a, description: x}", nil, "ровно одно"},
+		{"not an object schema", "tools:\n  - {name: a, description: x, url: http://a, parameters: {type: string}}", nil, "type: object"},
+		{"duplicate", "tools:\n  - {name: a, description: x, url: http://a}\n  - {name: a, description: y, url: http://b}", nil, "дважды"},
+		{"bad yaml", "tools: [", nil, "парсинга"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), ToolsFileName)
+		if err := os.WriteFile(path, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadTools(path)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: ReadTools error = %v, want mention of %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: ReadTools error = %v", tt.name, err)
+		}
+		var names []string
+		for _, spec := range got {
+			names = append(names, spec.Name)
+			if spec.Parameters["type"] != "object" {
+				t.Errorf("%s: %s parameters = %v", tt.name, spec.Name, spec.Parameters)
+			}
+		}
+		if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: tools = %v, want %v", tt.name, names, tt.want)
+		}
+	}
+
+	if got, err := ReadTools(filepath.Join(t.TempDir(), "missing.yaml")); got != nil || err != nil {
+		t.Errorf("ReadTools(missing) = %v, %v, want no tools", got, err)
+	}
+}
+
+func echoBuiltin(name string) Builtin {
+	return Builtin{
+		Spec: ToolSpec{Name: name, Description: "builtin " + name, Parameters: map[string]interface{}{"type": "object"}},
+		Run: func(args map[string]interface{}) (string, error) {
+			if args["fail"] == true {
+				return "", fmt.Errorf("failed")
+			}
+			return fmt.Sprintf("%s:%v", name, args["x"]), nil
+		},
+	}
+}
+
+func TestNewToolset(t *testing.T) {
+	withTempConfig(t)
+	user := []ToolSpec{{Name: "search", Description: "user search", URL: "http://a"}, {Name: "wc", Description: "words", Command: []string{"wc"}}}
+	ts := NewToolset(user, echoBuiltin("calculator"), echoBuiltin("search"))
+
+	tools := ts.OpenAI()
+	var got []string
+	for _, tool := range tools {
+		if tool.Type != "function" {
+			t.Errorf("tool %s type = %q", tool.Function.Name, tool.Type)
+		}
+		got = append(got, tool.Function.Name+"="+tool.Function.Description)
+	}
+	want := "calculator=builtin calculator,search=user search,wc=words"
+	if strings.Join(got, ",") != want {
+		t.Errorf("OpenAI() = %v, want %s", got, want)
+	}
+
+	var off *Toolset
+	if off.Specs() != nil || len(off.OpenAI()) != 0 {
+		t.Errorf("nil Toolset has tools")
+	}
+	if out := off.Call("calculator", "{}"); !strings.HasPrefix(out, "Error:") {
+		t.Errorf("nil Toolset Call = %q", out)
+	}
+}
+
+// TestToolHelperProcess подставляется как command пользовательского
+// инструмента: эхо stdin, ошибка или зависание.
+func TestToolHelperProcess(t *testing.T) {
+	mode := os.Getenv("TOOL_HELPER")
+	if mode == "" {
+		return
+	}
+	input, _ := io.ReadAll(os.Stdin)
+	switch mode {
+	case "echo":
+		fmt.Printf("got %s\n", input)
+		os.Exit(0)
+	case "fail":
+		fmt.Fprint(os.Stderr, "boom")
+		os.Exit(3)
+	case "hang":
+		time.Sleep(10 * time.Second)
+	}
+	os.Exit(0)
+}
+
+func TestToolsetRun(t *testing.T) {
+	withTempConfig(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/ok":
+			fmt.Fprintf(w, "%s %s %s", r.Header.Get("Content-Type"), r.Header.Get("X-Token"), body)
+		case "/big":
+			fmt.Fprint(w, strings.Repeat("я", ToolOutputLimit))
+		default:
+			http.Error(w, "nope", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("TOOL_TOKEN", "secret")
+
+	helper := []string{os.Args[0], "-test.run=TestToolHelperProcess"}
+	user := []ToolSpec{
+		{Name: "post", URL: srv.URL + "/ok", Headers: map[string]string{"X-Token": "${TOOL_TOKEN}"}},
+		{Name: "missing", URL: srv.URL + "/missing"},
+		{Name: "big", URL: srv.URL + "/big"},
+		{Name: "exec", Command: helper},
+		{Name: "slow", Command: helper, TimeoutSec: 1},
+	}
+	ts := NewToolset(user, echoBuiltin("calc"))
+
+	tests := []struct {
+		name, tool, args string
+		helper           string
+		want             string
+		wantErr          string
+	}{
+		{name: "builtin", tool: "calc", args: `{"x":2}`, want: "calc:2"},
+		{name: "builtin error", tool: "calc", args: `{"fail":true}`, wantErr: "failed"},
+		{name: "bad arguments", tool: "calc", args: `{`, wantErr: "неверные аргументы"},
+		{name: "unknown", tool: "nope", args: `{}`, wantErr: "неизвестный инструмент"},
+		{name: "http post", tool: "post", args: `{"q":"a"}`, want: `application/json secret {"q":"a"}`},
+		{name: "http empty args", tool: "post", args: ``, want: `application/json secret {}`},
+		{name: "http status", tool: "missing", args: `{}`, wantErr: "HTTP 404"},
+		{name: "command stdin", tool: "exec", args: `{"n": 1}`, helper: "echo", want: `got {"n":1}`},
+		{name: "command failure", tool: "exec", args: `{}`, helper: "fail", wantErr: "boom"},
+		{name: "command timeout", tool: "slow", args: `{}`, helper: "hang", wantErr: "время ожидания"},
+	}
+	for _, tt := range tests {
+		t.Setenv("TOOL_HELPER", tt.helper)
+		got, err := ts.Run(tt.tool, tt.args)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: Run error = %v, want mention of %q", tt.name, err, tt.wantErr)
+			}
+			if out := ts.Call(tt.tool, tt.args); !strings.HasPrefix(out, "Error: ") {
+				t.Errorf("%s: Call = %q, want error text", tt.name, out)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: Run = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	got, err := ts.Run("big", `{}`)
+	if err != nil || len(got) > ToolOutputLimit+50 || !strings.HasSuffix(got, "[результат обрезан]") {
+		t.Errorf("big output: %d bytes, %v", len(got), err)
+	}
+	if !strings.HasPrefix(got, "я") || strings.ContainsRune(got, '�') {
+		t.Errorf("big output cut in the middle of a rune")
+	}
+}
+
+func TestToolsetCallAll(t *testing.T) {
+	withTempConfig(t)
+	var running, peak atomic.Int32
+	sleep := Builtin{
+		Spec: ToolSpec{Name: "sleep", Description: "sleeps"},
+		Run: func(args map[string]interface{}) (string, error) {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			ms, _ := args["ms"].(float64)
+			time.Sleep(time.Duration(ms) * time.Millisecond)
+			return fmt.Sprintf("slept %v", ms), nil
+		},
+	}
+	helper := []string{os.Args[0], "-test.run=TestToolHelperProcess"}
+	t.Setenv("TOOL_HELPER", "hang")
+	ts := NewToolset([]ToolSpec{{Name: "hang", Command: helper}}, sleep).
+		WithLimits(ToolLimits{Workers: 2, Timeout: 300 * time.Millisecond})
+
+	tests := []struct {
+		name     string
+		calls    []ToolCall
+		want     []string // подстроки результатов по порядку
+		maxTime  time.Duration
+		wantPeak int32
+	}{
+		{
+			name:     "order kept, two at a time",
+			calls:    []ToolCall{{Name: "sleep", Arguments: `{"ms":150}`}, {Name: "sleep", Arguments: `{"ms":100}`}, {Name: "sleep", Arguments: `{"ms":50}`}, {Name: "sleep", Arguments: `{"ms":10}`}},
+			want:     []string{"slept 150", "slept 100", "slept 50", "slept 10"},
+			maxTime:  290 * time.Millisecond,
+			wantPeak: 2,
+		},
+		{
+			name:     "builtin and user tool timeouts",
+			calls:    []ToolCall{{Name: "sleep", Arguments: `{"ms":2000}`}, {Name: "hang", Arguments: `{}`}, {Name: "sleep", Arguments: `{"ms":1}`}},
+			want:     []string{"Error: sleep: превышено время ожидания", "Error: hang: превышено время ожидания", "slept 1"},
+			maxTime:  1500 * time.Millisecond,
+			wantPeak: 2,
+		},
+		{name: "no calls", calls: nil, want: nil, maxTime: 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		peak.Store(0)
+		start := time.Now()
+		got := ts.CallAll(tt.calls)
+		elapsed := time.Since(start)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %d results, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i, w := range tt.want {
+			if !strings.HasPrefix(got[i], w) {
+				t.Errorf("%s: result %d = %q, want %q", tt.name, i, got[i], w)
+			}
+		}
+		if elapsed > tt.maxTime {
+			t.Errorf("%s: took %v, want under %v", tt.name, elapsed, tt.maxTime)
+		}
+		if tt.wantPeak > 0 && peak.Load() > tt.wantPeak {
+			t.Errorf("%s: %d calls at once, want at most %d", tt.name, peak.Load(), tt.wantPeak)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package provider
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+// UsageFileName журнал расхода, общий для всех утилит (одна запись JSON на строку)
+const UsageFileName = "usage.jsonl"
+
+// charsPerToken грубая оценка для API, которые не возвращают usage
+const charsPerToken = 4
+
+// UsageRecord одна строка usage.jsonl — успешный запрос.
+type UsageRecord struct {
+	Time             time.Time `json:"time"`
+	Provider         string    `json:"provider"`
+	Model            string    `json:"model"`
+	Key              string    `json:"key,omitempty"` // последние символы ключа
+	Mode             string    `json:"mode"`
+	ChatID           string    `json:"chat_id,omitempty"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Estimated        bool      `json:"estimated,omitempty"` // токены посчитаны по длине текста
+}
+
+// UsagePath возвращает путь к usage.jsonl.
+func UsagePath() (string, error) {
+	return ConfigPath(UsageFileName)
+}
+
+// RecordUsage дописывает в журнал строку об успешном запросе.
+// Параллельные запуски безопасны: строка пишется одним вызовом в режиме O_APPEND.
+func RecordUsage(resp *Response, req *Request) error {
+	rec := UsageRecord{
+		Time:     time.Now(),
+		Provider: resp.Provider,
+		Model:    resp.Model,
+		Key:      resp.Key,
+		Mode:     req.Mode,
+	}
+	if req.History != nil {
+		rec.ChatID = req.History.ID
+	}
+	if resp.Usage != nil && resp.Usage.PromptTokens+resp.Usage.CompletionTokens > 0 {
+		rec.PromptTokens = resp.Usage.PromptTokens
+		rec.CompletionTokens = resp.Usage.CompletionTokens
+	} else {
+		rec.PromptTokens = estimateTokens(requestChars(req))
+		rec.CompletionTokens = estimateTokens(utf8.RuneCountInString(resp.Text))
+		rec.Estimated = true
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	path, err := UsagePath()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// requestChars оценивает размер запроса в символах: промпты, история и файлы.
+func requestChars(req *Request) int {
+	chars := utf8.RuneCountInString(req.System) + utf8.RuneCountInString(req.Prompt)
+	if req.History != nil {
+		for _, msg := range req.History.Messages {
+			chars += msg.Size
+		}
+	}
+	for _, f := range req.Files {
+		switch {
+		case f.IsText():
+			chars += utf8.RuneCount(f.Bytes())
+		case f.IsImage():
+			chars += DefaultImageCharCost
+		}
+	}
+	return chars
+}
+
+func estimateTokens(chars int) int {
+	return (chars + charsPerToken - 1) / charsPerToken
+}
+
+// --- Отчет (--usage-report) ---
+
+// UsageDimensions допустимые поля группировки отчета
+var UsageDimensions = []string{"day", "provider", "model", "key"}
+
+// UsageRow итог по одной группе.
+type UsageRow struct {
+	Group            []string `json:"group"`
+	Requests         int      `json:"requests"`
+	PromptTokens     int      `json:"prompt_tokens"`
+	CompletionTokens int      `json:"completion_tokens"`
+	TotalTokens      int      `json:"total_tokens"`
+	Estimated        int      `json:"estimated"` // сколько запросов с оценочными токенами
+}
+
+// ParseGroupBy разбирает --group-by ("day,provider"). Пусто — все поля.
+func ParseGroupBy(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return UsageDimensions, nil
+	}
+	var dims []string
+	for _, d := range strings.Split(value, ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		valid := false
+		for _, known := range UsageDimensions {
+			if d == known {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("неизвестное поле группировки '%s' (доступны: %s)", d, strings.Join(UsageDimensions, ", "))
+		}
+		dims = append(dims, d)
+	}
+	return dims, nil
+}
+
+func (r UsageRecord) field(dim string) string {
+	switch dim {
+	case "day":
+		return r.Time.Local().Format("2006-01-02")
+	case "provider":
+		return r.Provider
+	case "model":
+		return r.Model
+	case "key":
+		if r.Key == "" {
+			return "none"
+		}
+		return r.Key
+	}
+	return ""
+}
+
+// LoadUsageReport читает журнал и суммирует расход по группам.
+// Поврежденные строки пропускаются.
+func LoadUsageReport(dims []string) ([]UsageRow, error) {
+	path, err := UsagePath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	rows := map[string]*UsageRow{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec UsageRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil {
+			continue
+		}
+		group := make([]string, len(dims))
+		for i, d := range dims {
+			group[i] = rec.field(d)
+		}
+		id := strings.Join(group, "\x00")
+		row, ok := rows[id]
+		if !ok {
+			row = &UsageRow{Group: group}
+			rows[id] = row
+		}
+		row.Requests++
+		row.PromptTokens += rec.PromptTokens
+		row.CompletionTokens += rec.CompletionTokens
+		row.TotalTokens += rec.PromptTokens + rec.CompletionTokens
+		if rec.Estimated {
+			row.Estimated++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]UsageRow, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, *row)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return strings.Join(result[i].Group, "\x00") < strings.Join(result[j].Group, "\x00")
+	})
+	return result, nil
+}
+
+// PrintUsageReport печатает отчет таблицей, CSV или JSON (--output-format).
+func PrintUsageReport(groupBy, format string) error {
+	dims, err := ParseGroupBy(groupBy)
+	if err != nil {
+		return err
+	}
+	rows, err := LoadUsageReport(dims)
+	if err != nil {
+		return err
+	}
+
+	header := append(append([]string{}, dims...), "requests", "prompt_tokens", "completion_tokens", "total_tokens", "estimated")
+	record := func(row UsageRow) []string {
+		return append(append([]string{}, row.Group...),
+			strconv.Itoa(row.Requests), strconv.Itoa(row.PromptTokens), strconv.Itoa(row.CompletionTokens),
+			strconv.Itoa(row.TotalTokens), strconv.Itoa(row.Estimated))
+	}
+
+	switch format {
+	case OutputJSON:
+		if rows == nil {
+			rows = []UsageRow{}
+		}
+		data, err := json.Marshal(rows)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	case OutputCSV:
+		w := csv.NewWriter(os.Stdout)
+		w.Write(header)
+		for _, row := range rows {
+			w.Write(record(row))
+		}
+		w.Flush()
+		return w.Error()
+	default:
+		if len(rows) == 0 {
+			fmt.Println("Журнал расхода пуст")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(record(row), "\t"))
+		}
+		return w.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package provider
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageReport(t *testing.T) {
+	withTempConfig(t)
+
+	records := []struct {
+		resp *Response
+		req  *Request
+	}{
+		{&Response{Provider: "mistral", Model: "small", Key: "...aaaa", Usage: &Usage{PromptTokens: 10, CompletionTokens: 5}}, &Request{Mode: "general"}},
+		{&Response{Provider: "mistral", Model: "small", Key: "...aaaa", Usage: &Usage{PromptTokens: 1, CompletionTokens: 2}}, &Request{Mode: "code"}},
+		{&Response{Provider: "mistral", Model: "large", Key: "...bbbb", Usage: &Usage{PromptTokens: 7}}, &Request{Mode: "general"}},
+		// Без usage — оценка по длине: 8 символов промпта и 4 ответа
+		{&Response{Provider: "ollama", Model: "llama", Text: "abcd"}, &Request{Mode: "general", Prompt: "12345678"}},
+	}
+	for _, r := range records {
+		if err := RecordUsage(r.resp, r.req); err != nil {
+			t.Fatalf("RecordUsage error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		groupBy string
+		want    []UsageRow
+	}{
+		{"provider", []UsageRow{
+			{Group: []string{"mistral"}, Requests: 3, PromptTokens: 18, CompletionTokens: 7, TotalTokens: 25},
+			{Group: []string{"ollama"}, Requests: 1, PromptTokens: 2, CompletionTokens: 1, TotalTokens: 3, Estimated: 1},
+		}},
+		{"provider,model", []UsageRow{
+			{Group: []string{"mistral", "large"}, Requests: 1, PromptTokens: 7, TotalTokens: 7},
+			{Group: []string{"mistral", "small"}, Requests: 2, PromptTokens: 11, CompletionTokens: 7, TotalTokens: 18},
+			{Group: []string{"ollama", "llama"}, Requests: 1, PromptTokens: 2, CompletionTokens: 1, TotalTokens: 3, Estimated: 1},
+		}},
+		{"key", []UsageRow{
+			{Group: []string{"...aaaa"}, Requests: 2, PromptTokens: 11, CompletionTokens: 7, TotalTokens: 18},
+			{Group: []string{"...bbbb"}, Requests: 1, PromptTokens: 7, TotalTokens: 7},
+			{Group: []string{"none"}, Requests: 1, PromptTokens: 2, CompletionTokens: 1, TotalTokens: 3, Estimated: 1},
+		}},
+	}
+	for _, tt := range tests {
+		dims, err := ParseGroupBy(tt.groupBy)
+		if err != nil {
+			t.Fatalf("ParseGroupBy(%q) error = %v", tt.groupBy, err)
+		}
+		got, err := LoadUsageReport(dims)
+		if err != nil {
+			t.Fatalf("LoadUsageReport error = %v", err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("group by %s:\n got %+v\nwant %+v", tt.groupBy, got, tt.want)
+		}
+	}
+
+	// Группировка по дню: все записи сделаны только что
+	rows, err := LoadUsageReport([]string{"day"})
+	if err != nil || len(rows) != 1 || rows[0].Requests != 4 || rows[0].Group[0] != time.Now().Format("2006-01-02") {
+		t.Errorf("group by day = %+v, %v", rows, err)
+	}
+}
+
+func TestParseGroupBy(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{value: "", want: UsageDimensions},
+		{value: "Day, model", want: []string{"day", "model"}},
+		{value: "day,week", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseGroupBy(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseGroupBy(%q) error = %v", tt.value, err)
+			continue
+		}
+		if !tt.wantErr && strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("ParseGroupBy(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
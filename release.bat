@@ -85,6 +85,24 @@ if !errorlevel! neq 0 (
 )
 cd ..\..
 
+echo Building openaillm...
+cd cmd\openaillm
+go build -o ..\..\dist\windows-amd64\openaillm.exe
+if !errorlevel! neq 0 (
+    echo Error building openaillm
+    exit /b !errorlevel!
+)
+cd ..\..
+
+echo Building ollamallm...
+cd cmd\ollamallm
+go build -o ..\..\dist\windows-amd64\ollamallm.exe
+if !errorlevel! neq 0 (
+    echo Error building ollamallm
+    exit /b !errorlevel!
+)
+cd ..\..
+
 echo Building mistral...
 cd cmd\mistral
 go build -o ..\..\dist\windows-amd64\mistral.exe